@@ -2,47 +2,43 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fekuna/omnipos-audit-service/config"
 	"github.com/fekuna/omnipos-audit-service/internal/audit/handler"
 	"github.com/fekuna/omnipos-audit-service/internal/audit/listener"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/notify"
 	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
 	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
-	"github.com/fekuna/omnipos-pkg/broker"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
+	"github.com/fekuna/omnipos-audit-service/internal/signing"
 	"github.com/fekuna/omnipos-pkg/database/mongodb"
 	"github.com/fekuna/omnipos-pkg/logger"
 	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 )
 
 func main() {
+	// Maintenance subcommands share the configuration but not the server lifecycle
+	if len(os.Args) > 1 && os.Args[1] == "verify-chain" {
+		os.Exit(runVerifyChain(os.Args[2:]))
+	}
+
 	// 1. Load Configuration
 	cfg := config.LoadEnv()
 
 	// 2. Initialize Logger
-	logConfig := &logger.ZapLoggerConfig{
-		IsDevelopment:     false,
-		Encoding:          "json",
-		Level:             "info",
-		DisableCaller:     false,
-		DisableStacktrace: false,
-	}
-
-	if cfg.AppEnv == "development" {
-		logConfig.IsDevelopment = true
-		logConfig.Encoding = "console"
-		logConfig.Level = "debug"
-	}
-
-	appLogger := logger.NewZapLogger(logConfig)
+	appLogger := newLogger(cfg)
 	defer appLogger.Sync()
 
 	// 3. Connect to MongoDB
@@ -58,35 +54,204 @@ func main() {
 	appLogger.Info("Connected to MongoDB", zap.String("db_name", cfg.MongoDB.Database))
 
 	// 4. Initialize Components
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	repo := repository.NewMongoRepository(mongoClient)
-	uc := usecase.NewAuditUseCase(repo, appLogger)
-	h := handler.NewAuditHandler(uc, appLogger)
+	ensureIndexes(ctx, appLogger, "audit_logs", repo)
+
+	// Chains are verified against their checkpoints even while checkpointing is disabled
+	checkpointRepo := repository.NewMongoCheckpointRepository(mongoClient)
+	ensureIndexes(ctx, appLogger, "audit_checkpoints", checkpointRepo)
+	witness := repository.NewFileWitness(cfg.Checkpoint.WitnessFile)
+	signingKey, keyRing, err := checkpointKeys(cfg)
+	if err != nil {
+		appLogger.Fatal("Invalid checkpoint keys", zap.Error(err))
+	}
+
+	var observers []usecase.AppendObserver
+	var checkpointUC usecase.CheckpointUseCase
+	if signingKey != nil {
+		checkpointUC = usecase.NewCheckpointUseCase(
+			repo,
+			checkpointRepo,
+			witness,
+			signingKey,
+			keyRing,
+			usecase.CheckpointConfig{
+				EveryRecords: cfg.Checkpoint.EveryRecords,
+				Interval:     cfg.Checkpoint.Interval,
+			},
+			appLogger,
+		)
+		observers = append(observers, checkpointUC)
+
+		go checkpointUC.Run(ctx)
+		appLogger.Info("Checkpointing enabled",
+			zap.Int64("every_records", cfg.Checkpoint.EveryRecords),
+			zap.Duration("interval", cfg.Checkpoint.Interval),
+			zap.String("witness_file", cfg.Checkpoint.WitnessFile),
+		)
+	} else {
+		appLogger.Warn("Checkpoint signing key not configured, checkpointing disabled")
+	}
+
+	watchUC := usecase.NewWatchUseCase(repo, usecase.WatchConfig{
+		Mode:       cfg.Watch.Mode,
+		BufferSize: cfg.Watch.BufferSize,
+	}, appLogger)
+	observers = append(observers, watchUC)
+
+	kafkaEnabled := len(cfg.Kafka.Brokers) > 0 && cfg.Kafka.Brokers[0] != ""
+
+	// Alerts go to the webhooks and mailboxes merchants configure, and to the alerts topic
+	notifiers := map[string]notify.Notifier{
+		repository.ChannelWebhook: notify.NewWebhookNotifier(notify.NewWebhookClient(cfg.Delivery.Timeout)),
+	}
+	if cfg.SMTP.Host != "" {
+		notifiers[repository.ChannelEmail] = notify.NewEmailNotifier(notify.SMTPConfig{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.SMTP.From,
+		})
+	} else {
+		appLogger.Warn("SMTP not configured, email notification channels disabled")
+	}
+	if kafkaEnabled && cfg.Alert.KafkaTopic != "" {
+		alertWriter := &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Kafka.Brokers...),
+			Topic:        cfg.Alert.KafkaTopic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		}
+		defer alertWriter.Close()
+		notifiers[repository.ChannelKafka] = notify.NewKafkaNotifier(alertWriter)
+	}
+
+	notificationRepo := repository.NewMongoNotificationRepository(mongoClient)
+	ensureIndexes(ctx, appLogger, "notification_channels", notificationRepo)
+	notificationUC := usecase.NewNotificationUseCase(notificationRepo, notifiers, usecase.NotificationConfig{
+		Workers:      cfg.Delivery.Workers,
+		MaxAttempts:  cfg.Delivery.MaxAttempts,
+		Backoff:      cfg.Delivery.Backoff,
+		MaxBackoff:   cfg.Delivery.MaxBackoff,
+		Timeout:      cfg.Delivery.Timeout,
+		PollInterval: cfg.Delivery.Backoff,
+		KafkaTopic:   cfg.Alert.KafkaTopic,
+	}, appLogger)
+	go notificationUC.Run(ctx)
+
+	alertRepo := repository.NewMongoAlertRepository(mongoClient)
+	ensureIndexes(ctx, appLogger, "alert_rules", alertRepo)
+	alertUC := usecase.NewAlertUseCase(alertRepo, repo, usecase.AlertConfig{
+		RefreshInterval: cfg.Alert.RefreshInterval,
+	}, appLogger, notificationUC)
+	observers = append(observers, alertUC)
+	go alertUC.Run(ctx)
+
+	uc := usecase.NewAuditUseCase(repo, &usecase.ChainCheckpoints{
+		Repo:    checkpointRepo,
+		Witness: witness,
+		Keys:    keyRing,
+	}, appLogger, observers...)
+
+	quarantineRepo := repository.NewMongoQuarantineRepository(mongoClient)
+	ensureIndexes(ctx, appLogger, "quarantined_events", quarantineRepo)
+	quarantineUC := usecase.NewQuarantineUseCase(quarantineRepo, uc, appLogger)
+
+	var exportUC usecase.ExportJobUseCase
+	if cfg.Export.SigningKey != "" {
+		signingKey, err := signing.ParsePrivateKey(cfg.Export.SigningKey)
+		if err != nil {
+			appLogger.Fatal("Invalid export signing key", zap.Error(err))
+		}
+		exportRepo := repository.NewMongoExportJobRepository(mongoClient)
+		ensureIndexes(ctx, appLogger, "export_jobs", exportRepo)
+
+		exportUC = usecase.NewExportJobUseCase(
+			repo,
+			exportRepo,
+			repository.NewDirExportStore(cfg.Export.Dir),
+			signingKey,
+			usecase.ExportJobConfig{
+				TTL:             cfg.Export.TTL,
+				Workers:         cfg.Export.Workers,
+				CleanupInterval: cfg.Export.CleanupInterval,
+			},
+			appLogger,
+		)
+
+		go exportUC.Run(ctx)
+		appLogger.Info("Export jobs enabled",
+			zap.String("dir", cfg.Export.Dir),
+			zap.Duration("ttl", cfg.Export.TTL),
+			zap.Int("workers", cfg.Export.Workers),
+		)
+	} else {
+		appLogger.Warn("Export signing key not configured, export jobs disabled")
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	// 5. Initialize Kafka Consumer (if brokers are configured)
 	var auditListener *listener.AuditListener
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var ingestStats handler.IngestStatsProvider
 
-	if len(cfg.Kafka.Brokers) > 0 && cfg.Kafka.Brokers[0] != "" {
-		kafkaCfg := &broker.Config{
-			Brokers: cfg.Kafka.Brokers,
-			Topic:   cfg.Kafka.Topic,
-			GroupID: cfg.Kafka.GroupID,
+	if kafkaEnabled {
+		// Offsets are committed by the listener once events are stored
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:       cfg.Kafka.Brokers,
+			Topic:         cfg.Kafka.Topic,
+			GroupID:       cfg.Kafka.GroupID,
+			QueueCapacity: cfg.Kafka.BatchSize,
+		})
+		listenerCfg := listener.Config{
+			Topic:           cfg.Kafka.Topic,
+			Workers:         cfg.Kafka.Workers,
+			WorkerQueueSize: cfg.Kafka.WorkerQueueSize,
+			BatchSize:       cfg.Kafka.BatchSize,
+			BatchTimeout:    cfg.Kafka.BatchTimeout,
+			MaxRetries:      cfg.Kafka.MaxRetries,
+			RetryBackoff:    cfg.Kafka.RetryBackoff,
 		}
-		consumer := broker.NewConsumer(kafkaCfg)
-		auditListener = listener.NewAuditListener(consumer, uc, appLogger)
+		var deadLetter listener.DeadLetterWriter
+		if cfg.Kafka.DLQTopic != "" {
+			dlqWriter := &kafka.Writer{
+				Addr:         kafka.TCP(cfg.Kafka.Brokers...),
+				Topic:        cfg.Kafka.DLQTopic,
+				Balancer:     &kafka.Hash{},
+				RequiredAcks: kafka.RequireAll,
+			}
+			defer dlqWriter.Close()
+			deadLetter = dlqWriter
+		}
+		auditListener = listener.NewAuditListener(reader, uc, quarantineUC, deadLetter, listenerCfg, appLogger)
+		ingestStats = auditListener
 
-		// Start Kafka listener in background
-		go auditListener.Start(ctx)
+		// Start Kafka listener in background. If it gives up on an event the service shuts
+		// down so the event is redelivered from the last committed offset on restart.
+		go func() {
+			if err := auditListener.Start(ctx); err != nil {
+				appLogger.Error("Kafka Audit Listener stopped", zap.Error(err))
+				quit <- syscall.SIGTERM
+			}
+		}()
 		appLogger.Info("Kafka Audit Listener started",
 			zap.Strings("brokers", cfg.Kafka.Brokers),
 			zap.String("topic", cfg.Kafka.Topic),
 			zap.String("group_id", cfg.Kafka.GroupID),
+			zap.String("dlq_topic", cfg.Kafka.DLQTopic),
+			zap.Int("workers", cfg.Kafka.Workers),
 		)
 	} else {
 		appLogger.Warn("Kafka not configured, Audit Listener disabled")
 	}
 
+	h := handler.NewAuditHandler(uc, checkpointUC, quarantineUC, exportUC, watchUC, alertUC, notificationUC, ingestStats, appLogger)
+
 	// 6. Start gRPC Server
 	port := cfg.Server.GRPCPort
 	if !strings.HasPrefix(port, ":") {
@@ -98,7 +263,7 @@ func main() {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(authInterceptors(cfg, appLogger)...)
 
 	// Register Services
 	auditv1.RegisterAuditServiceServer(grpcServer, h)
@@ -116,8 +281,6 @@ func main() {
 	}()
 
 	// 7. Graceful Shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
 
 	appLogger.Info("Shutting down server...")
@@ -134,3 +297,89 @@ func main() {
 	grpcServer.GracefulStop()
 	appLogger.Info("Server stopped")
 }
+
+func newLogger(cfg *config.Config) logger.ZapLogger {
+	logConfig := &logger.ZapLoggerConfig{
+		IsDevelopment:     false,
+		Encoding:          "json",
+		Level:             "info",
+		DisableCaller:     false,
+		DisableStacktrace: false,
+	}
+
+	if cfg.AppEnv == "development" {
+		logConfig.IsDevelopment = true
+		logConfig.Encoding = "console"
+		logConfig.Level = "debug"
+	}
+
+	return logger.NewZapLogger(logConfig)
+}
+
+// ensureIndexes creates the indexes a repository relies on in the background. Indexes that
+// exist return at once; building a new one on a large collection can take hours, which must not
+// hold up or fail the start, so the build runs until it finishes or the service stops and a
+// failure is logged for the operators.
+func ensureIndexes(ctx context.Context, appLogger logger.ZapLogger, collection string, repo interface {
+	EnsureIndexes(ctx context.Context) error
+}) {
+	go func() {
+		start := time.Now()
+		if err := repo.EnsureIndexes(ctx); err != nil {
+			if ctx.Err() == nil {
+				appLogger.Warn("Could not create MongoDB indexes, queries on the collection may be slow",
+					zap.String("collection", collection), zap.Error(err))
+			}
+			return
+		}
+		appLogger.Info("MongoDB indexes ready", zap.String("collection", collection), zap.Duration("took", time.Since(start)))
+	}()
+}
+
+// checkpointKeys returns the checkpoint signing key, nil when checkpointing is disabled, and the
+// public keys checkpoints may be signed with
+func checkpointKeys(cfg *config.Config) (ed25519.PrivateKey, signing.KeyRing, error) {
+	keys, err := signing.ParsePublicKeys(cfg.Checkpoint.PublicKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Checkpoint.SigningKey == "" {
+		return nil, signing.NewKeyRing(keys...), nil
+	}
+	signingKey, err := signing.ParsePrivateKey(cfg.Checkpoint.SigningKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys = append(keys, signingKey.Public().(ed25519.PublicKey))
+	return signingKey, signing.NewKeyRing(keys...), nil
+}
+
+// authInterceptors verifies access tokens. Without a key the identity headers are trusted,
+// which must be enabled explicitly with AUTH_INSECURE_HEADERS.
+func authInterceptors(cfg *config.Config, appLogger logger.ZapLogger) []grpc.ServerOption {
+	if cfg.Auth.JWTSecret == "" && cfg.Auth.JWTPublicKeyFile == "" && cfg.Auth.JWKSFile == "" {
+		if !cfg.Auth.InsecureHeaders || cfg.AppEnv == "production" {
+			appLogger.Fatal("No access token key configured, set AUTH_JWT_SECRET, AUTH_JWT_PUBLIC_KEY_FILE or AUTH_JWKS_FILE")
+		}
+		appLogger.Warn("No access token key configured, trusting identity headers (AUTH_INSECURE_HEADERS)")
+		return []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(auth.MetadataUnaryInterceptor()),
+			grpc.ChainStreamInterceptor(auth.MetadataStreamInterceptor()),
+		}
+	}
+
+	verifier, err := auth.NewVerifier(auth.VerifierConfig{
+		HMACSecret:    cfg.Auth.JWTSecret,
+		PublicKeyFile: cfg.Auth.JWTPublicKeyFile,
+		JWKSFile:      cfg.Auth.JWKSFile,
+		Issuer:        cfg.Auth.Issuer,
+		Audience:      cfg.Auth.Audience,
+	})
+	if err != nil {
+		appLogger.Fatal("Invalid access token configuration", zap.Error(err))
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(auth.UnaryInterceptor(verifier)),
+		grpc.ChainStreamInterceptor(auth.StreamInterceptor(verifier)),
+	}
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -17,9 +19,61 @@ type Config struct {
 		Database string
 	}
 	Kafka struct {
-		Brokers []string
-		Topic   string
-		GroupID string
+		Brokers         []string
+		Topic           string
+		GroupID         string
+		DLQTopic        string // dead-letter topic, publishing is disabled when empty
+		Workers         int
+		WorkerQueueSize int
+		BatchSize       int
+		BatchTimeout    time.Duration
+		MaxRetries      int
+		RetryBackoff    time.Duration
+	}
+	Auth struct {
+		JWTSecret        string // HS256 secret
+		JWTPublicKeyFile string // PEM RSA public key for RS256
+		JWKSFile         string // local JWKS file for RS256
+		Issuer           string
+		Audience         string
+		// InsecureHeaders trusts the identity headers when no key is set, for local development only
+		InsecureHeaders bool
+	}
+	Checkpoint struct {
+		SigningKey   string // base64 Ed25519 seed or private key, checkpointing is disabled when empty
+		PublicKeys   string // comma separated base64 Ed25519 public keys of earlier signing keys
+		EveryRecords int64
+		Interval     time.Duration
+		WitnessFile  string
+	}
+	Watch struct {
+		Mode       string // auto, changestream or local
+		BufferSize int
+	}
+	Export struct {
+		Dir             string
+		SigningKey      string // base64 Ed25519 seed or private key, export jobs are disabled when empty
+		TTL             time.Duration
+		Workers         int
+		CleanupInterval time.Duration
+	}
+	Alert struct {
+		RefreshInterval time.Duration
+		KafkaTopic      string // alerts are not published to Kafka when empty
+	}
+	Delivery struct {
+		Workers     int
+		MaxAttempts int
+		Backoff     time.Duration
+		MaxBackoff  time.Duration
+		Timeout     time.Duration
+	}
+	SMTP struct {
+		Host     string // email channels are unavailable when empty
+		Port     string
+		Username string
+		Password string
+		From     string
 	}
 }
 
@@ -38,6 +92,56 @@ func LoadEnv() *Config {
 	cfg.Kafka.Brokers = strings.Split(getEnv("KAFKA_BROKERS", "localhost:9092"), ",")
 	cfg.Kafka.Topic = getEnv("KAFKA_TOPIC", "system.audit")
 	cfg.Kafka.GroupID = getEnv("KAFKA_GROUP_ID", "audit-service-group")
+	cfg.Kafka.DLQTopic = getEnv("KAFKA_DLQ_TOPIC", "system.audit.dlq")
+	cfg.Kafka.Workers = getEnvInt("KAFKA_WORKERS", 4)
+	cfg.Kafka.WorkerQueueSize = getEnvInt("KAFKA_WORKER_QUEUE_SIZE", 1000)
+	cfg.Kafka.BatchSize = getEnvInt("KAFKA_BATCH_SIZE", 500)
+	cfg.Kafka.BatchTimeout = getEnvDuration("KAFKA_BATCH_TIMEOUT", 500*time.Millisecond)
+	cfg.Kafka.MaxRetries = getEnvInt("KAFKA_MAX_RETRIES", 5)
+	cfg.Kafka.RetryBackoff = getEnvDuration("KAFKA_RETRY_BACKOFF", 500*time.Millisecond)
+
+	// Access token verification, identity headers are only trusted with AUTH_INSECURE_HEADERS
+	cfg.Auth.JWTSecret = getEnv("AUTH_JWT_SECRET", "")
+	cfg.Auth.JWTPublicKeyFile = getEnv("AUTH_JWT_PUBLIC_KEY_FILE", "")
+	cfg.Auth.JWKSFile = getEnv("AUTH_JWKS_FILE", "")
+	cfg.Auth.Issuer = getEnv("AUTH_JWT_ISSUER", "")
+	cfg.Auth.Audience = getEnv("AUTH_JWT_AUDIENCE", "")
+	cfg.Auth.InsecureHeaders = getEnvBool("AUTH_INSECURE_HEADERS", false)
+
+	// Merkle checkpoint configuration
+	cfg.Checkpoint.SigningKey = getEnv("CHECKPOINT_SIGNING_KEY", "")
+	cfg.Checkpoint.PublicKeys = getEnv("CHECKPOINT_PUBLIC_KEYS", "")
+	cfg.Checkpoint.EveryRecords = getEnvInt64("CHECKPOINT_EVERY_RECORDS", 1000)
+	cfg.Checkpoint.Interval = getEnvDuration("CHECKPOINT_INTERVAL", 15*time.Minute)
+	cfg.Checkpoint.WitnessFile = getEnv("CHECKPOINT_WITNESS_FILE", "checkpoints.ndjson")
+
+	// Live tail configuration
+	cfg.Watch.Mode = getEnv("WATCH_MODE", "auto")
+	cfg.Watch.BufferSize = getEnvInt("WATCH_BUFFER_SIZE", 10000)
+
+	// Export job configuration, bundles are signed with the checkpoint key unless one is set
+	cfg.Export.Dir = getEnv("EXPORT_DIR", "exports")
+	cfg.Export.SigningKey = getEnv("EXPORT_SIGNING_KEY", cfg.Checkpoint.SigningKey)
+	cfg.Export.TTL = getEnvDuration("EXPORT_TTL", 7*24*time.Hour)
+	cfg.Export.Workers = getEnvInt("EXPORT_WORKERS", 2)
+	cfg.Export.CleanupInterval = getEnvDuration("EXPORT_CLEANUP_INTERVAL", 10*time.Minute)
+
+	// Alert rule evaluation
+	cfg.Alert.RefreshInterval = getEnvDuration("ALERT_RULES_REFRESH_INTERVAL", 30*time.Second)
+	cfg.Alert.KafkaTopic = getEnv("ALERT_KAFKA_TOPIC", "system.audit.alerts")
+
+	// Alert delivery, failed attempts are retried with exponential backoff
+	cfg.Delivery.Workers = getEnvInt("ALERT_DELIVERY_WORKERS", 4)
+	cfg.Delivery.MaxAttempts = getEnvInt("ALERT_DELIVERY_MAX_ATTEMPTS", 8)
+	cfg.Delivery.Backoff = getEnvDuration("ALERT_DELIVERY_BACKOFF", 30*time.Second)
+	cfg.Delivery.MaxBackoff = getEnvDuration("ALERT_DELIVERY_MAX_BACKOFF", time.Hour)
+	cfg.Delivery.Timeout = getEnvDuration("ALERT_DELIVERY_TIMEOUT", 10*time.Second)
+
+	cfg.SMTP.Host = getEnv("SMTP_HOST", "")
+	cfg.SMTP.Port = getEnv("SMTP_PORT", "587")
+	cfg.SMTP.Username = getEnv("SMTP_USERNAME", "")
+	cfg.SMTP.Password = getEnv("SMTP_PASSWORD", "")
+	cfg.SMTP.From = getEnv("SMTP_FROM", "audit@omnipos.local")
 
 	return cfg
 }
@@ -48,3 +152,39 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	if value, exists := os.LookupEnv(key); exists {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
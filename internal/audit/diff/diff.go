@@ -0,0 +1,151 @@
+// Package diff compares the OldValue and NewValue snapshots of audit logs.
+package diff
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// Kinds of field change
+const (
+	OpAdded   = "added"
+	OpRemoved = "removed"
+	OpChanged = "changed"
+)
+
+// Change is one field that differs between two snapshots
+type Change struct {
+	// Field is the dotted path of the field, e.g. "price" or "address.city"
+	Field string
+	Op    string
+	Old   interface{} // nil when added
+	New   interface{} // nil when removed
+}
+
+// change is a Change with the path kept as segments, so keys containing dots survive
+type change struct {
+	path []string
+	op   string
+	old  interface{}
+	new  interface{}
+}
+
+// Fields compares two snapshots field by field. Nested objects are compared per field, arrays
+// and scalars as a whole. Changes are sorted by field path.
+func Fields(old, new map[string]interface{}) []Change {
+	changes := compare(old, new)
+	out := make([]Change, len(changes))
+	for i, c := range changes {
+		out[i] = Change{Field: strings.Join(c.path, "."), Op: c.op, Old: c.old, New: c.new}
+	}
+	return out
+}
+
+// Patch returns the JSON Patch that turns old into new, using add, remove and replace
+// operations in path order
+func Patch(old, new map[string]interface{}) []repository.PatchOp {
+	changes := compare(old, new)
+	ops := make([]repository.PatchOp, len(changes))
+	for i, c := range changes {
+		op := repository.PatchOp{Path: pointer(c.path), Value: c.new}
+		switch c.op {
+		case OpAdded:
+			op.Op = "add"
+		case OpRemoved:
+			op.Op = "remove"
+		default:
+			op.Op = "replace"
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+// ChangedFields returns the dotted paths of the changed fields and of every object containing
+// one, so that filtering on "address" also finds changes to "address.city"
+func ChangedFields(old, new map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var fields []string
+	for _, c := range compare(old, new) {
+		for i := 1; i <= len(c.path); i++ {
+			field := strings.Join(c.path[:i], ".")
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func compare(old, new map[string]interface{}) []change {
+	var changes []change
+	compareObjects(nil, jsonvalue.NormalizeMap(old), jsonvalue.NormalizeMap(new), &changes)
+	sort.Slice(changes, func(i, j int) bool { return lessPath(changes[i].path, changes[j].path) })
+	return changes
+}
+
+func compareObjects(prefix []string, old, new interface{}, changes *[]change) {
+	oldObj, _ := old.(map[string]interface{})
+	newObj, _ := new.(map[string]interface{})
+
+	for k, ov := range oldObj {
+		path := appendPath(prefix, k)
+		nv, ok := newObj[k]
+		if !ok {
+			*changes = append(*changes, change{path: path, op: OpRemoved, old: ov})
+			continue
+		}
+		compareValues(path, ov, nv, changes)
+	}
+	for k, nv := range newObj {
+		if _, ok := oldObj[k]; !ok {
+			*changes = append(*changes, change{path: appendPath(prefix, k), op: OpAdded, new: nv})
+		}
+	}
+}
+
+func compareValues(path []string, old, new interface{}, changes *[]change) {
+	_, oldIsObj := old.(map[string]interface{})
+	_, newIsObj := new.(map[string]interface{})
+	if oldIsObj && newIsObj {
+		compareObjects(path, old, new, changes)
+		return
+	}
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, change{path: path, op: OpChanged, old: old, new: new})
+	}
+}
+
+func appendPath(prefix []string, key string) []string {
+	path := make([]string, len(prefix)+1)
+	copy(path, prefix)
+	path[len(prefix)] = key
+	return path
+}
+
+func lessPath(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// pointerEscaper escapes a key for a JSON Pointer (RFC 6901)
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func pointer(path []string) string {
+	var b strings.Builder
+	for _, p := range path {
+		b.WriteByte('/')
+		b.WriteString(pointerEscaper.Replace(p))
+	}
+	return b.String()
+}
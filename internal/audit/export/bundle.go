@@ -0,0 +1,96 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// Names of the files in an evidence bundle
+const (
+	ManifestName  = "manifest.json"
+	SignatureName = "manifest.json.sig" // base64 Ed25519 signature of manifest.json
+)
+
+// ManifestVersion identifies the layout of an evidence bundle
+const ManifestVersion = 1
+
+// Manifest describes an evidence bundle. Its signature covers the manifest bytes, and the
+// manifest pins the other files by SHA-256, so the signature vouches for the whole bundle.
+type Manifest struct {
+	Version     int                    `json:"version"`
+	JobID       string                 `json:"job_id"`
+	Scope       repository.TenantScope `json:"scope"`
+	RequestedBy string                 `json:"requested_by,omitempty"`
+	Query       repository.LogQuery    `json:"query"`
+	Format      string                 `json:"format"`
+	RecordCount int64                  `json:"record_count"`
+	// FirstTimestamp and LastTimestamp bound the exported logs, they are omitted when there are none
+	FirstTimestamp time.Time      `json:"first_timestamp,omitzero"`
+	LastTimestamp  time.Time      `json:"last_timestamp,omitzero"`
+	CreatedAt      time.Time      `json:"created_at"`
+	GeneratedAt    time.Time      `json:"generated_at"`
+	Files          []ManifestFile `json:"files"`
+	KeyID          string         `json:"key_id"`
+	PublicKey      string         `json:"public_key"` // base64 Ed25519 public key
+}
+
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// RecordsName is the name of the records file of a format in a bundle
+func RecordsName(format string) string {
+	return "records." + format
+}
+
+// BundleFile is a file to put into a bundle next to the manifest
+type BundleFile struct {
+	Name string
+	Size int64
+	Body io.Reader
+}
+
+// WriteBundle writes a gzip compressed tar archive holding the signed manifest and files
+func WriteBundle(w io.Writer, m *Manifest, key ed25519.PrivateKey, files ...BundleFile) error {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	signature := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)))
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	entries := append([]BundleFile{
+		{Name: ManifestName, Size: int64(len(manifest)), Body: bytes.NewReader(manifest)},
+		{Name: SignatureName, Size: int64(len(signature)), Body: bytes.NewReader(signature)},
+	}, files...)
+	for _, f := range entries {
+		hdr := &tar.Header{
+			Name:    f.Name,
+			Mode:    0o644,
+			Size:    f.Size,
+			ModTime: m.GeneratedAt,
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f.Body); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
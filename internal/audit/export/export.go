@@ -0,0 +1,250 @@
+// Package export writes audit logs as CSV, NDJSON or Parquet files.
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Export formats
+const (
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+// Formats lists the supported export formats
+var Formats = []string{FormatCSV, FormatNDJSON, FormatParquet}
+
+// ErrUnknownFormat is returned for a format other than csv, ndjson or parquet
+var ErrUnknownFormat = errors.New("export format must be csv, ndjson or parquet")
+
+// parquetRowGroupSize bounds the rows buffered in memory before a Parquet row group is written
+const parquetRowGroupSize = 10000
+
+// Record is the flat form of an audit log in an export. Details and the snapshots are JSON
+// encoded, so every format has the same columns.
+type Record struct {
+	ID            string    `json:"id" parquet:"id"`
+	MerchantID    string    `json:"merchant_id" parquet:"merchant_id"`
+	StoreID       string    `json:"store_id" parquet:"store_id"`
+	UserID        string    `json:"user_id" parquet:"user_id"`
+	SessionID     string    `json:"session_id" parquet:"session_id"`
+	Action        string    `json:"action" parquet:"action"`
+	Entity        string    `json:"entity" parquet:"entity"`
+	EntityID      string    `json:"entity_id" parquet:"entity_id"`
+	Severity      string    `json:"severity" parquet:"severity"`
+	Result        string    `json:"result" parquet:"result"`
+	ErrorMessage  string    `json:"error_message" parquet:"error_message"`
+	SourceService string    `json:"source_service" parquet:"source_service"`
+	CorrelationID string    `json:"correlation_id" parquet:"correlation_id"`
+	IPAddress     string    `json:"ip_address" parquet:"ip_address"`
+	UserAgent     string    `json:"user_agent" parquet:"user_agent"`
+	DurationMs    int64     `json:"duration_ms" parquet:"duration_ms"`
+	Timestamp     time.Time `json:"timestamp" parquet:"timestamp,timestamp(millisecond)"`
+	Details       string    `json:"details" parquet:"details,json"`
+	OldValue      string    `json:"old_value" parquet:"old_value,json"`
+	NewValue      string    `json:"new_value" parquet:"new_value,json"`
+	ChangedFields string    `json:"changed_fields" parquet:"changed_fields"` // comma separated
+	Sequence      int64     `json:"sequence" parquet:"sequence"`
+	PrevHash      string    `json:"prev_hash" parquet:"prev_hash"`
+	Hash          string    `json:"hash" parquet:"hash"`
+}
+
+// columns are the CSV header, in Record field order
+var columns = []string{
+	"id", "merchant_id", "store_id", "user_id", "session_id", "action", "entity", "entity_id",
+	"severity", "result", "error_message", "source_service", "correlation_id", "ip_address",
+	"user_agent", "duration_ms", "timestamp", "details", "old_value", "new_value", "changed_fields",
+	"sequence", "prev_hash", "hash",
+}
+
+// NewRecord flattens an audit log
+func NewRecord(log *repository.AuditLog) (Record, error) {
+	r := Record{
+		ID:            log.ID,
+		MerchantID:    log.MerchantID,
+		StoreID:       log.StoreID,
+		UserID:        log.UserID,
+		SessionID:     log.SessionID,
+		Action:        log.Action,
+		Entity:        log.Entity,
+		EntityID:      log.EntityID,
+		Severity:      log.Severity,
+		Result:        log.Result,
+		ErrorMessage:  log.ErrorMessage,
+		SourceService: log.SourceService,
+		CorrelationID: log.CorrelationID,
+		IPAddress:     log.IPAddress,
+		UserAgent:     log.UserAgent,
+		DurationMs:    log.DurationMs,
+		Timestamp:     log.Timestamp.UTC(),
+		ChangedFields: strings.Join(log.ChangedFields, ","),
+		Sequence:      log.Sequence,
+		PrevHash:      log.PrevHash,
+		Hash:          log.Hash,
+	}
+	var err error
+	if r.Details, err = encodeJSON(log.Details); err != nil {
+		return r, err
+	}
+	if r.OldValue, err = encodeJSON(log.OldValue); err != nil {
+		return r, err
+	}
+	if r.NewValue, err = encodeJSON(log.NewValue); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// encodeJSON encodes a document decoded from BSON, empty documents become an empty string
+func encodeJSON(m map[string]interface{}) (string, error) {
+	if len(m) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(jsonvalue.Normalize(m))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *Record) csvRow() []string {
+	return []string{
+		r.ID, r.MerchantID, r.StoreID, r.UserID, r.SessionID, r.Action, r.Entity, r.EntityID,
+		r.Severity, r.Result, r.ErrorMessage, r.SourceService, r.CorrelationID, r.IPAddress,
+		r.UserAgent, strconv.FormatInt(r.DurationMs, 10), r.Timestamp.Format(time.RFC3339Nano),
+		r.Details, r.OldValue, r.NewValue, r.ChangedFields,
+		strconv.FormatInt(r.Sequence, 10), r.PrevHash, r.Hash,
+	}
+}
+
+// Writer encodes audit logs in one format
+type Writer interface {
+	Write(log *repository.AuditLog) error
+	// Close writes any buffered data and the format's footer. It does not close the underlying writer.
+	Close() error
+}
+
+// CheckFormat returns ErrUnknownFormat for an unsupported format
+func CheckFormat(format string) error {
+	switch format {
+	case FormatCSV, FormatNDJSON, FormatParquet:
+		return nil
+	}
+	return ErrUnknownFormat
+}
+
+// NewWriter returns a Writer for format writing to w
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(columns); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: cw}, nil
+	case FormatNDJSON:
+		bw := bufio.NewWriter(w)
+		return &ndjsonWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case FormatParquet:
+		return &parquetWriter{w: parquet.NewGenericWriter[Record](w, parquet.MaxRowsPerRowGroup(parquetRowGroupSize))}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// ContentType returns the media type of a format
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(log *repository.AuditLog) error {
+	r, err := NewRecord(log)
+	if err != nil {
+		return err
+	}
+	return c.w.Write(r.csvRow())
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(log *repository.AuditLog) error {
+	r, err := NewRecord(log)
+	if err != nil {
+		return err
+	}
+	return n.enc.Encode(ndjsonRecord{
+		Record:   r,
+		Details:  rawJSON(r.Details),
+		OldValue: rawJSON(r.OldValue),
+		NewValue: rawJSON(r.NewValue),
+	})
+}
+
+// ndjsonRecord keeps details and the snapshots as nested objects instead of JSON strings
+type ndjsonRecord struct {
+	Record
+	Details  json.RawMessage `json:"details,omitempty"`
+	OldValue json.RawMessage `json:"old_value,omitempty"`
+	NewValue json.RawMessage `json:"new_value,omitempty"`
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return n.w.Flush()
+}
+
+type parquetWriter struct {
+	w *parquet.GenericWriter[Record]
+}
+
+func (p *parquetWriter) Write(log *repository.AuditLog) error {
+	r, err := NewRecord(log)
+	if err != nil {
+		return err
+	}
+	_, err = p.w.Write([]Record{r})
+	return err
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) CreateAlertRule(ctx context.Context, req *auditv1.CreateAlertRuleRequest) (*auditv1.AlertRule, error) {
+	if req.Rule == nil {
+		return nil, status.Error(codes.InvalidArgument, "rule is required")
+	}
+
+	rule, err := h.alerts.CreateAlertRule(ctx, toAlertRuleInput(req.Rule))
+	if err != nil {
+		return nil, h.alertRuleError(err, "failed to create alert rule", "")
+	}
+	h.logger.Info("Alert rule created", zap.String("id", rule.ID), zap.String("merchant_id", rule.MerchantID))
+	return toProtoAlertRule(rule), nil
+}
+
+func (h *AuditHandler) GetAlertRule(ctx context.Context, req *auditv1.GetAlertRuleRequest) (*auditv1.AlertRule, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	rule, err := h.alerts.GetAlertRule(ctx, req.Id)
+	if err != nil {
+		return nil, h.alertRuleError(err, "failed to get alert rule", req.Id)
+	}
+	return toProtoAlertRule(rule), nil
+}
+
+func (h *AuditHandler) ListAlertRules(ctx context.Context, req *auditv1.ListAlertRulesRequest) (*auditv1.ListAlertRulesResponse, error) {
+	list, err := h.alerts.ListAlertRules(ctx, req.MerchantId)
+	if err != nil {
+		return nil, h.alertRuleError(err, "failed to list alert rules", "")
+	}
+
+	resp := &auditv1.ListAlertRulesResponse{Rules: make([]*auditv1.AlertRule, len(list))}
+	for i := range list {
+		resp.Rules[i] = toProtoAlertRule(&list[i])
+	}
+	return resp, nil
+}
+
+func (h *AuditHandler) UpdateAlertRule(ctx context.Context, req *auditv1.UpdateAlertRuleRequest) (*auditv1.AlertRule, error) {
+	if req.Rule == nil || req.Rule.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "rule.id is required")
+	}
+
+	rule, err := h.alerts.UpdateAlertRule(ctx, req.Rule.Id, toAlertRuleInput(req.Rule))
+	if err != nil {
+		return nil, h.alertRuleError(err, "failed to update alert rule", req.Rule.Id)
+	}
+	h.logger.Info("Alert rule updated", zap.String("id", rule.ID), zap.String("merchant_id", rule.MerchantID))
+	return toProtoAlertRule(rule), nil
+}
+
+func (h *AuditHandler) DeleteAlertRule(ctx context.Context, req *auditv1.DeleteAlertRuleRequest) (*emptypb.Empty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	if err := h.alerts.DeleteAlertRule(ctx, req.Id); err != nil {
+		return nil, h.alertRuleError(err, "failed to delete alert rule", req.Id)
+	}
+	h.logger.Info("Alert rule deleted", zap.String("id", req.Id))
+	return &emptypb.Empty{}, nil
+}
+
+func (h *AuditHandler) ListAlerts(ctx context.Context, req *auditv1.ListAlertsRequest) (*auditv1.ListAlertsResponse, error) {
+	input := &usecase.ListAlertsInput{
+		MerchantID: req.MerchantId,
+		RuleID:     req.RuleId,
+		Severity:   req.Severity,
+		Page:       req.Page,
+		PageSize:   req.PageSize,
+	}
+
+	alerts, total, err := h.alerts.ListAlerts(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		h.logger.Error("Failed to list alerts", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to list alerts")
+	}
+
+	resp := &auditv1.ListAlertsResponse{
+		Alerts: make([]*auditv1.Alert, len(alerts)),
+		Total:  total,
+	}
+	for i := range alerts {
+		resp.Alerts[i] = toProtoAlert(&alerts[i])
+	}
+	return resp, nil
+}
+
+func (h *AuditHandler) alertRuleError(err error, msg, id string) error {
+	if scopeErr := scopeError(err); scopeErr != nil {
+		return scopeErr
+	}
+	switch {
+	case errors.Is(err, repository.ErrAlertRuleNotFound):
+		return status.Error(codes.NotFound, "alert rule not found")
+	case errors.Is(err, usecase.ErrMerchantRequired):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, usecase.ErrAlertRuleLimit):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	var validationErr *usecase.ValidationError
+	if errors.As(err, &validationErr) {
+		return invalidArgument(validationErr)
+	}
+	h.logger.Error(msg, zap.Error(err), zap.String("id", id))
+	return status.Error(codes.Internal, msg)
+}
+
+func toAlertRuleInput(r *auditv1.AlertRule) *usecase.AlertRuleInput {
+	input := &usecase.AlertRuleInput{
+		MerchantID:    r.MerchantId,
+		Name:          r.Name,
+		Description:   r.Description,
+		Enabled:       r.Enabled,
+		MinDurationMs: r.MinDurationMs,
+		MaxDurationMs: r.MaxDurationMs,
+		Severity:      r.Severity,
+		Suppression:   time.Duration(r.SuppressionSeconds) * time.Second,
+	}
+	for _, f := range r.Filters {
+		input.Filters = append(input.Filters, usecase.FieldFilter{Field: f.Field, Values: f.Values, Not: f.Not})
+	}
+	if t := r.Threshold; t != nil {
+		input.Threshold = &usecase.RuleThresholdInput{
+			Count:   t.Count,
+			Window:  time.Duration(t.WindowSeconds) * time.Second,
+			GroupBy: t.GroupBy,
+		}
+	}
+	if c := r.Change; c != nil {
+		input.Change = &usecase.RuleChangeInput{Field: c.Field, MinPercent: c.MinPercent}
+	}
+	return input
+}
+
+func toProtoAlertRule(r *repository.AlertRule) *auditv1.AlertRule {
+	rule := &auditv1.AlertRule{
+		Id:                 r.ID,
+		MerchantId:         r.MerchantID,
+		Name:               r.Name,
+		Description:        r.Description,
+		Enabled:            r.Enabled,
+		MinDurationMs:      r.Query.MinDurationMs,
+		MaxDurationMs:      r.Query.MaxDurationMs,
+		Severity:           r.Severity,
+		SuppressionSeconds: int64(r.Suppression / time.Second),
+		CreatedBy:          r.CreatedBy,
+		CreatedAt:          timestamppb.New(r.CreatedAt),
+		UpdatedAt:          timestamppb.New(r.UpdatedAt),
+	}
+	for _, f := range usecase.RuleFilters(r) {
+		rule.Filters = append(rule.Filters, &auditv1.FieldFilter{Field: f.Field, Values: f.Values, Not: f.Not})
+	}
+	if t := r.Threshold; t != nil {
+		rule.Threshold = &auditv1.AlertThreshold{
+			Count:         t.Count,
+			WindowSeconds: int64(t.Window / time.Second),
+		}
+		for _, f := range t.GroupBy {
+			rule.Threshold.GroupBy = append(rule.Threshold.GroupBy, string(f))
+		}
+	}
+	if c := r.Change; c != nil {
+		rule.Change = &auditv1.AlertChange{Field: c.Field, MinPercent: c.MinPercent}
+	}
+	return rule
+}
+
+func toProtoAlert(a *repository.Alert) *auditv1.Alert {
+	return &auditv1.Alert{
+		Id:             a.ID,
+		MerchantId:     a.MerchantID,
+		RuleId:         a.RuleID,
+		RuleName:       a.RuleName,
+		Severity:       a.Severity,
+		GroupKey:       a.GroupKey,
+		Count:          a.Count,
+		LogIds:         a.LogIDs,
+		Message:        a.Message,
+		FirstTimestamp: timestamppb.New(a.FirstTimestamp),
+		LastTimestamp:  timestamppb.New(a.LastTimestamp),
+		CreatedAt:      timestamppb.New(a.CreatedAt),
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchEntries bounds one BatchCreateAuditLogs call and one bulk write of StreamAuditLogs
+const maxBatchEntries = 1000
+
+// maxStreamFailures bounds the failed entries StreamAuditLogs lists in its response
+const maxStreamFailures = 1000
+
+func (h *AuditHandler) BatchCreateAuditLogs(ctx context.Context, req *auditv1.BatchCreateAuditLogsRequest) (*auditv1.BatchCreateAuditLogsResponse, error) {
+	if len(req.Entries) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "entries are required")
+	}
+	if len(req.Entries) > maxBatchEntries {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d entries per batch, use StreamAuditLogs for more", maxBatchEntries)
+	}
+
+	results := h.createBatch(ctx, requestMetadataFrom(ctx), req.Entries, 0)
+	return toBatchResponse(results), nil
+}
+
+// StreamAuditLogs accepts any number of entries, e.g. from a terminal that was offline,
+// and stores them in bulk writes of up to maxBatchEntries. The response counts every entry but
+// only lists the results of the first maxStreamFailures entries that failed, identified by
+// their index, so that a long stream does not keep a result per entry.
+func (h *AuditHandler) StreamAuditLogs(stream auditv1.AuditService_StreamAuditLogsServer) error {
+	ctx := stream.Context()
+	meta := requestMetadataFrom(ctx)
+
+	resp := &auditv1.BatchCreateAuditLogsResponse{}
+	received := 0
+	pending := make([]*auditv1.CreateAuditLogRequest, 0, maxBatchEntries)
+	flush := func() {
+		for _, r := range h.createBatch(ctx, meta, pending, received) {
+			if r.Success {
+				resp.Succeeded++
+				continue
+			}
+			resp.Failed++
+			if len(resp.Results) < maxStreamFailures {
+				resp.Results = append(resp.Results, r)
+			}
+		}
+		received += len(pending)
+		pending = pending[:0]
+	}
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			flush()
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		pending = append(pending, req)
+		if len(pending) == maxBatchEntries {
+			flush()
+		}
+	}
+}
+
+// createBatch stores the entries with one bulk write. offset is the position of the first entry
+// in the whole request, used for result indexes and derived idempotency keys.
+func (h *AuditHandler) createBatch(ctx context.Context, meta requestMetadata, entries []*auditv1.CreateAuditLogRequest, offset int) []*auditv1.CreateAuditLogResult {
+	results := make([]*auditv1.CreateAuditLogResult, len(entries))
+	inputs := make([]*usecase.CreateAuditLogInput, 0, len(entries))
+	positions := make([]int, 0, len(entries))
+
+	for i, entry := range entries {
+		index := int32(offset + i)
+		if entry == nil {
+			results[i] = &auditv1.CreateAuditLogResult{Index: index, Code: int32(codes.InvalidArgument), Error: "entry is empty"}
+			continue
+		}
+
+		input := toCreateAuditLogInput(meta, entry)
+		// A request-level key must still identify each entry on its own
+		if entry.IdempotencyKey == "" && meta.IdempotencyKey != "" {
+			input.EventID = fmt.Sprintf("%s:%d", meta.IdempotencyKey, index)
+		}
+		inputs = append(inputs, input)
+		positions = append(positions, i)
+	}
+
+	for j, err := range h.uc.CreateAuditLogs(ctx, inputs) {
+		i := positions[j]
+		index := int32(offset + i)
+		var validationErr *usecase.ValidationError
+		if errors.As(err, &validationErr) {
+			results[i] = &auditv1.CreateAuditLogResult{
+				Index:           index,
+				Code:            int32(codes.InvalidArgument),
+				Error:           validationErr.Error(),
+				FieldViolations: toProtoFieldViolations(validationErr),
+			}
+			continue
+		}
+		if err != nil {
+			h.logger.Error("Failed to create audit log", zap.Error(err), zap.Int32("index", index))
+			results[i] = &auditv1.CreateAuditLogResult{Index: index, Code: int32(codes.Internal), Error: "failed to create audit log"}
+			continue
+		}
+		results[i] = &auditv1.CreateAuditLogResult{Index: index, Success: true, Code: int32(codes.OK)}
+	}
+	return results
+}
+
+func toBatchResponse(results []*auditv1.CreateAuditLogResult) *auditv1.BatchCreateAuditLogsResponse {
+	resp := &auditv1.BatchCreateAuditLogsResponse{Results: results}
+	for _, r := range results {
+		if r.Success {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+	return resp
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) GetInclusionProof(ctx context.Context, req *auditv1.GetInclusionProofRequest) (*auditv1.GetInclusionProofResponse, error) {
+	if h.checkpoints == nil {
+		return nil, status.Error(codes.FailedPrecondition, "checkpointing is not configured")
+	}
+	if req.LogId == "" {
+		return nil, status.Error(codes.InvalidArgument, "log_id is required")
+	}
+
+	proof, err := h.checkpoints.GetInclusionProof(ctx, req.LogId)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		switch {
+		case errors.Is(err, repository.ErrAuditLogNotFound):
+			return nil, status.Error(codes.NotFound, "audit log not found")
+		case errors.Is(err, usecase.ErrNotCheckpointed):
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, usecase.ErrUnknownCheckpointKey):
+			h.logger.Error("Checkpoint public key not configured", zap.Error(err), zap.String("log_id", req.LogId))
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		case errors.Is(err, usecase.ErrCheckpointMismatch), errors.Is(err, usecase.ErrBrokenChain):
+			h.logger.Error("Checkpoint no longer matches stored audit logs", zap.Error(err), zap.String("log_id", req.LogId))
+			return nil, status.Error(codes.DataLoss, err.Error())
+		}
+		h.logger.Error("Failed to build inclusion proof", zap.Error(err), zap.String("log_id", req.LogId))
+		return nil, status.Error(codes.Internal, "failed to build inclusion proof")
+	}
+
+	return &auditv1.GetInclusionProofResponse{
+		Log:        toProtoAuditLog(proof.Log),
+		Checkpoint: toProtoCheckpoint(proof.Checkpoint),
+		LeafIndex:  proof.LeafIndex,
+		LeafHash:   proof.LeafHash,
+		AuditPath:  proof.AuditPath,
+		PublicKey:  proof.PublicKey,
+	}, nil
+}
+
+func toProtoCheckpoint(cp *repository.Checkpoint) *auditv1.Checkpoint {
+	return &auditv1.Checkpoint{
+		Id:           cp.ID,
+		MerchantId:   cp.MerchantID,
+		FromSequence: cp.FromSequence,
+		ToSequence:   cp.ToSequence,
+		LeafCount:    cp.LeafCount,
+		RootHash:     cp.RootHash,
+		HeadHash:     cp.HeadHash,
+		PrevRootHash: cp.PrevRootHash,
+		CreatedAt:    timestamppb.New(cp.CreatedAt),
+		KeyId:        cp.KeyID,
+		Signature:    cp.Signature,
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"strconv"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/export"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// exportChunkSize is the largest payload of one ExportAuditLogs message
+const exportChunkSize = 64 * 1024
+
+// ExportAuditLogs streams every matching log as chunks of a CSV, NDJSON or Parquet file.
+// The media type is sent in the x-content-type header, the record count in the x-record-count trailer.
+func (h *AuditHandler) ExportAuditLogs(req *auditv1.ExportAuditLogsRequest, stream auditv1.AuditService_ExportAuditLogsServer) error {
+	if err := export.CheckFormat(req.Format); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx := stream.Context()
+	filter := req.Filter
+	if filter == nil {
+		filter = &auditv1.ListAuditLogsRequest{}
+	}
+	input := &usecase.ExportAuditLogsInput{
+		Filter: *toListAuditLogsInput(filter),
+		Format: req.Format,
+	}
+	// The media type is only announced with the first chunk, once the request has been validated
+	headerSet := false
+	setHeader := func() error {
+		if headerSet {
+			return nil
+		}
+		headerSet = true
+		return stream.SetHeader(metadata.Pairs("x-content-type", export.ContentType(req.Format)))
+	}
+
+	w := bufio.NewWriterSize(chunkWriter(func(data []byte) error {
+		if err := setHeader(); err != nil {
+			return err
+		}
+		return stream.Send(&auditv1.ExportAuditLogsResponse{Data: data})
+	}), exportChunkSize)
+	written, err := h.uc.ExportAuditLogs(ctx, input, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return scopeErr
+		}
+		if errors.Is(err, export.ErrUnknownFormat) || errors.Is(err, repository.ErrInvalidQuery) {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		var validationErr *usecase.ValidationError
+		if errors.As(err, &validationErr) {
+			return invalidArgument(validationErr)
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		h.logger.Error("Failed to export audit logs", zap.Error(err), zap.Int64("written", written))
+		return status.Error(codes.Internal, "failed to export audit logs")
+	}
+
+	// An empty export sends no chunk but still has a media type
+	if err := setHeader(); err != nil {
+		return err
+	}
+	stream.SetTrailer(metadata.Pairs("x-record-count", strconv.FormatInt(written, 10)))
+	return nil
+}
+
+// chunkWriter sends what is written to it as stream messages of at most exportChunkSize
+type chunkWriter func(data []byte) error
+
+func (send chunkWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		size := min(len(p), exportChunkSize)
+		// Stats handlers may read a message after Send returns, so p is copied
+		data := make([]byte, size)
+		copy(data, p[:size])
+		if err := send(data); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/export"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) StartExport(ctx context.Context, req *auditv1.StartExportRequest) (*auditv1.ExportJob, error) {
+	if h.exports == nil {
+		return nil, status.Error(codes.FailedPrecondition, "export jobs are not configured")
+	}
+	filter := req.Filter
+	if filter == nil {
+		filter = &auditv1.ListAuditLogsRequest{}
+	}
+	input := &usecase.ExportAuditLogsInput{
+		Filter: *toListAuditLogsInput(filter),
+		Format: req.Format,
+	}
+
+	job, err := h.exports.StartExport(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		if errors.Is(err, export.ErrUnknownFormat) || errors.Is(err, repository.ErrInvalidQuery) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		var validationErr *usecase.ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, invalidArgument(validationErr)
+		}
+		h.logger.Error("Failed to start export", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to start export")
+	}
+	return toProtoExportJob(job), nil
+}
+
+func (h *AuditHandler) GetExportStatus(ctx context.Context, req *auditv1.GetExportStatusRequest) (*auditv1.ExportJob, error) {
+	if h.exports == nil {
+		return nil, status.Error(codes.FailedPrecondition, "export jobs are not configured")
+	}
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	job, err := h.exports.GetExportStatus(ctx, req.Id)
+	if err != nil {
+		return nil, h.exportJobError(err, req.Id)
+	}
+	return toProtoExportJob(job), nil
+}
+
+// DownloadExport streams the archive of a succeeded export job in chunks. Its SHA-256 is
+// sent in the x-archive-sha256 header.
+func (h *AuditHandler) DownloadExport(req *auditv1.DownloadExportRequest, stream auditv1.AuditService_DownloadExportServer) error {
+	if h.exports == nil {
+		return status.Error(codes.FailedPrecondition, "export jobs are not configured")
+	}
+	if req.Id == "" {
+		return status.Error(codes.InvalidArgument, "id is required")
+	}
+	ctx := stream.Context()
+
+	job, archive, err := h.exports.DownloadExport(ctx, req.Id)
+	if err != nil {
+		return h.exportJobError(err, req.Id)
+	}
+	defer archive.Close()
+
+	if err := stream.SetHeader(metadata.Pairs("x-archive-sha256", job.ArchiveSHA256)); err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(chunkWriter(func(data []byte) error {
+		return stream.Send(&auditv1.DownloadExportResponse{Data: data})
+	}), exportChunkSize)
+	if _, err := io.Copy(w, archive); err != nil {
+		return h.exportJobError(err, req.Id)
+	}
+	if err := w.Flush(); err != nil {
+		return h.exportJobError(err, req.Id)
+	}
+	return nil
+}
+
+func (h *AuditHandler) exportJobError(err error, id string) error {
+	if scopeErr := scopeError(err); scopeErr != nil {
+		return scopeErr
+	}
+	switch {
+	case errors.Is(err, repository.ErrExportJobNotFound):
+		return status.Error(codes.NotFound, "export job not found")
+	case errors.Is(err, usecase.ErrExportNotReady), errors.Is(err, usecase.ErrExportExpired):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	h.logger.Error("Failed to read export job", zap.Error(err), zap.String("job_id", id))
+	return status.Error(codes.Internal, "failed to read export job")
+}
+
+func toProtoExportJob(job *repository.ExportJob) *auditv1.ExportJob {
+	pb := &auditv1.ExportJob{
+		Id:            job.ID,
+		Status:        job.Status,
+		Format:        job.Format,
+		RecordCount:   job.RecordCount,
+		ArchiveSize:   job.ArchiveSize,
+		ArchiveSha256: job.ArchiveSHA256,
+		KeyId:         job.KeyID,
+		Error:         job.Error,
+		CreatedAt:     timestamppb.New(job.CreatedAt),
+	}
+	if !job.StartedAt.IsZero() {
+		pb.StartedAt = timestamppb.New(job.StartedAt)
+	}
+	if !job.CompletedAt.IsZero() {
+		pb.CompletedAt = timestamppb.New(job.CompletedAt)
+	}
+	if !job.ExpiresAt.IsZero() {
+		pb.ExpiresAt = timestamppb.New(job.ExpiresAt)
+	}
+	return pb
+}
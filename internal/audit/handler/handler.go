@@ -2,13 +2,19 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"strings"
 
 	// For model type re-use or DTO mapping
 
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
 	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
 	"github.com/fekuna/omnipos-pkg/logger"
 	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
@@ -17,40 +23,103 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// IngestStatsProvider reports the backlog of the Kafka listener
+type IngestStatsProvider interface {
+	InFlight() int64
+	QueueDepths() []int
+}
+
 type AuditHandler struct {
 	auditv1.UnimplementedAuditServiceServer
-	uc     usecase.UseCase
-	logger logger.ZapLogger
+	uc            usecase.UseCase
+	checkpoints   usecase.CheckpointUseCase // nil when checkpointing is disabled
+	quarantine    usecase.QuarantineUseCase
+	exports       usecase.ExportJobUseCase // nil when export jobs are disabled
+	watch         usecase.WatchUseCase
+	alerts        usecase.AlertUseCase
+	notifications usecase.NotificationUseCase
+	ingest        IngestStatsProvider // nil when Kafka is not configured
+	logger        logger.ZapLogger
 }
 
-func NewAuditHandler(uc usecase.UseCase, logger logger.ZapLogger) *AuditHandler {
+func NewAuditHandler(
+	uc usecase.UseCase,
+	checkpoints usecase.CheckpointUseCase,
+	quarantine usecase.QuarantineUseCase,
+	exports usecase.ExportJobUseCase,
+	watch usecase.WatchUseCase,
+	alerts usecase.AlertUseCase,
+	notifications usecase.NotificationUseCase,
+	ingest IngestStatsProvider,
+	logger logger.ZapLogger,
+) *AuditHandler {
 	return &AuditHandler{
-		uc:     uc,
-		logger: logger,
+		uc:            uc,
+		checkpoints:   checkpoints,
+		quarantine:    quarantine,
+		exports:       exports,
+		watch:         watch,
+		alerts:        alerts,
+		notifications: notifications,
+		ingest:        ingest,
+		logger:        logger,
 	}
 }
 
 func (h *AuditHandler) CreateAuditLog(ctx context.Context, req *auditv1.CreateAuditLogRequest) (*emptypb.Empty, error) {
-	// Extract metadata
-	merchantID := ""
-	userID := ""
-	ipAddress := ""
-	userAgent := ""
-	if md, ok := metadata.FromIncomingContext(ctx); ok {
-		if val := md.Get("x-merchant-id"); len(val) > 0 {
-			merchantID = val[0]
+	input := toCreateAuditLogInput(requestMetadataFrom(ctx), req)
+
+	if err := h.uc.CreateAuditLog(ctx, input); err != nil {
+		var validationErr *usecase.ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, invalidArgument(validationErr)
 		}
-		if val := md.Get("x-user-id"); len(val) > 0 {
-			userID = val[0]
+		h.logger.Error("Failed to create audit log", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to create audit log")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// requestMetadata holds the caller details of a request
+type requestMetadata struct {
+	MerchantID     string
+	UserID         string
+	IPAddress      string
+	UserAgent      string
+	IdempotencyKey string
+}
+
+func requestMetadataFrom(ctx context.Context) requestMetadata {
+	var m requestMetadata
+	id, _ := auth.IdentityFrom(ctx)
+	m.MerchantID = id.MerchantID
+	m.UserID = id.UserID
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		// Services write on behalf of the merchant and user named in the metadata
+		if id.Role == auth.RoleService {
+			if val := md.Get("x-merchant-id"); len(val) > 0 {
+				m.MerchantID = val[0]
+			}
+			if val := md.Get("x-user-id"); len(val) > 0 {
+				m.UserID = val[0]
+			}
 		}
 		if val := md.Get("x-forwarded-for"); len(val) > 0 {
-			ipAddress = val[0]
+			// The first entry is the original client, the rest are proxies
+			m.IPAddress = strings.TrimSpace(strings.Split(val[0], ",")[0])
 		}
 		if val := md.Get("user-agent"); len(val) > 0 {
-			userAgent = val[0]
+			m.UserAgent = val[0]
+		}
+		if val := md.Get("x-idempotency-key"); len(val) > 0 {
+			m.IdempotencyKey = val[0]
 		}
 	}
+	return m
+}
 
+func toCreateAuditLogInput(m requestMetadata, req *auditv1.CreateAuditLogRequest) *usecase.CreateAuditLogInput {
 	details := make(map[string]interface{})
 	if req.Details != nil {
 		details = req.Details.AsMap()
@@ -66,15 +135,20 @@ func (h *AuditHandler) CreateAuditLog(ctx context.Context, req *auditv1.CreateAu
 		newValue = req.NewValue.AsMap()
 	}
 
-	input := &usecase.CreateAuditLogInput{
-		MerchantID: merchantID,
-		UserID:     userID,
+	eventID := req.IdempotencyKey
+	if eventID == "" {
+		eventID = m.IdempotencyKey
+	}
+
+	return &usecase.CreateAuditLogInput{
+		MerchantID: m.MerchantID,
+		UserID:     m.UserID,
 		Action:     req.Action,
 		Entity:     req.Entity,
 		EntityID:   req.EntityId,
 		Details:    details,
-		IPAddress:  ipAddress,
-		UserAgent:  userAgent,
+		IPAddress:  m.IPAddress,
+		UserAgent:  m.UserAgent,
 		// Enhanced fields
 		StoreID:       req.StoreId,
 		SessionID:     req.SessionId,
@@ -86,39 +160,76 @@ func (h *AuditHandler) CreateAuditLog(ctx context.Context, req *auditv1.CreateAu
 		SourceService: req.SourceService,
 		CorrelationID: req.CorrelationId,
 		DurationMs:    req.DurationMs,
+		EventID:       eventID,
 	}
+}
 
-	if err := h.uc.CreateAuditLog(ctx, input); err != nil {
-		h.logger.Error("Failed to create audit log", zap.Error(err))
-		return nil, status.Error(codes.Internal, "failed to create audit log")
+func (h *AuditHandler) ListAuditLogs(ctx context.Context, req *auditv1.ListAuditLogsRequest) (*auditv1.ListAuditLogsResponse, error) {
+	// Audit logs are restricted to the caller's merchant, store or own actions depending on its role
+	input := toListAuditLogsInput(req)
+
+	res, err := h.uc.ListAuditLogs(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		if errors.Is(err, usecase.ErrInvalidPageToken) || errors.Is(err, usecase.ErrInvalidTotalMode) ||
+			errors.Is(err, repository.ErrInvalidQuery) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		var validationErr *usecase.ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, invalidArgument(validationErr)
+		}
+		h.logger.Error("Failed to list audit logs", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to list audit logs")
 	}
 
-	return &emptypb.Empty{}, nil
-}
+	respLogs := make([]*auditv1.AuditLog, len(res.Logs))
+	for i := range res.Logs {
+		respLogs[i] = toProtoAuditLog(&res.Logs[i])
+	}
 
-func (h *AuditHandler) ListAuditLogs(ctx context.Context, req *auditv1.ListAuditLogsRequest) (*auditv1.ListAuditLogsResponse, error) {
-	// Audit logs are restricted to the merchant
-	merchantID := ""
-	if md, ok := metadata.FromIncomingContext(ctx); ok {
-		if val := md.Get("x-merchant-id"); len(val) > 0 {
-			merchantID = val[0]
+	resp := &auditv1.ListAuditLogsResponse{
+		Logs:           respLogs,
+		Total:          int32(res.Total),
+		TotalEstimated: res.TotalEstimated,
+		NextPageToken:  res.NextPageToken,
+	}
+	for _, m := range res.Matches {
+		match := &auditv1.SearchMatch{Score: m.Score, Highlights: make([]*auditv1.Highlight, len(m.Highlights))}
+		for i, hl := range m.Highlights {
+			match.Highlights[i] = &auditv1.Highlight{Field: hl.Field, Snippet: hl.Snippet}
 		}
+		resp.Matches = append(resp.Matches, match)
 	}
+	return resp, nil
+}
 
+func toListAuditLogsInput(req *auditv1.ListAuditLogsRequest) *usecase.ListAuditLogsInput {
 	input := &usecase.ListAuditLogsInput{
-		MerchantID: merchantID,
+		MerchantID: req.MerchantId,
 		UserID:     req.UserId,
 		Entity:     req.Entity,
 		EntityID:   req.EntityId,
 		Action:     req.Action,
 		Page:       req.Page,
 		PageSize:   req.PageSize,
+		PageToken:  req.PageToken,
+		TotalMode:  req.TotalMode,
 		// Enhanced filters
 		StoreID:       req.StoreId,
 		Severity:      req.Severity,
 		Result:        req.Result,
 		SourceService: req.SourceService,
 		CorrelationID: req.CorrelationId,
+		ChangedField:  req.ChangedField,
+		Query:         req.Query,
+		MinDurationMs: req.MinDurationMs,
+		MaxDurationMs: req.MaxDurationMs,
+	}
+	for _, f := range req.Filters {
+		input.Filters = append(input.Filters, usecase.FieldFilter{Field: f.Field, Values: f.Values, Not: f.Not})
 	}
 
 	if req.StartDate != nil {
@@ -127,46 +238,87 @@ func (h *AuditHandler) ListAuditLogs(ctx context.Context, req *auditv1.ListAudit
 	if req.EndDate != nil {
 		input.EndDate = req.EndDate.AsTime()
 	}
+	return input
+}
 
-	logs, total, err := h.uc.ListAuditLogs(ctx, input)
-	if err != nil {
-		h.logger.Error("Failed to list audit logs", zap.Error(err))
-		return nil, status.Error(codes.Internal, "failed to list audit logs")
+func toProtoAuditLog(l *repository.AuditLog) *auditv1.AuditLog {
+	details, _ := structpb.NewStruct(l.Details)
+	oldValue, _ := structpb.NewStruct(l.OldValue)
+	newValue, _ := structpb.NewStruct(l.NewValue)
+
+	return &auditv1.AuditLog{
+		Id:         l.ID,
+		MerchantId: l.MerchantID,
+		UserId:     l.UserID,
+		Action:     l.Action,
+		Entity:     l.Entity,
+		EntityId:   l.EntityID,
+		Details:    details,
+		IpAddress:  l.IPAddress,
+		UserAgent:  l.UserAgent,
+		Timestamp:  timestamppb.New(l.Timestamp),
+		// Enhanced fields
+		StoreId:       l.StoreID,
+		SessionId:     l.SessionID,
+		OldValue:      oldValue,
+		NewValue:      newValue,
+		Result:        l.Result,
+		ErrorMessage:  l.ErrorMessage,
+		Severity:      l.Severity,
+		SourceService: l.SourceService,
+		CorrelationId: l.CorrelationID,
+		DurationMs:    l.DurationMs,
+		EventId:       l.EventID,
+		// Hash chain fields
+		Sequence: l.Sequence,
+		PrevHash: l.PrevHash,
+		Hash:     l.Hash,
+		// Change index
+		Patch:         toProtoPatch(l.Patch),
+		ChangedFields: l.ChangedFields,
 	}
+}
 
-	respLogs := make([]*auditv1.AuditLog, len(logs))
-	for i, l := range logs {
-		details, _ := structpb.NewStruct(l.Details)
-		oldValue, _ := structpb.NewStruct(l.OldValue)
-		newValue, _ := structpb.NewStruct(l.NewValue)
-
-		respLogs[i] = &auditv1.AuditLog{
-			Id:         l.ID,
-			MerchantId: l.MerchantID,
-			UserId:     l.UserID,
-			Action:     l.Action,
-			Entity:     l.Entity,
-			EntityId:   l.EntityID,
-			Details:    details,
-			IpAddress:  l.IPAddress,
-			UserAgent:  l.UserAgent,
-			Timestamp:  timestamppb.New(l.Timestamp),
-			// Enhanced fields
-			StoreId:       l.StoreID,
-			SessionId:     l.SessionID,
-			OldValue:      oldValue,
-			NewValue:      newValue,
-			Result:        l.Result,
-			ErrorMessage:  l.ErrorMessage,
-			Severity:      l.Severity,
-			SourceService: l.SourceService,
-			CorrelationId: l.CorrelationID,
-			DurationMs:    l.DurationMs,
+func toProtoPatch(ops []repository.PatchOp) []*auditv1.PatchOperation {
+	out := make([]*auditv1.PatchOperation, len(ops))
+	for i, op := range ops {
+		out[i] = &auditv1.PatchOperation{Op: op.Op, Path: op.Path}
+		switch {
+		case op.Op == "remove":
+		case op.Value == nil:
+			out[i].Value = structpb.NewNullValue()
+		default:
+			out[i].Value = toProtoValue(jsonvalue.Normalize(op.Value))
 		}
 	}
+	return out
+}
+
+// scopeError maps a read rejected by tenant scoping to PermissionDenied, or returns nil
+func scopeError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrUnscopedQuery):
+		return status.Error(codes.PermissionDenied, "caller is not scoped to a merchant")
+	case errors.Is(err, usecase.ErrCrossTenant), errors.Is(err, usecase.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
 
-	return &auditv1.ListAuditLogsResponse{
-		Logs:  respLogs,
-		Total: total,
-	}, nil
+// invalidArgument returns an InvalidArgument status carrying the field violations as BadRequest details
+func invalidArgument(err *usecase.ValidationError) error {
+	st := status.New(codes.InvalidArgument, err.Error())
+	br := &errdetails.BadRequest{FieldViolations: toProtoFieldViolations(err)}
+	if withDetails, detailsErr := st.WithDetails(br); detailsErr == nil {
+		return withDetails.Err()
+	}
+	return st.Err()
+}
+
+func toProtoFieldViolations(err *usecase.ValidationError) []*errdetails.BadRequest_FieldViolation {
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(err.Violations))
+	for i, v := range err.Violations {
+		violations[i] = &errdetails.BadRequest_FieldViolation{Field: v.Field, Description: v.Description}
+	}
+	return violations
 }
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/diff"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) GetAuditLog(ctx context.Context, req *auditv1.GetAuditLogRequest) (*auditv1.AuditLog, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	log, err := h.uc.GetAuditLog(ctx, req.Id)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		// Logs outside the caller's scope are reported as missing too
+		if errors.Is(err, repository.ErrAuditLogNotFound) {
+			return nil, status.Error(codes.NotFound, "audit log not found")
+		}
+		h.logger.Error("Failed to get audit log", zap.Error(err), zap.String("id", req.Id))
+		return nil, status.Error(codes.Internal, "failed to get audit log")
+	}
+	return toProtoAuditLog(log), nil
+}
+
+func (h *AuditHandler) GetEntityHistory(ctx context.Context, req *auditv1.GetEntityHistoryRequest) (*auditv1.GetEntityHistoryResponse, error) {
+	input := &usecase.GetEntityHistoryInput{
+		MerchantID: req.MerchantId,
+		Entity:     req.Entity,
+		EntityID:   req.EntityId,
+		PageSize:   req.PageSize,
+		PageToken:  req.PageToken,
+	}
+
+	history, err := h.uc.GetEntityHistory(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		if errors.Is(err, usecase.ErrEntityRequired) || errors.Is(err, usecase.ErrInvalidPageToken) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		h.logger.Error("Failed to get entity history", zap.Error(err),
+			zap.String("entity", req.Entity), zap.String("entity_id", req.EntityId))
+		return nil, status.Error(codes.Internal, "failed to get entity history")
+	}
+
+	resp := &auditv1.GetEntityHistoryResponse{
+		Entries:       make([]*auditv1.EntityHistoryEntry, len(history.Entries)),
+		NextPageToken: history.NextPageToken,
+	}
+	for i := range history.Entries {
+		entry := &history.Entries[i]
+		resp.Entries[i] = &auditv1.EntityHistoryEntry{
+			Log:     toProtoAuditLog(&entry.Log),
+			Changes: toProtoFieldChanges(entry.Changes),
+		}
+	}
+	return resp, nil
+}
+
+func toProtoFieldChanges(changes []diff.Change) []*auditv1.FieldChange {
+	out := make([]*auditv1.FieldChange, len(changes))
+	for i, c := range changes {
+		out[i] = &auditv1.FieldChange{
+			Field:    c.Field,
+			Op:       c.Op,
+			OldValue: toProtoValue(c.Old),
+			NewValue: toProtoValue(c.New),
+		}
+	}
+	return out
+}
+
+// toProtoValue converts a normalized snapshot value, nil stays unset
+func toProtoValue(v interface{}) *structpb.Value {
+	if v == nil {
+		return nil
+	}
+	val, err := structpb.NewValue(v)
+	if err != nil {
+		return nil
+	}
+	return val
+}
+
+func (h *AuditHandler) GetEntityState(ctx context.Context, req *auditv1.GetEntityStateRequest) (*auditv1.GetEntityStateResponse, error) {
+	input := &usecase.GetEntityStateInput{
+		MerchantID: req.MerchantId,
+		Entity:     req.Entity,
+		EntityID:   req.EntityId,
+	}
+	if req.AsOf != nil {
+		input.AsOf = req.AsOf.AsTime()
+	}
+
+	state, err := h.uc.GetEntityState(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		switch {
+		case errors.Is(err, usecase.ErrEntityRequired):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, usecase.ErrNoEntityHistory):
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		h.logger.Error("Failed to rebuild entity state", zap.Error(err),
+			zap.String("entity", req.Entity), zap.String("entity_id", req.EntityId))
+		return nil, status.Error(codes.Internal, "failed to rebuild entity state")
+	}
+
+	resp := &auditv1.GetEntityStateResponse{
+		Entity:      state.Entity,
+		EntityId:    state.EntityID,
+		AsOf:        timestamppb.New(state.AsOf),
+		Exists:      state.Exists,
+		LastLog:     toProtoAuditLog(state.LastLog),
+		AppliedLogs: state.AppliedLogs,
+		Gaps:        make([]*auditv1.StateGap, len(state.Gaps)),
+		Complete:    state.Complete,
+	}
+	if state.State != nil {
+		if resp.State, err = structpb.NewStruct(state.State); err != nil {
+			h.logger.Error("Failed to encode entity state", zap.Error(err), zap.String("entity_id", req.EntityId))
+			return nil, status.Error(codes.Internal, "failed to rebuild entity state")
+		}
+	}
+	for i, g := range state.Gaps {
+		resp.Gaps[i] = &auditv1.StateGap{
+			LogId:     g.LogID,
+			Timestamp: timestamppb.New(g.Timestamp),
+			Reason:    g.Reason,
+			Fields:    g.Fields,
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"context"
+
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+)
+
+func (h *AuditHandler) GetIngestStats(ctx context.Context, req *auditv1.GetIngestStatsRequest) (*auditv1.GetIngestStatsResponse, error) {
+	resp := &auditv1.GetIngestStatsResponse{
+		AlertQueueDepth: int32(h.alerts.QueueDepth()),
+	}
+	if h.ingest == nil {
+		return resp, nil
+	}
+
+	depths := h.ingest.QueueDepths()
+	resp.ListenerEnabled = true
+	resp.InFlight = h.ingest.InFlight()
+	resp.WorkerQueueDepths = make([]int32, len(depths))
+	for i, d := range depths {
+		resp.WorkerQueueDepths[i] = int32(d)
+	}
+	return resp, nil
+}
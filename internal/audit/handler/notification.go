@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) CreateNotificationChannel(ctx context.Context, req *auditv1.CreateNotificationChannelRequest) (*auditv1.NotificationChannel, error) {
+	if req.Channel == nil {
+		return nil, status.Error(codes.InvalidArgument, "channel is required")
+	}
+
+	ch, err := h.notifications.CreateNotificationChannel(ctx, toNotificationChannelInput(req.Channel))
+	if err != nil {
+		return nil, h.notificationChannelError(err, "failed to create notification channel", "")
+	}
+	h.logger.Info("Notification channel created", zap.String("id", ch.ID), zap.String("merchant_id", ch.MerchantID))
+	return toProtoNotificationChannel(ch), nil
+}
+
+func (h *AuditHandler) GetNotificationChannel(ctx context.Context, req *auditv1.GetNotificationChannelRequest) (*auditv1.NotificationChannel, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	ch, err := h.notifications.GetNotificationChannel(ctx, req.Id)
+	if err != nil {
+		return nil, h.notificationChannelError(err, "failed to get notification channel", req.Id)
+	}
+	return toProtoNotificationChannel(ch), nil
+}
+
+func (h *AuditHandler) ListNotificationChannels(ctx context.Context, req *auditv1.ListNotificationChannelsRequest) (*auditv1.ListNotificationChannelsResponse, error) {
+	list, err := h.notifications.ListNotificationChannels(ctx, req.MerchantId)
+	if err != nil {
+		return nil, h.notificationChannelError(err, "failed to list notification channels", "")
+	}
+
+	resp := &auditv1.ListNotificationChannelsResponse{Channels: make([]*auditv1.NotificationChannel, len(list))}
+	for i := range list {
+		resp.Channels[i] = toProtoNotificationChannel(&list[i])
+	}
+	return resp, nil
+}
+
+func (h *AuditHandler) UpdateNotificationChannel(ctx context.Context, req *auditv1.UpdateNotificationChannelRequest) (*auditv1.NotificationChannel, error) {
+	if req.Channel == nil || req.Channel.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "channel.id is required")
+	}
+
+	ch, err := h.notifications.UpdateNotificationChannel(ctx, req.Channel.Id, toNotificationChannelInput(req.Channel))
+	if err != nil {
+		return nil, h.notificationChannelError(err, "failed to update notification channel", req.Channel.Id)
+	}
+	h.logger.Info("Notification channel updated", zap.String("id", ch.ID), zap.String("merchant_id", ch.MerchantID))
+	return toProtoNotificationChannel(ch), nil
+}
+
+func (h *AuditHandler) DeleteNotificationChannel(ctx context.Context, req *auditv1.DeleteNotificationChannelRequest) (*emptypb.Empty, error) {
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	if err := h.notifications.DeleteNotificationChannel(ctx, req.Id); err != nil {
+		return nil, h.notificationChannelError(err, "failed to delete notification channel", req.Id)
+	}
+	h.logger.Info("Notification channel deleted", zap.String("id", req.Id))
+	return &emptypb.Empty{}, nil
+}
+
+func (h *AuditHandler) ListAlertDeliveries(ctx context.Context, req *auditv1.ListAlertDeliveriesRequest) (*auditv1.ListAlertDeliveriesResponse, error) {
+	input := &usecase.ListAlertDeliveriesInput{
+		MerchantID: req.MerchantId,
+		AlertID:    req.AlertId,
+		ChannelID:  req.ChannelId,
+		Status:     req.Status,
+		Page:       req.Page,
+		PageSize:   req.PageSize,
+	}
+
+	deliveries, total, err := h.notifications.ListAlertDeliveries(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		h.logger.Error("Failed to list alert deliveries", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to list alert deliveries")
+	}
+
+	resp := &auditv1.ListAlertDeliveriesResponse{
+		Deliveries: make([]*auditv1.AlertDelivery, len(deliveries)),
+		Total:      total,
+	}
+	for i := range deliveries {
+		resp.Deliveries[i] = toProtoAlertDelivery(&deliveries[i])
+	}
+	return resp, nil
+}
+
+func (h *AuditHandler) notificationChannelError(err error, msg, id string) error {
+	if scopeErr := scopeError(err); scopeErr != nil {
+		return scopeErr
+	}
+	switch {
+	case errors.Is(err, repository.ErrNotificationChannelNotFound):
+		return status.Error(codes.NotFound, "notification channel not found")
+	case errors.Is(err, usecase.ErrMerchantRequired):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, usecase.ErrChannelTypeUnavailable):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, usecase.ErrNotificationChannelLimit):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	var validationErr *usecase.ValidationError
+	if errors.As(err, &validationErr) {
+		return invalidArgument(validationErr)
+	}
+	h.logger.Error(msg, zap.Error(err), zap.String("id", id))
+	return status.Error(codes.Internal, msg)
+}
+
+func toNotificationChannelInput(c *auditv1.NotificationChannel) *usecase.NotificationChannelInput {
+	return &usecase.NotificationChannelInput{
+		MerchantID:  c.MerchantId,
+		Name:        c.Name,
+		Type:        c.Type,
+		Enabled:     c.Enabled,
+		URL:         c.Url,
+		Secret:      c.Secret,
+		Recipients:  c.Recipients,
+		MinSeverity: c.MinSeverity,
+		RuleIDs:     c.RuleIds,
+	}
+}
+
+func toProtoNotificationChannel(c *repository.NotificationChannel) *auditv1.NotificationChannel {
+	return &auditv1.NotificationChannel{
+		Id:          c.ID,
+		MerchantId:  c.MerchantID,
+		Name:        c.Name,
+		Type:        c.Type,
+		Enabled:     c.Enabled,
+		Url:         c.URL,
+		Secret:      c.Secret,
+		Recipients:  c.Recipients,
+		MinSeverity: c.MinSeverity,
+		RuleIds:     c.RuleIDs,
+		CreatedBy:   c.CreatedBy,
+		CreatedAt:   timestamppb.New(c.CreatedAt),
+		UpdatedAt:   timestamppb.New(c.UpdatedAt),
+	}
+}
+
+func toProtoAlertDelivery(d *repository.AlertDelivery) *auditv1.AlertDelivery {
+	delivery := &auditv1.AlertDelivery{
+		Id:          d.ID,
+		MerchantId:  d.MerchantID,
+		AlertId:     d.AlertID,
+		ChannelId:   d.ChannelID,
+		ChannelType: d.ChannelType,
+		Target:      d.Target,
+		Status:      d.Status,
+		Attempts:    int32(d.Attempts),
+		LastError:   d.LastError,
+		CreatedAt:   timestamppb.New(d.CreatedAt),
+		UpdatedAt:   timestamppb.New(d.UpdatedAt),
+	}
+	if !d.NextAttemptAt.IsZero() {
+		delivery.NextAttemptAt = timestamppb.New(d.NextAttemptAt)
+	}
+	if !d.DeliveredAt.IsZero() {
+		delivery.DeliveredAt = timestamppb.New(d.DeliveredAt)
+	}
+	return delivery
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) ListQuarantinedEvents(ctx context.Context, req *auditv1.ListQuarantinedEventsRequest) (*auditv1.ListQuarantinedEventsResponse, error) {
+	input := &usecase.ListQuarantinedEventsInput{
+		Status:     req.Status,
+		MerchantID: req.MerchantId,
+		Reason:     req.Reason,
+		Page:       req.Page,
+		PageSize:   req.PageSize,
+	}
+
+	events, total, err := h.quarantine.ListQuarantinedEvents(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		h.logger.Error("Failed to list quarantined events", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to list quarantined events")
+	}
+
+	respEvents := make([]*auditv1.QuarantinedEvent, len(events))
+	for i := range events {
+		respEvents[i] = toProtoQuarantinedEvent(&events[i])
+	}
+
+	return &auditv1.ListQuarantinedEventsResponse{
+		Events: respEvents,
+		Total:  total,
+	}, nil
+}
+
+func (h *AuditHandler) GetQuarantinedEvent(ctx context.Context, req *auditv1.GetQuarantinedEventRequest) (*auditv1.QuarantinedEvent, error) {
+	event, err := h.quarantine.GetQuarantinedEvent(ctx, req.Id)
+	if err != nil {
+		return nil, h.quarantineError(err, "failed to get quarantined event", req.Id)
+	}
+	return toProtoQuarantinedEvent(event), nil
+}
+
+func (h *AuditHandler) ReplayQuarantinedEvent(ctx context.Context, req *auditv1.ReplayQuarantinedEventRequest) (*auditv1.QuarantinedEvent, error) {
+	event, err := h.quarantine.ReplayQuarantinedEvent(ctx, req.Id)
+	if err != nil {
+		return nil, h.quarantineError(err, "failed to replay quarantined event", req.Id)
+	}
+	h.logger.Info("Quarantined event replayed", zap.String("id", req.Id))
+	return toProtoQuarantinedEvent(event), nil
+}
+
+func (h *AuditHandler) DiscardQuarantinedEvent(ctx context.Context, req *auditv1.DiscardQuarantinedEventRequest) (*auditv1.QuarantinedEvent, error) {
+	event, err := h.quarantine.DiscardQuarantinedEvent(ctx, req.Id, req.Reason)
+	if err != nil {
+		return nil, h.quarantineError(err, "failed to discard quarantined event", req.Id)
+	}
+	h.logger.Info("Quarantined event discarded", zap.String("id", req.Id), zap.String("reason", req.Reason))
+	return toProtoQuarantinedEvent(event), nil
+}
+
+func (h *AuditHandler) quarantineError(err error, msg, id string) error {
+	if scopeErr := scopeError(err); scopeErr != nil {
+		return scopeErr
+	}
+	switch {
+	case errors.Is(err, repository.ErrQuarantinedEventNotFound):
+		return status.Error(codes.NotFound, "quarantined event not found")
+	case errors.Is(err, repository.ErrQuarantineResolved):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, usecase.ErrUndecodableEvent):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	var validationErr *usecase.ValidationError
+	if errors.As(err, &validationErr) {
+		return status.Error(codes.FailedPrecondition, validationErr.Error())
+	}
+	h.logger.Error(msg, zap.Error(err), zap.String("id", id))
+	return status.Error(codes.Internal, msg)
+}
+
+func toProtoQuarantinedEvent(e *repository.QuarantinedEvent) *auditv1.QuarantinedEvent {
+	event := &auditv1.QuarantinedEvent{
+		Id:            e.ID,
+		EventId:       e.EventID,
+		MerchantId:    e.MerchantID,
+		Topic:         e.Topic,
+		Partition:     int32(e.Partition),
+		Offset:        e.Offset,
+		Key:           e.Key,
+		Payload:       e.Payload,
+		Reason:        e.Reason,
+		Error:         e.Error,
+		Attempts:      int32(e.Attempts),
+		Status:        e.Status,
+		QuarantinedAt: timestamppb.New(e.QuarantinedAt),
+		Resolution:    e.Resolution,
+	}
+	if e.ResolvedAt != nil {
+		event.ResolvedAt = timestamppb.New(*e.ResolvedAt)
+	}
+	return event
+}
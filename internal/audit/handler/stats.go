@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (h *AuditHandler) GetAuditStats(ctx context.Context, req *auditv1.GetAuditStatsRequest) (*auditv1.GetAuditStatsResponse, error) {
+	filter := req.Filter
+	if filter == nil {
+		filter = &auditv1.ListAuditLogsRequest{}
+	}
+	input := &usecase.GetAuditStatsInput{
+		Filter:   *toListAuditLogsInput(filter),
+		GroupBy:  req.GroupBy,
+		Bucket:   req.Bucket,
+		Timezone: req.Timezone,
+	}
+
+	stats, err := h.uc.GetAuditStats(ctx, input)
+	if err != nil {
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		if errors.Is(err, repository.ErrInvalidQuery) || errors.Is(err, repository.ErrInvalidStatsSpec) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		var validationErr *usecase.ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, invalidArgument(validationErr)
+		}
+		h.logger.Error("Failed to aggregate audit stats", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to aggregate audit stats")
+	}
+
+	resp := &auditv1.GetAuditStatsResponse{
+		StartDate: timestamppb.New(stats.StartDate),
+		EndDate:   timestamppb.New(stats.EndDate),
+		Rows:      make([]*auditv1.AuditStatsRow, len(stats.Rows)),
+		Truncated: stats.Truncated,
+	}
+	for i, r := range stats.Rows {
+		row := &auditv1.AuditStatsRow{
+			Keys:          r.Keys,
+			Count:         r.Count,
+			FailureCount:  r.FailureCount,
+			PartialCount:  r.PartialCount,
+			FailureRate:   r.FailureRate,
+			AvgDurationMs: r.AvgDurationMs,
+			P50DurationMs: r.P50DurationMs,
+			P90DurationMs: r.P90DurationMs,
+			P99DurationMs: r.P99DurationMs,
+		}
+		if !r.Bucket.IsZero() {
+			row.BucketStart = timestamppb.New(r.Bucket)
+		}
+		resp.Rows[i] = row
+	}
+	return resp, nil
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (h *AuditHandler) VerifyChain(ctx context.Context, req *auditv1.VerifyChainRequest) (*auditv1.VerifyChainResponse, error) {
+	// Without a merchant in the request the caller's own chain is verified
+	input := &usecase.VerifyChainInput{
+		MerchantID:   req.MerchantId,
+		FromSequence: req.FromSequence,
+		ToSequence:   req.ToSequence,
+	}
+	if req.StartDate != nil {
+		input.StartDate = req.StartDate.AsTime()
+	}
+	if req.EndDate != nil {
+		input.EndDate = req.EndDate.AsTime()
+	}
+
+	res, err := h.uc.VerifyChain(ctx, input)
+	if err != nil {
+		if errors.Is(err, usecase.ErrMerchantRequired) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if scopeErr := scopeError(err); scopeErr != nil {
+			return nil, scopeErr
+		}
+		h.logger.Error("Failed to verify audit chain", zap.Error(err), zap.String("merchant_id", req.MerchantId))
+		return nil, status.Error(codes.Internal, "failed to verify audit chain")
+	}
+
+	if res.CheckpointFailure != "" {
+		h.logger.Warn("Latest checkpoint failed authentication",
+			zap.String("merchant_id", res.MerchantID), zap.String("reason", res.CheckpointFailure))
+	}
+
+	resp := &auditv1.VerifyChainResponse{
+		MerchantId:       res.MerchantID,
+		Valid:            res.Valid,
+		CheckedRecords:   res.CheckedRecords,
+		FirstSequence:    res.FirstSequence,
+		LastSequence:     res.LastSequence,
+		MissingSequences: make([]*auditv1.SequenceGap, len(res.MissingSequences)),
+		TamperedRecords:  make([]*auditv1.ChainBreak, len(res.TamperedRecords)),
+		Truncated:        res.Truncated,
+	}
+	if res.FirstBrokenLink != nil {
+		resp.FirstBrokenLink = toProtoChainBreak(res.FirstBrokenLink)
+	}
+	for i, g := range res.MissingSequences {
+		resp.MissingSequences[i] = &auditv1.SequenceGap{From: g.From, To: g.To}
+	}
+	for i := range res.TamperedRecords {
+		resp.TamperedRecords[i] = toProtoChainBreak(&res.TamperedRecords[i])
+	}
+
+	return resp, nil
+}
+
+func toProtoChainBreak(b *usecase.ChainBreak) *auditv1.ChainBreak {
+	return &auditv1.ChainBreak{
+		Sequence:     b.Sequence,
+		LogId:        b.LogID,
+		Reason:       b.Reason,
+		ExpectedHash: b.ExpectedHash,
+		ActualHash:   b.ActualHash,
+	}
+}
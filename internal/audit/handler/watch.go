@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
+	auditv1 "github.com/fekuna/omnipos-proto/gen/go/omnipos/audit/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WatchAuditLogs pushes new logs matching the filter as they are stored, e.g. for a live
+// screen of voids. Each log comes with a token to resume after it on reconnect.
+func (h *AuditHandler) WatchAuditLogs(req *auditv1.WatchAuditLogsRequest, stream auditv1.AuditService_WatchAuditLogsServer) error {
+	ctx := stream.Context()
+	filter := req.Filter
+	if filter == nil {
+		filter = &auditv1.ListAuditLogsRequest{}
+	}
+	input := &usecase.WatchAuditLogsInput{
+		Filter:      *toListAuditLogsInput(filter),
+		ResumeToken: req.ResumeToken,
+	}
+
+	err := h.watch.WatchAuditLogs(ctx, input, func(e *usecase.WatchEvent) error {
+		return stream.Send(&auditv1.WatchAuditLogsResponse{
+			Log:         toProtoAuditLog(e.Log),
+			ResumeToken: e.ResumeToken,
+		})
+	})
+	if err == nil || ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if scopeErr := scopeError(err); scopeErr != nil {
+		return scopeErr
+	}
+	switch {
+	case errors.Is(err, usecase.ErrInvalidResumeToken), errors.Is(err, repository.ErrInvalidQuery):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, usecase.ErrResumeTokenExpired):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, usecase.ErrWatcherLagged):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, repository.ErrChangeStreamsUnsupported):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	var validationErr *usecase.ValidationError
+	if errors.As(err, &validationErr) {
+		return invalidArgument(validationErr)
+	}
+	if _, ok := status.FromError(err); ok {
+		return err // the stream itself failed
+	}
+	h.logger.Error("Failed to watch audit logs", zap.Error(err))
+	return status.Error(codes.Internal, "failed to watch audit logs")
+}
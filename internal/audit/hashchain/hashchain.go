@@ -0,0 +1,119 @@
+package hashchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// GenesisHash is the previous hash of the first record in a merchant's chain
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Version identifies the canonical encoding used to compute record hashes
+const Version = 1
+
+// canonicalRecord fixes the field order of the hashed content.
+// Maps are serialized with sorted keys by encoding/json.
+type canonicalRecord struct {
+	Version       int                    `json:"v"`
+	ID            string                 `json:"id"`
+	MerchantID    string                 `json:"merchant_id"`
+	Sequence      int64                  `json:"sequence"`
+	PrevHash      string                 `json:"prev_hash"`
+	UserID        string                 `json:"user_id"`
+	Action        string                 `json:"action"`
+	Entity        string                 `json:"entity"`
+	EntityID      string                 `json:"entity_id"`
+	Details       map[string]interface{} `json:"details"`
+	IPAddress     string                 `json:"ip_address"`
+	UserAgent     string                 `json:"user_agent"`
+	Timestamp     string                 `json:"timestamp"`
+	StoreID       string                 `json:"store_id"`
+	SessionID     string                 `json:"session_id"`
+	OldValue      map[string]interface{} `json:"old_value"`
+	NewValue      map[string]interface{} `json:"new_value"`
+	Result        string                 `json:"result"`
+	ErrorMessage  string                 `json:"error_message"`
+	Severity      string                 `json:"severity"`
+	SourceService string                 `json:"source_service"`
+	CorrelationID string                 `json:"correlation_id"`
+	DurationMs    int64                  `json:"duration_ms"`
+}
+
+// Canonical returns the deterministic byte representation of a record that is covered by its hash.
+// The record's own Hash field is not part of it.
+func Canonical(log *repository.AuditLog) ([]byte, error) {
+	rec := canonicalRecord{
+		Version:       Version,
+		ID:            log.ID,
+		MerchantID:    log.MerchantID,
+		Sequence:      log.Sequence,
+		PrevHash:      log.PrevHash,
+		UserID:        log.UserID,
+		Action:        log.Action,
+		Entity:        log.Entity,
+		EntityID:      log.EntityID,
+		Details:       normalizeMap(log.Details),
+		IPAddress:     log.IPAddress,
+		UserAgent:     log.UserAgent,
+		Timestamp:     FormatTimestamp(log.Timestamp),
+		StoreID:       log.StoreID,
+		SessionID:     log.SessionID,
+		OldValue:      normalizeMap(log.OldValue),
+		NewValue:      normalizeMap(log.NewValue),
+		Result:        log.Result,
+		ErrorMessage:  log.ErrorMessage,
+		Severity:      log.Severity,
+		SourceService: log.SourceService,
+		CorrelationID: log.CorrelationID,
+		DurationMs:    log.DurationMs,
+	}
+	return json.Marshal(rec)
+}
+
+// Compute returns the hex encoded SHA-256 hash of the record's canonical content
+func Compute(log *repository.AuditLog) (string, error) {
+	b, err := Canonical(log)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Link appends the record to the chain whose current head is given and sets its hash.
+// A nil or empty head starts a new chain.
+func Link(log *repository.AuditLog, head *repository.ChainHead) error {
+	log.Sequence = 1
+	log.PrevHash = GenesisHash
+	if head != nil && head.Sequence > 0 {
+		log.Sequence = head.Sequence + 1
+		log.PrevHash = head.Hash
+	}
+
+	hash, err := Compute(log)
+	if err != nil {
+		return err
+	}
+	log.Hash = hash
+	return nil
+}
+
+// FormatTimestamp renders a timestamp the way it is hashed
+func FormatTimestamp(t time.Time) string {
+	return jsonvalue.FormatTimestamp(t)
+}
+
+// normalizeMap converts BSON decoded values back to plain JSON values so that a record hashes
+// the same before it is stored and after it is read back. Empty maps hash as null because
+// omitempty fields do not survive a round trip.
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	return jsonvalue.NormalizeMap(m)
+}
@@ -0,0 +1,147 @@
+package hashchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func chainLog() *repository.AuditLog {
+	return &repository.AuditLog{
+		ID:         "l1",
+		MerchantID: "m1",
+		UserID:     "u1",
+		Action:     "order.update",
+		Entity:     "order",
+		EntityID:   "o1",
+		Details: map[string]interface{}{
+			"items":  []interface{}{map[string]interface{}{"sku": "a", "qty": 2}},
+			"amount": 12.5,
+			"count":  int64(1) << 60,
+		},
+		OldValue:  map[string]interface{}{"status": "open"},
+		NewValue:  map[string]interface{}{"status": "paid"},
+		Timestamp: time.Date(2025, 3, 1, 12, 0, 0, 123456789, time.UTC),
+		Result:    "success",
+		Severity:  "info",
+	}
+}
+
+func TestLink(t *testing.T) {
+	tests := []struct {
+		name         string
+		head         *repository.ChainHead
+		wantSequence int64
+		wantPrevHash string
+	}{
+		{name: "nil head starts a chain", wantSequence: 1, wantPrevHash: GenesisHash},
+		{name: "empty head starts a chain", head: &repository.ChainHead{}, wantSequence: 1, wantPrevHash: GenesisHash},
+		{
+			name:         "head is extended",
+			head:         &repository.ChainHead{Sequence: 7, Hash: "abc"},
+			wantSequence: 8,
+			wantPrevHash: "abc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := chainLog()
+			if err := Link(log, tt.head); err != nil {
+				t.Fatalf("Link: %v", err)
+			}
+			if log.Sequence != tt.wantSequence {
+				t.Errorf("sequence = %d, want %d", log.Sequence, tt.wantSequence)
+			}
+			if log.PrevHash != tt.wantPrevHash {
+				t.Errorf("prev hash = %s, want %s", log.PrevHash, tt.wantPrevHash)
+			}
+			if want, _ := Compute(log); log.Hash != want || len(log.Hash) != 64 {
+				t.Errorf("hash = %s, want %s", log.Hash, want)
+			}
+		})
+	}
+}
+
+func TestLinkChainsRecords(t *testing.T) {
+	first := chainLog()
+	if err := Link(first, nil); err != nil {
+		t.Fatalf("Link first: %v", err)
+	}
+	second := chainLog()
+	second.ID = "l2"
+	if err := Link(second, &repository.ChainHead{Sequence: first.Sequence, Hash: first.Hash}); err != nil {
+		t.Fatalf("Link second: %v", err)
+	}
+	if second.PrevHash != first.Hash {
+		t.Errorf("second prev hash = %s, want the first hash %s", second.PrevHash, first.Hash)
+	}
+	if second.Hash == first.Hash {
+		t.Error("records with different ids hash the same")
+	}
+}
+
+func TestComputeDetectsEdits(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*repository.AuditLog)
+	}{
+		{name: "prev hash", edit: func(l *repository.AuditLog) { l.PrevHash = GenesisHash[1:] + "1" }},
+		{name: "sequence", edit: func(l *repository.AuditLog) { l.Sequence++ }},
+		{name: "user", edit: func(l *repository.AuditLog) { l.UserID = "u2" }},
+		{name: "detail value", edit: func(l *repository.AuditLog) { l.Details["amount"] = 13.5 }},
+		{name: "new value", edit: func(l *repository.AuditLog) { l.NewValue["status"] = "void" }},
+		{name: "timestamp", edit: func(l *repository.AuditLog) { l.Timestamp = l.Timestamp.Add(time.Millisecond) }},
+		{name: "duration", edit: func(l *repository.AuditLog) { l.DurationMs = 5 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := chainLog()
+			if err := Link(log, nil); err != nil {
+				t.Fatalf("Link: %v", err)
+			}
+			tt.edit(log)
+			if actual, _ := Compute(log); actual == log.Hash {
+				t.Errorf("edited %s still hashes to %s", tt.name, log.Hash)
+			}
+		})
+	}
+}
+
+func TestComputeSurvivesStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*repository.AuditLog)
+	}{
+		{name: "nested values"},
+		{name: "empty maps", edit: func(l *repository.AuditLog) { l.Details, l.OldValue, l.NewValue = map[string]interface{}{}, nil, nil }},
+		{name: "sub-millisecond timestamp", edit: func(l *repository.AuditLog) { l.Timestamp = l.Timestamp.Add(999 * time.Microsecond) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := chainLog()
+			if tt.edit != nil {
+				tt.edit(log)
+			}
+			if err := Link(log, nil); err != nil {
+				t.Fatalf("Link: %v", err)
+			}
+
+			b, err := bson.Marshal(log)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var stored repository.AuditLog
+			if err := bson.Unmarshal(b, &stored); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if actual, err := Compute(&stored); err != nil || actual != log.Hash {
+				t.Errorf("stored record hashes to %s (%v), want %s", actual, err, log.Hash)
+			}
+		})
+	}
+}
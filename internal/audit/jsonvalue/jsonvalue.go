@@ -0,0 +1,117 @@
+// Package jsonvalue converts snapshot values, as sent in events or decoded from BSON, into plain
+// JSON values, so that a snapshot compares and hashes the same before and after it is stored.
+package jsonvalue
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TimestampLayout keeps millisecond precision, which is what MongoDB stores
+const TimestampLayout = "2006-01-02T15:04:05.000Z"
+
+// FormatTimestamp renders a timestamp the way snapshots hold it
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Truncate(time.Millisecond).Format(TimestampLayout)
+}
+
+// Normalize converts v into a plain JSON value: objects become map[string]interface{}, arrays
+// []interface{}, numbers json.Number and times strings in TimestampLayout.
+//
+// Numbers keep their exact value. Integers are written in full, so int64 values above 2^53 are
+// not rounded; other numbers are written the way encoding/json writes a float64. A json.Number
+// is normalized the way MongoDB stores it, as an integer when it is one and as a float64
+// otherwise, so the number read back normalizes to the same value.
+func Normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return normalizeObject(val)
+	case primitive.M:
+		return normalizeObject(val)
+	case primitive.D:
+		out := make(map[string]interface{}, len(val))
+		for _, e := range val {
+			out[e.Key] = Normalize(e.Value)
+		}
+		return out
+	case primitive.A:
+		return normalizeSlice(val)
+	case []interface{}:
+		return normalizeSlice(val)
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(n, 10))
+		}
+		if f, err := val.Float64(); err == nil {
+			return floatNumber(f, v)
+		}
+		return v
+	case int:
+		return json.Number(strconv.FormatInt(int64(val), 10))
+	case int32:
+		return json.Number(strconv.FormatInt(int64(val), 10))
+	case int64:
+		return json.Number(strconv.FormatInt(val, 10))
+	case float32:
+		return floatNumber(float64(val), v)
+	case float64:
+		return floatNumber(val, v)
+	case primitive.Decimal128:
+		return val.String()
+	case primitive.DateTime:
+		return FormatTimestamp(val.Time())
+	case time.Time:
+		return FormatTimestamp(val)
+	default:
+		return v
+	}
+}
+
+// NormalizeMap normalizes every value of m, a nil map stays nil
+func NormalizeMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	return normalizeObject(m)
+}
+
+func normalizeObject(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = Normalize(v)
+	}
+	return out
+}
+
+func normalizeSlice(s []interface{}) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = Normalize(v)
+	}
+	return out
+}
+
+// floatNumber writes f like encoding/json does. NaN and infinities have no JSON form and
+// are returned as the original value.
+func floatNumber(f float64, original interface{}) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return original
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b := strconv.AppendFloat(nil, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return json.Number(b)
+}
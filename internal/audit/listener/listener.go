@@ -2,135 +2,434 @@ package listener
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fekuna/omnipos-audit-service/internal/audit/usecase"
-	"github.com/fekuna/omnipos-pkg/broker"
 	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 )
 
+// maxRetryBackoff caps the delay between persistence retries
+const maxRetryBackoff = 30 * time.Second
+
+// MessageReader is the part of *kafka.Reader the listener uses.
+// Messages are only acknowledged through CommitMessages.
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// DeadLetterWriter publishes events that could not be stored. *kafka.Writer implements it.
+type DeadLetterWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Config controls how the listener spreads, batches and retries writes
+type Config struct {
+	// Topic is the topic the reader consumes, for logging
+	Topic string
+	// Workers is the number of concurrent writers. Events of one merchant always go to the same worker.
+	Workers int
+	// WorkerQueueSize bounds the events waiting per worker. Fetching pauses while a queue is full.
+	WorkerQueueSize int
+	BatchSize       int
+	BatchTimeout    time.Duration
+	MaxRetries      int
+	RetryBackoff    time.Duration
+}
+
 // AuditListener listens to Kafka for audit events from all services
 type AuditListener struct {
-	consumer *broker.KafkaConsumer
-	uc       usecase.UseCase
-	logger   logger.ZapLogger
+	reader     MessageReader
+	uc         usecase.UseCase
+	quarantine usecase.QuarantineUseCase
+	deadLetter DeadLetterWriter // nil when no dead-letter topic is configured
+	cfg        Config
+	logger     logger.ZapLogger
+
+	offsets  *offsetTracker
+	queues   []chan *job
+	inFlight atomic.Int64
+}
+
+// job is a fetched message on its way through a worker
+type job struct {
+	msg       kafka.Message
+	offset    trackedOffset
+	event     *usecase.AuditEvent
+	decodeErr error
 }
 
 // NewAuditListener creates a new audit listener
-func NewAuditListener(consumer *broker.KafkaConsumer, uc usecase.UseCase, logger logger.ZapLogger) *AuditListener {
+func NewAuditListener(
+	reader MessageReader,
+	uc usecase.UseCase,
+	quarantine usecase.QuarantineUseCase,
+	deadLetter DeadLetterWriter,
+	cfg Config,
+	logger logger.ZapLogger,
+) *AuditListener {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	if cfg.WorkerQueueSize < 1 {
+		cfg.WorkerQueueSize = cfg.BatchSize
+	}
+
+	queues := make([]chan *job, cfg.Workers)
+	for i := range queues {
+		queues[i] = make(chan *job, cfg.WorkerQueueSize)
+	}
+
 	return &AuditListener{
-		consumer: consumer,
-		uc:       uc,
-		logger:   logger,
-	}
-}
-
-// AuditEvent represents an audit event from Kafka
-type AuditEvent struct {
-	EventID       string       `json:"event_id"`
-	EventType     string       `json:"event_type"`
-	SourceService string       `json:"source_service"`
-	Payload       AuditPayload `json:"payload"`
-	Timestamp     time.Time    `json:"timestamp"`
-}
-
-// AuditPayload contains the actual audit log data
-type AuditPayload struct {
-	MerchantID string                 `json:"merchant_id"`
-	UserID     string                 `json:"user_id"`
-	Action     string                 `json:"action"`
-	EntityType string                 `json:"entity_type"`
-	EntityID   string                 `json:"entity_id"`
-	Details    map[string]interface{} `json:"details"`
-	IPAddress  string                 `json:"ip_address"`
-	UserAgent  string                 `json:"user_agent"`
-	// Enhanced fields
-	StoreID       string                 `json:"store_id,omitempty"`
-	SessionID     string                 `json:"session_id,omitempty"`
-	OldValue      map[string]interface{} `json:"old_value,omitempty"`
-	NewValue      map[string]interface{} `json:"new_value,omitempty"`
-	Result        string                 `json:"result,omitempty"`
-	ErrorMessage  string                 `json:"error_message,omitempty"`
-	Severity      string                 `json:"severity,omitempty"`
-	CorrelationID string                 `json:"correlation_id,omitempty"`
-	DurationMs    int64                  `json:"duration_ms,omitempty"`
-}
-
-// Start begins listening for audit events from Kafka
-func (l *AuditListener) Start(ctx context.Context) {
-	l.logger.Info("Starting Audit Kafka Listener", zap.String("topic", "system.audit"))
+		reader:     reader,
+		uc:         uc,
+		quarantine: quarantine,
+		deadLetter: deadLetter,
+		cfg:        cfg,
+		logger:     logger,
+		offsets:    newOffsetTracker(),
+		queues:     queues,
+	}
+}
+
+// Start begins listening for audit events from Kafka.
+// Fetched messages are spread over the workers by merchant, so each merchant's events are stored
+// in order. An offset is committed only after it and every earlier message of its partition have
+// been stored or quarantined. If that is not possible, Start returns an error without committing
+// so the events are redelivered once the consumer restarts.
+func (l *AuditListener) Start(ctx context.Context) error {
+	l.logger.Info("Starting Audit Kafka Listener",
+		zap.String("topic", l.cfg.Topic),
+		zap.Int("workers", l.cfg.Workers),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(l.queues))
+	for i, queue := range l.queues {
+		wg.Add(1)
+		go func(worker int, queue chan *job) {
+			defer wg.Done()
+			if err := l.runWorker(ctx, queue); err != nil {
+				errCh <- fmt.Errorf("worker %d: %w", worker, err)
+				cancel()
+			}
+		}(i, queue)
+	}
+
+	l.dispatch(ctx)
+	wg.Wait()
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		l.logger.Info("Stopping Audit Kafka Listener")
+		return nil
+	}
+}
+
+// dispatch fetches messages and hands them to the worker that owns their merchant until ctx is done
+func (l *AuditListener) dispatch(ctx context.Context) {
 	for {
+		msg, err := l.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			l.logger.Error("Failed to fetch kafka message", zap.Error(err))
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		j := &job{msg: msg}
+		j.event, j.decodeErr = usecase.DecodeAuditEvent(msg.Value)
+
+		j.offset = l.offsets.track(msg)
+		l.inFlight.Add(1)
+
+		queue := l.queues[l.workerFor(j)]
+		select {
+		case queue <- j:
+			continue
+		default:
+		}
+
+		// Backpressure: stop fetching until the worker catches up
+		l.logger.Debug("Worker queue full, waiting", zap.Int64("in_flight", l.inFlight.Load()))
 		select {
+		case queue <- j:
 		case <-ctx.Done():
-			l.logger.Info("Stopping Audit Kafka Listener")
 			return
-		default:
-			msg, err := l.consumer.ReadMessage(ctx)
-			if err != nil {
-				if ctx.Err() != nil {
-					return
-				}
-				l.logger.Error("Failed to read kafka message", zap.Error(err))
-				time.Sleep(1 * time.Second)
-				continue
+		}
+	}
+}
+
+// workerFor picks the worker by merchant, falling back to the message key and partition
+func (l *AuditListener) workerFor(j *job) int {
+	key := ""
+	if j.event != nil {
+		key = j.event.Payload.MerchantID
+	}
+	if key == "" {
+		key = string(j.msg.Key)
+	}
+	if key == "" {
+		key = strconv.Itoa(j.msg.Partition)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(l.queues)))
+}
+
+// runWorker writes the jobs of one queue in batches until ctx is done
+func (l *AuditListener) runWorker(ctx context.Context, queue chan *job) error {
+	for {
+		var first *job
+		select {
+		case <-ctx.Done():
+			return nil
+		case first = <-queue:
+		}
+		batch := l.collectBatch(queue, first)
+
+		if err := l.processBatch(ctx, batch); err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
-			l.processMessage(ctx, msg.Value)
+			first, last := batch[0].msg, batch[len(batch)-1].msg
+			return fmt.Errorf("persist batch from partition %d offset %d to partition %d offset %d: %w",
+				first.Partition, first.Offset, last.Partition, last.Offset, err)
+		}
+
+		offsets := make([]trackedOffset, len(batch))
+		for i, j := range batch {
+			offsets[i] = j.offset
+		}
+		l.inFlight.Add(-int64(len(batch)))
+
+		err := l.offsets.complete(offsets, func(commits ...kafka.Message) error {
+			return l.reader.CommitMessages(ctx, commits...)
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			// The messages will be redelivered and deduplicated on their event ids
+			l.logger.Error("Failed to commit kafka messages", zap.Error(err), zap.Int("count", len(offsets)))
 		}
 	}
 }
 
-// processMessage handles a single audit event message
-func (l *AuditListener) processMessage(ctx context.Context, value []byte) {
-	var event AuditEvent
-	if err := json.Unmarshal(value, &event); err != nil {
-		l.logger.Error("Failed to unmarshal audit event", zap.Error(err), zap.String("raw", string(value)))
-		return
+// collectBatch adds queued jobs to the batch until it is full or the batch timeout has passed
+// since the first job was taken.
+func (l *AuditListener) collectBatch(queue chan *job, first *job) []*job {
+	batch := []*job{first}
+	timer := time.NewTimer(l.cfg.BatchTimeout)
+	defer timer.Stop()
+
+	for len(batch) < l.cfg.BatchSize {
+		select {
+		case j := <-queue:
+			batch = append(batch, j)
+		case <-timer.C:
+			return batch
+		}
 	}
+	return batch
+}
 
-	l.logger.Info("Processing audit event",
-		zap.String("event_id", event.EventID),
-		zap.String("action", event.Payload.Action),
-		zap.String("source", event.SourceService),
-	)
+// InFlight returns the number of messages fetched but not yet stored or quarantined
+func (l *AuditListener) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// QueueDepths returns the number of messages waiting per worker
+func (l *AuditListener) QueueDepths() []int {
+	depths := make([]int, len(l.queues))
+	for i, queue := range l.queues {
+		depths[i] = len(queue)
+	}
+	return depths
+}
+
+// processBatch stores the events of a batch. Events that cannot be parsed or stored are
+// quarantined. It returns an error only when an event could be neither stored nor quarantined.
+func (l *AuditListener) processBatch(ctx context.Context, batch []*job) error {
+	inputs := make([]*usecase.CreateAuditLogInput, 0, len(batch))
+	sources := make([]kafka.Message, 0, len(batch))
+	for _, j := range batch {
+		msg := j.msg
+		if j.decodeErr != nil {
+			l.logger.Error("Failed to unmarshal audit event",
+				zap.Error(j.decodeErr),
+				zap.Int("partition", msg.Partition),
+				zap.Int64("offset", msg.Offset),
+				zap.Int("size", len(msg.Value)),
+			)
+			if err := l.deadLetterMessage(ctx, msg, usecase.QuarantineReasonUnmarshal, j.decodeErr, 1); err != nil {
+				return err
+			}
+			continue
+		}
 
-	// Create audit log using the usecase with all enhanced fields
-	input := &usecase.CreateAuditLogInput{
-		MerchantID: event.Payload.MerchantID,
-		UserID:     event.Payload.UserID,
-		Action:     event.Payload.Action,
-		Entity:     event.Payload.EntityType,
-		EntityID:   event.Payload.EntityID,
-		Details:    event.Payload.Details,
-		IPAddress:  event.Payload.IPAddress,
-		UserAgent:  event.Payload.UserAgent,
-		// Enhanced fields
-		StoreID:       event.Payload.StoreID,
-		SessionID:     event.Payload.SessionID,
-		OldValue:      event.Payload.OldValue,
-		NewValue:      event.Payload.NewValue,
-		Result:        event.Payload.Result,
-		ErrorMessage:  event.Payload.ErrorMessage,
-		Severity:      event.Payload.Severity,
-		SourceService: event.SourceService, // Source from event level
-		CorrelationID: event.Payload.CorrelationID,
-		DurationMs:    event.Payload.DurationMs,
-	}
-
-	err := l.uc.CreateAuditLog(ctx, input)
+		event := j.event
+		l.logger.Debug("Processing audit event",
+			zap.String("event_id", event.EventID),
+			zap.String("action", event.Payload.Action),
+			zap.String("source", event.SourceService),
+		)
+
+		// Events without a producer id are deduplicated on their position in the topic
+		inputs = append(inputs, event.ToInput(usecase.KafkaEventID(msg.Topic, msg.Partition, msg.Offset)))
+		sources = append(sources, msg)
+	}
+
+	errs, err := l.createWithRetry(ctx, inputs)
 	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed++
 		l.logger.Error("Failed to create audit log from event",
 			zap.Error(err),
-			zap.String("event_id", event.EventID),
+			zap.String("event_id", inputs[i].EventID),
 		)
-		return
+		reason, attempts := usecase.QuarantineReasonPersist, l.cfg.MaxRetries+1
+		if isPermanent(err) {
+			reason, attempts = usecase.QuarantineReasonValidation, 1
+		}
+		if err := l.deadLetterMessage(ctx, sources[i], reason, err, attempts); err != nil {
+			return err
+		}
 	}
 
-	l.logger.Info("Audit log created from Kafka event", zap.String("event_id", event.EventID))
+	l.logger.Debug("Audit batch stored",
+		zap.Int("messages", len(batch)),
+		zap.Int("stored", len(inputs)-failed),
+		zap.Int("quarantined", len(batch)-len(inputs)+failed),
+	)
+	return nil
+}
+
+// deadLetterMessage stores the message in the quarantine collection and publishes it to the
+// dead-letter topic. The quarantine record is required before the offset may be committed,
+// so an outage that also prevents quarantining stops the listener instead of dropping events.
+func (l *AuditListener) deadLetterMessage(ctx context.Context, msg kafka.Message, reason string, cause error, attempts int) error {
+	quarantined, err := l.quarantine.Quarantine(ctx, &usecase.QuarantineInput{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Payload:   msg.Value,
+		Reason:    reason,
+		Err:       cause,
+		Attempts:  attempts,
+	})
+	if err != nil {
+		return fmt.Errorf("quarantine event: %w (original error: %v)", err, cause)
+	}
+
+	l.logger.Warn("Audit event quarantined",
+		zap.String("quarantine_id", quarantined.ID),
+		zap.String("reason", reason),
+		zap.Int("partition", msg.Partition),
+		zap.Int64("offset", msg.Offset),
+	)
+
+	if l.deadLetter == nil {
+		return nil
+	}
+	headers := append([]kafka.Header{}, msg.Headers...)
+	dlq := kafka.Message{
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: append(headers,
+			kafka.Header{Key: "x-dlq-reason", Value: []byte(reason)},
+			kafka.Header{Key: "x-dlq-error", Value: []byte(cause.Error())},
+			kafka.Header{Key: "x-dlq-attempts", Value: []byte(strconv.Itoa(attempts))},
+			kafka.Header{Key: "x-dlq-quarantine-id", Value: []byte(quarantined.ID)},
+			kafka.Header{Key: "x-original-topic", Value: []byte(msg.Topic)},
+			kafka.Header{Key: "x-original-partition", Value: []byte(strconv.Itoa(msg.Partition))},
+			kafka.Header{Key: "x-original-offset", Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		),
+	}
+	if err := l.deadLetter.WriteMessages(ctx, dlq); err != nil {
+		// The quarantine record is authoritative, the topic is a notification for other consumers
+		l.logger.Error("Failed to publish to dead-letter topic",
+			zap.Error(err),
+			zap.String("quarantine_id", quarantined.ID),
+		)
+	}
+	return nil
+}
+
+// createWithRetry stores the logs, retrying failed writes with exponential backoff. Invalid logs
+// are not retried. It returns the errors of the logs that still failed after the last retry.
+func (l *AuditListener) createWithRetry(ctx context.Context, inputs []*usecase.CreateAuditLogInput) ([]error, error) {
+	errs := l.uc.CreateAuditLogs(ctx, inputs)
+	backoff := l.cfg.RetryBackoff
+	for attempt := 1; attempt <= l.cfg.MaxRetries; attempt++ {
+		var retry []int
+		for i, err := range errs {
+			if err != nil && !isPermanent(err) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+
+		l.logger.Warn("Retrying audit log writes",
+			zap.Error(errs[retry[0]]),
+			zap.Int("attempt", attempt),
+			zap.Int("failed", len(retry)),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+
+		subset := make([]*usecase.CreateAuditLogInput, len(retry))
+		for j, i := range retry {
+			subset[j] = inputs[i]
+		}
+		for j, err := range l.uc.CreateAuditLogs(ctx, subset) {
+			errs[retry[j]] = err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return errs, nil
+}
+
+// isPermanent reports whether retrying the write cannot succeed
+func isPermanent(err error) bool {
+	var validationErr *usecase.ValidationError
+	return errors.As(err, &validationErr)
 }
 
-// Close closes the Kafka consumer
+// Close closes the Kafka reader
 func (l *AuditListener) Close() error {
-	return l.consumer.Close()
+	return l.reader.Close()
 }
@@ -0,0 +1,115 @@
+package listener
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetTracker records the messages in flight per partition. Workers finish messages out of
+// order, but an offset may only be committed once every earlier message of its partition is done.
+//
+// kafka-go does not expose the consumer group generation. A partition that is reassigned to this
+// consumer is fetched again from its committed offset, so a fetched offset that does not follow
+// the tracked ones starts a new generation of the partition. Messages of an earlier generation
+// are still stored when their worker gets to them, but they are never committed.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionOffsets
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+type partitionOffsets struct {
+	generation int
+	pending    []int64 // offsets in fetch order
+	done       map[int64]bool
+	committed  int64 // last committed offset, -1 before the first commit
+}
+
+// trackedOffset identifies a tracked message to complete
+type trackedOffset struct {
+	partitionKey
+	generation int
+	offset     int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+}
+
+// track registers a fetched message. Messages must be tracked in fetch order.
+func (t *offsetTracker) track(msg kafka.Message) trackedOffset {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool), committed: -1}
+		t.partitions[key] = p
+	}
+
+	last := p.committed
+	if n := len(p.pending); n > 0 {
+		last = p.pending[n-1]
+	}
+	if msg.Offset <= last {
+		// The partition was reassigned and is fetched again, what is pending belongs to the
+		// previous assignment
+		p.generation++
+		p.pending = nil
+		p.done = make(map[int64]bool)
+	}
+
+	tracked := trackedOffset{partitionKey: key, generation: p.generation, offset: msg.Offset}
+	// Offsets at or below the last commit are handled again but never committed twice
+	if msg.Offset > p.committed {
+		p.pending = append(p.pending, msg.Offset)
+	}
+	return tracked
+}
+
+// complete marks messages as handled and passes the committable position of every partition
+// that advanced to commit. The lock is held while committing so positions never move backwards.
+func (t *offsetTracker) complete(offsets []trackedOffset, commit func(msgs ...kafka.Message) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	touched := make(map[partitionKey]bool)
+	for _, o := range offsets {
+		p, ok := t.partitions[o.partitionKey]
+		if !ok || p.generation != o.generation || o.offset <= p.committed {
+			continue
+		}
+		p.done[o.offset] = true
+		touched[o.partitionKey] = true
+	}
+
+	var commits []kafka.Message
+	for key := range touched {
+		p := t.partitions[key]
+		advanced := int64(-1)
+		for len(p.pending) > 0 && p.done[p.pending[0]] {
+			advanced = p.pending[0]
+			delete(p.done, advanced)
+			p.pending = p.pending[1:]
+		}
+		if advanced >= 0 {
+			commits = append(commits, kafka.Message{Topic: key.topic, Partition: key.partition, Offset: advanced})
+		}
+	}
+	if len(commits) == 0 {
+		return nil
+	}
+	if err := commit(commits...); err != nil {
+		return err
+	}
+	for _, msg := range commits {
+		t.partitions[partitionKey{topic: msg.Topic, partition: msg.Partition}].committed = msg.Offset
+	}
+	return nil
+}
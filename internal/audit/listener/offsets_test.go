@@ -0,0 +1,129 @@
+package listener
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// offsetStep fetches messages or completes fetched ones, done indexes into fetched
+type offsetStep struct {
+	fetch     []kafka.Message
+	done      []int
+	commitErr error
+	// wantCommits are the offsets passed to commit, nil when commit is not called
+	wantCommits []kafka.Message
+}
+
+func msg(topic string, partition int, offset int64) kafka.Message {
+	return kafka.Message{Topic: topic, Partition: partition, Offset: offset}
+}
+
+func TestOffsetTrackerCommitOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []offsetStep
+	}{
+		{
+			name: "in order",
+			steps: []offsetStep{
+				{fetch: []kafka.Message{msg("a", 0, 1), msg("a", 0, 2)}},
+				{done: []int{0}, wantCommits: []kafka.Message{msg("a", 0, 1)}},
+				{done: []int{1}, wantCommits: []kafka.Message{msg("a", 0, 2)}},
+			},
+		},
+		{
+			name: "later offset waits for an earlier one",
+			steps: []offsetStep{
+				{fetch: []kafka.Message{msg("a", 0, 1), msg("a", 0, 2), msg("a", 0, 3)}},
+				{done: []int{2}},
+				{done: []int{1}},
+				{done: []int{0}, wantCommits: []kafka.Message{msg("a", 0, 3)}},
+			},
+		},
+		{
+			name: "partitions and topics advance independently",
+			steps: []offsetStep{
+				{fetch: []kafka.Message{msg("a", 0, 1), msg("a", 1, 1), msg("b", 0, 5), msg("a", 0, 2)}},
+				{done: []int{3, 1}, wantCommits: []kafka.Message{msg("a", 1, 1)}},
+				{done: []int{2}, wantCommits: []kafka.Message{msg("b", 0, 5)}},
+				{done: []int{0}, wantCommits: []kafka.Message{msg("a", 0, 2)}},
+			},
+		},
+		{
+			name: "failed commit is retried with the next completion",
+			steps: []offsetStep{
+				{fetch: []kafka.Message{msg("a", 0, 1), msg("a", 0, 2)}},
+				{done: []int{0}, commitErr: errors.New("broker down"), wantCommits: []kafka.Message{msg("a", 0, 1)}},
+				{done: []int{1}, wantCommits: []kafka.Message{msg("a", 0, 2)}},
+			},
+		},
+		{
+			name: "redelivered offsets are not committed twice",
+			steps: []offsetStep{
+				{fetch: []kafka.Message{msg("a", 0, 1), msg("a", 0, 2)}},
+				{done: []int{0, 1}, wantCommits: []kafka.Message{msg("a", 0, 2)}},
+				{fetch: []kafka.Message{msg("a", 0, 2), msg("a", 0, 3)}},
+				{done: []int{2}},
+				{done: []int{3}, wantCommits: []kafka.Message{msg("a", 0, 3)}},
+			},
+		},
+		{
+			name: "reassigned partition drops the earlier generation",
+			steps: []offsetStep{
+				{fetch: []kafka.Message{msg("a", 0, 1), msg("a", 0, 2), msg("a", 0, 3)}},
+				{done: []int{0}, wantCommits: []kafka.Message{msg("a", 0, 1)}},
+				// Fetched again from the committed offset after a rebalance
+				{fetch: []kafka.Message{msg("a", 0, 2), msg("a", 0, 3)}},
+				{done: []int{1, 2}},
+				{done: []int{3}, wantCommits: []kafka.Message{msg("a", 0, 2)}},
+				{done: []int{4}, wantCommits: []kafka.Message{msg("a", 0, 3)}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker()
+			var fetched []trackedOffset
+			for i, step := range tt.steps {
+				for _, m := range step.fetch {
+					fetched = append(fetched, tracker.track(m))
+				}
+				if len(step.done) == 0 {
+					continue
+				}
+
+				offsets := make([]trackedOffset, len(step.done))
+				for j, d := range step.done {
+					offsets[j] = fetched[d]
+				}
+				var commits []kafka.Message
+				err := tracker.complete(offsets, func(msgs ...kafka.Message) error {
+					commits = append(commits, msgs...)
+					return step.commitErr
+				})
+				if !errors.Is(err, step.commitErr) {
+					t.Fatalf("step %d: complete error = %v, want %v", i, err, step.commitErr)
+				}
+				if !reflect.DeepEqual(sortedCommits(commits), step.wantCommits) {
+					t.Errorf("step %d: commits = %v, want %v", i, commits, step.wantCommits)
+				}
+			}
+		})
+	}
+}
+
+// sortedCommits orders commits by topic and partition, complete walks partitions in map order
+func sortedCommits(commits []kafka.Message) []kafka.Message {
+	sort.Slice(commits, func(i, j int) bool {
+		if commits[i].Topic != commits[j].Topic {
+			return commits[i].Topic < commits[j].Topic
+		}
+		return commits[i].Partition < commits[j].Partition
+	})
+	return commits
+}
@@ -0,0 +1,156 @@
+// Package merkle implements the Merkle tree hash, audit paths and proof verification of RFC 6962.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// ErrIndexOutOfRange is returned when a proof is requested for a leaf that is not in the tree
+var ErrIndexOutOfRange = errors.New("leaf index out of range")
+
+// LeafHash hashes the data of a single leaf
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Root returns the Merkle tree hash of the given leaf data
+func Root(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	hashes := make([][]byte, len(leaves))
+	for i, l := range leaves {
+		hashes[i] = LeafHash(l)
+	}
+	return rootOf(hashes)
+}
+
+func rootOf(hashes [][]byte) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	k := split(len(hashes))
+	return nodeHash(rootOf(hashes[:k]), rootOf(hashes[k:]))
+}
+
+// Tree holds every level of a Merkle tree so that audit paths can be read without rehashing
+type Tree struct {
+	// levels[0] are the leaf hashes. Each level pairs the nodes below it from the left, a last
+	// node without a partner is carried up unchanged, which yields the RFC 6962 tree.
+	levels [][][]byte
+}
+
+// NewTree hashes the given leaf data into a tree
+func NewTree(leaves [][]byte) *Tree {
+	level := make([][]byte, len(leaves))
+	for i, l := range leaves {
+		level[i] = LeafHash(l)
+	}
+	t := &Tree{levels: [][][]byte{level}}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, nodeHash(level[i], level[i+1]))
+		}
+		if len(level)%2 == 1 {
+			next = append(next, level[len(level)-1])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// Size returns the number of leaves
+func (t *Tree) Size() int {
+	return len(t.levels[0])
+}
+
+// Root returns the Merkle tree hash, the same as Root of the leaf data
+func (t *Tree) Root() []byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return top[0]
+}
+
+// LeafHash returns the hash of the leaf at index
+func (t *Tree) LeafHash(index int) ([]byte, error) {
+	if index < 0 || index >= t.Size() {
+		return nil, ErrIndexOutOfRange
+	}
+	return t.levels[0][index], nil
+}
+
+// Proof returns the audit path for the leaf at index, ordered from the leaf up to the root
+func (t *Tree) Proof(index int) ([][]byte, error) {
+	if index < 0 || index >= t.Size() {
+		return nil, ErrIndexOutOfRange
+	}
+	var proof [][]byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyProof checks that leafHash is the leaf at index of a tree with the given size and root
+func VerifyProof(leafHash []byte, index, size int, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	computed, ok := climb(leafHash, index, size, proof)
+	return ok && bytes.Equal(computed, root)
+}
+
+// climb recomputes the root from a leaf and its audit path, consuming the path from the root side
+func climb(hash []byte, index, size int, proof [][]byte) ([]byte, bool) {
+	if size == 1 {
+		return hash, len(proof) == 0
+	}
+	if len(proof) == 0 {
+		return nil, false
+	}
+	k := split(size)
+	sibling := proof[len(proof)-1]
+	rest := proof[:len(proof)-1]
+	if index < k {
+		left, ok := climb(hash, index, k, rest)
+		return nodeHash(left, sibling), ok
+	}
+	right, ok := climb(hash, index-k, size-k, rest)
+	return nodeHash(sibling, right), ok
+}
+
+// split returns the largest power of two smaller than n
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
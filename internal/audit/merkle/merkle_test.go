@@ -0,0 +1,109 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// rfc6962Leaves and rfc6962Roots are the reference inputs and tree hashes of the Certificate
+// Transparency test data, rfc6962Roots[i] is the root of the first i+1 leaves
+var (
+	rfc6962Leaves = []string{
+		"",
+		"00",
+		"10",
+		"2021",
+		"3031",
+		"40414243",
+		"5051525354555657",
+		"606162636465666768696a6b6c6d6e6f",
+	}
+	rfc6962Roots = []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+)
+
+func TestRootMatchesRFC6962Vectors(t *testing.T) {
+	leaves := make([][]byte, len(rfc6962Leaves))
+	for i, l := range rfc6962Leaves {
+		var err error
+		if leaves[i], err = hex.DecodeString(l); err != nil {
+			t.Fatalf("decode leaf %d: %v", i, err)
+		}
+	}
+
+	type rootCase struct {
+		name   string
+		leaves [][]byte
+		want   string
+	}
+	tests := []rootCase{
+		{name: "empty", want: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	for i, root := range rfc6962Roots {
+		tests = append(tests, rootCase{name: fmt.Sprintf("%d leaves", i+1), leaves: leaves[:i+1], want: root})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(Root(tt.leaves)); got != tt.want {
+				t.Errorf("Root = %s, want %s", got, tt.want)
+			}
+			if got := hex.EncodeToString(NewTree(tt.leaves).Root()); got != tt.want {
+				t.Errorf("Tree.Root = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTreeProofVerifies(t *testing.T) {
+	for size := 1; size <= 17; size++ {
+		t.Run(fmt.Sprintf("%d leaves", size), func(t *testing.T) {
+			leaves := make([][]byte, size)
+			for i := range leaves {
+				leaves[i] = []byte(fmt.Sprintf("leaf %d", i))
+			}
+			tree := NewTree(leaves)
+			root := tree.Root()
+			if !bytes.Equal(root, Root(leaves)) {
+				t.Fatalf("Tree.Root = %x, want %x", root, Root(leaves))
+			}
+
+			for index := 0; index < size; index++ {
+				leafHash, err := tree.LeafHash(index)
+				if err != nil {
+					t.Fatalf("LeafHash(%d): %v", index, err)
+				}
+				proof, err := tree.Proof(index)
+				if err != nil {
+					t.Fatalf("Proof(%d): %v", index, err)
+				}
+				if !VerifyProof(leafHash, index, size, proof, root) {
+					t.Errorf("proof of leaf %d does not verify", index)
+				}
+				if size > 1 && VerifyProof(leafHash, (index+1)%size, size, proof, root) {
+					t.Errorf("proof of leaf %d verifies at index %d", index, (index+1)%size)
+				}
+				if VerifyProof(LeafHash([]byte("other")), index, size, proof, root) {
+					t.Errorf("proof of leaf %d verifies another leaf", index)
+				}
+				if len(proof) > 0 && VerifyProof(leafHash, index, size, proof[:len(proof)-1], root) {
+					t.Errorf("truncated proof of leaf %d verifies", index)
+				}
+			}
+
+			if _, err := tree.Proof(size); err != ErrIndexOutOfRange {
+				t.Errorf("Proof(%d) error = %v, want %v", size, err, ErrIndexOutOfRange)
+			}
+		})
+	}
+}
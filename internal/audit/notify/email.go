@@ -0,0 +1,131 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// SMTPConfig is the mail server alerts are sent through
+type SMTPConfig struct {
+	Host string
+	// Port 465 uses implicit TLS, other ports upgrade with STARTTLS when the server offers it
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+type emailNotifier struct {
+	cfg SMTPConfig
+}
+
+// NewEmailNotifier mails alerts as plain text to the target recipients
+func NewEmailNotifier(cfg SMTPConfig) Notifier {
+	return &emailNotifier{cfg: cfg}
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, target Target, alert *repository.Alert) error {
+	if len(target.Recipients) == 0 {
+		return Permanent(errors.New("no recipients"))
+	}
+
+	conn, err := n.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, implicitTLS := conn.(*tls.Conn); !implicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: n.cfg.Host}); err != nil {
+				return err
+			}
+		}
+	}
+	if n.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return Permanent(fmt.Errorf("smtp auth: %w", err))
+		}
+	}
+
+	if err := c.Mail(n.cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range target.Recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.message(target, alert)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (n *emailNotifier) dial(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(n.cfg.Host, n.cfg.Port)
+	if n.cfg.Port == "465" {
+		d := &tls.Dialer{Config: &tls.Config{ServerName: n.cfg.Host}}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (n *emailNotifier) message(target Target, alert *repository.Alert) []byte {
+	subject := fmt.Sprintf("[%s] %s", strings.ToUpper(alert.Severity), alert.RuleName)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(target.Recipients, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@omnipos-audit>\r\n", target.DeliveryID)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "%s\r\n\r\n", alert.Message)
+	fmt.Fprintf(&b, "Rule:      %s (%s)\r\n", alert.RuleName, alert.RuleID)
+	fmt.Fprintf(&b, "Severity:  %s\r\n", alert.Severity)
+	fmt.Fprintf(&b, "Merchant:  %s\r\n", alert.MerchantID)
+	if alert.GroupKey != "" {
+		fmt.Fprintf(&b, "Group:     %s\r\n", alert.GroupKey)
+	}
+	fmt.Fprintf(&b, "Logs:      %d, %s to %s\r\n", alert.Count,
+		alert.FirstTimestamp.UTC().Format(time.RFC3339), alert.LastTimestamp.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Log IDs:   %s\r\n", strings.Join(alert.LogIDs, ", "))
+	fmt.Fprintf(&b, "Alert ID:  %s\r\n", alert.ID)
+	return b.Bytes()
+}
+
+// headerValue keeps merchant supplied text from starting new header lines
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageWriter publishes Kafka messages. *kafka.Writer implements it.
+type MessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+type kafkaNotifier struct {
+	writer MessageWriter
+}
+
+// NewKafkaNotifier publishes alerts as JSON keyed by merchant, so each merchant's alerts keep their order
+func NewKafkaNotifier(writer MessageWriter) Notifier {
+	return &kafkaNotifier{writer: writer}
+}
+
+func (n *kafkaNotifier) Notify(ctx context.Context, target Target, alert *repository.Alert) error {
+	value, err := json.Marshal(NewPayload(alert))
+	if err != nil {
+		return Permanent(err)
+	}
+	return n.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(alert.MerchantID),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "event", Value: []byte(AlertEvent)},
+			{Key: "delivery_id", Value: []byte(target.DeliveryID)},
+		},
+	})
+}
@@ -0,0 +1,76 @@
+// Package notify delivers alerts to webhooks, email recipients and Kafka.
+package notify
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// Target is where an alert is delivered, the fields used depend on the notifier
+type Target struct {
+	// DeliveryID identifies the delivery, it stays the same across retries
+	DeliveryID string
+	URL        string
+	Secret     string
+	Recipients []string
+}
+
+// Notifier delivers alerts of one channel type
+type Notifier interface {
+	Notify(ctx context.Context, target Target, alert *repository.Alert) error
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Payload is the JSON form of an alert sent to webhooks and the Kafka topic
+type Payload struct {
+	ID             string    `json:"id"`
+	MerchantID     string    `json:"merchant_id"`
+	RuleID         string    `json:"rule_id"`
+	RuleName       string    `json:"rule_name"`
+	Severity       string    `json:"severity"`
+	GroupKey       string    `json:"group_key,omitempty"`
+	Count          int64     `json:"count"`
+	LogIDs         []string  `json:"log_ids"`
+	Message        string    `json:"message"`
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func NewPayload(a *repository.Alert) Payload {
+	return Payload{
+		ID:             a.ID,
+		MerchantID:     a.MerchantID,
+		RuleID:         a.RuleID,
+		RuleName:       a.RuleName,
+		Severity:       a.Severity,
+		GroupKey:       a.GroupKey,
+		Count:          a.Count,
+		LogIDs:         a.LogIDs,
+		Message:        a.Message,
+		FirstTimestamp: a.FirstTimestamp,
+		LastTimestamp:  a.LastTimestamp,
+		CreatedAt:      a.CreatedAt,
+	}
+}
@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// Webhook request headers
+const (
+	HeaderEvent     = "X-Omnipos-Event"
+	HeaderDelivery  = "X-Omnipos-Delivery"
+	HeaderTimestamp = "X-Omnipos-Timestamp"
+	HeaderSignature = "X-Omnipos-Signature"
+)
+
+// AlertEvent is the event type of alert webhooks and Kafka messages
+const AlertEvent = "audit.alert"
+
+// defaultWebhookTimeout bounds a webhook request when the client is given no timeout
+const defaultWebhookTimeout = 10 * time.Second
+
+var (
+	// ErrInsecureWebhook is returned for webhook URLs that are not https
+	ErrInsecureWebhook = errors.New("webhook url must use https")
+	// ErrForbiddenAddress is returned when a webhook host resolves to an address that is not
+	// publicly routable, such as loopback, private or link-local addresses
+	ErrForbiddenAddress = errors.New("webhook address is not publicly routable")
+	// ErrWebhookRedirect is returned when a webhook responds with a redirect, which is not followed
+	ErrWebhookRedirect = errors.New("webhook redirects are not followed")
+)
+
+// blockedPrefixes are ranges outside the net.IP classes checked by PublicAddress that must
+// not be reached either
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // this network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, embeds IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4, embeds IPv4 addresses
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved
+}
+
+// PublicAddress reports whether webhooks may be sent to ip. Loopback, private, link-local,
+// multicast, unspecified and reserved addresses are refused.
+func PublicAddress(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range blockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewWebhookClient returns the HTTP client webhooks should be sent with. Every connection is
+// checked against PublicAddress after the host is resolved, so a name that is later pointed
+// at an internal address is refused as well. Proxies are not used and redirects are not
+// followed, a request is bounded by timeout.
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !PublicAddress(net.ParseIP(host)) {
+				return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return ErrWebhookRedirect
+		},
+	}
+}
+
+type webhookNotifier struct {
+	client *http.Client
+}
+
+// NewWebhookNotifier posts alerts as JSON to the target URL, signed with the target secret.
+// The client should come from NewWebhookClient.
+func NewWebhookNotifier(client *http.Client) Notifier {
+	return &webhookNotifier{client: client}
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, target Target, alert *repository.Alert) error {
+	// Channels are validated on write, this also covers ones stored before https was required
+	if u, err := url.Parse(target.URL); err != nil || u.Scheme != "https" {
+		return Permanent(ErrInsecureWebhook)
+	}
+
+	body, err := json.Marshal(NewPayload(alert))
+	if err != nil {
+		return Permanent(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, AlertEvent)
+	req.Header.Set(HeaderDelivery, target.DeliveryID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(target.Secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrForbiddenAddress) || errors.Is(err, ErrWebhookRedirect) {
+			return Permanent(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook responded with %s", resp.Status)
+	// Other client errors will not go away on their own
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret. Receivers recompute
+// it from the X-Omnipos-Timestamp header and the raw body to authenticate a webhook.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,188 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			name:      "alert body",
+			secret:    "secret",
+			timestamp: "1700000000",
+			body:      `{"id":"a1"}`,
+			want:      "c3ad6a9a885977e16e050d0f7afb23472dd55f8f780017b4fadf17366b55bc57",
+		},
+		{
+			name:      "empty secret and body",
+			timestamp: "0",
+			want:      "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("Sign = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "93.184.216.34", want: true},
+		{ip: "2606:2800:220:1:248:1893:25c8:1946", want: true},
+		{ip: "127.0.0.1"},
+		{ip: "::1"},
+		{ip: "10.1.2.3"},
+		{ip: "172.16.0.1"},
+		{ip: "192.168.1.1"},
+		{ip: "fd00::1"},
+		{ip: "169.254.169.254"}, // cloud metadata
+		{ip: "fe80::1"},
+		{ip: "0.0.0.0"},
+		{ip: "::"},
+		{ip: "0.1.2.3"},
+		{ip: "100.64.0.1"},
+		{ip: "192.0.0.1"},
+		{ip: "198.18.0.1"},
+		{ip: "224.0.0.1"},
+		{ip: "ff02::1"},
+		{ip: "240.0.0.1"},
+		{ip: "255.255.255.255"},
+		{ip: "::ffff:127.0.0.1"},                 // IPv4-mapped loopback
+		{ip: "::ffff:10.0.0.1"},                  // IPv4-mapped private
+		{ip: "64:ff9b::a00:1"},                   // NAT64 of 10.0.0.1
+		{ip: "2002:a00:1::1"},                    // 6to4 of 10.0.0.1
+		{ip: "::ffff:93.184.216.34", want: true}, // IPv4-mapped public
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("invalid test address %s", tt.ip)
+			}
+			if got := PublicAddress(ip); got != tt.want {
+				t.Errorf("PublicAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+	if PublicAddress(nil) {
+		t.Error("PublicAddress(nil) = true, want false")
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	alert := &repository.Alert{ID: "a1", MerchantID: "m1", RuleID: "r1", Severity: "critical", Count: 3}
+
+	tests := []struct {
+		name          string
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "accepted", status: http.StatusNoContent},
+		{name: "server error is retried", status: http.StatusBadGateway, wantErr: true},
+		{name: "rate limit is retried", status: http.StatusTooManyRequests, wantErr: true},
+		{name: "client error is permanent", status: http.StatusNotFound, wantErr: true, wantPermanent: true},
+		{name: "redirect is permanent", status: http.StatusFound, wantErr: true, wantPermanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "https://169.254.169.254/")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			// The test server listens on loopback, which NewWebhookClient refuses, so its
+			// transport is used with the webhook client's redirect policy
+			client := srv.Client()
+			client.CheckRedirect = NewWebhookClient(time.Second).CheckRedirect
+
+			target := Target{DeliveryID: "d1", URL: srv.URL + "/hook", Secret: "secret"}
+			err := NewWebhookNotifier(client).Notify(context.Background(), target, alert)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify error = %v, want error %v", err, tt.wantErr)
+			}
+			if IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("permanent = %v, want %v (%v)", IsPermanent(err), tt.wantPermanent, err)
+			}
+
+			if got == nil {
+				t.Fatal("webhook was not called")
+			}
+			if e := got.Header.Get(HeaderEvent); e != AlertEvent {
+				t.Errorf("event header = %q, want %q", e, AlertEvent)
+			}
+			if d := got.Header.Get(HeaderDelivery); d != "d1" {
+				t.Errorf("delivery header = %q, want d1", d)
+			}
+			want := "sha256=" + Sign("secret", got.Header.Get(HeaderTimestamp), body)
+			if s := got.Header.Get(HeaderSignature); s != want {
+				t.Errorf("signature header = %q, want %q", s, want)
+			}
+			if !strings.Contains(string(body), `"id":"a1"`) {
+				t.Errorf("body = %s, want the alert payload", body)
+			}
+		})
+	}
+}
+
+func TestWebhookRefusesInternalTargets(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("internal webhook was called")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr error
+	}{
+		{name: "plain http", url: strings.Replace(srv.URL, "https://", "http://", 1), wantErr: ErrInsecureWebhook},
+		{name: "loopback", url: srv.URL, wantErr: ErrForbiddenAddress},
+		{name: "name resolving to loopback", url: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), wantErr: ErrForbiddenAddress},
+	}
+
+	notifier := NewWebhookNotifier(NewWebhookClient(time.Second))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := notifier.Notify(context.Background(), Target{URL: tt.url, Secret: "secret"}, &repository.Alert{ID: "a1"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Notify error = %v, want %v", err, tt.wantErr)
+			}
+			if !IsPermanent(err) {
+				t.Errorf("Notify error %v is not permanent", err)
+			}
+		})
+	}
+}
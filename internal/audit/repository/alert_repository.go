@@ -0,0 +1,482 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fekuna/omnipos-pkg/database/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AlertRule raises an alert for a merchant's logs matching Query. Without a threshold every
+// matching log fires, with one only the log that takes its window above the count. A change
+// condition additionally requires a numeric snapshot field to change by a minimum percentage.
+type AlertRule struct {
+	ID          string         `bson:"_id"`
+	MerchantID  string         `bson:"merchant_id"`
+	Name        string         `bson:"name"`
+	Description string         `bson:"description,omitempty"`
+	Enabled     bool           `bson:"enabled"`
+	Query       LogQuery       `bson:"query"`
+	Threshold   *RuleThreshold `bson:"threshold,omitempty"`
+	Change      *RuleChange    `bson:"change,omitempty"`
+	// Severity is the severity of the alerts raised: info, warning or critical
+	Severity string `bson:"severity"`
+	// Suppression is how long the rule stays quiet for a group after firing
+	Suppression time.Duration `bson:"suppression"`
+	CreatedBy   string        `bson:"created_by,omitempty"`
+	CreatedAt   time.Time     `bson:"created_at"`
+	UpdatedAt   time.Time     `bson:"updated_at"`
+}
+
+// RuleThreshold fires when more than Count matching logs fall within Window, counted
+// separately for every combination of the GroupBy fields
+type RuleThreshold struct {
+	Count   int64         `bson:"count"`
+	Window  time.Duration `bson:"window"`
+	GroupBy []Field       `bson:"group_by,omitempty"`
+}
+
+// WindowBuckets is the number of buckets a threshold window is counted in. A window may reach
+// back up to one bucket further than its length.
+const WindowBuckets = 10
+
+// MaxWindowLogIDs bounds the log ids kept per window bucket and per alert
+const MaxWindowLogIDs = 100
+
+// BucketSize is the length of the buckets the threshold's window is counted in
+func (t *RuleThreshold) BucketSize() time.Duration {
+	return max(t.Window/WindowBuckets, time.Second)
+}
+
+// RuleWindow is what a threshold window of a rule group has counted
+type RuleWindow struct {
+	Count int64
+	// LogIDs are the most recent logs counted, at most MaxWindowLogIDs
+	LogIDs []string
+	First  time.Time
+	Last   time.Time
+}
+
+// RuleGroupState is what a rule group has fired, shared by every instance evaluating rules
+type RuleGroupState struct {
+	// ResetAt starts the threshold window over, earlier buckets are no longer counted
+	ResetAt time.Time `bson:"reset_at,omitempty"`
+	// SuppressedUntil keeps the group quiet after firing
+	SuppressedUntil time.Time `bson:"suppressed_until,omitempty"`
+	// ExpiresAt is when the state may be removed
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// RuleChange matches logs whose snapshots change a numeric field by at least MinPercent
+type RuleChange struct {
+	// Field is a dotted path in old_value and new_value, e.g. "price"
+	Field      string  `bson:"field"`
+	MinPercent float64 `bson:"min_percent"`
+}
+
+// Alert is raised when a rule fires
+type Alert struct {
+	ID         string `bson:"_id"`
+	MerchantID string `bson:"merchant_id"`
+	RuleID     string `bson:"rule_id"`
+	RuleName   string `bson:"rule_name"`
+	Severity   string `bson:"severity"`
+	// GroupKey names the threshold group, e.g. "user_id=42"
+	GroupKey string `bson:"group_key,omitempty"`
+	// Count is the number of matching logs in the window, 1 without a threshold
+	Count int64 `bson:"count"`
+	// LogIDs are the logs that fired the rule, the most recent last, at most MaxWindowLogIDs
+	LogIDs         []string  `bson:"log_ids"`
+	Message        string    `bson:"message"`
+	FirstTimestamp time.Time `bson:"first_timestamp"`
+	LastTimestamp  time.Time `bson:"last_timestamp"`
+	CreatedAt      time.Time `bson:"created_at"`
+	// DispatchPending is set while the alert's deliveries are not recorded yet, the alert is
+	// stored with it so that a restart does not lose the fan-out
+	DispatchPending bool `bson:"dispatch_pending,omitempty"`
+	// DispatchAt is when a pending alert may be claimed for dispatch
+	DispatchAt time.Time `bson:"dispatch_at,omitempty"`
+}
+
+type AlertFilter struct {
+	RuleID   string
+	Severity string
+}
+
+// ErrAlertRuleNotFound is returned when an alert rule does not exist in the scope
+var ErrAlertRuleNotFound = errors.New("alert rule not found")
+
+// AlertCursor is how far a merchant's chain has been evaluated against its alert rules. One
+// instance at a time holds the cursor's lease and evaluates the logs after it.
+type AlertCursor struct {
+	MerchantID string    `bson:"_id"`
+	Sequence   int64     `bson:"sequence"`
+	Owner      string    `bson:"owner"`
+	LeaseUntil time.Time `bson:"lease_until"`
+}
+
+// ErrAlertCursorLeased is returned when another instance holds a merchant's alert cursor
+var ErrAlertCursorLeased = errors.New("alert cursor leased by another instance")
+
+type AlertRepository interface {
+	EnsureIndexes(ctx context.Context) error
+	CreateAlertRule(ctx context.Context, rule *AlertRule) error
+	GetAlertRule(ctx context.Context, scope TenantScope, id string) (*AlertRule, error)
+	ListAlertRules(ctx context.Context, scope TenantScope, enabledOnly bool) ([]AlertRule, error)
+	UpdateAlertRule(ctx context.Context, scope TenantScope, rule *AlertRule) error
+	DeleteAlertRule(ctx context.Context, scope TenantScope, id string) error
+	CreateAlert(ctx context.Context, alert *Alert) error
+	ListAlerts(ctx context.Context, scope TenantScope, filter AlertFilter, page, pageSize int32) ([]Alert, int32, error)
+	// AddToWindow counts a log matching a threshold rule in its bucket of the group's window and
+	// returns the window ending at the log's bucket. Buckets before the group's ResetAt are left out.
+	AddToWindow(ctx context.Context, rule *AlertRule, groupKey, logID string, at time.Time) (*RuleWindow, error)
+	// ClaimFiring stores next as the group's state unless the group is suppressed at at or its
+	// window was reset after at. It reports whether the caller may fire, so that a group fires
+	// once even when several instances see it cross the threshold.
+	ClaimFiring(ctx context.Context, ruleID, groupKey string, at time.Time, next RuleGroupState) (bool, error)
+	// ClaimAlertCursor leases the merchant's cursor to owner until now+lease. A merchant without a
+	// cursor starts at initial, the last sequence that does not need to be evaluated.
+	ClaimAlertCursor(ctx context.Context, merchantID, owner string, initial int64, now time.Time, lease time.Duration) (*AlertCursor, error)
+	// AdvanceAlertCursor moves a cursor owner holds to sequence and keeps it leased until
+	// leaseUntil, a zero leaseUntil releases it. It returns ErrAlertCursorLeased if the lease was lost.
+	AdvanceAlertCursor(ctx context.Context, merchantID, owner string, sequence int64, leaseUntil time.Time) error
+}
+
+type mongoAlertRepository struct {
+	rules   *mongo.Collection
+	alerts  *mongo.Collection
+	windows *mongo.Collection
+	states  *mongo.Collection
+	cursors *mongo.Collection
+}
+
+func NewMongoAlertRepository(client *mongodb.Client) AlertRepository {
+	db := client.Database()
+	return &mongoAlertRepository{
+		rules:   db.Collection("alert_rules"),
+		alerts:  db.Collection("alerts"),
+		windows: db.Collection("alert_windows"),
+		states:  db.Collection("alert_rule_states"),
+		cursors: db.Collection("alert_cursors"),
+	}
+}
+
+// ruleGroupID identifies a rule group in alert_rule_states
+func ruleGroupID(ruleID, groupKey string) string {
+	return ruleID + "|" + groupKey
+}
+
+func (r *mongoAlertRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.rules.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetName("merchant_name"),
+		},
+		{
+			Keys:    bson.D{{Key: "enabled", Value: 1}},
+			Options: options.Index().SetName("enabled"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.alerts.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("merchant_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "rule_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("rule_created_at"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.windows.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "rule_id", Value: 1}, {Key: "group_key", Value: 1},
+				{Key: "bucket_size_ms", Value: 1}, {Key: "bucket", Value: 1},
+			},
+			Options: options.Index().SetName("rule_group_bucket"),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.states.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (r *mongoAlertRepository) CreateAlertRule(ctx context.Context, rule *AlertRule) error {
+	if err := requireMerchant(rule.MerchantID); err != nil {
+		return err
+	}
+	_, err := r.rules.InsertOne(ctx, rule)
+	return err
+}
+
+func (r *mongoAlertRepository) GetAlertRule(ctx context.Context, scope TenantScope, id string) (*AlertRule, error) {
+	query := bson.M{"_id": id}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+
+	var rule AlertRule
+	err := r.rules.FindOne(ctx, query).Decode(&rule)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAlertRuleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (r *mongoAlertRepository) ListAlertRules(ctx context.Context, scope TenantScope, enabledOnly bool) ([]AlertRule, error) {
+	query := bson.M{}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+	if enabledOnly {
+		query["enabled"] = true
+	}
+
+	cursor, err := r.rules.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "merchant_id", Value: 1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rules []AlertRule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (r *mongoAlertRepository) UpdateAlertRule(ctx context.Context, scope TenantScope, rule *AlertRule) error {
+	query := bson.M{"_id": rule.ID}
+	if err := scope.apply(query); err != nil {
+		return err
+	}
+	res, err := r.rules.ReplaceOne(ctx, query, rule)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrAlertRuleNotFound
+	}
+	return nil
+}
+
+func (r *mongoAlertRepository) DeleteAlertRule(ctx context.Context, scope TenantScope, id string) error {
+	query := bson.M{"_id": id}
+	if err := scope.apply(query); err != nil {
+		return err
+	}
+	res, err := r.rules.DeleteOne(ctx, query)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrAlertRuleNotFound
+	}
+	return nil
+}
+
+func (r *mongoAlertRepository) CreateAlert(ctx context.Context, alert *Alert) error {
+	_, err := r.alerts.InsertOne(ctx, alert)
+	return err
+}
+
+func (r *mongoAlertRepository) ListAlerts(ctx context.Context, scope TenantScope, filter AlertFilter, page, pageSize int32) ([]Alert, int32, error) {
+	query := bson.M{}
+	if err := scope.apply(query); err != nil {
+		return nil, 0, err
+	}
+	if filter.RuleID != "" {
+		query["rule_id"] = filter.RuleID
+	}
+	if filter.Severity != "" {
+		query["severity"] = filter.Severity
+	}
+
+	skip := int64((page - 1) * pageSize)
+	opts := options.Find().SetSkip(skip).SetLimit(int64(pageSize)).SetSort(bson.M{"created_at": -1})
+	cursor, err := r.alerts.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var alerts []Alert
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return nil, 0, err
+	}
+
+	total, err := r.alerts.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return alerts, int32(total), nil
+}
+
+// windowBucket is a bucket of a threshold window in alert_windows
+type windowBucket struct {
+	Count  int64     `bson:"count"`
+	LogIDs []string  `bson:"log_ids"`
+	First  time.Time `bson:"first"`
+	Last   time.Time `bson:"last"`
+}
+
+func (r *mongoAlertRepository) AddToWindow(ctx context.Context, rule *AlertRule, groupKey, logID string, at time.Time) (*RuleWindow, error) {
+	t := rule.Threshold
+	size := t.BucketSize()
+	bucket := at.Truncate(size)
+
+	// Buckets outlive the window in wall clock time, so replayed logs are counted too
+	id := fmt.Sprintf("%s|%s|%d|%d", rule.ID, groupKey, size.Milliseconds(), bucket.UnixMilli())
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"rule_id":        rule.ID,
+			"group_key":      groupKey,
+			"bucket_size_ms": size.Milliseconds(),
+			"bucket":         bucket,
+		},
+		"$inc":  bson.M{"count": 1},
+		"$push": bson.M{"log_ids": bson.M{"$each": bson.A{logID}, "$slice": -MaxWindowLogIDs}},
+		"$min":  bson.M{"first": at},
+		"$max":  bson.M{"last": at, "expires_at": time.Now().UTC().Add(t.Window + size)},
+	}
+	if _, err := r.windows.UpdateOne(ctx, bson.M{"_id": id}, update, options.Update().SetUpsert(true)); err != nil {
+		return nil, fmt.Errorf("count window bucket: %w", err)
+	}
+
+	since := at.Add(-t.Window).Truncate(size)
+	var state RuleGroupState
+	err := r.states.FindOne(ctx, bson.M{"_id": ruleGroupID(rule.ID, groupKey)}).Decode(&state)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("get rule group state: %w", err)
+	}
+	if state.ResetAt.After(since) {
+		since = state.ResetAt
+	}
+
+	query := bson.M{
+		"rule_id":        rule.ID,
+		"group_key":      groupKey,
+		"bucket_size_ms": size.Milliseconds(),
+		"bucket":         bson.M{"$gte": since, "$lte": bucket},
+	}
+	cursor, err := r.windows.Find(ctx, query, options.Find().SetSort(bson.M{"bucket": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var buckets []windowBucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, err
+	}
+	w := &RuleWindow{}
+	for _, b := range buckets {
+		w.Count += b.Count
+		w.LogIDs = append(w.LogIDs, b.LogIDs...)
+		if w.First.IsZero() || b.First.Before(w.First) {
+			w.First = b.First
+		}
+		if b.Last.After(w.Last) {
+			w.Last = b.Last
+		}
+	}
+	if len(w.LogIDs) > MaxWindowLogIDs {
+		w.LogIDs = w.LogIDs[len(w.LogIDs)-MaxWindowLogIDs:]
+	}
+	return w, nil
+}
+
+func (r *mongoAlertRepository) ClaimFiring(ctx context.Context, ruleID, groupKey string, at time.Time, next RuleGroupState) (bool, error) {
+	// $not also matches groups that never fired
+	query := bson.M{
+		"_id":              ruleGroupID(ruleID, groupKey),
+		"suppressed_until": bson.M{"$not": bson.M{"$gt": at}},
+		"reset_at":         bson.M{"$not": bson.M{"$gt": at}},
+	}
+	update := bson.M{"$set": bson.M{
+		"rule_id":          ruleID,
+		"group_key":        groupKey,
+		"reset_at":         next.ResetAt,
+		"suppressed_until": next.SuppressedUntil,
+		"expires_at":       next.ExpiresAt,
+	}}
+	_, err := r.states.UpdateOne(ctx, query, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The group exists but did not match, it is suppressed or another instance fired it
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *mongoAlertRepository) ClaimAlertCursor(ctx context.Context, merchantID, owner string, initial int64, now time.Time, lease time.Duration) (*AlertCursor, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+	// $not also matches a cursor that was released or never leased
+	query := bson.M{
+		"_id": merchantID,
+		"$or": bson.A{
+			bson.M{"owner": owner},
+			bson.M{"lease_until": bson.M{"$not": bson.M{"$gt": now}}},
+		},
+	}
+	update := bson.M{
+		"$set":         bson.M{"owner": owner, "lease_until": now.Add(lease)},
+		"$setOnInsert": bson.M{"sequence": initial},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var cursor AlertCursor
+	err := r.cursors.FindOneAndUpdate(ctx, query, update, opts).Decode(&cursor)
+	if mongo.IsDuplicateKeyError(err) {
+		// The cursor exists but did not match, another instance holds it
+		return nil, ErrAlertCursorLeased
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+func (r *mongoAlertRepository) AdvanceAlertCursor(ctx context.Context, merchantID, owner string, sequence int64, leaseUntil time.Time) error {
+	if err := requireMerchant(merchantID); err != nil {
+		return err
+	}
+	res, err := r.cursors.UpdateOne(ctx,
+		bson.M{"_id": merchantID, "owner": owner},
+		bson.M{"$set": bson.M{"lease_until": leaseUntil}, "$max": bson.M{"sequence": sequence}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrAlertCursorLeased
+	}
+	return nil
+}
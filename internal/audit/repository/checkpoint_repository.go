@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fekuna/omnipos-pkg/database/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Checkpoint is a signed Merkle root over a contiguous range of a merchant's chain
+type Checkpoint struct {
+	ID           string    `bson:"_id" json:"id"`
+	MerchantID   string    `bson:"merchant_id" json:"merchant_id"`
+	FromSequence int64     `bson:"from_sequence" json:"from_sequence"`
+	ToSequence   int64     `bson:"to_sequence" json:"to_sequence"`
+	LeafCount    int64     `bson:"leaf_count" json:"leaf_count"`
+	RootHash     string    `bson:"root_hash" json:"root_hash"`
+	HeadHash     string    `bson:"head_hash" json:"head_hash"` // chain hash of the record at ToSequence
+	PrevRootHash string    `bson:"prev_root_hash,omitempty" json:"prev_root_hash,omitempty"`
+	CreatedAt    time.Time `bson:"created_at" json:"created_at"`
+	KeyID        string    `bson:"key_id" json:"key_id"`
+	Signature    string    `bson:"signature" json:"signature"` // base64 Ed25519 signature
+}
+
+// ErrCheckpointNotFound is returned when no checkpoint matches
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// ErrCheckpointExists is returned when another writer already checkpointed the range
+var ErrCheckpointExists = errors.New("checkpoint already exists")
+
+type CheckpointRepository interface {
+	EnsureIndexes(ctx context.Context) error
+	CreateCheckpoint(ctx context.Context, cp *Checkpoint) error
+	GetLatestCheckpoint(ctx context.Context, merchantID string) (*Checkpoint, error)
+	FindCheckpointCovering(ctx context.Context, merchantID string, sequence int64) (*Checkpoint, error)
+}
+
+type mongoCheckpointRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoCheckpointRepository(client *mongodb.Client) CheckpointRepository {
+	return &mongoCheckpointRepository{
+		collection: client.Database().Collection("audit_checkpoints"),
+	}
+}
+
+func (r *mongoCheckpointRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "from_sequence", Value: 1}},
+			Options: options.Index().SetName("merchant_from_sequence_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "to_sequence", Value: -1}},
+			Options: options.Index().SetName("merchant_to_sequence"),
+		},
+	})
+	return err
+}
+
+func (r *mongoCheckpointRepository) CreateCheckpoint(ctx context.Context, cp *Checkpoint) error {
+	_, err := r.collection.InsertOne(ctx, cp)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrCheckpointExists
+	}
+	return err
+}
+
+func (r *mongoCheckpointRepository) GetLatestCheckpoint(ctx context.Context, merchantID string) (*Checkpoint, error) {
+	opts := options.FindOne().SetSort(bson.M{"to_sequence": -1})
+	return r.findOne(ctx, bson.M{"merchant_id": merchantID}, opts)
+}
+
+func (r *mongoCheckpointRepository) FindCheckpointCovering(ctx context.Context, merchantID string, sequence int64) (*Checkpoint, error) {
+	query := bson.M{
+		"merchant_id":   merchantID,
+		"from_sequence": bson.M{"$lte": sequence},
+		"to_sequence":   bson.M{"$gte": sequence},
+	}
+	return r.findOne(ctx, query, options.FindOne())
+}
+
+func (r *mongoCheckpointRepository) findOne(ctx context.Context, query bson.M, opts *options.FindOneOptions) (*Checkpoint, error) {
+	var cp Checkpoint
+	err := r.collection.FindOne(ctx, query, opts).Decode(&cp)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCheckpointNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// CheckpointWitness keeps a copy of every checkpoint outside of MongoDB
+type CheckpointWitness interface {
+	Append(cp *Checkpoint) error
+	// Find returns the witnessed copy of a checkpoint, ErrCheckpointNotFound when there is none
+	Find(merchantID, id string) (*Checkpoint, error)
+}
+
+// maxWitnessLine bounds a witness line, a checkpoint takes well under 1 KiB
+const maxWitnessLine = 1 << 20
+
+type fileWitness struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileWitness appends checkpoints as JSON lines to a local append-only file
+func NewFileWitness(path string) CheckpointWitness {
+	return &fileWitness{path: path}
+}
+
+func (w *fileWitness) Append(cp *Checkpoint) error {
+	line, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (w *fileWitness) Find(merchantID, id string) (*Checkpoint, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := os.Open(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrCheckpointNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxWitnessLine)
+	for scanner.Scan() {
+		var cp Checkpoint
+		if err := json.Unmarshal(scanner.Bytes(), &cp); err != nil {
+			// A line cut short by a crash is skipped
+			continue
+		}
+		if cp.ID == id && cp.MerchantID == merchantID {
+			return &cp, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrCheckpointNotFound
+}
@@ -0,0 +1,248 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fekuna/omnipos-pkg/database/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Export job statuses
+const (
+	ExportPending   = "pending"
+	ExportRunning   = "running"
+	ExportSucceeded = "succeeded"
+	ExportFailed    = "failed"
+	ExportExpired   = "expired" // the archive was deleted
+)
+
+// ExportJob is an asynchronous export of the logs matching Query into a signed archive
+type ExportJob struct {
+	ID string `bson:"_id"`
+	// Scope is the read scope of the requester, the job is only visible to callers covering it
+	Scope       TenantScope `bson:"scope"`
+	RequestedBy string      `bson:"requested_by,omitempty"`
+	Format      string      `bson:"format"`
+	Query       LogQuery    `bson:"query"`
+	Status      string      `bson:"status"`
+	RecordCount int64       `bson:"record_count"`
+	// ArchiveName is the archive's name in the ExportStore
+	ArchiveName   string    `bson:"archive_name,omitempty"`
+	ArchiveSize   int64     `bson:"archive_size,omitempty"`
+	ArchiveSHA256 string    `bson:"archive_sha256,omitempty"`
+	KeyID         string    `bson:"key_id,omitempty"`
+	Error         string    `bson:"error,omitempty"`
+	CreatedAt     time.Time `bson:"created_at"`
+	StartedAt     time.Time `bson:"started_at,omitempty"`
+	// ClaimID identifies the worker building a running job, HeartbeatAt is when it last
+	// reported progress and Attempts counts the claims
+	ClaimID     string    `bson:"claim_id,omitempty"`
+	HeartbeatAt time.Time `bson:"heartbeat_at,omitempty"`
+	Attempts    int       `bson:"attempts,omitempty"`
+	CompletedAt time.Time `bson:"completed_at,omitempty"`
+	// ExpiresAt is when a succeeded job's archive gets deleted
+	ExpiresAt time.Time `bson:"expires_at,omitempty"`
+}
+
+// ErrExportJobNotFound is returned when no export job matches, or it is no longer in the expected status
+var ErrExportJobNotFound = errors.New("export job not found")
+
+// ExportJobFilter selects export jobs by status, the time bounds are ignored when zero
+type ExportJobFilter struct {
+	Status          string
+	ExpiresBefore   time.Time
+	HeartbeatBefore time.Time
+}
+
+type ExportJobRepository interface {
+	EnsureIndexes(ctx context.Context) error
+	CreateExportJob(ctx context.Context, job *ExportJob) error
+	GetExportJob(ctx context.Context, id string) (*ExportJob, error)
+	// ClaimExportJob moves a pending job to running under claimID, so that only one worker builds it
+	ClaimExportJob(ctx context.Context, id, claimID string, startedAt time.Time) (*ExportJob, error)
+	// HeartbeatExportJob records that the worker holding claimID is still building the job. It
+	// returns ErrExportJobNotFound once the job was taken from the worker.
+	HeartbeatExportJob(ctx context.Context, id, claimID string, at time.Time) error
+	// ReleaseExportJob moves a running job back to pending if it is still held by job.ClaimID
+	ReleaseExportJob(ctx context.Context, job *ExportJob) error
+	// UpdateExportJob replaces the job if it is still in status from and held by job.ClaimID
+	UpdateExportJob(ctx context.Context, job *ExportJob, from string) error
+	ListExportJobs(ctx context.Context, filter ExportJobFilter, limit int64) ([]ExportJob, error)
+}
+
+type mongoExportJobRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoExportJobRepository(client *mongodb.Client) ExportJobRepository {
+	return &mongoExportJobRepository{
+		collection: client.Database().Collection("export_jobs"),
+	}
+}
+
+func (r *mongoExportJobRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("status_expires_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "heartbeat_at", Value: 1}},
+			Options: options.Index().SetName("status_heartbeat_at"),
+		},
+	})
+	return err
+}
+
+func (r *mongoExportJobRepository) CreateExportJob(ctx context.Context, job *ExportJob) error {
+	_, err := r.collection.InsertOne(ctx, job)
+	return err
+}
+
+func (r *mongoExportJobRepository) GetExportJob(ctx context.Context, id string) (*ExportJob, error) {
+	var job ExportJob
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrExportJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (r *mongoExportJobRepository) ClaimExportJob(ctx context.Context, id, claimID string, startedAt time.Time) (*ExportJob, error) {
+	var job ExportJob
+	err := r.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": ExportPending},
+		bson.M{
+			"$set": bson.M{"status": ExportRunning, "started_at": startedAt, "claim_id": claimID, "heartbeat_at": startedAt},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrExportJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (r *mongoExportJobRepository) HeartbeatExportJob(ctx context.Context, id, claimID string, at time.Time) error {
+	res, err := r.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": ExportRunning, "claim_id": claimID},
+		bson.M{"$set": bson.M{"heartbeat_at": at}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrExportJobNotFound
+	}
+	return nil
+}
+
+func (r *mongoExportJobRepository) ReleaseExportJob(ctx context.Context, job *ExportJob) error {
+	res, err := r.collection.UpdateOne(ctx,
+		bson.M{"_id": job.ID, "status": ExportRunning, "claim_id": job.ClaimID},
+		bson.M{
+			"$set":   bson.M{"status": ExportPending},
+			"$unset": bson.M{"started_at": "", "claim_id": "", "heartbeat_at": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrExportJobNotFound
+	}
+	return nil
+}
+
+func (r *mongoExportJobRepository) UpdateExportJob(ctx context.Context, job *ExportJob, from string) error {
+	filter := bson.M{"_id": job.ID, "status": from}
+	if job.ClaimID != "" {
+		filter["claim_id"] = job.ClaimID
+	}
+	res, err := r.collection.ReplaceOne(ctx, filter, job)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrExportJobNotFound
+	}
+	return nil
+}
+
+func (r *mongoExportJobRepository) ListExportJobs(ctx context.Context, filter ExportJobFilter, limit int64) ([]ExportJob, error) {
+	query := bson.M{"status": filter.Status}
+	if !filter.ExpiresBefore.IsZero() {
+		query["expires_at"] = bson.M{"$lte": filter.ExpiresBefore}
+	}
+	if !filter.HeartbeatBefore.IsZero() {
+		query["heartbeat_at"] = bson.M{"$lte": filter.HeartbeatBefore}
+	}
+
+	opts := options.Find().SetSort(bson.M{"created_at": 1}).SetLimit(limit)
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var jobs []ExportJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ExportStore keeps export archives outside of MongoDB
+type ExportStore interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	// Remove deletes an archive, removing a missing one is not an error
+	Remove(name string) error
+}
+
+type dirExportStore struct {
+	dir string
+}
+
+// NewDirExportStore keeps archives as files in dir, which may be a mounted object storage bucket
+func NewDirExportStore(dir string) ExportStore {
+	return &dirExportStore{dir: dir}
+}
+
+func (s *dirExportStore) Create(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+}
+
+func (s *dirExportStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *dirExportStore) Remove(name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// path keeps names inside the directory
+func (s *dirExportStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
@@ -0,0 +1,324 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryRepository struct {
+	mu   sync.RWMutex
+	logs map[string]*AuditLog
+}
+
+// NewMemoryRepository returns a Repository that keeps audit logs in memory. It follows the
+// Mongo repository's query semantics and index constraints, so use cases can run without a
+// database, e.g. in tests.
+func NewMemoryRepository() Repository {
+	return &memoryRepository{logs: make(map[string]*AuditLog)}
+}
+
+func (r *memoryRepository) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (r *memoryRepository) CreateAuditLog(ctx context.Context, log *AuditLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.insert(log)
+}
+
+// insert enforces the unique indexes of the audit_logs collection. The caller must hold the write lock.
+func (r *memoryRepository) insert(log *AuditLog) error {
+	if _, ok := r.logs[log.ID]; ok {
+		return fmt.Errorf("audit log %s already exists", log.ID)
+	}
+	for _, existing := range r.logs {
+		if existing.MerchantID != log.MerchantID {
+			continue
+		}
+		if log.EventID != "" && existing.EventID == log.EventID {
+			return ErrDuplicateEvent
+		}
+		if log.Sequence != 0 && existing.Sequence == log.Sequence {
+			return ErrSequenceConflict
+		}
+	}
+	stored := *log
+	r.logs[log.ID] = &stored
+	return nil
+}
+
+func (r *memoryRepository) InsertAuditLogs(ctx context.Context, logs []*AuditLog) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, log := range logs {
+		if err := r.insert(log); err != nil {
+			return i, err
+		}
+	}
+	return len(logs), nil
+}
+
+func (r *memoryRepository) FindExistingEventIDs(ctx context.Context, merchantID string, eventIDs []string) ([]string, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(eventIDs))
+	for _, id := range eventIDs {
+		wanted[id] = true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var found []string
+	for _, log := range r.logs {
+		if log.MerchantID == merchantID && wanted[log.EventID] {
+			found = append(found, log.EventID)
+			delete(wanted, log.EventID)
+		}
+	}
+	return found, nil
+}
+
+func (r *memoryRepository) GetAuditLog(ctx context.Context, scope TenantScope, id string) (*AuditLog, error) {
+	if err := scope.check(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	log, ok := r.logs[id]
+	if !ok || !scope.Contains(log) {
+		return nil, ErrAuditLogNotFound
+	}
+	copied := *log
+	return &copied, nil
+}
+
+func (r *memoryRepository) ListAuditLogs(ctx context.Context, scope TenantScope, q *LogQuery, opts ListOptions) (*LogPage, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	logs, err := r.find(scope, q.Matches)
+	if err != nil {
+		return nil, err
+	}
+
+	var scores map[string]float64
+	if opts.ByRelevance {
+		scores = make(map[string]float64, len(logs))
+		for _, log := range logs {
+			scores[log.ID] = textScore(&log, q.Text)
+		}
+		sort.SliceStable(logs, func(i, j int) bool {
+			if si, sj := scores[logs[i].ID], scores[logs[j].ID]; si != sj {
+				return si > sj
+			}
+			return logAfter(&logs[i], &logs[j])
+		})
+	} else {
+		sortLogs(logs, false)
+	}
+
+	page := paginate(logs, opts, false)
+	if opts.ByRelevance {
+		page.Scores = make([]float64, len(page.Logs))
+		for i := range page.Logs {
+			page.Scores[i] = scores[page.Logs[i].ID]
+		}
+	}
+	return page, nil
+}
+
+func (r *memoryRepository) ListEntityLogs(ctx context.Context, scope TenantScope, entity, entityID string, opts ListOptions) (*LogPage, error) {
+	logs, err := r.find(scope, func(log *AuditLog) bool {
+		return log.Entity == entity && log.EntityID == entityID
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortLogs(logs, true)
+	return paginate(logs, opts, true), nil
+}
+
+func (r *memoryRepository) WalkEntityLogs(ctx context.Context, scope TenantScope, entity, entityID string, until time.Time, fn func(*AuditLog) error) error {
+	logs, err := r.find(scope, func(log *AuditLog) bool {
+		return log.Entity == entity && log.EntityID == entityID && !log.Timestamp.After(until)
+	})
+	if err != nil {
+		return err
+	}
+	sortLogs(logs, true)
+	for i := range logs {
+		if err := fn(&logs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) WalkAuditLogs(ctx context.Context, scope TenantScope, q *LogQuery, fn func(*AuditLog) error) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	logs, err := r.find(scope, q.Matches)
+	if err != nil {
+		return err
+	}
+	sortLogs(logs, true)
+	for i := range logs {
+		if err := fn(&logs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetChainHead(ctx context.Context, merchantID string) (*ChainHead, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	head := &ChainHead{}
+	for _, log := range r.logs {
+		if log.MerchantID == merchantID && log.Sequence > head.Sequence {
+			head.Sequence, head.Hash = log.Sequence, log.Hash
+		}
+	}
+	return head, nil
+}
+
+func (r *memoryRepository) GetAuditLogBySequence(ctx context.Context, merchantID string, sequence int64) (*AuditLog, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, log := range r.logs {
+		if log.MerchantID == merchantID && log.Sequence == sequence {
+			copied := *log
+			return &copied, nil
+		}
+	}
+	return nil, ErrAuditLogNotFound
+}
+
+func (r *memoryRepository) WalkChain(ctx context.Context, rng ChainRange, fn func(*AuditLog) error) error {
+	if err := requireMerchant(rng.MerchantID); err != nil {
+		return err
+	}
+	logs, err := r.find(MerchantScope(rng.MerchantID), func(log *AuditLog) bool {
+		return log.Sequence > 0 &&
+			(rng.FromSequence <= 0 || log.Sequence >= rng.FromSequence) &&
+			(rng.ToSequence <= 0 || log.Sequence <= rng.ToSequence) &&
+			(rng.StartDate.IsZero() || !log.Timestamp.Before(rng.StartDate)) &&
+			(rng.EndDate.IsZero() || !log.Timestamp.After(rng.EndDate))
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Sequence < logs[j].Sequence })
+
+	for i := range logs {
+		if err := fn(&logs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) ListChainMerchants(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var merchants []string
+	for _, log := range r.logs {
+		if log.Sequence > 0 && !seen[log.MerchantID] {
+			seen[log.MerchantID] = true
+			merchants = append(merchants, log.MerchantID)
+		}
+	}
+	sort.Strings(merchants)
+	return merchants, nil
+}
+
+// find returns copies of the logs inside the scope that match
+func (r *memoryRepository) find(scope TenantScope, match func(*AuditLog) bool) ([]AuditLog, error) {
+	if err := scope.check(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var logs []AuditLog
+	for _, log := range r.logs {
+		if scope.Contains(log) && match(log) {
+			logs = append(logs, *log)
+		}
+	}
+	return logs, nil
+}
+
+// logAfter reports whether a comes after b in (timestamp, _id) order
+func logAfter(a, b *AuditLog) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return a.ID > b.ID
+}
+
+func sortLogs(logs []AuditLog, ascending bool) {
+	sort.Slice(logs, func(i, j int) bool {
+		if ascending {
+			return logAfter(&logs[j], &logs[i])
+		}
+		return logAfter(&logs[i], &logs[j])
+	})
+}
+
+// paginate cuts one page out of sorted logs like listPage does
+func paginate(logs []AuditLog, opts ListOptions, ascending bool) *LogPage {
+	page := &LogPage{}
+	switch opts.Total {
+	case TotalExact:
+		page.Total = int64(len(logs))
+	case TotalEstimated:
+		page.Total = min(int64(len(logs)), EstimatedTotalCap)
+		page.TotalEstimated = page.Total == EstimatedTotalCap
+	}
+
+	start := 0
+	if opts.After != nil && !opts.ByRelevance {
+		after := &AuditLog{ID: opts.After.ID, Timestamp: opts.After.Timestamp}
+		start = sort.Search(len(logs), func(i int) bool {
+			if ascending {
+				return logAfter(&logs[i], after)
+			}
+			return logAfter(after, &logs[i])
+		})
+	} else if opts.Skip > 0 {
+		start = int(min(opts.Skip, int64(len(logs))))
+	}
+	logs = logs[start:]
+
+	if len(logs) > int(opts.PageSize) {
+		logs = logs[:opts.PageSize]
+		last := logs[len(logs)-1]
+		page.Next = &LogCursor{Timestamp: last.Timestamp, ID: last.ID}
+	}
+	page.Logs = logs
+	return page
+}
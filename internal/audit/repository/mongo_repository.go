@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/fekuna/omnipos-pkg/database/mongodb"
@@ -32,11 +34,84 @@ type AuditLog struct {
 	SourceService string                 `bson:"source_service,omitempty"`
 	CorrelationID string                 `bson:"correlation_id,omitempty"`
 	DurationMs    int64                  `bson:"duration_ms,omitempty"`
+	// EventID is the producer's id for the event (Kafka event_id or gRPC idempotency key)
+	EventID string `bson:"event_id,omitempty"`
+	// Hash chain fields, kept per merchant
+	Sequence int64  `bson:"sequence,omitempty"`
+	PrevHash string `bson:"prev_hash,omitempty"`
+	Hash     string `bson:"hash,omitempty"`
+	// Patch and ChangedFields are derived from OldValue and NewValue at ingest, so they are not hashed
+	Patch         []PatchOp `bson:"patch,omitempty"`
+	ChangedFields []string  `bson:"changed_fields,omitempty"`
+	// DetailsText holds the string values inside Details for the text index, it is not hashed either
+	DetailsText []string `bson:"details_text,omitempty"`
 }
 
+// PatchOp is an RFC 6902 JSON Patch operation. Value is null for remove.
+type PatchOp struct {
+	Op    string      `bson:"op" json:"op"`
+	Path  string      `bson:"path" json:"path"`
+	Value interface{} `bson:"value" json:"value"`
+}
+
+// ChainHead is the last linked record of a merchant's hash chain
+type ChainHead struct {
+	Sequence int64  `bson:"sequence"`
+	Hash     string `bson:"hash"`
+}
+
+// ChainRange selects the linked records of one merchant, ordered by sequence
+type ChainRange struct {
+	MerchantID   string
+	FromSequence int64
+	ToSequence   int64
+	StartDate    time.Time
+	EndDate      time.Time
+}
+
+// ErrAuditLogNotFound is returned when a requested audit log does not exist
+var ErrAuditLogNotFound = errors.New("audit log not found")
+
+// ErrSequenceConflict is returned when another writer already used the record's sequence number
+var ErrSequenceConflict = errors.New("audit log sequence already exists")
+
+// ErrDuplicateEvent is returned when the merchant already has a log for the record's event id
+var ErrDuplicateEvent = errors.New("audit event already stored")
+
+const (
+	chainIndexName = "merchant_sequence_unique"
+	eventIndexName = "merchant_event_unique"
+)
+
+// walkBatchSize is the number of logs fetched per round trip when walking a whole query
+const walkBatchSize = 1000
+
 type Repository interface {
+	EnsureIndexes(ctx context.Context) error
 	CreateAuditLog(ctx context.Context, log *AuditLog) error
-	ListAuditLogs(ctx context.Context, filter map[string]interface{}, page, pageSize int32) ([]AuditLog, int32, error)
+	// InsertAuditLogs writes the logs in order and stops at the first that fails. It returns how
+	// many were inserted and why the next one was not. When the outcome is unknown, e.g. on a
+	// write concern error, it returns 0 and the error.
+	InsertAuditLogs(ctx context.Context, logs []*AuditLog) (int, error)
+	FindExistingEventIDs(ctx context.Context, merchantID string, eventIDs []string) ([]string, error)
+	// Reads return ErrUnscopedQuery unless they are scoped to a merchant or explicitly to all merchants
+	GetAuditLog(ctx context.Context, scope TenantScope, id string) (*AuditLog, error)
+	// ListAuditLogs returns logs newest first
+	ListAuditLogs(ctx context.Context, scope TenantScope, q *LogQuery, opts ListOptions) (*LogPage, error)
+	// ListEntityLogs returns the logs of one entity oldest first
+	ListEntityLogs(ctx context.Context, scope TenantScope, entity, entityID string, opts ListOptions) (*LogPage, error)
+	// WalkEntityLogs calls fn for the logs of one entity up to and including until, oldest first
+	WalkEntityLogs(ctx context.Context, scope TenantScope, entity, entityID string, until time.Time, fn func(*AuditLog) error) error
+	// WalkAuditLogs calls fn for every log matching q, oldest first, without a page limit
+	WalkAuditLogs(ctx context.Context, scope TenantScope, q *LogQuery, fn func(*AuditLog) error) error
+	// WatchAuditLogs pushes logs as they are inserted, see mongoRepository.WatchAuditLogs
+	WatchAuditLogs(ctx context.Context, scope TenantScope, resumeToken string, fn func(log *AuditLog, token string) error) error
+	// AggregateStats groups the matching logs by fields and time bucket
+	AggregateStats(ctx context.Context, scope TenantScope, q *LogQuery, spec StatsSpec) (*StatsResult, error)
+	GetChainHead(ctx context.Context, merchantID string) (*ChainHead, error)
+	GetAuditLogBySequence(ctx context.Context, merchantID string, sequence int64) (*AuditLog, error)
+	WalkChain(ctx context.Context, rng ChainRange, fn func(*AuditLog) error) error
+	ListChainMerchants(ctx context.Context) ([]string, error)
 }
 
 type mongoRepository struct {
@@ -52,54 +127,383 @@ func NewMongoRepository(client *mongodb.Client) Repository {
 	}
 }
 
+func (r *mongoRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "merchant_id", Value: 1}, {Key: "sequence", Value: 1}},
+			Options: options.Index().
+				SetName(chainIndexName).
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"sequence": bson.M{"$exists": true}}),
+		},
+		{
+			Keys: bson.D{{Key: "merchant_id", Value: 1}, {Key: "event_id", Value: 1}},
+			Options: options.Index().
+				SetName(eventIndexName).
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"event_id": bson.M{"$exists": true}}),
+		},
+		{
+			// Serves the (timestamp, _id) keyset seeks of ListAuditLogs
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("merchant_timestamp_id"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "merchant_id", Value: 1},
+				{Key: "entity", Value: 1},
+				{Key: "entity_id", Value: 1},
+				{Key: "timestamp", Value: 1},
+				{Key: "_id", Value: 1},
+			},
+			Options: options.Index().SetName("merchant_entity_timestamp"),
+		},
+		{
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "changed_fields", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("merchant_changed_fields").SetSparse(true),
+		},
+		{
+			// A collection can only have one text index
+			Keys: bson.D{
+				{Key: "action", Value: "text"},
+				{Key: "entity", Value: "text"},
+				{Key: "error_message", Value: "text"},
+				{Key: "details_text", Value: "text"},
+			},
+			Options: options.Index().
+				SetName("audit_text").
+				SetWeights(bson.D{
+					{Key: "action", Value: 5},
+					{Key: "entity", Value: 5},
+					{Key: "error_message", Value: 3},
+					{Key: "details_text", Value: 1},
+				}).
+				SetDefaultLanguage("none"),
+		},
+	})
+	return err
+}
+
 func (r *mongoRepository) CreateAuditLog(ctx context.Context, log *AuditLog) error {
 	_, err := r.collection.InsertOne(ctx, log)
+	switch {
+	case isDuplicateKeyOn(err, eventIndexName):
+		return ErrDuplicateEvent
+	case isDuplicateKeyOn(err, chainIndexName):
+		return ErrSequenceConflict
+	}
 	return err
 }
 
-func (r *mongoRepository) ListAuditLogs(ctx context.Context, filter map[string]interface{}, page, pageSize int32) ([]AuditLog, int32, error) {
-	// Build BSON filter
-	query := bson.M{}
-	for k, v := range filter {
-		if v != "" {
-			query[k] = v
+func (r *mongoRepository) InsertAuditLogs(ctx context.Context, logs []*AuditLog) (int, error) {
+	if len(logs) == 0 {
+		return 0, nil
+	}
+
+	docs := make([]interface{}, len(logs))
+	for i, log := range logs {
+		docs[i] = log
+	}
+
+	_, err := r.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(true))
+	if err == nil {
+		return len(logs), nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return 0, err
+	}
+
+	// An ordered insert stops at its only write error, everything before it was written
+	we := bulkErr.WriteErrors[0]
+	if we.Index < 0 || we.Index >= len(logs) {
+		return 0, err
+	}
+	werr := error(we)
+	switch {
+	case isDuplicateKeyOn(werr, eventIndexName):
+		werr = ErrDuplicateEvent
+	case isDuplicateKeyOn(werr, chainIndexName):
+		werr = ErrSequenceConflict
+	}
+	return we.Index, werr
+}
+
+func (r *mongoRepository) FindExistingEventIDs(ctx context.Context, merchantID string, eventIDs []string) ([]string, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+	query := bson.M{"merchant_id": merchantID, "event_id": bson.M{"$in": eventIDs}}
+	values, err := r.collection.Distinct(ctx, "event_id", query)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]string, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			found = append(found, id)
 		}
 	}
+	return found, nil
+}
+
+func (r *mongoRepository) GetChainHead(ctx context.Context, merchantID string) (*ChainHead, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+	opts := options.FindOne().
+		SetSort(bson.M{"sequence": -1}).
+		SetProjection(bson.M{"sequence": 1, "hash": 1})
 
-	// Handle date range in filter if present (expecting specific keys)
-	if start, ok := filter["start_date"].(time.Time); ok && !start.IsZero() {
-		query["timestamp"] = bson.M{"$gte": start}
+	var head ChainHead
+	err := r.collection.FindOne(ctx, bson.M{"merchant_id": merchantID, "sequence": bson.M{"$gt": 0}}, opts).Decode(&head)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &ChainHead{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+func (r *mongoRepository) GetAuditLog(ctx context.Context, scope TenantScope, id string) (*AuditLog, error) {
+	query := bson.M{"_id": id}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+
+	var log AuditLog
+	err := r.collection.FindOne(ctx, query).Decode(&log)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAuditLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (r *mongoRepository) ListAuditLogs(ctx context.Context, scope TenantScope, q *LogQuery, opts ListOptions) (*LogPage, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	query := q.filter()
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+	return r.listPage(ctx, query, opts, false)
+}
+
+func (r *mongoRepository) ListEntityLogs(ctx context.Context, scope TenantScope, entity, entityID string, opts ListOptions) (*LogPage, error) {
+	query := bson.M{"entity": entity, "entity_id": entityID}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+	return r.listPage(ctx, query, opts, true)
+}
+
+func (r *mongoRepository) WalkEntityLogs(ctx context.Context, scope TenantScope, entity, entityID string, until time.Time, fn func(*AuditLog) error) error {
+	query := bson.M{"entity": entity, "entity_id": entityID, "timestamp": bson.M{"$lte": until}}
+	if err := scope.apply(query); err != nil {
+		return err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return err
 	}
-	if end, ok := filter["end_date"].(time.Time); ok && !end.IsZero() {
-		if val, exists := query["timestamp"].(bson.M); exists {
-			val["$lte"] = end
-			query["timestamp"] = val
-		} else {
-			query["timestamp"] = bson.M{"$lte": end}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var log AuditLog
+		if err := cursor.Decode(&log); err != nil {
+			return err
+		}
+		if err := fn(&log); err != nil {
+			return err
 		}
 	}
+	return cursor.Err()
+}
 
-	// Pagination options
-	skip := int64((page - 1) * pageSize)
-	limit := int64(pageSize)
-	opts := options.Find().SetSkip(skip).SetLimit(limit).SetSort(bson.M{"timestamp": -1})
+func (r *mongoRepository) WalkAuditLogs(ctx context.Context, scope TenantScope, q *LogQuery, fn func(*AuditLog) error) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	query := q.filter()
+	if err := scope.apply(query); err != nil {
+		return err
+	}
 
+	// Exports read whole quarters, so the cursor may outlive the default idle timeout between batches
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetBatchSize(walkBatchSize).
+		SetNoCursorTimeout(true)
 	cursor, err := r.collection.Find(ctx, query, opts)
 	if err != nil {
-		return nil, 0, err
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var log AuditLog
+		if err := cursor.Decode(&log); err != nil {
+			return err
+		}
+		if err := fn(&log); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// listPage reads one page of the logs matching query, ordered by (timestamp, _id)
+func (r *mongoRepository) listPage(ctx context.Context, query bson.M, opts ListOptions, ascending bool) (*LogPage, error) {
+	page := &LogPage{}
+	var err error
+	switch opts.Total {
+	case TotalExact:
+		page.Total, err = r.collection.CountDocuments(ctx, query)
+	case TotalEstimated:
+		page.Total, err = r.collection.CountDocuments(ctx, query, options.Count().SetLimit(EstimatedTotalCap))
+		page.TotalEstimated = page.Total == EstimatedTotalCap
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	order := -1
+	if ascending {
+		order = 1
+	}
+	sort := bson.D{{Key: "timestamp", Value: order}, {Key: "_id", Value: order}}
+	if opts.ByRelevance {
+		sort = append(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}}, sort...)
+	}
+	// One extra log tells whether another page follows
+	findOpts := options.Find().
+		SetLimit(int64(opts.PageSize) + 1).
+		SetSort(sort)
+	find := query
+	if opts.After != nil && !opts.ByRelevance {
+		find = bson.M{"$and": bson.A{query, seekAfter(opts.After, ascending)}}
+	} else if opts.Skip > 0 {
+		findOpts.SetSkip(opts.Skip)
+	}
+
+	if opts.ByRelevance {
+		findOpts.SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}})
+	}
+
+	cursor, err := r.collection.Find(ctx, find, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	if opts.ByRelevance {
+		var scored []scoredLog
+		if err = cursor.All(ctx, &scored); err != nil {
+			return nil, err
+		}
+		page.Logs = make([]AuditLog, len(scored))
+		page.Scores = make([]float64, len(scored))
+		for i := range scored {
+			page.Logs[i] = scored[i].AuditLog
+			page.Scores[i] = scored[i].Score
+		}
+	} else if err = cursor.All(ctx, &page.Logs); err != nil {
+		return nil, err
+	}
+
+	if len(page.Logs) > int(opts.PageSize) {
+		page.Logs = page.Logs[:opts.PageSize]
+		if page.Scores != nil {
+			page.Scores = page.Scores[:opts.PageSize]
+		}
+		last := page.Logs[len(page.Logs)-1]
+		page.Next = &LogCursor{Timestamp: last.Timestamp, ID: last.ID}
+	}
+	return page, nil
+}
+
+func (r *mongoRepository) GetAuditLogBySequence(ctx context.Context, merchantID string, sequence int64) (*AuditLog, error) {
+	if err := requireMerchant(merchantID); err != nil {
+		return nil, err
+	}
+	var log AuditLog
+	err := r.collection.FindOne(ctx, bson.M{"merchant_id": merchantID, "sequence": sequence}).Decode(&log)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAuditLogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (r *mongoRepository) WalkChain(ctx context.Context, rng ChainRange, fn func(*AuditLog) error) error {
+	if err := requireMerchant(rng.MerchantID); err != nil {
+		return err
+	}
+	sequence := bson.M{"$gt": 0}
+	if rng.FromSequence > 0 {
+		sequence["$gte"] = rng.FromSequence
+	}
+	if rng.ToSequence > 0 {
+		sequence["$lte"] = rng.ToSequence
+	}
+	query := bson.M{"merchant_id": rng.MerchantID, "sequence": sequence}
+
+	timestamp := bson.M{}
+	if !rng.StartDate.IsZero() {
+		timestamp["$gte"] = rng.StartDate
+	}
+	if !rng.EndDate.IsZero() {
+		timestamp["$lte"] = rng.EndDate
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+
+	cursor, err := r.collection.Find(ctx, query, options.Find().SetSort(bson.M{"sequence": 1}))
+	if err != nil {
+		return err
 	}
 	defer cursor.Close(ctx)
 
-	var logs []AuditLog
-	if err = cursor.All(ctx, &logs); err != nil {
-		return nil, 0, err
+	for cursor.Next(ctx) {
+		var log AuditLog
+		if err := cursor.Decode(&log); err != nil {
+			return err
+		}
+		if err := fn(&log); err != nil {
+			return err
+		}
 	}
+	return cursor.Err()
+}
 
-	// Count total
-	total, err := r.collection.CountDocuments(ctx, query)
+func (r *mongoRepository) ListChainMerchants(ctx context.Context) ([]string, error) {
+	values, err := r.collection.Distinct(ctx, "merchant_id", bson.M{"sequence": bson.M{"$gt": 0}})
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	return logs, int32(total), nil
+	merchants := make([]string, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.(string); ok {
+			merchants = append(merchants, id)
+		}
+	}
+	return merchants, nil
+}
+
+// isDuplicateKeyOn reports whether err is a duplicate key error raised by the named index
+func isDuplicateKeyOn(err error, index string) bool {
+	return err != nil && mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), index)
 }
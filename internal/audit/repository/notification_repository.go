@@ -0,0 +1,333 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fekuna/omnipos-pkg/database/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Notification channel types. Kafka is not configured per merchant, every alert is published
+// to the alerts topic when one is set.
+const (
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+	ChannelKafka   = "kafka"
+)
+
+// Alert delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed" // gave up, no further attempts are made
+)
+
+// NotificationChannel is where a merchant wants its alerts delivered
+type NotificationChannel struct {
+	ID         string `bson:"_id"`
+	MerchantID string `bson:"merchant_id"`
+	Name       string `bson:"name"`
+	Type       string `bson:"type"`
+	Enabled    bool   `bson:"enabled"`
+	// URL and Secret configure a webhook, requests are signed with HMAC-SHA256 of Secret
+	URL    string `bson:"url,omitempty"`
+	Secret string `bson:"secret,omitempty"`
+	// Recipients are the addresses of an email channel
+	Recipients []string `bson:"recipients,omitempty"`
+	// MinSeverity skips alerts of a lower severity, all are delivered when empty
+	MinSeverity string `bson:"min_severity,omitempty"`
+	// RuleIDs limits the channel to the alerts of these rules, all are delivered when empty
+	RuleIDs   []string  `bson:"rule_ids,omitempty"`
+	CreatedBy string    `bson:"created_by,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// AlertDelivery records the delivery of one alert to one channel
+type AlertDelivery struct {
+	ID         string `bson:"_id"`
+	MerchantID string `bson:"merchant_id"`
+	AlertID    string `bson:"alert_id"`
+	// ChannelID is empty for the Kafka alerts topic
+	ChannelID   string `bson:"channel_id,omitempty"`
+	ChannelType string `bson:"channel_type"`
+	// Target is where the alert went: the webhook URL, the recipients or the topic
+	Target string `bson:"target"`
+	// Alert is the alert as it is delivered
+	Alert     Alert  `bson:"alert"`
+	Status    string `bson:"status"`
+	Attempts  int    `bson:"attempts"`
+	LastError string `bson:"last_error,omitempty"`
+	// NextAttemptAt is when a pending delivery is tried again
+	NextAttemptAt time.Time `bson:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time `bson:"created_at"`
+	UpdatedAt     time.Time `bson:"updated_at"`
+	DeliveredAt   time.Time `bson:"delivered_at,omitempty"`
+}
+
+type AlertDeliveryFilter struct {
+	AlertID   string
+	ChannelID string
+	Status    string
+}
+
+// ErrNotificationChannelNotFound is returned when a channel does not exist in the scope
+var ErrNotificationChannelNotFound = errors.New("notification channel not found")
+
+// ErrNoDueDelivery is returned when no pending delivery is due
+var ErrNoDueDelivery = errors.New("no delivery is due")
+
+// ErrNoPendingAlert is returned when no alert is waiting to be dispatched
+var ErrNoPendingAlert = errors.New("no alert is pending dispatch")
+
+type NotificationRepository interface {
+	EnsureIndexes(ctx context.Context) error
+	CreateNotificationChannel(ctx context.Context, channel *NotificationChannel) error
+	GetNotificationChannel(ctx context.Context, scope TenantScope, id string) (*NotificationChannel, error)
+	ListNotificationChannels(ctx context.Context, scope TenantScope, enabledOnly bool) ([]NotificationChannel, error)
+	UpdateNotificationChannel(ctx context.Context, scope TenantScope, channel *NotificationChannel) error
+	DeleteNotificationChannel(ctx context.Context, scope TenantScope, id string) error
+	// ClaimPendingAlert returns the oldest alert whose deliveries are not recorded yet and
+	// postpones it by lease, so that no other instance dispatches it meanwhile
+	ClaimPendingAlert(ctx context.Context, now time.Time, lease time.Duration) (*Alert, error)
+	MarkAlertDispatched(ctx context.Context, alertID string) error
+	// CreateAlertDeliveries skips deliveries that are already recorded, so that an alert can be
+	// dispatched again after an interrupted attempt
+	CreateAlertDeliveries(ctx context.Context, deliveries []AlertDelivery) error
+	// ClaimAlertDelivery returns the oldest pending delivery due at now and postpones it by
+	// lease, so that no other worker attempts it meanwhile
+	ClaimAlertDelivery(ctx context.Context, now time.Time, lease time.Duration) (*AlertDelivery, error)
+	UpdateAlertDelivery(ctx context.Context, delivery *AlertDelivery) error
+	ListAlertDeliveries(ctx context.Context, scope TenantScope, filter AlertDeliveryFilter, page, pageSize int32) ([]AlertDelivery, int32, error)
+}
+
+type mongoNotificationRepository struct {
+	channels   *mongo.Collection
+	deliveries *mongo.Collection
+	alerts     *mongo.Collection
+}
+
+func NewMongoNotificationRepository(client *mongodb.Client) NotificationRepository {
+	return &mongoNotificationRepository{
+		channels:   client.Database().Collection("notification_channels"),
+		deliveries: client.Database().Collection("alert_deliveries"),
+		alerts:     client.Database().Collection("alerts"),
+	}
+}
+
+func (r *mongoNotificationRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.channels.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "name", Value: 1}},
+		Options: options.Index().SetName("merchant_name"),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+			Options: options.Index().SetName("status_next_attempt_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "merchant_id", Value: 1}, {Key: "created_at", Value: -1}},
+			Options: options.Index().SetName("merchant_created_at"),
+		},
+		{
+			Keys:    bson.D{{Key: "alert_id", Value: 1}},
+			Options: options.Index().SetName("alert_id"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.alerts.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "dispatch_at", Value: 1}},
+		Options: options.Index().SetName("dispatch_pending_at").
+			SetPartialFilterExpression(bson.M{"dispatch_pending": true}),
+	})
+	return err
+}
+
+func (r *mongoNotificationRepository) CreateNotificationChannel(ctx context.Context, channel *NotificationChannel) error {
+	if err := requireMerchant(channel.MerchantID); err != nil {
+		return err
+	}
+	_, err := r.channels.InsertOne(ctx, channel)
+	return err
+}
+
+func (r *mongoNotificationRepository) GetNotificationChannel(ctx context.Context, scope TenantScope, id string) (*NotificationChannel, error) {
+	query := bson.M{"_id": id}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+
+	var channel NotificationChannel
+	err := r.channels.FindOne(ctx, query).Decode(&channel)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotificationChannelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (r *mongoNotificationRepository) ListNotificationChannels(ctx context.Context, scope TenantScope, enabledOnly bool) ([]NotificationChannel, error) {
+	query := bson.M{}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+	if enabledOnly {
+		query["enabled"] = true
+	}
+
+	cursor, err := r.channels.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "merchant_id", Value: 1}, {Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var channels []NotificationChannel
+	if err := cursor.All(ctx, &channels); err != nil {
+		return nil, err
+	}
+	return channels, nil
+}
+
+func (r *mongoNotificationRepository) UpdateNotificationChannel(ctx context.Context, scope TenantScope, channel *NotificationChannel) error {
+	query := bson.M{"_id": channel.ID}
+	if err := scope.apply(query); err != nil {
+		return err
+	}
+	res, err := r.channels.ReplaceOne(ctx, query, channel)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotificationChannelNotFound
+	}
+	return nil
+}
+
+func (r *mongoNotificationRepository) DeleteNotificationChannel(ctx context.Context, scope TenantScope, id string) error {
+	query := bson.M{"_id": id}
+	if err := scope.apply(query); err != nil {
+		return err
+	}
+	res, err := r.channels.DeleteOne(ctx, query)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotificationChannelNotFound
+	}
+	return nil
+}
+
+func (r *mongoNotificationRepository) ClaimPendingAlert(ctx context.Context, now time.Time, lease time.Duration) (*Alert, error) {
+	var alert Alert
+	err := r.alerts.FindOneAndUpdate(ctx,
+		bson.M{"dispatch_pending": true, "dispatch_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"dispatch_at": now.Add(lease)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"dispatch_at": 1}),
+	).Decode(&alert)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoPendingAlert
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &alert, nil
+}
+
+func (r *mongoNotificationRepository) MarkAlertDispatched(ctx context.Context, alertID string) error {
+	_, err := r.alerts.UpdateOne(ctx,
+		bson.M{"_id": alertID},
+		bson.M{"$unset": bson.M{"dispatch_pending": "", "dispatch_at": ""}},
+	)
+	return err
+}
+
+func (r *mongoNotificationRepository) CreateAlertDeliveries(ctx context.Context, deliveries []AlertDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(deliveries))
+	for i := range deliveries {
+		docs[i] = &deliveries[i]
+	}
+	_, err := r.deliveries.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+
+	// Deliveries have deterministic ids, a duplicate was recorded by an earlier dispatch
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return err
+	}
+	for _, we := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(we) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *mongoNotificationRepository) ClaimAlertDelivery(ctx context.Context, now time.Time, lease time.Duration) (*AlertDelivery, error) {
+	var delivery AlertDelivery
+	err := r.deliveries.FindOneAndUpdate(ctx,
+		bson.M{"status": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"next_attempt_at": 1}),
+	).Decode(&delivery)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNoDueDelivery
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (r *mongoNotificationRepository) UpdateAlertDelivery(ctx context.Context, delivery *AlertDelivery) error {
+	_, err := r.deliveries.ReplaceOne(ctx, bson.M{"_id": delivery.ID}, delivery)
+	return err
+}
+
+func (r *mongoNotificationRepository) ListAlertDeliveries(ctx context.Context, scope TenantScope, filter AlertDeliveryFilter, page, pageSize int32) ([]AlertDelivery, int32, error) {
+	query := bson.M{}
+	if err := scope.apply(query); err != nil {
+		return nil, 0, err
+	}
+	if filter.AlertID != "" {
+		query["alert_id"] = filter.AlertID
+	}
+	if filter.ChannelID != "" {
+		query["channel_id"] = filter.ChannelID
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+
+	skip := int64((page - 1) * pageSize)
+	opts := options.Find().SetSkip(skip).SetLimit(int64(pageSize)).SetSort(bson.M{"created_at": -1})
+	cursor, err := r.deliveries.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var deliveries []AlertDelivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, 0, err
+	}
+
+	total, err := r.deliveries.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return deliveries, int32(total), nil
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// LogCursor is the position of a log in the (timestamp, _id) order audit logs are listed in
+type LogCursor struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// TotalMode says how a listing counts its matches
+type TotalMode int
+
+const (
+	TotalNone      TotalMode = iota // no count
+	TotalExact                      // count every match
+	TotalEstimated                  // count up to EstimatedTotalCap matches
+)
+
+// EstimatedTotalCap bounds the work of an estimated count. A listing with more matches reports
+// the cap and marks the total as estimated.
+const EstimatedTotalCap = 10000
+
+// ListOptions controls which page of audit logs is read
+type ListOptions struct {
+	PageSize int32
+	// After seeks past the given log, the last one of the previous page
+	After *LogCursor
+	// Skip is the offset of page-numbered listings, ignored when After is set
+	Skip  int64
+	Total TotalMode
+	// ByRelevance orders a text search by score, pages are then selected with Skip
+	ByRelevance bool
+}
+
+// LogPage is one page of audit logs
+type LogPage struct {
+	Logs           []AuditLog
+	Total          int64
+	TotalEstimated bool
+	// Next is the cursor of the following page, nil on the last page
+	Next *LogCursor
+	// Scores are the text scores of the logs when listed by relevance
+	Scores []float64
+}
+
+// scoredLog is a log read together with its text score
+type scoredLog struct {
+	AuditLog `bson:",inline"`
+	Score    float64 `bson:"score"`
+}
+
+// seekAfter matches the logs listed after the cursor, in descending or ascending order
+func seekAfter(c *LogCursor, ascending bool) bson.M {
+	op := "$lt"
+	if ascending {
+		op = "$gt"
+	}
+	return bson.M{"$or": bson.A{
+		bson.M{"timestamp": bson.M{op: c.Timestamp}},
+		bson.M{"timestamp": c.Timestamp, "_id": bson.M{op: c.ID}},
+	}}
+}
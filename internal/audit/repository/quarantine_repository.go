@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fekuna/omnipos-pkg/database/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Quarantine statuses
+const (
+	QuarantineStatusQuarantined = "quarantined"
+	QuarantineStatusReplayed    = "replayed"
+	QuarantineStatusDiscarded   = "discarded"
+)
+
+// QuarantinedEvent is a Kafka audit event that could not be stored
+type QuarantinedEvent struct {
+	ID            string     `bson:"_id"`
+	EventID       string     `bson:"event_id,omitempty"`
+	MerchantID    string     `bson:"merchant_id,omitempty"`
+	Topic         string     `bson:"topic"`
+	Partition     int        `bson:"partition"`
+	Offset        int64      `bson:"offset"`
+	Key           string     `bson:"key,omitempty"`
+	Payload       []byte     `bson:"payload"`
+	Reason        string     `bson:"reason"` // unmarshal_failed, validation_failed, persist_failed
+	Error         string     `bson:"error"`
+	Attempts      int        `bson:"attempts"`
+	Status        string     `bson:"status"`
+	QuarantinedAt time.Time  `bson:"quarantined_at"`
+	ResolvedAt    *time.Time `bson:"resolved_at,omitempty"`
+	Resolution    string     `bson:"resolution,omitempty"`
+}
+
+type QuarantineFilter struct {
+	Status string
+	Reason string
+}
+
+// ErrQuarantinedEventNotFound is returned when a quarantined event does not exist
+var ErrQuarantinedEventNotFound = errors.New("quarantined event not found")
+
+// ErrQuarantineResolved is returned when a quarantined event was already replayed or discarded
+var ErrQuarantineResolved = errors.New("quarantined event already resolved")
+
+type QuarantineRepository interface {
+	EnsureIndexes(ctx context.Context) error
+	// CreateQuarantinedEvent returns the stored event. A message that was already quarantined
+	// is not stored again, the existing event for its topic, partition and offset is returned.
+	CreateQuarantinedEvent(ctx context.Context, event *QuarantinedEvent) (*QuarantinedEvent, error)
+	// Events that could not be decoded have no merchant and are only visible with AllMerchants
+	GetQuarantinedEvent(ctx context.Context, scope TenantScope, id string) (*QuarantinedEvent, error)
+	ListQuarantinedEvents(ctx context.Context, scope TenantScope, filter QuarantineFilter, page, pageSize int32) ([]QuarantinedEvent, int32, error)
+	// ResolveQuarantinedEvent moves a quarantined event to a final status
+	ResolveQuarantinedEvent(ctx context.Context, scope TenantScope, id, status, resolution string) (*QuarantinedEvent, error)
+	RecordReplayFailure(ctx context.Context, id, errMsg string) error
+}
+
+type mongoQuarantineRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongoQuarantineRepository(client *mongodb.Client) QuarantineRepository {
+	return &mongoQuarantineRepository{
+		collection: client.Database().Collection("quarantined_events"),
+	}
+}
+
+func (r *mongoQuarantineRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// A redelivered poison message is quarantined only once
+			Keys:    bson.D{{Key: "topic", Value: 1}, {Key: "partition", Value: 1}, {Key: "offset", Value: 1}},
+			Options: options.Index().SetName("topic_partition_offset_unique").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "status", Value: 1}, {Key: "quarantined_at", Value: -1}},
+			Options: options.Index().SetName("status_quarantined_at"),
+		},
+	})
+	return err
+}
+
+func (r *mongoQuarantineRepository) CreateQuarantinedEvent(ctx context.Context, event *QuarantinedEvent) (*QuarantinedEvent, error) {
+	_, err := r.collection.InsertOne(ctx, event)
+	if err == nil {
+		return event, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing QuarantinedEvent
+	err = r.collection.FindOne(ctx, bson.M{
+		"topic":     event.Topic,
+		"partition": event.Partition,
+		"offset":    event.Offset,
+	}).Decode(&existing)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrQuarantinedEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+func (r *mongoQuarantineRepository) GetQuarantinedEvent(ctx context.Context, scope TenantScope, id string) (*QuarantinedEvent, error) {
+	query := bson.M{"_id": id}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+
+	var event QuarantinedEvent
+	err := r.collection.FindOne(ctx, query).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrQuarantinedEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (r *mongoQuarantineRepository) ListQuarantinedEvents(ctx context.Context, scope TenantScope, filter QuarantineFilter, page, pageSize int32) ([]QuarantinedEvent, int32, error) {
+	query := bson.M{}
+	if err := scope.apply(query); err != nil {
+		return nil, 0, err
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.Reason != "" {
+		query["reason"] = filter.Reason
+	}
+
+	skip := int64((page - 1) * pageSize)
+	limit := int64(pageSize)
+	opts := options.Find().SetSkip(skip).SetLimit(limit).SetSort(bson.M{"quarantined_at": -1})
+
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []QuarantinedEvent
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, 0, err
+	}
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, int32(total), nil
+}
+
+func (r *mongoQuarantineRepository) ResolveQuarantinedEvent(ctx context.Context, scope TenantScope, id, status, resolution string) (*QuarantinedEvent, error) {
+	query := bson.M{"_id": id, "status": QuarantineStatusQuarantined}
+	if err := scope.apply(query); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{"$set": bson.M{
+		"status":      status,
+		"resolved_at": now,
+		"resolution":  resolution,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var event QuarantinedEvent
+	err := r.collection.FindOneAndUpdate(ctx, query, update, opts).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, getErr := r.GetQuarantinedEvent(ctx, scope, id); getErr != nil {
+			return nil, getErr
+		}
+		return nil, ErrQuarantineResolved
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (r *mongoQuarantineRepository) RecordReplayFailure(ctx context.Context, id, errMsg string) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"error": errMsg},
+		"$inc": bson.M{"attempts": 1},
+	})
+	return err
+}
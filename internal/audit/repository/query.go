@@ -0,0 +1,424 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Field is a field of an audit log that a LogQuery can filter on
+type Field string
+
+const (
+	FieldUserID        Field = "user_id"
+	FieldEntity        Field = "entity"
+	FieldEntityID      Field = "entity_id"
+	FieldAction        Field = "action"
+	FieldStoreID       Field = "store_id"
+	FieldSeverity      Field = "severity"
+	FieldResult        Field = "result"
+	FieldSourceService Field = "source_service"
+	FieldCorrelationID Field = "correlation_id"
+	FieldChangedFields Field = "changed_fields"
+
+	detailsPrefix = "details."
+)
+
+var queryFields = map[Field]bool{
+	FieldUserID:        true,
+	FieldEntity:        true,
+	FieldEntityID:      true,
+	FieldAction:        true,
+	FieldStoreID:       true,
+	FieldSeverity:      true,
+	FieldResult:        true,
+	FieldSourceService: true,
+	FieldCorrelationID: true,
+	FieldChangedFields: true,
+}
+
+// maxDetailsDepth bounds the nesting of a details path
+const maxDetailsDepth = 8
+
+// detailsPathPattern matches dotted paths such as "payment.method", never operators like "$where"
+var detailsPathPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// DetailsField is the field at a dotted path inside Details, e.g. "payment.method"
+func DetailsField(path string) Field {
+	return Field(detailsPrefix + path)
+}
+
+// ValidDetailsPath reports whether path can be used with DetailsField
+func ValidDetailsPath(path string) bool {
+	return detailsPathPattern.MatchString(path) && strings.Count(path, ".") < maxDetailsDepth
+}
+
+// Valid reports whether the field can be filtered on
+func (f Field) Valid() bool {
+	if path, ok := strings.CutPrefix(string(f), detailsPrefix); ok {
+		return ValidDetailsPath(path)
+	}
+	return queryFields[f]
+}
+
+// Condition matches logs whose field equals one of Values or starts with one of Prefixes.
+// Not inverts the condition, logs without the field then match as well. Values of details
+// fields also match the number or boolean they spell.
+type Condition struct {
+	Field    Field    `bson:"field" json:"field"`
+	Values   []string `bson:"values,omitempty" json:"values,omitempty"`
+	Prefixes []string `bson:"prefixes,omitempty" json:"prefixes,omitempty"`
+	Not      bool     `bson:"not,omitempty" json:"not,omitempty"`
+}
+
+// LogQuery selects audit logs. Every condition and bound that is set must match.
+type LogQuery struct {
+	Conditions []Condition `bson:"conditions,omitempty" json:"conditions,omitempty"`
+	// StartDate and EndDate bound the timestamp inclusively, zero means unbounded
+	StartDate     time.Time `bson:"start_date,omitempty" json:"start_date,omitzero"`
+	EndDate       time.Time `bson:"end_date,omitempty" json:"end_date,omitzero"`
+	MinDurationMs *int64    `bson:"min_duration_ms,omitempty" json:"min_duration_ms,omitempty"`
+	MaxDurationMs *int64    `bson:"max_duration_ms,omitempty" json:"max_duration_ms,omitempty"`
+	// Text searches the text index, see ListOptions.ByRelevance
+	Text string `bson:"text,omitempty" json:"text,omitempty"`
+}
+
+// ErrInvalidQuery is returned for a LogQuery that fails validation
+var ErrInvalidQuery = errors.New("invalid audit log query")
+
+// Validate checks that the query only uses known fields and consistent bounds
+func (q *LogQuery) Validate() error {
+	for _, c := range q.Conditions {
+		if !c.Field.Valid() {
+			return fmt.Errorf("%w: cannot filter on %q", ErrInvalidQuery, c.Field)
+		}
+		if len(c.Values) == 0 && len(c.Prefixes) == 0 {
+			return fmt.Errorf("%w: condition on %s has no values", ErrInvalidQuery, c.Field)
+		}
+		for _, p := range c.Prefixes {
+			if p == "" {
+				return fmt.Errorf("%w: condition on %s has an empty prefix", ErrInvalidQuery, c.Field)
+			}
+		}
+	}
+	if !q.StartDate.IsZero() && !q.EndDate.IsZero() && q.EndDate.Before(q.StartDate) {
+		return fmt.Errorf("%w: end date is before start date", ErrInvalidQuery)
+	}
+	if q.MinDurationMs != nil && q.MaxDurationMs != nil && *q.MaxDurationMs < *q.MinDurationMs {
+		return fmt.Errorf("%w: maximum duration is below minimum duration", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// filter builds the Mongo filter of a validated query
+func (q *LogQuery) filter() bson.M {
+	query := bson.M{}
+	var and bson.A
+	for _, c := range q.Conditions {
+		and = append(and, c.filter())
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+
+	timestamp := bson.M{}
+	if !q.StartDate.IsZero() {
+		timestamp["$gte"] = q.StartDate
+	}
+	if !q.EndDate.IsZero() {
+		timestamp["$lte"] = q.EndDate
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+
+	duration := bson.M{}
+	if q.MinDurationMs != nil {
+		duration["$gte"] = *q.MinDurationMs
+	}
+	if q.MaxDurationMs != nil {
+		duration["$lte"] = *q.MaxDurationMs
+	}
+	if len(duration) > 0 {
+		query["duration_ms"] = duration
+	}
+
+	if q.Text != "" {
+		query["$text"] = bson.M{"$search": q.Text}
+	}
+	return query
+}
+
+func (c Condition) filter() bson.M {
+	details := strings.HasPrefix(string(c.Field), detailsPrefix)
+	values := bson.A{}
+	for _, v := range c.Values {
+		values = append(values, v)
+		if details {
+			values = append(values, typedValues(v)...)
+		}
+	}
+	for _, p := range c.Prefixes {
+		// An anchored, literal prefix can use the field's index
+		values = append(values, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(p)})
+	}
+
+	op := "$in"
+	if c.Not {
+		op = "$nin"
+	}
+	return bson.M{string(c.Field): bson.M{op: values}}
+}
+
+// typedValues returns the number or boolean a details value spells, so that "12" also
+// matches a details value stored as a number
+func typedValues(v string) bson.A {
+	switch v {
+	case "true":
+		return bson.A{true}
+	case "false":
+		return bson.A{false}
+	}
+	// Mongo compares numbers across int32, int64 and double
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return bson.A{f}
+	}
+	return nil
+}
+
+// Matches reports whether a log satisfies the query the way its Mongo filter does.
+// Text search is approximated, see textScore.
+func (q *LogQuery) Matches(log *AuditLog) bool {
+	for _, c := range q.Conditions {
+		if !c.matches(log) {
+			return false
+		}
+	}
+	if !q.StartDate.IsZero() && log.Timestamp.Before(q.StartDate) {
+		return false
+	}
+	if !q.EndDate.IsZero() && log.Timestamp.After(q.EndDate) {
+		return false
+	}
+	// duration_ms is omitted when zero, and a missing field never satisfies a bound
+	if (q.MinDurationMs != nil || q.MaxDurationMs != nil) && log.DurationMs == 0 {
+		return false
+	}
+	if q.MinDurationMs != nil && log.DurationMs < *q.MinDurationMs {
+		return false
+	}
+	if q.MaxDurationMs != nil && log.DurationMs > *q.MaxDurationMs {
+		return false
+	}
+	if q.Text != "" && textScore(log, q.Text) == 0 {
+		return false
+	}
+	return true
+}
+
+func (c Condition) matches(log *AuditLog) bool {
+	found := false
+	for _, v := range fieldValues(log, c.Field) {
+		if c.matchesValue(v) {
+			found = true
+			break
+		}
+	}
+	return found != c.Not
+}
+
+func (c Condition) matchesValue(v interface{}) bool {
+	s, isString := v.(string)
+	for _, want := range c.Values {
+		if isString && s == want {
+			return true
+		}
+		for _, typed := range typedValues(want) {
+			if sameScalar(v, typed) {
+				return true
+			}
+		}
+	}
+	if isString {
+		for _, p := range c.Prefixes {
+			if strings.HasPrefix(s, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldValues returns the values of a field as Mongo sees them, array elements one by one.
+// Fields stored with omitempty are missing when empty.
+func fieldValues(log *AuditLog, f Field) []interface{} {
+	if path, ok := strings.CutPrefix(string(f), detailsPrefix); ok {
+		return lookupPath(log.Details, strings.Split(path, "."))
+	}
+
+	var value string
+	switch f {
+	case FieldUserID:
+		return []interface{}{log.UserID}
+	case FieldEntity:
+		return []interface{}{log.Entity}
+	case FieldEntityID:
+		return []interface{}{log.EntityID}
+	case FieldAction:
+		return []interface{}{log.Action}
+	case FieldStoreID:
+		value = log.StoreID
+	case FieldSeverity:
+		value = log.Severity
+	case FieldResult:
+		value = log.Result
+	case FieldSourceService:
+		value = log.SourceService
+	case FieldCorrelationID:
+		value = log.CorrelationID
+	case FieldChangedFields:
+		values := make([]interface{}, len(log.ChangedFields))
+		for i, v := range log.ChangedFields {
+			values[i] = v
+		}
+		return values
+	}
+	if value == "" {
+		return nil
+	}
+	return []interface{}{value}
+}
+
+func lookupPath(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		if arr, ok := asArray(v); ok {
+			return arr
+		}
+		return []interface{}{v}
+	}
+
+	var next interface{}
+	var ok bool
+	switch doc := v.(type) {
+	case map[string]interface{}:
+		next, ok = doc[path[0]]
+	case primitive.M:
+		next, ok = doc[path[0]]
+	case primitive.D:
+		for _, e := range doc {
+			if e.Key == path[0] {
+				next, ok = e.Value, true
+				break
+			}
+		}
+	default:
+		// Paths reach into the documents of an array as well
+		if arr, isArr := asArray(v); isArr {
+			var values []interface{}
+			for _, item := range arr {
+				values = append(values, lookupPath(item, path)...)
+			}
+			return values
+		}
+	}
+	if !ok {
+		return nil
+	}
+	return lookupPath(next, path[1:])
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch arr := v.(type) {
+	case []interface{}:
+		return arr, true
+	case primitive.A:
+		return arr, true
+	}
+	return nil, false
+}
+
+// sameScalar compares a stored value with a typed query value, numbers across their types
+func sameScalar(stored, want interface{}) bool {
+	if b, ok := want.(bool); ok {
+		sb, isBool := stored.(bool)
+		return isBool && sb == b
+	}
+	f, ok := want.(float64)
+	if !ok {
+		return false
+	}
+	switch n := stored.(type) {
+	case int:
+		return float64(n) == f
+	case int32:
+		return float64(n) == f
+	case int64:
+		return float64(n) == f
+	case float32:
+		return float64(n) == f
+	case float64:
+		return n == f
+	case json.Number:
+		nf, err := n.Float64()
+		return err == nil && nf == f
+	}
+	return false
+}
+
+// textWeights mirror the weights of the audit_text index
+var textWeights = []struct {
+	weight int
+	values func(*AuditLog) []string
+}{
+	{5, func(l *AuditLog) []string { return []string{l.Action} }},
+	{5, func(l *AuditLog) []string { return []string{l.Entity} }},
+	{3, func(l *AuditLog) []string { return []string{l.ErrorMessage} }},
+	{1, func(l *AuditLog) []string { return l.DetailsText }},
+}
+
+// textScore approximates the text index: terms match whole words case-insensitively, a log
+// containing a negated term (-word) scores zero, and the score sums the weights of the
+// fields each term occurs in.
+func textScore(log *AuditLog, text string) float64 {
+	var words []map[string]bool
+	for _, tw := range textWeights {
+		set := make(map[string]bool)
+		for _, v := range tw.values(log) {
+			for _, w := range splitWords(v) {
+				set[w] = true
+			}
+		}
+		words = append(words, set)
+	}
+
+	score := 0
+	for _, term := range strings.Fields(strings.ToLower(text)) {
+		term = strings.Trim(term, `"`)
+		negated := strings.HasPrefix(term, "-")
+		term = strings.TrimPrefix(term, "-")
+		for i, set := range words {
+			if !set[term] {
+				continue
+			}
+			if negated {
+				return 0
+			}
+			score += textWeights[i].weight
+		}
+	}
+	return float64(score)
+}
+
+func splitWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,462 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var queryBase = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// queryFixtures are the logs every query case runs against. l4 belongs to another merchant
+// and must never be returned for m1.
+func queryFixtures() []*AuditLog {
+	return []*AuditLog{
+		{
+			ID: "l1", MerchantID: "m1", UserID: "u1", StoreID: "s1",
+			Action: "order.create", Entity: "order", EntityID: "o1",
+			Severity: "info", Result: "success", SourceService: "pos", CorrelationID: "c1",
+			Details: map[string]interface{}{
+				"payment": map[string]interface{}{"method": "card"},
+				"amount":  int64(12),
+				"vip":     true,
+			},
+			DetailsText:   []string{"card"},
+			ChangedFields: []string{"status"},
+			DurationMs:    100,
+			Timestamp:     queryBase,
+		},
+		{
+			ID: "l2", MerchantID: "m1", UserID: "u2", StoreID: "s2",
+			Action: "order.void", Entity: "order", EntityID: "o1",
+			Severity: "critical", Result: "failure", SourceService: "pos",
+			ErrorMessage: "drawer locked",
+			Details: map[string]interface{}{
+				"payment": map[string]interface{}{"method": "cash"},
+				"amount":  12.5,
+				"vip":     false,
+				"tags":    []interface{}{"a", "b"},
+			},
+			DetailsText:   []string{"cash", "a", "b"},
+			ChangedFields: []string{"status", "total"},
+			Timestamp:     queryBase.Add(time.Hour),
+		},
+		{
+			ID: "l3", MerchantID: "m1", UserID: "u1",
+			Action: "product.update", Entity: "product", EntityID: "p1",
+			Severity: "warning", SourceService: "catalog",
+			Details:     map[string]interface{}{"amount": "12"},
+			DetailsText: []string{"discount"},
+			DurationMs:  2500,
+			Timestamp:   queryBase.Add(2 * time.Hour),
+		},
+		{
+			ID: "l4", MerchantID: "m2", UserID: "u1",
+			Action: "order.create", Entity: "order", EntityID: "o9",
+			Severity:  "critical",
+			Details:   map[string]interface{}{"amount": int64(12)},
+			Timestamp: queryBase.Add(30 * time.Minute),
+		},
+	}
+}
+
+func int64Ptr(v int64) *int64 { return &v }
+
+func TestLogQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  LogQuery
+		filter bson.M
+		// want are the ids of merchant m1 matching the query, in listing order
+		want []string
+	}{
+		{
+			name:   "empty query",
+			query:  LogQuery{},
+			filter: bson.M{},
+			want:   []string{"l3", "l2", "l1"},
+		},
+		{
+			name:   "start date is inclusive",
+			query:  LogQuery{StartDate: queryBase.Add(time.Hour)},
+			filter: bson.M{"timestamp": bson.M{"$gte": queryBase.Add(time.Hour)}},
+			want:   []string{"l3", "l2"},
+		},
+		{
+			name:   "end date is inclusive",
+			query:  LogQuery{EndDate: queryBase.Add(time.Hour)},
+			filter: bson.M{"timestamp": bson.M{"$lte": queryBase.Add(time.Hour)}},
+			want:   []string{"l2", "l1"},
+		},
+		{
+			name:  "date range",
+			query: LogQuery{StartDate: queryBase.Add(time.Minute), EndDate: queryBase.Add(time.Hour)},
+			filter: bson.M{"timestamp": bson.M{
+				"$gte": queryBase.Add(time.Minute),
+				"$lte": queryBase.Add(time.Hour),
+			}},
+			want: []string{"l2"},
+		},
+		{
+			name:   "in",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldAction, Values: []string{"order.create", "order.void"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"action": bson.M{"$in": bson.A{"order.create", "order.void"}}}}},
+			want:   []string{"l2", "l1"},
+		},
+		{
+			name:   "nin",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldAction, Values: []string{"order.void"}, Not: true}}},
+			filter: bson.M{"$and": bson.A{bson.M{"action": bson.M{"$nin": bson.A{"order.void"}}}}},
+			want:   []string{"l3", "l1"},
+		},
+		{
+			name:   "nin matches logs without the field",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldStoreID, Values: []string{"s1"}, Not: true}}},
+			filter: bson.M{"$and": bson.A{bson.M{"store_id": bson.M{"$nin": bson.A{"s1"}}}}},
+			want:   []string{"l3", "l2"},
+		},
+		{
+			name:   "in does not match logs without the field",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldResult, Values: []string{"success", "failure"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"result": bson.M{"$in": bson.A{"success", "failure"}}}}},
+			want:   []string{"l2", "l1"},
+		},
+		{
+			name:   "prefix",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldAction, Prefixes: []string{"order."}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"action": bson.M{"$in": bson.A{primitive.Regex{Pattern: `^order\.`}}}}}},
+			want:   []string{"l2", "l1"},
+		},
+		{
+			name:  "prefix and value",
+			query: LogQuery{Conditions: []Condition{{Field: FieldAction, Values: []string{"product.update"}, Prefixes: []string{"order.v"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"action": bson.M{"$in": bson.A{
+				"product.update", primitive.Regex{Pattern: `^order\.v`},
+			}}}}},
+			want: []string{"l3", "l2"},
+		},
+		{
+			name:   "negated prefix",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldAction, Prefixes: []string{"order."}, Not: true}}},
+			filter: bson.M{"$and": bson.A{bson.M{"action": bson.M{"$nin": bson.A{primitive.Regex{Pattern: `^order\.`}}}}}},
+			want:   []string{"l3"},
+		},
+		{
+			name:   "prefix is literal",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldAction, Prefixes: []string{"order.*"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"action": bson.M{"$in": bson.A{primitive.Regex{Pattern: `^order\.\*`}}}}}},
+			want:   nil,
+		},
+		{
+			name:   "details string",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("payment.method"), Values: []string{"card"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.payment.method": bson.M{"$in": bson.A{"card"}}}}},
+			want:   []string{"l1"},
+		},
+		{
+			name:   "details number matches numbers and numeric strings",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("amount"), Values: []string{"12"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.amount": bson.M{"$in": bson.A{"12", float64(12)}}}}},
+			want:   []string{"l3", "l1"},
+		},
+		{
+			name:   "details float",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("amount"), Values: []string{"12.5"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.amount": bson.M{"$in": bson.A{"12.5", 12.5}}}}},
+			want:   []string{"l2"},
+		},
+		{
+			name:   "details true",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("vip"), Values: []string{"true"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.vip": bson.M{"$in": bson.A{"true", true}}}}},
+			want:   []string{"l1"},
+		},
+		{
+			name:   "details false",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("vip"), Values: []string{"false"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.vip": bson.M{"$in": bson.A{"false", false}}}}},
+			want:   []string{"l2"},
+		},
+		{
+			name:   "details negated number",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("amount"), Values: []string{"12"}, Not: true}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.amount": bson.M{"$nin": bson.A{"12", float64(12)}}}}},
+			want:   []string{"l2"},
+		},
+		{
+			name:   "details array element",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("tags"), Values: []string{"b"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.tags": bson.M{"$in": bson.A{"b"}}}}},
+			want:   []string{"l2"},
+		},
+		{
+			name:   "details prefix",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("payment.method"), Prefixes: []string{"ca"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.payment.method": bson.M{"$in": bson.A{primitive.Regex{Pattern: "^ca"}}}}}},
+			want:   []string{"l2", "l1"},
+		},
+		{
+			name:   "prefix does not match numbers",
+			query:  LogQuery{Conditions: []Condition{{Field: DetailsField("amount"), Prefixes: []string{"1"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"details.amount": bson.M{"$in": bson.A{primitive.Regex{Pattern: "^1"}}}}}},
+			want:   []string{"l3"},
+		},
+		{
+			name:   "changed field",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldChangedFields, Values: []string{"total"}}}},
+			filter: bson.M{"$and": bson.A{bson.M{"changed_fields": bson.M{"$in": bson.A{"total"}}}}},
+			want:   []string{"l2"},
+		},
+		{
+			name:   "negated changed field",
+			query:  LogQuery{Conditions: []Condition{{Field: FieldChangedFields, Values: []string{"total"}, Not: true}}},
+			filter: bson.M{"$and": bson.A{bson.M{"changed_fields": bson.M{"$nin": bson.A{"total"}}}}},
+			want:   []string{"l3", "l1"},
+		},
+		{
+			name: "conditions on several fields",
+			query: LogQuery{Conditions: []Condition{
+				{Field: FieldUserID, Values: []string{"u1"}},
+				{Field: FieldEntity, Values: []string{"order"}},
+			}},
+			filter: bson.M{"$and": bson.A{
+				bson.M{"user_id": bson.M{"$in": bson.A{"u1"}}},
+				bson.M{"entity": bson.M{"$in": bson.A{"order"}}},
+			}},
+			want: []string{"l1"},
+		},
+		{
+			name: "conditions on one field",
+			query: LogQuery{Conditions: []Condition{
+				{Field: FieldAction, Prefixes: []string{"order."}},
+				{Field: FieldAction, Values: []string{"order.create"}, Not: true},
+			}},
+			filter: bson.M{"$and": bson.A{
+				bson.M{"action": bson.M{"$in": bson.A{primitive.Regex{Pattern: `^order\.`}}}},
+				bson.M{"action": bson.M{"$nin": bson.A{"order.create"}}},
+			}},
+			want: []string{"l2"},
+		},
+		{
+			name:   "min duration excludes logs without one",
+			query:  LogQuery{MinDurationMs: int64Ptr(100)},
+			filter: bson.M{"duration_ms": bson.M{"$gte": int64(100)}},
+			want:   []string{"l3", "l1"},
+		},
+		{
+			name:   "max duration excludes logs without one",
+			query:  LogQuery{MaxDurationMs: int64Ptr(1000)},
+			filter: bson.M{"duration_ms": bson.M{"$lte": int64(1000)}},
+			want:   []string{"l1"},
+		},
+		{
+			name:   "duration range",
+			query:  LogQuery{MinDurationMs: int64Ptr(101), MaxDurationMs: int64Ptr(2500)},
+			filter: bson.M{"duration_ms": bson.M{"$gte": int64(101), "$lte": int64(2500)}},
+			want:   []string{"l3"},
+		},
+		{
+			name:   "text",
+			query:  LogQuery{Text: "locked"},
+			filter: bson.M{"$text": bson.M{"$search": "locked"}},
+			want:   []string{"l2"},
+		},
+		{
+			name:   "text in details",
+			query:  LogQuery{Text: "Discount"},
+			filter: bson.M{"$text": bson.M{"$search": "Discount"}},
+			want:   []string{"l3"},
+		},
+		{
+			name:   "text with a negated term",
+			query:  LogQuery{Text: "order -locked"},
+			filter: bson.M{"$text": bson.M{"$search": "order -locked"}},
+			want:   []string{"l1"},
+		},
+		{
+			name: "everything combined",
+			query: LogQuery{
+				Conditions: []Condition{
+					{Field: FieldAction, Prefixes: []string{"order."}},
+					{Field: FieldSeverity, Values: []string{"critical"}},
+					{Field: DetailsField("payment.method"), Values: []string{"cash"}},
+				},
+				StartDate: queryBase,
+				EndDate:   queryBase.Add(time.Hour),
+				Text:      "drawer",
+			},
+			filter: bson.M{
+				"$and": bson.A{
+					bson.M{"action": bson.M{"$in": bson.A{primitive.Regex{Pattern: `^order\.`}}}},
+					bson.M{"severity": bson.M{"$in": bson.A{"critical"}}},
+					bson.M{"details.payment.method": bson.M{"$in": bson.A{"cash"}}},
+				},
+				"timestamp": bson.M{"$gte": queryBase, "$lte": queryBase.Add(time.Hour)},
+				"$text":     bson.M{"$search": "drawer"},
+			},
+			want: []string{"l2"},
+		},
+	}
+
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	fixtures := queryFixtures()
+	for _, log := range fixtures {
+		if err := repo.CreateAuditLog(ctx, log); err != nil {
+			t.Fatalf("create %s: %v", log.ID, err)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.query.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			if got := tt.query.filter(); !reflect.DeepEqual(got, tt.filter) {
+				t.Errorf("filter() = %#v, want %#v", got, tt.filter)
+			}
+
+			var matched []string
+			for _, log := range fixtures {
+				if log.MerchantID == "m1" && tt.query.Matches(log) {
+					matched = append(matched, log.ID)
+				}
+			}
+			if want := sortedCopy(tt.want); !reflect.DeepEqual(matched, want) {
+				t.Errorf("Matches() selected %v, want %v", matched, want)
+			}
+
+			page, err := repo.ListAuditLogs(ctx, MerchantScope("m1"), &tt.query, ListOptions{PageSize: 10, Total: TotalExact})
+			if err != nil {
+				t.Fatalf("ListAuditLogs() = %v", err)
+			}
+			if got := logIDs(page.Logs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListAuditLogs() = %v, want %v", got, tt.want)
+			}
+			if page.Total != int64(len(tt.want)) {
+				t.Errorf("Total = %d, want %d", page.Total, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestLogQueryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		query LogQuery
+	}{
+		{"unknown field", LogQuery{Conditions: []Condition{{Field: "ip_address", Values: []string{"x"}}}}},
+		{"operator in details path", LogQuery{Conditions: []Condition{{Field: DetailsField("$where"), Values: []string{"x"}}}}},
+		{"details path too deep", LogQuery{Conditions: []Condition{{Field: DetailsField("a.b.c.d.e.f.g.h.i"), Values: []string{"x"}}}}},
+		{"no values", LogQuery{Conditions: []Condition{{Field: FieldAction}}}},
+		{"empty prefix", LogQuery{Conditions: []Condition{{Field: FieldAction, Prefixes: []string{""}}}}},
+		{"end before start", LogQuery{StartDate: queryBase, EndDate: queryBase.Add(-time.Second)}},
+		{"max below min duration", LogQuery{MinDurationMs: int64Ptr(10), MaxDurationMs: int64Ptr(9)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.query.Validate(); !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("Validate() = %v, want ErrInvalidQuery", err)
+			}
+			_, err := NewMemoryRepository().ListAuditLogs(context.Background(), MerchantScope("m1"), &tt.query, ListOptions{PageSize: 10})
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("ListAuditLogs() = %v, want ErrInvalidQuery", err)
+			}
+		})
+	}
+}
+
+func TestLogQueryCursor(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	// c and d share a timestamp, their order falls back to the id
+	logs := []*AuditLog{
+		{ID: "a", MerchantID: "m1", Action: "order.create", Timestamp: queryBase},
+		{ID: "b", MerchantID: "m1", Action: "order.void", Timestamp: queryBase.Add(time.Minute)},
+		{ID: "c", MerchantID: "m1", Action: "order.create", Timestamp: queryBase.Add(2 * time.Minute)},
+		{ID: "d", MerchantID: "m1", Action: "order.create", Timestamp: queryBase.Add(2 * time.Minute)},
+		{ID: "e", MerchantID: "m1", Action: "order.create", Timestamp: queryBase.Add(3 * time.Minute)},
+		{ID: "x", MerchantID: "m2", Action: "order.create", Timestamp: queryBase.Add(2 * time.Minute)},
+	}
+	for _, log := range logs {
+		if err := repo.CreateAuditLog(ctx, log); err != nil {
+			t.Fatalf("create %s: %v", log.ID, err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query LogQuery
+		want  []string
+	}{
+		{"all", LogQuery{}, []string{"e", "d", "c", "b", "a"}},
+		{"filtered", LogQuery{Conditions: []Condition{{Field: FieldAction, Values: []string{"order.create"}}}}, []string{"e", "d", "c", "a"}},
+		{"bounded", LogQuery{StartDate: queryBase.Add(time.Minute), EndDate: queryBase.Add(2 * time.Minute)}, []string{"d", "c", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			var after *LogCursor
+			for pages := 0; ; pages++ {
+				if pages > len(logs) {
+					t.Fatalf("pagination did not end, got %v", got)
+				}
+				page, err := repo.ListAuditLogs(ctx, MerchantScope("m1"), &tt.query, ListOptions{PageSize: 2, After: after})
+				if err != nil {
+					t.Fatalf("ListAuditLogs() = %v", err)
+				}
+				got = append(got, logIDs(page.Logs)...)
+				if page.Next == nil {
+					break
+				}
+				last := page.Logs[len(page.Logs)-1]
+				if page.Next.ID != last.ID || !page.Next.Timestamp.Equal(last.Timestamp) {
+					t.Fatalf("Next = %+v, want the last log %s", page.Next, last.ID)
+				}
+				after = page.Next
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	cursor := &LogCursor{Timestamp: queryBase, ID: "c"}
+	wantDesc := bson.M{"$or": bson.A{
+		bson.M{"timestamp": bson.M{"$lt": queryBase}},
+		bson.M{"timestamp": queryBase, "_id": bson.M{"$lt": "c"}},
+	}}
+	if got := seekAfter(cursor, false); !reflect.DeepEqual(got, wantDesc) {
+		t.Errorf("seekAfter(descending) = %#v, want %#v", got, wantDesc)
+	}
+	wantAsc := bson.M{"$or": bson.A{
+		bson.M{"timestamp": bson.M{"$gt": queryBase}},
+		bson.M{"timestamp": queryBase, "_id": bson.M{"$gt": "c"}},
+	}}
+	if got := seekAfter(cursor, true); !reflect.DeepEqual(got, wantAsc) {
+		t.Errorf("seekAfter(ascending) = %#v, want %#v", got, wantAsc)
+	}
+}
+
+func logIDs(logs []AuditLog) []string {
+	var ids []string
+	for _, log := range logs {
+		ids = append(ids, log.ID)
+	}
+	return ids
+}
+
+func sortedCopy(ids []string) []string {
+	if ids == nil {
+		return nil
+	}
+	out := append([]string(nil), ids...)
+	sort.Strings(out)
+	return out
+}
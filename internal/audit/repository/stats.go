@@ -0,0 +1,300 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Time buckets of an aggregation
+const (
+	BucketNone = ""
+	BucketHour = "hour"
+	BucketDay  = "day"
+	BucketWeek = "week" // weeks start on Monday
+)
+
+// MaxStatsRows bounds the rows of an aggregation, more groups mark the result as truncated
+const MaxStatsRows = 5000
+
+// statsGroupFields are the fields an aggregation can group by
+var statsGroupFields = map[Field]bool{
+	FieldAction:        true,
+	FieldEntity:        true,
+	FieldUserID:        true,
+	FieldStoreID:       true,
+	FieldSeverity:      true,
+	FieldResult:        true,
+	FieldSourceService: true,
+}
+
+// StatsSpec describes how matching logs are grouped
+type StatsSpec struct {
+	GroupBy  []Field
+	Bucket   string
+	Location *time.Location // buckets start at midnight in this location, UTC when nil
+}
+
+// StatsRow holds the metrics of one group in one time bucket
+type StatsRow struct {
+	// Bucket is the start of the time bucket, zero without bucketing
+	Bucket time.Time
+	// Keys are the values of the grouped fields
+	Keys     map[Field]string
+	Count    int64
+	Failures int64
+	Partials int64
+	// Duration metrics only cover logs that report a duration, they are nil when none do
+	AvgDurationMs *float64
+	P50DurationMs *float64
+	P90DurationMs *float64
+	P99DurationMs *float64
+}
+
+type StatsResult struct {
+	// Rows are ordered by bucket, then by descending count
+	Rows      []StatsRow
+	Truncated bool
+}
+
+// ErrInvalidStatsSpec is returned for a StatsSpec that fails validation
+var ErrInvalidStatsSpec = errors.New("invalid audit stats spec")
+
+// Validate checks the grouped fields and the bucket size
+func (s *StatsSpec) Validate() error {
+	seen := make(map[Field]bool)
+	for _, f := range s.GroupBy {
+		if !statsGroupFields[f] {
+			return fmt.Errorf("%w: cannot group by %q", ErrInvalidStatsSpec, f)
+		}
+		if seen[f] {
+			return fmt.Errorf("%w: %s is grouped by twice", ErrInvalidStatsSpec, f)
+		}
+		seen[f] = true
+	}
+	switch s.Bucket {
+	case BucketNone, BucketHour, BucketDay, BucketWeek:
+	default:
+		return fmt.Errorf("%w: unknown bucket %q", ErrInvalidStatsSpec, s.Bucket)
+	}
+	return nil
+}
+
+func (s *StatsSpec) location() *time.Location {
+	if s.Location == nil {
+		return time.UTC
+	}
+	return s.Location
+}
+
+// statsPercentiles are the duration percentiles reported per row
+var statsPercentiles = bson.A{0.5, 0.9, 0.99}
+
+// statsDoc is a row as returned by the aggregation
+type statsDoc struct {
+	ID          bson.M     `bson:"_id"`
+	Count       int64      `bson:"count"`
+	Failures    int64      `bson:"failures"`
+	Partials    int64      `bson:"partials"`
+	AvgDuration *float64   `bson:"avg_duration"`
+	Percentiles []*float64 `bson:"percentiles"`
+}
+
+// AggregateStats groups the matching logs. Percentiles use $percentile, which needs MongoDB 7.0.
+func (r *mongoRepository) AggregateStats(ctx context.Context, scope TenantScope, q *LogQuery, spec StatsSpec) (*StatsResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	match := q.filter()
+	if err := scope.apply(match); err != nil {
+		return nil, err
+	}
+
+	group := bson.M{}
+	for _, f := range spec.GroupBy {
+		group[string(f)] = "$" + string(f)
+	}
+	if spec.Bucket != BucketNone {
+		trunc := bson.M{
+			"date":     "$timestamp",
+			"unit":     spec.Bucket,
+			"timezone": spec.location().String(),
+		}
+		if spec.Bucket == BucketWeek {
+			trunc["startOfWeek"] = "monday"
+		}
+		group["bucket"] = bson.M{"$dateTrunc": trunc}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          group,
+			"count":        bson.M{"$sum": 1},
+			"failures":     bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$result", "failure"}}, 1, 0}}},
+			"partials":     bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$result", "partial"}}, 1, 0}}},
+			"avg_duration": bson.M{"$avg": "$duration_ms"},
+			"percentiles": bson.M{"$percentile": bson.M{
+				"input":  "$duration_ms",
+				"p":      statsPercentiles,
+				"method": "approximate",
+			}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.bucket", Value: 1}, {Key: "count", Value: -1}}}},
+		{{Key: "$limit", Value: MaxStatsRows + 1}},
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []statsDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	res := &StatsResult{}
+	if len(docs) > MaxStatsRows {
+		docs = docs[:MaxStatsRows]
+		res.Truncated = true
+	}
+	res.Rows = make([]StatsRow, len(docs))
+	for i, d := range docs {
+		row := StatsRow{
+			Keys:          make(map[Field]string, len(spec.GroupBy)),
+			Count:         d.Count,
+			Failures:      d.Failures,
+			Partials:      d.Partials,
+			AvgDurationMs: d.AvgDuration,
+		}
+		for _, f := range spec.GroupBy {
+			row.Keys[f], _ = d.ID[string(f)].(string)
+		}
+		if bucket, ok := d.ID["bucket"].(primitive.DateTime); ok {
+			row.Bucket = bucket.Time().UTC()
+		}
+		if len(d.Percentiles) == len(statsPercentiles) {
+			row.P50DurationMs, row.P90DurationMs, row.P99DurationMs = d.Percentiles[0], d.Percentiles[1], d.Percentiles[2]
+		}
+		res.Rows[i] = row
+	}
+	return res, nil
+}
+
+func (r *memoryRepository) AggregateStats(ctx context.Context, scope TenantScope, q *LogQuery, spec StatsSpec) (*StatsResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	logs, err := r.find(scope, q.Matches)
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		row       StatsRow
+		durations []float64
+	}
+	groups := make(map[string]*group)
+	for i := range logs {
+		log := &logs[i]
+		bucket := truncateTime(log.Timestamp, spec.Bucket, spec.location())
+		keys := make(map[Field]string, len(spec.GroupBy))
+		id := []string{bucket.String()}
+		for _, f := range spec.GroupBy {
+			values := fieldValues(log, f)
+			if len(values) > 0 {
+				keys[f], _ = values[0].(string)
+			}
+			id = append(id, keys[f])
+		}
+
+		key := strings.Join(id, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &group{row: StatsRow{Bucket: bucket, Keys: keys}}
+			groups[key] = g
+		}
+		g.row.Count++
+		switch log.Result {
+		case "failure":
+			g.row.Failures++
+		case "partial":
+			g.row.Partials++
+		}
+		if log.DurationMs != 0 {
+			g.durations = append(g.durations, float64(log.DurationMs))
+		}
+	}
+
+	res := &StatsResult{}
+	for _, g := range groups {
+		if n := len(g.durations); n > 0 {
+			sort.Float64s(g.durations)
+			sum := 0.0
+			for _, d := range g.durations {
+				sum += d
+			}
+			avg := sum / float64(n)
+			g.row.AvgDurationMs = &avg
+			g.row.P50DurationMs = percentile(g.durations, 0.5)
+			g.row.P90DurationMs = percentile(g.durations, 0.9)
+			g.row.P99DurationMs = percentile(g.durations, 0.99)
+		}
+		res.Rows = append(res.Rows, g.row)
+	}
+	sort.Slice(res.Rows, func(i, j int) bool {
+		if !res.Rows[i].Bucket.Equal(res.Rows[j].Bucket) {
+			return res.Rows[i].Bucket.Before(res.Rows[j].Bucket)
+		}
+		return res.Rows[i].Count > res.Rows[j].Count
+	})
+	if len(res.Rows) > MaxStatsRows {
+		res.Rows = res.Rows[:MaxStatsRows]
+		res.Truncated = true
+	}
+	return res, nil
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) *float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	v := sorted[rank]
+	return &v
+}
+
+// truncateTime returns the start of the bucket t falls in, zero without bucketing
+func truncateTime(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	var start time.Time
+	switch bucket {
+	case BucketHour:
+		start = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case BucketDay:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	case BucketWeek:
+		offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+		start = time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, loc)
+	default:
+		return time.Time{}
+	}
+	return start.UTC()
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TenantScope restricts a read to one merchant, and optionally to one of its stores or users.
+// Reads across all merchants must be requested explicitly with AllMerchants, which only
+// platform administrators get.
+type TenantScope struct {
+	MerchantID   string `bson:"merchant_id,omitempty" json:"merchant_id,omitempty"`
+	StoreID      string `bson:"store_id,omitempty" json:"store_id,omitempty"`
+	UserID       string `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	AllMerchants bool   `bson:"all_merchants,omitempty" json:"all_merchants,omitempty"`
+}
+
+// ErrUnscopedQuery is returned when a read has neither a merchant nor AllMerchants set
+var ErrUnscopedQuery = errors.New("query is not scoped to a merchant")
+
+// MerchantScope scopes a read to a single merchant
+func MerchantScope(merchantID string) TenantScope {
+	return TenantScope{MerchantID: merchantID}
+}
+
+// apply adds the scope's conditions to a query, replacing any the query already has
+func (s TenantScope) apply(query bson.M) error {
+	switch {
+	case s.MerchantID != "":
+		query["merchant_id"] = s.MerchantID
+		if s.StoreID != "" {
+			query["store_id"] = s.StoreID
+		}
+		if s.UserID != "" {
+			query["user_id"] = s.UserID
+		}
+	case s.AllMerchants:
+		delete(query, "merchant_id")
+	default:
+		return ErrUnscopedQuery
+	}
+	return nil
+}
+
+// requireMerchant rejects reads that name no merchant
+func requireMerchant(merchantID string) error {
+	if merchantID == "" {
+		return ErrUnscopedQuery
+	}
+	return nil
+}
+
+// check rejects a scope that names neither a merchant nor all merchants
+func (s TenantScope) check() error {
+	if s.MerchantID == "" && !s.AllMerchants {
+		return ErrUnscopedQuery
+	}
+	return nil
+}
+
+// Contains reports whether a log is inside the scope, the in-memory counterpart of apply
+func (s TenantScope) Contains(log *AuditLog) bool {
+	if s.MerchantID == "" {
+		return s.AllMerchants
+	}
+	return log.MerchantID == s.MerchantID &&
+		(s.StoreID == "" || log.StoreID == s.StoreID) &&
+		(s.UserID == "" || log.UserID == s.UserID)
+}
+
+// Covers reports whether everything visible to other is visible to s as well
+func (s TenantScope) Covers(other TenantScope) bool {
+	if s.AllMerchants {
+		return true
+	}
+	return s.MerchantID != "" && other.MerchantID == s.MerchantID &&
+		(s.StoreID == "" || other.StoreID == s.StoreID) &&
+		(s.UserID == "" || other.UserID == s.UserID)
+}
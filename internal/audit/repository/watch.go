@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Server error codes of change streams
+const (
+	changeStreamNotSupportedCode = 40573 // standalone servers have no oplog
+	changeStreamHistoryLostCode  = 286
+)
+
+// ErrChangeStreamsUnsupported is returned by WatchAuditLogs when the server has no change streams,
+// e.g. a standalone MongoDB or the in-memory repository
+var ErrChangeStreamsUnsupported = errors.New("change streams are not supported")
+
+// ErrWatchHistoryLost is returned when a resume token is older than the server's oplog
+var ErrWatchHistoryLost = errors.New("watch resume point is no longer available")
+
+// ErrInvalidWatchToken is returned for a resume token this repository did not issue
+var ErrInvalidWatchToken = errors.New("invalid watch resume token")
+
+// changeEvent is the part of a change stream event WatchAuditLogs reads
+type changeEvent struct {
+	FullDocument AuditLog `bson:"fullDocument"`
+}
+
+// WatchAuditLogs calls fn for every log inserted in the scope with an opaque token to resume
+// after it. It resumes after resumeToken when one is given and runs until ctx is done or fn fails.
+func (r *mongoRepository) WatchAuditLogs(ctx context.Context, scope TenantScope, resumeToken string, fn func(log *AuditLog, token string) error) error {
+	match := bson.M{}
+	if err := scope.apply(match); err != nil {
+		return err
+	}
+	stage := bson.M{"operationType": "insert"}
+	for field, value := range match {
+		stage["fullDocument."+field] = value
+	}
+
+	opts := options.ChangeStream()
+	if resumeToken != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(resumeToken)
+		if err != nil || bson.Raw(raw).Validate() != nil {
+			return ErrInvalidWatchToken
+		}
+		opts.SetStartAfter(bson.Raw(raw))
+	}
+
+	stream, err := r.collection.Watch(ctx, mongo.Pipeline{{{Key: "$match", Value: stage}}}, opts)
+	if err != nil {
+		return watchError(err)
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event changeEvent
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+		token := base64.RawURLEncoding.EncodeToString(stream.ResumeToken())
+		if err := fn(&event.FullDocument, token); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return watchError(stream.Err())
+}
+
+func watchError(err error) error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		switch {
+		case serverErr.HasErrorCode(changeStreamNotSupportedCode):
+			return ErrChangeStreamsUnsupported
+		case serverErr.HasErrorCode(changeStreamHistoryLostCode):
+			return ErrWatchHistoryLost
+		}
+	}
+	return err
+}
+
+func (r *memoryRepository) WatchAuditLogs(ctx context.Context, scope TenantScope, resumeToken string, fn func(log *AuditLog, token string) error) error {
+	return ErrChangeStreamsUnsupported
+}
@@ -0,0 +1,211 @@
+// Package rules evaluates merchant-defined alert rules against stored audit logs.
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// Firing is a rule firing on a log
+type Firing struct {
+	Rule     *repository.AlertRule
+	GroupKey string
+	Count    int64
+	// LogIDs are the most recent logs in the window, oldest first
+	LogIDs  []string
+	First   time.Time
+	Last    time.Time
+	Message string
+}
+
+// Store keeps the threshold windows and firings of rule groups. It is shared by every instance
+// evaluating rules, see repository.AlertRepository.
+type Store interface {
+	AddToWindow(ctx context.Context, rule *repository.AlertRule, groupKey, logID string, at time.Time) (*repository.RuleWindow, error)
+	ClaimFiring(ctx context.Context, ruleID, groupKey string, at time.Time, next repository.RuleGroupState) (bool, error)
+}
+
+// Engine evaluates rules against logs. Windows are kept in event time, so a replayed backlog
+// fires as it would have live. A threshold window that fires starts over with its next bucket.
+type Engine struct {
+	store Store
+}
+
+func NewEngine(store Store) *Engine {
+	return &Engine{store: store}
+}
+
+// Evaluate returns the rules that fire on log. rules are the enabled rules of the log's merchant.
+// Rules whose state could not be read or written are skipped and reported in the error.
+func (e *Engine) Evaluate(ctx context.Context, rules []repository.AlertRule, log *repository.AuditLog) ([]Firing, error) {
+	var firings []Firing
+	var errs []error
+	for i := range rules {
+		rule := &rules[i]
+		if rule.MerchantID != log.MerchantID || !rule.Query.Matches(log) {
+			continue
+		}
+		changeMsg := ""
+		if rule.Change != nil {
+			pct, ok := changePercent(log, rule.Change.Field)
+			if !ok || pct < rule.Change.MinPercent {
+				continue
+			}
+			changeMsg = fmt.Sprintf("%s changed by %s%%", rule.Change.Field, strconv.FormatFloat(pct, 'f', 1, 64))
+		}
+
+		f := Firing{
+			Rule:   rule,
+			Count:  1,
+			LogIDs: []string{log.ID},
+			First:  log.Timestamp,
+			Last:   log.Timestamp,
+		}
+		fire, err := e.check(ctx, rule, log, &f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", rule.ID, err))
+			continue
+		}
+		if !fire {
+			continue
+		}
+
+		f.Message = message(rule, log, &f, changeMsg)
+		firings = append(firings, f)
+	}
+	return firings, errors.Join(errs...)
+}
+
+// check counts log in the rule's threshold window and claims the firing when the window went
+// above the count and the group is not suppressed
+func (e *Engine) check(ctx context.Context, rule *repository.AlertRule, log *repository.AuditLog, f *Firing) (bool, error) {
+	t := rule.Threshold
+	if t == nil && rule.Suppression <= 0 {
+		return true, nil
+	}
+
+	keep := rule.Suppression
+	next := repository.RuleGroupState{}
+	if t != nil {
+		f.GroupKey = groupKey(t.GroupBy, log)
+		w, err := e.store.AddToWindow(ctx, rule, f.GroupKey, log.ID, log.Timestamp)
+		if err != nil {
+			return false, err
+		}
+		if w.Count <= t.Count {
+			return false, nil
+		}
+		f.Count, f.LogIDs, f.First, f.Last = w.Count, w.LogIDs, w.First, w.Last
+
+		size := t.BucketSize()
+		next.ResetAt = log.Timestamp.Truncate(size).Add(size)
+		keep = max(keep, t.Window+size)
+	}
+	if rule.Suppression > 0 {
+		next.SuppressedUntil = log.Timestamp.Add(rule.Suppression)
+	}
+	next.ExpiresAt = time.Now().UTC().Add(keep)
+	return e.store.ClaimFiring(ctx, rule.ID, f.GroupKey, log.Timestamp, next)
+}
+
+// groupKey names a threshold group, e.g. "user_id=42,store_id=7"
+func groupKey(fields []repository.Field, log *repository.AuditLog) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = string(f) + "=" + fieldValue(log, f)
+	}
+	return strings.Join(parts, ",")
+}
+
+func fieldValue(log *repository.AuditLog, f repository.Field) string {
+	switch f {
+	case repository.FieldUserID:
+		return log.UserID
+	case repository.FieldEntity:
+		return log.Entity
+	case repository.FieldEntityID:
+		return log.EntityID
+	case repository.FieldAction:
+		return log.Action
+	case repository.FieldStoreID:
+		return log.StoreID
+	case repository.FieldSeverity:
+		return log.Severity
+	case repository.FieldResult:
+		return log.Result
+	case repository.FieldSourceService:
+		return log.SourceService
+	}
+	return ""
+}
+
+// changePercent returns by how many percent a numeric snapshot field changed. A change away
+// from zero counts as infinite.
+func changePercent(log *repository.AuditLog, path string) (float64, bool) {
+	old, ok := number(log.OldValue, path)
+	if !ok {
+		return 0, false
+	}
+	new, ok := number(log.NewValue, path)
+	if !ok {
+		return 0, false
+	}
+	if old == 0 {
+		if new == 0 {
+			return 0, true
+		}
+		return math.Inf(1), true
+	}
+	return math.Abs(new-old) / math.Abs(old) * 100, true
+}
+
+// number looks up a dotted path in a snapshot, numeric strings such as decimals count as numbers
+func number(snapshot map[string]interface{}, path string) (float64, bool) {
+	var v interface{} = jsonvalue.Normalize(snapshot)
+	for _, part := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		if v, ok = m[part]; !ok {
+			return 0, false
+		}
+	}
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func message(rule *repository.AlertRule, log *repository.AuditLog, f *Firing, change string) string {
+	var b strings.Builder
+	if rule.Threshold != nil {
+		fmt.Fprintf(&b, "%d logs matched %q within %s", f.Count, rule.Name, rule.Threshold.Window)
+		if f.GroupKey != "" {
+			fmt.Fprintf(&b, " for %s", f.GroupKey)
+		}
+	} else {
+		fmt.Fprintf(&b, "%s matched %q", log.Action, rule.Name)
+	}
+	if change != "" {
+		fmt.Fprintf(&b, ", %s", change)
+	}
+	if log.Entity != "" {
+		fmt.Fprintf(&b, " on %s %s", log.Entity, log.EntityID)
+	}
+	return b.String()
+}
@@ -0,0 +1,564 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/rules"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
+	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Limits on alert rules
+const (
+	maxAlertRules         = 100
+	maxRuleNameLength     = 100
+	maxRuleDescLength     = 1000
+	maxRuleThresholdCount = 10000
+	maxRuleWindow         = 24 * time.Hour
+	maxRuleSuppression    = 7 * 24 * time.Hour
+	maxRuleGroupBy        = 3
+)
+
+// ErrAlertRuleLimit is returned when a merchant already has the maximum number of rules
+var ErrAlertRuleLimit = fmt.Errorf("a merchant may have at most %d alert rules", maxAlertRules)
+
+// Defaults for AlertConfig values that are not positive
+const defaultAlertRefreshInterval = 30 * time.Second
+
+// Evaluation cursors
+const (
+	// alertCursorLease is how long an instance holds a merchant's cursor without advancing it
+	alertCursorLease = time.Minute
+	// alertCursorBatch is how many logs are evaluated between cursor updates, at most this many
+	// are evaluated again after a crash
+	alertCursorBatch = 100
+	// maxAlertBacklog bounds the logs a merchant catches up on, older ones are skipped
+	maxAlertBacklog = 100000
+)
+
+type AlertConfig struct {
+	// RefreshInterval is how often rules changed by other instances are picked up and every
+	// merchant with rules catches up on logs not evaluated yet
+	RefreshInterval time.Duration
+}
+
+type AlertRuleInput struct {
+	// MerchantID names the merchant when a platform administrator creates a rule
+	MerchantID  string
+	Name        string
+	Description string
+	Enabled     bool
+	// Filters select the logs the rule looks at, see ListAuditLogsInput.Filters
+	Filters       []FieldFilter
+	MinDurationMs *int64
+	MaxDurationMs *int64
+	Threshold     *RuleThresholdInput
+	Change        *RuleChangeInput
+	// Severity is info, warning or critical, warning when empty
+	Severity    string
+	Suppression time.Duration
+}
+
+// RuleThresholdInput fires when more than Count matching logs fall within Window
+type RuleThresholdInput struct {
+	Count  int64
+	Window time.Duration
+	// GroupBy counts separately per action, entity, user_id, store_id, severity, result or source_service
+	GroupBy []string
+}
+
+// RuleChangeInput matches logs whose old_value and new_value differ in Field by at least MinPercent
+type RuleChangeInput struct {
+	Field      string
+	MinPercent float64
+}
+
+type ListAlertsInput struct {
+	MerchantID string
+	RuleID     string
+	Severity   string
+	Page       int32
+	PageSize   int32
+}
+
+type AlertUseCase interface {
+	AppendObserver
+	// Run evaluates appended logs against the rules until ctx is done
+	Run(ctx context.Context)
+	CreateAlertRule(ctx context.Context, input *AlertRuleInput) (*repository.AlertRule, error)
+	GetAlertRule(ctx context.Context, id string) (*repository.AlertRule, error)
+	ListAlertRules(ctx context.Context, merchantID string) ([]repository.AlertRule, error)
+	// UpdateAlertRule replaces the rule's settings, its merchant cannot change
+	UpdateAlertRule(ctx context.Context, id string, input *AlertRuleInput) (*repository.AlertRule, error)
+	DeleteAlertRule(ctx context.Context, id string) error
+	ListAlerts(ctx context.Context, input *ListAlertsInput) ([]repository.Alert, int32, error)
+	// QueueDepth returns the number of merchants with logs waiting for evaluation
+	QueueDepth() int
+}
+
+type alertUseCase struct {
+	repo      repository.AlertRepository
+	logs      repository.Repository
+	cfg       AlertConfig
+	logger    logger.ZapLogger
+	observers []AlertObserver
+	owner     string // identifies this instance on the cursors it leases
+	reload    chan struct{}
+	wake      chan struct{}
+
+	pendingMu sync.Mutex
+	pending   map[string]int64 // merchants to catch up, by the first sequence appended or 0
+
+	// engine and rules are only used by the Run goroutine
+	engine *rules.Engine
+	rules  map[string][]repository.AlertRule // enabled rules by merchant
+}
+
+// NewAlertUseCase creates the alert use case. Logs are read from logs in sequence order, behind
+// a cursor per merchant, so that none is missed across restarts. observers are told about every
+// alert stored.
+func NewAlertUseCase(repo repository.AlertRepository, logs repository.Repository, cfg AlertConfig, logger logger.ZapLogger, observers ...AlertObserver) AlertUseCase {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultAlertRefreshInterval
+	}
+	return &alertUseCase{
+		repo:      repo,
+		logs:      logs,
+		cfg:       cfg,
+		logger:    logger,
+		observers: observers,
+		owner:     uuid.New().String(),
+		reload:    make(chan struct{}, 1),
+		wake:      make(chan struct{}, 1),
+		pending:   make(map[string]int64),
+		engine:    rules.NewEngine(repo),
+		rules:     make(map[string][]repository.AlertRule),
+	}
+}
+
+// LogAppended marks the log's merchant for evaluation without blocking the write path
+func (uc *alertUseCase) LogAppended(log *repository.AuditLog) {
+	if log.Sequence <= 0 {
+		return
+	}
+	uc.pendingMu.Lock()
+	if first, ok := uc.pending[log.MerchantID]; !ok || (first > 0 && log.Sequence < first) {
+		uc.pending[log.MerchantID] = log.Sequence
+	}
+	uc.pendingMu.Unlock()
+
+	select {
+	case uc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (uc *alertUseCase) QueueDepth() int {
+	uc.pendingMu.Lock()
+	defer uc.pendingMu.Unlock()
+	return len(uc.pending)
+}
+
+func (uc *alertUseCase) Run(ctx context.Context) {
+	uc.loadRules(ctx)
+	// Catch up on what was stored while no instance was evaluating
+	uc.markRuleMerchants()
+	ticker := time.NewTicker(uc.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		uc.catchUp(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-uc.wake:
+		case <-uc.reload:
+			uc.loadRules(ctx)
+		case <-ticker.C:
+			uc.loadRules(ctx)
+			// Picks up merchants whose evaluation failed or whose cursor another instance
+			// left behind
+			uc.markRuleMerchants()
+		}
+	}
+}
+
+// markRuleMerchants marks every merchant with rules for catching up
+func (uc *alertUseCase) markRuleMerchants() {
+	uc.pendingMu.Lock()
+	defer uc.pendingMu.Unlock()
+	for merchantID := range uc.rules {
+		if _, ok := uc.pending[merchantID]; !ok {
+			uc.pending[merchantID] = 0
+		}
+	}
+}
+
+// catchUp evaluates the logs after the cursor of every pending merchant
+func (uc *alertUseCase) catchUp(ctx context.Context) {
+	uc.pendingMu.Lock()
+	pending := uc.pending
+	uc.pending = make(map[string]int64)
+	uc.pendingMu.Unlock()
+
+	for merchantID, first := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		if len(uc.rules[merchantID]) == 0 {
+			continue
+		}
+		if err := uc.evaluateMerchant(ctx, merchantID, first); err != nil && ctx.Err() == nil {
+			// The merchant is marked again on the next refresh
+			uc.logger.Error("Failed to evaluate alert rules", zap.Error(err), zap.String("merchant_id", merchantID))
+		}
+	}
+}
+
+// evaluateMerchant evaluates the merchant's logs after its cursor, up to the current chain head.
+// first is the first sequence appended since the last catch up, a merchant without a cursor
+// starts there or at the head when it is 0.
+func (uc *alertUseCase) evaluateMerchant(ctx context.Context, merchantID string, first int64) error {
+	head, err := uc.logs.GetChainHead(ctx, merchantID)
+	if err != nil {
+		return err
+	}
+	initial := head.Sequence
+	if first > 0 {
+		initial = first - 1
+	}
+
+	cursor, err := uc.repo.ClaimAlertCursor(ctx, merchantID, uc.owner, initial, time.Now().UTC(), alertCursorLease)
+	if errors.Is(err, repository.ErrAlertCursorLeased) {
+		// Another instance is evaluating the merchant and catches up on these logs too
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sequence := cursor.Sequence
+	if backlog := head.Sequence - sequence; backlog > maxAlertBacklog {
+		uc.logger.Warn("Alert evaluation backlog too long, skipping older logs",
+			zap.String("merchant_id", merchantID), zap.Int64("backlog", backlog))
+		sequence = head.Sequence - maxAlertBacklog
+	}
+
+	var evaluated int
+	if sequence < head.Sequence {
+		rng := repository.ChainRange{MerchantID: merchantID, FromSequence: sequence + 1, ToSequence: head.Sequence}
+		err = uc.logs.WalkChain(ctx, rng, func(log *repository.AuditLog) error {
+			uc.evaluate(ctx, log)
+			sequence = log.Sequence
+			evaluated++
+			if evaluated%alertCursorBatch == 0 {
+				return uc.repo.AdvanceAlertCursor(ctx, merchantID, uc.owner, sequence, time.Now().UTC().Add(alertCursorLease))
+			}
+			return nil
+		})
+		if errors.Is(err, repository.ErrAlertCursorLeased) {
+			uc.logger.Warn("Alert cursor lease lost", zap.String("merchant_id", merchantID))
+			return nil
+		}
+	}
+	// Release the cursor at the last evaluated log even when the walk failed
+	advErr := uc.repo.AdvanceAlertCursor(ctx, merchantID, uc.owner, sequence, time.Time{})
+	if err == nil && !errors.Is(advErr, repository.ErrAlertCursorLeased) {
+		err = advErr
+	}
+	return err
+}
+
+func (uc *alertUseCase) loadRules(ctx context.Context) {
+	list, err := uc.repo.ListAlertRules(ctx, repository.TenantScope{AllMerchants: true}, true)
+	if err != nil {
+		if ctx.Err() == nil {
+			uc.logger.Error("Failed to load alert rules", zap.Error(err))
+		}
+		return
+	}
+	byMerchant := make(map[string][]repository.AlertRule)
+	for _, rule := range list {
+		byMerchant[rule.MerchantID] = append(byMerchant[rule.MerchantID], rule)
+	}
+	uc.rules = byMerchant
+}
+
+func (uc *alertUseCase) evaluate(ctx context.Context, log *repository.AuditLog) {
+	merchantRules := uc.rules[log.MerchantID]
+	if len(merchantRules) == 0 {
+		return
+	}
+	firings, err := uc.engine.Evaluate(ctx, merchantRules, log)
+	if err != nil {
+		uc.logger.Error("Failed to evaluate alert rules", zap.Error(err),
+			zap.String("log_id", log.ID), zap.String("merchant_id", log.MerchantID))
+	}
+	for _, f := range firings {
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		alert := &repository.Alert{
+			ID:             uuid.New().String(),
+			MerchantID:     log.MerchantID,
+			RuleID:         f.Rule.ID,
+			RuleName:       f.Rule.Name,
+			Severity:       f.Rule.Severity,
+			GroupKey:       f.GroupKey,
+			Count:          f.Count,
+			LogIDs:         f.LogIDs,
+			Message:        f.Message,
+			FirstTimestamp: f.First,
+			LastTimestamp:  f.Last,
+			CreatedAt:      now,
+			// Stored pending dispatch, the notification worker records its deliveries
+			DispatchPending: true,
+			DispatchAt:      now,
+		}
+		if err := uc.repo.CreateAlert(ctx, alert); err != nil {
+			uc.logger.Error("Failed to store alert", zap.Error(err),
+				zap.String("rule_id", f.Rule.ID), zap.String("merchant_id", log.MerchantID))
+			continue
+		}
+		uc.logger.Info("Alert raised",
+			zap.String("alert_id", alert.ID),
+			zap.String("rule_id", alert.RuleID),
+			zap.String("merchant_id", alert.MerchantID),
+			zap.String("severity", alert.Severity),
+		)
+		for _, o := range uc.observers {
+			o.AlertRaised(alert)
+		}
+	}
+}
+
+// requestReload makes Run pick up a rule change of this instance right away
+func (uc *alertUseCase) requestReload() {
+	select {
+	case uc.reload <- struct{}{}:
+	default:
+	}
+}
+
+// ruleScope is the scope rules are managed in: owners manage their merchant's rules,
+// platform administrators those of any merchant
+func ruleScope(ctx context.Context, merchantID string) (repository.TenantScope, error) {
+	return merchantReadScope(ctx, merchantID)
+}
+
+func (uc *alertUseCase) CreateAlertRule(ctx context.Context, input *AlertRuleInput) (*repository.AlertRule, error) {
+	scope, err := ruleScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	if scope.MerchantID == "" {
+		if scope.AllMerchants {
+			return nil, ErrMerchantRequired
+		}
+		return nil, repository.ErrUnscopedQuery
+	}
+
+	rule := &repository.AlertRule{
+		ID:         uuid.New().String(),
+		MerchantID: scope.MerchantID,
+	}
+	if err := applyRuleInput(rule, input); err != nil {
+		return nil, err
+	}
+
+	existing, err := uc.repo.ListAlertRules(ctx, scope, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxAlertRules {
+		return nil, ErrAlertRuleLimit
+	}
+
+	id, _ := auth.IdentityFrom(ctx)
+	rule.CreatedBy = id.UserID
+	rule.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	rule.UpdatedAt = rule.CreatedAt
+	if err := uc.repo.CreateAlertRule(ctx, rule); err != nil {
+		return nil, err
+	}
+	uc.requestReload()
+	return rule, nil
+}
+
+func (uc *alertUseCase) GetAlertRule(ctx context.Context, id string) (*repository.AlertRule, error) {
+	scope, err := ruleScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return uc.repo.GetAlertRule(ctx, scope, id)
+}
+
+func (uc *alertUseCase) ListAlertRules(ctx context.Context, merchantID string) ([]repository.AlertRule, error) {
+	scope, err := ruleScope(ctx, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	return uc.repo.ListAlertRules(ctx, scope, false)
+}
+
+func (uc *alertUseCase) UpdateAlertRule(ctx context.Context, id string, input *AlertRuleInput) (*repository.AlertRule, error) {
+	scope, err := ruleScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	rule, err := uc.repo.GetAlertRule(ctx, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if input.MerchantID != "" && input.MerchantID != rule.MerchantID {
+		return nil, ErrCrossTenant
+	}
+
+	if err := applyRuleInput(rule, input); err != nil {
+		return nil, err
+	}
+	rule.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if err := uc.repo.UpdateAlertRule(ctx, scope, rule); err != nil {
+		return nil, err
+	}
+	uc.requestReload()
+	return rule, nil
+}
+
+func (uc *alertUseCase) DeleteAlertRule(ctx context.Context, id string) error {
+	scope, err := ruleScope(ctx, "")
+	if err != nil {
+		return err
+	}
+	if err := uc.repo.DeleteAlertRule(ctx, scope, id); err != nil {
+		return err
+	}
+	uc.requestReload()
+	return nil
+}
+
+func (uc *alertUseCase) ListAlerts(ctx context.Context, input *ListAlertsInput) ([]repository.Alert, int32, error) {
+	scope, err := ruleScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	page, pageSize := normalizePage(input.Page, input.PageSize)
+	filter := repository.AlertFilter{
+		RuleID:   input.RuleID,
+		Severity: input.Severity,
+	}
+	return uc.repo.ListAlerts(ctx, scope, filter, page, pageSize)
+}
+
+// applyRuleInput validates the input and copies it onto the rule. Invalid input is reported
+// as a *ValidationError.
+func applyRuleInput(rule *repository.AlertRule, input *AlertRuleInput) error {
+	v := &validator{}
+	if v.required("name", input.Name) {
+		v.maxLength("name", input.Name, maxRuleNameLength)
+	}
+	v.maxLength("description", input.Description, maxRuleDescLength)
+
+	q := repository.LogQuery{MinDurationMs: input.MinDurationMs, MaxDurationMs: input.MaxDurationMs}
+	if len(input.Filters) > maxFilters {
+		v.add("filters", "must have at most %d entries", maxFilters)
+	}
+	for i, f := range input.Filters {
+		if c, ok := v.condition(fmt.Sprintf("filters[%d]", i), f); ok {
+			q.Conditions = append(q.Conditions, c)
+		}
+	}
+	if input.MinDurationMs != nil && *input.MinDurationMs < 0 {
+		v.add("min_duration_ms", "must not be negative")
+	}
+	if input.MinDurationMs != nil && input.MaxDurationMs != nil && *input.MaxDurationMs < *input.MinDurationMs {
+		v.add("max_duration_ms", "must not be below min_duration_ms")
+	}
+	if len(input.Filters) == 0 && input.MinDurationMs == nil && input.MaxDurationMs == nil && input.Change == nil {
+		v.add("filters", "a rule needs a filter or a change condition")
+	}
+
+	var threshold *repository.RuleThreshold
+	if t := input.Threshold; t != nil {
+		threshold = &repository.RuleThreshold{Count: t.Count, Window: t.Window}
+		if t.Count < 1 || t.Count > maxRuleThresholdCount {
+			v.add("threshold.count", "must be between 1 and %d", maxRuleThresholdCount)
+		}
+		if t.Window <= 0 || t.Window > maxRuleWindow {
+			v.add("threshold.window", "must be positive and at most %s", maxRuleWindow)
+		}
+		if len(t.GroupBy) > maxRuleGroupBy {
+			v.add("threshold.group_by", "at most %d fields are allowed", maxRuleGroupBy)
+		}
+		for i, name := range t.GroupBy {
+			field, ok := statsGroupFields[name]
+			if !ok {
+				v.add(fmt.Sprintf("threshold.group_by[%d]", i), "cannot group by %q", name)
+				continue
+			}
+			threshold.GroupBy = append(threshold.GroupBy, field)
+		}
+	}
+
+	var change *repository.RuleChange
+	if c := input.Change; c != nil {
+		change = &repository.RuleChange{Field: c.Field, MinPercent: c.MinPercent}
+		if !repository.ValidDetailsPath(c.Field) {
+			v.add("change.field", "must be a dotted field path such as price or address.city")
+		}
+		if c.MinPercent <= 0 {
+			v.add("change.min_percent", "must be positive")
+		}
+	}
+
+	severity := input.Severity
+	if severity == "" {
+		severity = "warning"
+	}
+	v.oneOf("severity", severity, allowedSeverities)
+	if input.Suppression < 0 || input.Suppression > maxRuleSuppression {
+		v.add("suppression", "must be between 0 and %s", maxRuleSuppression)
+	}
+
+	if err := v.err(); err != nil {
+		return err
+	}
+	rule.Name = input.Name
+	rule.Description = input.Description
+	rule.Enabled = input.Enabled
+	rule.Query = q
+	rule.Threshold = threshold
+	rule.Change = change
+	rule.Severity = severity
+	rule.Suppression = input.Suppression
+	return nil
+}
+
+// RuleFilters returns the filters a rule was created with
+func RuleFilters(rule *repository.AlertRule) []FieldFilter {
+	names := make(map[repository.Field]string, len(filterFields))
+	for name, field := range filterFields {
+		names[field] = name
+	}
+
+	filters := make([]FieldFilter, 0, len(rule.Query.Conditions))
+	for _, c := range rule.Query.Conditions {
+		name, ok := names[c.Field]
+		if !ok {
+			// Anything else is a details path, whose field name is already the filter name
+			name = string(c.Field)
+		}
+		values := append([]string(nil), c.Values...)
+		for _, prefix := range c.Prefixes {
+			values = append(values, prefix+"*")
+		}
+		filters = append(filters, FieldFilter{Field: name, Values: values, Not: c.Not})
+	}
+	return filters
+}
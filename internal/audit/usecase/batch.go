@@ -0,0 +1,183 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/hashchain"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// batchItem tracks one input of a batch through linking and insertion
+type batchItem struct {
+	index int
+	log   *repository.AuditLog
+	err   error
+	// stored is set once the log is known to be in the collection
+	stored bool
+}
+
+// CreateAuditLogs links the logs of every merchant in input order and writes each merchant's
+// logs with one ordered bulk insert. An ordered insert stops at the first failure, so a stored
+// log never points at one that was not stored. The logs after a failure are appended again one
+// by one when another writer got in first, and failed otherwise.
+func (uc *auditUseCase) CreateAuditLogs(ctx context.Context, inputs []*CreateAuditLogInput) []error {
+	errs := make([]error, len(inputs))
+	if len(inputs) == 0 {
+		return errs
+	}
+
+	// Group by merchant, dropping repeated event ids inside the batch
+	byMerchant := make(map[string][]*batchItem)
+	firstOfEvent := make(map[[2]string]int)
+	duplicateOf := make(map[int]int)
+	for i, input := range inputs {
+		if err := ValidateCreateAuditLogInput(input); err != nil {
+			errs[i] = err
+			continue
+		}
+		if input.EventID != "" {
+			key := [2]string{input.MerchantID, input.EventID}
+			if first, ok := firstOfEvent[key]; ok {
+				duplicateOf[i] = first
+				continue
+			}
+			firstOfEvent[key] = i
+		}
+		byMerchant[input.MerchantID] = append(byMerchant[input.MerchantID], &batchItem{index: i, log: newAuditLog(input)})
+	}
+
+	merchants := make([]string, 0, len(byMerchant))
+	for merchantID := range byMerchant {
+		merchants = append(merchants, merchantID)
+	}
+	// A fixed lock order prevents deadlocks between concurrent batches
+	sort.Strings(merchants)
+	locks := make([]*sync.Mutex, len(merchants))
+	for i, merchantID := range merchants {
+		locks[i] = uc.chainLock(merchantID)
+		locks[i].Lock()
+	}
+	defer func() {
+		for _, mu := range locks {
+			mu.Unlock()
+		}
+	}()
+
+	for _, merchantID := range merchants {
+		items, err := uc.linkBatch(ctx, merchantID, byMerchant[merchantID])
+		if err != nil {
+			for _, item := range byMerchant[merchantID] {
+				item.err = err
+			}
+			continue
+		}
+		if len(items) == 0 {
+			continue
+		}
+
+		logs := make([]*repository.AuditLog, len(items))
+		for i, item := range items {
+			logs[i] = item.log
+		}
+		n, err := uc.repo.InsertAuditLogs(ctx, logs)
+		for _, item := range items[:n] {
+			item.stored = true
+		}
+		if err != nil {
+			uc.appendRest(ctx, items[n:], err)
+		}
+	}
+
+	for _, merchantID := range merchants {
+		for _, item := range byMerchant[merchantID] {
+			if errors.Is(item.err, repository.ErrDuplicateEvent) {
+				item.err = nil
+			}
+			errs[item.index] = item.err
+			if item.stored {
+				uc.notify(item.log)
+			}
+		}
+	}
+	for i, first := range duplicateOf {
+		errs[i] = errs[first]
+	}
+	return errs
+}
+
+// linkBatch drops events the merchant already stored and chains the remaining logs after the
+// current head. Items that were already stored are marked as such and left out of the result.
+func (uc *auditUseCase) linkBatch(ctx context.Context, merchantID string, items []*batchItem) ([]*batchItem, error) {
+	var eventIDs []string
+	for _, item := range items {
+		if item.log.EventID != "" {
+			eventIDs = append(eventIDs, item.log.EventID)
+		}
+	}
+	existing := map[string]bool{}
+	if len(eventIDs) > 0 {
+		found, err := uc.repo.FindExistingEventIDs(ctx, merchantID, eventIDs)
+		if err != nil {
+			return nil, fmt.Errorf("find existing events: %w", err)
+		}
+		for _, id := range found {
+			existing[id] = true
+		}
+	}
+
+	head, err := uc.repo.GetChainHead(ctx, merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("get chain head: %w", err)
+	}
+
+	linked := make([]*batchItem, 0, len(items))
+	for _, item := range items {
+		if existing[item.log.EventID] {
+			item.err = repository.ErrDuplicateEvent
+			continue
+		}
+		if err := hashchain.Link(item.log, head); err != nil {
+			return nil, fmt.Errorf("hash audit log: %w", err)
+		}
+		head = &repository.ChainHead{Sequence: item.log.Sequence, Hash: item.log.Hash}
+		linked = append(linked, item)
+	}
+	return linked, nil
+}
+
+// appendRest finishes a merchant's batch after its ordered insert stopped at items[0] with err.
+// Nothing after items[0] was written. When another writer stored the event or extended the chain
+// first, the remaining logs are linked to the new head and appended one by one. Other errors fail
+// the remaining logs too, so the caller retries them in order.
+func (uc *auditUseCase) appendRest(ctx context.Context, items []*batchItem, err error) {
+	switch {
+	case errors.Is(err, repository.ErrDuplicateEvent):
+		items[0].err = err
+		items = items[1:]
+	case errors.Is(err, repository.ErrSequenceConflict):
+	default:
+		items[0].err = err
+		failRest(items[1:], err)
+		return
+	}
+
+	for i, item := range items {
+		item.err = uc.appendToChain(ctx, item.log)
+		item.stored = item.err == nil
+		if item.err != nil && !errors.Is(item.err, repository.ErrDuplicateEvent) {
+			// Later logs must not skip over a failed one
+			failRest(items[i+1:], item.err)
+			return
+		}
+	}
+}
+
+func failRest(items []*batchItem, err error) {
+	for _, item := range items {
+		item.err = fmt.Errorf("previous audit log in batch failed: %w", err)
+	}
+}
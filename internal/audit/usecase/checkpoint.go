@@ -0,0 +1,395 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/hashchain"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/merkle"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/signing"
+	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// maxCheckpointLeaves bounds the records covered by one checkpoint so a backlog is split into several
+const maxCheckpointLeaves = 100000
+
+// maxCachedTrees bounds the checkpoint trees kept for inclusion proofs. A full tree holds about
+// 6 MiB of hashes.
+const maxCachedTrees = 8
+
+// ErrNotCheckpointed is returned when a log is not covered by any checkpoint yet
+var ErrNotCheckpointed = errors.New("audit log is not covered by a checkpoint yet")
+
+// ErrCheckpointMismatch is returned when the stored records no longer reproduce a checkpoint root
+var ErrCheckpointMismatch = errors.New("audit logs do not match the signed checkpoint")
+
+// ErrBrokenChain is returned when a checkpoint range has missing sequence numbers
+var ErrBrokenChain = errors.New("audit chain has missing records")
+
+// ErrUnknownCheckpointKey is returned when a checkpoint was signed by a key that is not configured
+var ErrUnknownCheckpointKey = errors.New("checkpoint signed by an unknown key")
+
+// defaultCheckpointInterval is used when CheckpointConfig.Interval is not positive
+const defaultCheckpointInterval = 15 * time.Minute
+
+type CheckpointConfig struct {
+	// EveryRecords triggers a checkpoint after that many appends, only the interval is used when not positive
+	EveryRecords int64
+	Interval     time.Duration
+}
+
+type CheckpointUseCase interface {
+	AppendObserver
+	// Run checkpoints merchants on the configured interval and when enough records were appended
+	Run(ctx context.Context)
+	CreateCheckpoint(ctx context.Context, merchantID string) (*repository.Checkpoint, error)
+	GetInclusionProof(ctx context.Context, logID string) (*InclusionProof, error)
+}
+
+// InclusionProof shows that a log is a leaf of a signed checkpoint
+type InclusionProof struct {
+	Log        *repository.AuditLog
+	Checkpoint *repository.Checkpoint
+	LeafIndex  int64
+	LeafHash   string
+	AuditPath  []string
+	PublicKey  string
+}
+
+type checkpointUseCase struct {
+	repo        repository.Repository
+	checkpoints repository.CheckpointRepository
+	witness     repository.CheckpointWitness
+	key         ed25519.PrivateKey
+	keyID       string
+	keys        signing.KeyRing // public keys checkpoints were signed with
+	cfg         CheckpointConfig
+	logger      logger.ZapLogger
+
+	mu      sync.Mutex
+	pending map[string]int64 // records appended per merchant since the last trigger
+	trigger chan string
+
+	treesMu   sync.Mutex
+	trees     map[string]*merkle.Tree // verified trees by checkpoint id
+	treeOrder []string                // checkpoint ids in the order they were cached
+}
+
+func NewCheckpointUseCase(
+	repo repository.Repository,
+	checkpoints repository.CheckpointRepository,
+	witness repository.CheckpointWitness,
+	key ed25519.PrivateKey,
+	keys signing.KeyRing,
+	cfg CheckpointConfig,
+	logger logger.ZapLogger,
+) CheckpointUseCase {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultCheckpointInterval
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	ring := signing.NewKeyRing(pub)
+	for id, k := range keys {
+		ring[id] = k
+	}
+	return &checkpointUseCase{
+		repo:        repo,
+		checkpoints: checkpoints,
+		witness:     witness,
+		key:         key,
+		keyID:       signing.KeyID(pub),
+		keys:        ring,
+		cfg:         cfg,
+		logger:      logger,
+		pending:     make(map[string]int64),
+		trigger:     make(chan string, 64),
+		trees:       make(map[string]*merkle.Tree),
+	}
+}
+
+func (uc *checkpointUseCase) LogAppended(log *repository.AuditLog) {
+	if uc.cfg.EveryRecords <= 0 {
+		return
+	}
+
+	uc.mu.Lock()
+	uc.pending[log.MerchantID]++
+	due := uc.pending[log.MerchantID] >= uc.cfg.EveryRecords
+	if due {
+		uc.pending[log.MerchantID] = 0
+	}
+	uc.mu.Unlock()
+
+	if due {
+		select {
+		case uc.trigger <- log.MerchantID:
+		default:
+			// The interval run picks the merchant up if the trigger queue is full
+		}
+	}
+}
+
+func (uc *checkpointUseCase) Run(ctx context.Context) {
+	ticker := time.NewTicker(uc.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case merchantID := <-uc.trigger:
+			uc.checkpointMerchant(ctx, merchantID)
+		case <-ticker.C:
+			merchants, err := uc.repo.ListChainMerchants(ctx)
+			if err != nil {
+				uc.logger.Error("Failed to list merchants for checkpointing", zap.Error(err))
+				continue
+			}
+			for _, merchantID := range merchants {
+				uc.checkpointMerchant(ctx, merchantID)
+			}
+		}
+	}
+}
+
+func (uc *checkpointUseCase) checkpointMerchant(ctx context.Context, merchantID string) {
+	cp, err := uc.CreateCheckpoint(ctx, merchantID)
+	if err != nil {
+		if ctx.Err() == nil {
+			uc.logger.Error("Failed to create checkpoint", zap.Error(err), zap.String("merchant_id", merchantID))
+		}
+		return
+	}
+	if cp != nil {
+		uc.logger.Info("Checkpoint created",
+			zap.String("merchant_id", merchantID),
+			zap.Int64("from_sequence", cp.FromSequence),
+			zap.Int64("to_sequence", cp.ToSequence),
+			zap.String("root_hash", cp.RootHash),
+		)
+	}
+}
+
+// CreateCheckpoint signs the records appended since the merchant's last checkpoint.
+// It returns nil when there is nothing new to checkpoint.
+func (uc *checkpointUseCase) CreateCheckpoint(ctx context.Context, merchantID string) (*repository.Checkpoint, error) {
+	from := int64(1)
+	prevRoot := ""
+	latest, err := uc.checkpoints.GetLatestCheckpoint(ctx, merchantID)
+	switch {
+	case err == nil:
+		from = latest.ToSequence + 1
+		prevRoot = latest.RootHash
+	case !errors.Is(err, repository.ErrCheckpointNotFound):
+		return nil, fmt.Errorf("get latest checkpoint: %w", err)
+	}
+
+	head, err := uc.repo.GetChainHead(ctx, merchantID)
+	if err != nil {
+		return nil, fmt.Errorf("get chain head: %w", err)
+	}
+	if head.Sequence < from {
+		return nil, nil
+	}
+	to := head.Sequence
+	if to-from+1 > maxCheckpointLeaves {
+		to = from + maxCheckpointLeaves - 1
+	}
+
+	leaves, headHash, err := uc.loadLeaves(ctx, merchantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &repository.Checkpoint{
+		ID:           uuid.New().String(),
+		MerchantID:   merchantID,
+		FromSequence: from,
+		ToSequence:   to,
+		LeafCount:    int64(len(leaves)),
+		RootHash:     hex.EncodeToString(merkle.Root(leaves)),
+		HeadHash:     headHash,
+		PrevRootHash: prevRoot,
+		CreatedAt:    time.Now().UTC().Truncate(time.Millisecond),
+		KeyID:        uc.keyID,
+	}
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(uc.key, CheckpointMessage(cp)))
+
+	// The witness is written first so that no stored checkpoint is missing from it. It may
+	// end up with checkpoints that were not stored, e.g. when another instance stored the
+	// range first, which still sign records that exist.
+	if err := uc.witness.Append(cp); err != nil {
+		return nil, fmt.Errorf("write checkpoint witness: %w", err)
+	}
+	if err := uc.checkpoints.CreateCheckpoint(ctx, cp); err != nil {
+		if errors.Is(err, repository.ErrCheckpointExists) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("store checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+func (uc *checkpointUseCase) GetInclusionProof(ctx context.Context, logID string) (*InclusionProof, error) {
+	scope, err := readScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	// Logs of other merchants are reported as missing
+	log, err := uc.repo.GetAuditLog(ctx, scope, logID)
+	if err != nil {
+		return nil, err
+	}
+	if log.Sequence == 0 {
+		return nil, ErrNotCheckpointed
+	}
+
+	cp, err := uc.checkpoints.FindCheckpointCovering(ctx, log.MerchantID, log.Sequence)
+	if errors.Is(err, repository.ErrCheckpointNotFound) {
+		return nil, ErrNotCheckpointed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find checkpoint: %w", err)
+	}
+	// The checkpoint may predate a key rotation
+	pub, ok := uc.keys[cp.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCheckpointKey, cp.KeyID)
+	}
+
+	tree, err := uc.checkpointTree(ctx, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tree may be cached, so the log itself is checked against the leaf it was sealed as
+	index := int(log.Sequence - cp.FromSequence)
+	leafHash, err := tree.LeafHash(index)
+	if err != nil {
+		return nil, err
+	}
+	actual, err := hashchain.Compute(log)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := hex.DecodeString(actual)
+	if err != nil || actual != log.Hash || !bytes.Equal(merkle.LeafHash(leaf), leafHash) {
+		return nil, ErrCheckpointMismatch
+	}
+	path, err := tree.Proof(index)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &InclusionProof{
+		Log:        log,
+		Checkpoint: cp,
+		LeafIndex:  int64(index),
+		LeafHash:   hex.EncodeToString(leafHash),
+		AuditPath:  make([]string, len(path)),
+		PublicKey:  base64.StdEncoding.EncodeToString(pub),
+	}
+	for i, p := range path {
+		proof.AuditPath[i] = hex.EncodeToString(p)
+	}
+	return proof, nil
+}
+
+// checkpointTree returns the Merkle tree of a checkpoint's records, loading and verifying it
+// against the signed root unless it is cached
+func (uc *checkpointUseCase) checkpointTree(ctx context.Context, cp *repository.Checkpoint) (*merkle.Tree, error) {
+	uc.treesMu.Lock()
+	tree, ok := uc.trees[cp.ID]
+	uc.treesMu.Unlock()
+	if ok {
+		return tree, nil
+	}
+
+	leaves, _, err := uc.loadLeaves(ctx, cp.MerchantID, cp.FromSequence, cp.ToSequence)
+	if err != nil {
+		return nil, err
+	}
+	tree = merkle.NewTree(leaves)
+	if hex.EncodeToString(tree.Root()) != cp.RootHash {
+		return nil, ErrCheckpointMismatch
+	}
+
+	uc.treesMu.Lock()
+	defer uc.treesMu.Unlock()
+	if _, ok := uc.trees[cp.ID]; !ok {
+		if len(uc.treeOrder) >= maxCachedTrees {
+			delete(uc.trees, uc.treeOrder[0])
+			uc.treeOrder = uc.treeOrder[1:]
+		}
+		uc.trees[cp.ID] = tree
+		uc.treeOrder = append(uc.treeOrder, cp.ID)
+	}
+	return tree, nil
+}
+
+// loadLeaves returns the leaf data (the decoded record hashes) of a contiguous chain range
+// together with the hash of its last record. Records are rehashed so that an edited
+// record cannot be sealed into a checkpoint.
+func (uc *checkpointUseCase) loadLeaves(ctx context.Context, merchantID string, from, to int64) ([][]byte, string, error) {
+	leaves := make([][]byte, 0, to-from+1)
+	next := from
+	last := ""
+
+	rng := repository.ChainRange{MerchantID: merchantID, FromSequence: from, ToSequence: to}
+	err := uc.repo.WalkChain(ctx, rng, func(log *repository.AuditLog) error {
+		if log.Sequence != next {
+			return fmt.Errorf("%w: expected sequence %d, got %d", ErrBrokenChain, next, log.Sequence)
+		}
+		actual, err := hashchain.Compute(log)
+		if err != nil {
+			return err
+		}
+		if actual != log.Hash {
+			return fmt.Errorf("%w: sequence %d", ErrCheckpointMismatch, log.Sequence)
+		}
+		leaf, err := hex.DecodeString(log.Hash)
+		if err != nil {
+			return fmt.Errorf("decode hash of sequence %d: %w", log.Sequence, err)
+		}
+		leaves = append(leaves, leaf)
+		last = log.Hash
+		next++
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if next != to+1 {
+		return nil, "", fmt.Errorf("%w: expected sequence %d", ErrBrokenChain, next)
+	}
+	return leaves, last, nil
+}
+
+// CheckpointMessage is the byte string covered by a checkpoint's signature
+func CheckpointMessage(cp *repository.Checkpoint) []byte {
+	return []byte(strings.Join([]string{
+		"omnipos-audit-checkpoint/v1",
+		cp.ID,
+		cp.MerchantID,
+		strconv.FormatInt(cp.FromSequence, 10),
+		strconv.FormatInt(cp.ToSequence, 10),
+		strconv.FormatInt(cp.LeafCount, 10),
+		cp.RootHash,
+		cp.HeadHash,
+		cp.PrevRootHash,
+		hashchain.FormatTimestamp(cp.CreatedAt),
+		cp.KeyID,
+	}, "\n"))
+}
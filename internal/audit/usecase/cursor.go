@@ -0,0 +1,65 @@
+package usecase
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// ErrInvalidPageToken is returned for a page token this service did not issue
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// pageToken is the content of an opaque page token. Listings in (timestamp, _id) order
+// continue after a log, text searches ordered by relevance continue at an offset.
+type pageToken struct {
+	Timestamp int64  `json:"t,omitempty"` // unix milliseconds
+	ID        string `json:"id,omitempty"`
+	Offset    int64  `json:"o,omitempty"`
+}
+
+func encodePageToken(c *repository.LogCursor) string {
+	if c == nil {
+		return ""
+	}
+	return encodeToken(pageToken{Timestamp: c.Timestamp.UnixMilli(), ID: c.ID})
+}
+
+func encodeOffsetToken(offset int64) string {
+	return encodeToken(pageToken{Offset: offset})
+}
+
+func encodeToken(t pageToken) string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageToken(token string) (*pageToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	var t pageToken
+	if err := json.Unmarshal(data, &t); err != nil || (t.ID == "") == (t.Offset <= 0) {
+		return nil, ErrInvalidPageToken
+	}
+	return &t, nil
+}
+
+// decodeCursorToken decodes a token that must continue after a log
+func decodeCursorToken(token string) (*repository.LogCursor, error) {
+	t, err := decodePageToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if t.ID == "" {
+		return nil, ErrInvalidPageToken
+	}
+	return t.cursor(), nil
+}
+
+func (t *pageToken) cursor() *repository.LogCursor {
+	return &repository.LogCursor{Timestamp: time.UnixMilli(t.Timestamp).UTC(), ID: t.ID}
+}
@@ -0,0 +1,94 @@
+package usecase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AuditEvent represents an audit event from Kafka
+type AuditEvent struct {
+	EventID       string       `json:"event_id"`
+	EventType     string       `json:"event_type"`
+	SourceService string       `json:"source_service"`
+	Payload       AuditPayload `json:"payload"`
+	Timestamp     time.Time    `json:"timestamp"`
+}
+
+// AuditPayload contains the actual audit log data
+type AuditPayload struct {
+	MerchantID string                 `json:"merchant_id"`
+	UserID     string                 `json:"user_id"`
+	Action     string                 `json:"action"`
+	EntityType string                 `json:"entity_type"`
+	EntityID   string                 `json:"entity_id"`
+	Details    map[string]interface{} `json:"details"`
+	IPAddress  string                 `json:"ip_address"`
+	UserAgent  string                 `json:"user_agent"`
+	// Enhanced fields
+	StoreID       string                 `json:"store_id,omitempty"`
+	SessionID     string                 `json:"session_id,omitempty"`
+	OldValue      map[string]interface{} `json:"old_value,omitempty"`
+	NewValue      map[string]interface{} `json:"new_value,omitempty"`
+	Result        string                 `json:"result,omitempty"`
+	ErrorMessage  string                 `json:"error_message,omitempty"`
+	Severity      string                 `json:"severity,omitempty"`
+	CorrelationID string                 `json:"correlation_id,omitempty"`
+	DurationMs    int64                  `json:"duration_ms,omitempty"`
+}
+
+// DecodeAuditEvent parses a raw Kafka message value
+func DecodeAuditEvent(value []byte) (*AuditEvent, error) {
+	// Numbers in snapshots and details stay json.Number, so integers above 2^53 are kept exact
+	var event AuditEvent
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&event); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return &event, nil
+}
+
+// KafkaEventID identifies an event by its position in the topic.
+// It is used for events that were published without a producer event id.
+func KafkaEventID(topic string, partition int, offset int64) string {
+	return fmt.Sprintf("kafka:%s:%d:%d", topic, partition, offset)
+}
+
+// ToInput maps the event to a CreateAuditLogInput. fallbackEventID is used when the
+// producer did not set an event id.
+func (e *AuditEvent) ToInput(fallbackEventID string) *CreateAuditLogInput {
+	eventID := e.EventID
+	if eventID == "" {
+		eventID = fallbackEventID
+	}
+
+	return &CreateAuditLogInput{
+		MerchantID: e.Payload.MerchantID,
+		UserID:     e.Payload.UserID,
+		Action:     e.Payload.Action,
+		Entity:     e.Payload.EntityType,
+		EntityID:   e.Payload.EntityID,
+		Details:    e.Payload.Details,
+		IPAddress:  e.Payload.IPAddress,
+		UserAgent:  e.Payload.UserAgent,
+		// Enhanced fields
+		StoreID:       e.Payload.StoreID,
+		SessionID:     e.Payload.SessionID,
+		OldValue:      e.Payload.OldValue,
+		NewValue:      e.Payload.NewValue,
+		Result:        e.Payload.Result,
+		ErrorMessage:  e.Payload.ErrorMessage,
+		Severity:      e.Payload.Severity,
+		SourceService: e.SourceService, // Source from event level
+		CorrelationID: e.Payload.CorrelationID,
+		DurationMs:    e.Payload.DurationMs,
+		EventID:       eventID,
+	}
+}
@@ -0,0 +1,51 @@
+package usecase
+
+import (
+	"context"
+	"io"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/export"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+type ExportAuditLogsInput struct {
+	// Filter selects the logs, paging is ignored and every match is exported oldest first
+	Filter ListAuditLogsInput
+	// Format is csv, ndjson or parquet
+	Format string
+}
+
+// ExportAuditLogs writes every log matching the filter to w and returns how many were written
+func (uc *auditUseCase) ExportAuditLogs(ctx context.Context, input *ExportAuditLogsInput, w io.Writer) (int64, error) {
+	if err := export.CheckFormat(input.Format); err != nil {
+		return 0, err
+	}
+	scope, err := readScope(ctx, input.Filter.MerchantID)
+	if err != nil {
+		return 0, err
+	}
+	q, err := buildLogQuery(&input.Filter)
+	if err != nil {
+		return 0, err
+	}
+	if err := q.Validate(); err != nil {
+		return 0, err
+	}
+
+	ew, err := export.NewWriter(input.Format, w)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	err = uc.repo.WalkAuditLogs(ctx, scope, q, func(log *repository.AuditLog) error {
+		if err := ew.Write(log); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, ew.Close()
+}
@@ -0,0 +1,474 @@
+package usecase
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/export"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
+	"github.com/fekuna/omnipos-audit-service/internal/signing"
+	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// exportJobTimeout bounds building one archive
+const exportJobTimeout = 6 * time.Hour
+
+// A worker reports progress on its job every exportHeartbeatInterval. A running job without a
+// heartbeat for exportHeartbeatTimeout was interrupted, e.g. by a restart, and is queued again
+// until it has been claimed maxExportAttempts times.
+const (
+	exportHeartbeatInterval = 30 * time.Second
+	exportHeartbeatTimeout  = 2 * time.Minute
+	maxExportAttempts       = 3
+)
+
+// Defaults for ExportJobConfig durations that are not positive
+const (
+	defaultExportTTL             = 7 * 24 * time.Hour
+	defaultExportCleanupInterval = 10 * time.Minute
+)
+
+// exportSweepLimit bounds the jobs handled per status in one cleanup run
+const exportSweepLimit = 100
+
+// ErrExportNotReady is returned when a job's archive is requested before the job succeeded
+var ErrExportNotReady = errors.New("export is not ready")
+
+// ErrExportExpired is returned when a job's archive was already deleted
+var ErrExportExpired = errors.New("export has expired")
+
+// errExportClaimLost stops a worker whose job was queued again while it was building it
+var errExportClaimLost = errors.New("export job was taken from this worker")
+
+type ExportJobConfig struct {
+	// TTL is how long an archive is kept after the job succeeded
+	TTL             time.Duration
+	Workers         int
+	CleanupInterval time.Duration
+}
+
+type ExportJobUseCase interface {
+	// Run builds queued archives, queues interrupted ones again and deletes expired ones until
+	// ctx is done
+	Run(ctx context.Context)
+	StartExport(ctx context.Context, input *ExportAuditLogsInput) (*repository.ExportJob, error)
+	GetExportStatus(ctx context.Context, id string) (*repository.ExportJob, error)
+	// DownloadExport opens the archive of a succeeded job, the caller closes it
+	DownloadExport(ctx context.Context, id string) (*repository.ExportJob, io.ReadCloser, error)
+}
+
+type exportJobUseCase struct {
+	repo   repository.Repository
+	jobs   repository.ExportJobRepository
+	store  repository.ExportStore
+	key    ed25519.PrivateKey
+	keyID  string
+	cfg    ExportJobConfig
+	logger logger.ZapLogger
+	queue  chan string
+}
+
+func NewExportJobUseCase(
+	repo repository.Repository,
+	jobs repository.ExportJobRepository,
+	store repository.ExportStore,
+	key ed25519.PrivateKey,
+	cfg ExportJobConfig,
+	logger logger.ZapLogger,
+) ExportJobUseCase {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultExportTTL
+	}
+	if cfg.CleanupInterval <= 0 {
+		cfg.CleanupInterval = defaultExportCleanupInterval
+	}
+	return &exportJobUseCase{
+		repo:   repo,
+		jobs:   jobs,
+		store:  store,
+		key:    key,
+		keyID:  signing.KeyID(key.Public().(ed25519.PublicKey)),
+		cfg:    cfg,
+		logger: logger,
+		queue:  make(chan string, exportSweepLimit),
+	}
+}
+
+func (uc *exportJobUseCase) StartExport(ctx context.Context, input *ExportAuditLogsInput) (*repository.ExportJob, error) {
+	scope, err := readScope(ctx, input.Filter.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	if scope.MerchantID == "" && !scope.AllMerchants {
+		return nil, repository.ErrUnscopedQuery
+	}
+	q, err := buildLogQuery(&input.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	if err := export.CheckFormat(input.Format); err != nil {
+		return nil, err
+	}
+
+	id, _ := auth.IdentityFrom(ctx)
+	job := &repository.ExportJob{
+		ID:          uuid.New().String(),
+		Scope:       scope,
+		RequestedBy: id.UserID,
+		Format:      input.Format,
+		Query:       *q,
+		Status:      repository.ExportPending,
+		CreatedAt:   time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := uc.jobs.CreateExportJob(ctx, job); err != nil {
+		return nil, err
+	}
+	select {
+	case uc.queue <- job.ID:
+	default:
+		// The next cleanup run queues pending jobs again
+	}
+	return job, nil
+}
+
+func (uc *exportJobUseCase) GetExportStatus(ctx context.Context, id string) (*repository.ExportJob, error) {
+	scope, err := readScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	job, err := uc.jobs.GetExportJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Jobs of a wider scope than the caller's are reported as missing
+	if !scope.Covers(job.Scope) {
+		return nil, repository.ErrExportJobNotFound
+	}
+	return job, nil
+}
+
+func (uc *exportJobUseCase) DownloadExport(ctx context.Context, id string) (*repository.ExportJob, io.ReadCloser, error) {
+	job, err := uc.GetExportStatus(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch job.Status {
+	case repository.ExportSucceeded:
+	case repository.ExportExpired:
+		return nil, nil, ErrExportExpired
+	default:
+		return nil, nil, ErrExportNotReady
+	}
+
+	archive, err := uc.store.Open(job.ArchiveName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open export archive: %w", err)
+	}
+	return job, archive, nil
+}
+
+func (uc *exportJobUseCase) Run(ctx context.Context) {
+	for i := 0; i < uc.cfg.Workers; i++ {
+		go uc.work(ctx)
+	}
+
+	cleanup := time.NewTicker(uc.cfg.CleanupInterval)
+	defer cleanup.Stop()
+	heartbeats := time.NewTicker(exportHeartbeatInterval)
+	defer heartbeats.Stop()
+
+	uc.requeueStale(ctx)
+	uc.sweep(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeats.C:
+			uc.requeueStale(ctx)
+		case <-cleanup.C:
+			uc.sweep(ctx)
+		}
+	}
+}
+
+func (uc *exportJobUseCase) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-uc.queue:
+			uc.runJob(ctx, id)
+		}
+	}
+}
+
+// sweep deletes expired archives and queues pending jobs
+func (uc *exportJobUseCase) sweep(ctx context.Context) {
+	now := time.Now().UTC()
+
+	expired, err := uc.jobs.ListExportJobs(ctx, repository.ExportJobFilter{Status: repository.ExportSucceeded, ExpiresBefore: now}, exportSweepLimit)
+	if err != nil {
+		uc.logger.Error("Failed to list expired export jobs", zap.Error(err))
+	}
+	for i := range expired {
+		job := &expired[i]
+		if err := uc.store.Remove(job.ArchiveName); err != nil {
+			uc.logger.Error("Failed to delete export archive", zap.Error(err), zap.String("job_id", job.ID))
+			continue
+		}
+		job.Status = repository.ExportExpired
+		if err := uc.jobs.UpdateExportJob(ctx, job, repository.ExportSucceeded); err != nil {
+			uc.logger.Error("Failed to expire export job", zap.Error(err), zap.String("job_id", job.ID))
+		}
+	}
+
+	pending, err := uc.jobs.ListExportJobs(ctx, repository.ExportJobFilter{Status: repository.ExportPending}, exportSweepLimit)
+	if err != nil {
+		uc.logger.Error("Failed to list pending export jobs", zap.Error(err))
+	}
+	for _, job := range pending {
+		select {
+		case uc.queue <- job.ID:
+		default:
+			return
+		}
+	}
+}
+
+// requeueStale queues the running jobs whose worker stopped reporting progress again, or fails
+// them once they were claimed maxExportAttempts times
+func (uc *exportJobUseCase) requeueStale(ctx context.Context) {
+	cutoff := time.Now().UTC().Add(-exportHeartbeatTimeout)
+	stale, err := uc.jobs.ListExportJobs(ctx, repository.ExportJobFilter{Status: repository.ExportRunning, HeartbeatBefore: cutoff}, exportSweepLimit)
+	if err != nil {
+		uc.logger.Error("Failed to list interrupted export jobs", zap.Error(err))
+		return
+	}
+	for i := range stale {
+		job := &stale[i]
+		if job.Attempts >= maxExportAttempts {
+			uc.fail(ctx, job, fmt.Errorf("export was interrupted %d times", job.Attempts))
+			continue
+		}
+		if err := uc.jobs.ReleaseExportJob(ctx, job); err != nil {
+			if !errors.Is(err, repository.ErrExportJobNotFound) {
+				uc.logger.Error("Failed to queue interrupted export job", zap.Error(err), zap.String("job_id", job.ID))
+			}
+			continue
+		}
+		uc.logger.Warn("Export job was interrupted, queued again",
+			zap.String("job_id", job.ID), zap.Int("attempts", job.Attempts))
+		select {
+		case uc.queue <- job.ID:
+		default:
+			// The next cleanup run queues pending jobs again
+		}
+	}
+}
+
+func (uc *exportJobUseCase) runJob(ctx context.Context, id string) {
+	job, err := uc.jobs.ClaimExportJob(ctx, id, uuid.New().String(), time.Now().UTC().Truncate(time.Millisecond))
+	if errors.Is(err, repository.ErrExportJobNotFound) {
+		return // another worker or instance has it
+	}
+	if err != nil {
+		uc.logger.Error("Failed to claim export job", zap.Error(err), zap.String("job_id", id))
+		return
+	}
+
+	if err := uc.buildClaimed(ctx, job); err != nil {
+		if ctx.Err() != nil {
+			return // shutting down, the job is queued again once its heartbeat is stale
+		}
+		if errors.Is(err, errExportClaimLost) {
+			uc.logger.Warn("Export job was queued again while building it", zap.String("job_id", job.ID))
+			return
+		}
+		uc.logger.Error("Export job failed", zap.Error(err), zap.String("job_id", job.ID))
+		uc.fail(ctx, job, err)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	job.Status = repository.ExportSucceeded
+	job.CompletedAt = now
+	job.ExpiresAt = now.Add(uc.cfg.TTL)
+	if err := uc.jobs.UpdateExportJob(ctx, job, repository.ExportRunning); err != nil {
+		uc.logger.Error("Failed to complete export job", zap.Error(err), zap.String("job_id", job.ID))
+		if err := uc.store.Remove(job.ArchiveName); err != nil {
+			uc.logger.Error("Failed to delete export archive", zap.Error(err), zap.String("job_id", job.ID))
+		}
+		return
+	}
+	uc.logger.Info("Export job succeeded",
+		zap.String("job_id", job.ID),
+		zap.Int64("records", job.RecordCount),
+		zap.Int64("archive_size", job.ArchiveSize),
+	)
+}
+
+// buildClaimed builds the job's archive and reports progress meanwhile. It returns
+// errExportClaimLost when the job was taken from this worker before the archive was done.
+func (uc *exportJobUseCase) buildClaimed(ctx context.Context, job *repository.ExportJob) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, exportJobTimeout)
+	defer cancel()
+	jobCtx, abort := context.WithCancelCause(timeoutCtx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(exportHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := uc.jobs.HeartbeatExportJob(jobCtx, job.ID, job.ClaimID, time.Now().UTC().Truncate(time.Millisecond))
+			if errors.Is(err, repository.ErrExportJobNotFound) {
+				abort(errExportClaimLost)
+				return
+			}
+			if err != nil && jobCtx.Err() == nil {
+				uc.logger.Error("Failed to record export job heartbeat", zap.Error(err), zap.String("job_id", job.ID))
+			}
+		}
+	}()
+
+	err := uc.buildArchive(jobCtx, job)
+	abort(nil)
+	<-done
+	if errors.Is(context.Cause(jobCtx), errExportClaimLost) {
+		if err == nil {
+			if removeErr := uc.store.Remove(job.ArchiveName); removeErr != nil {
+				uc.logger.Error("Failed to delete export archive", zap.Error(removeErr), zap.String("job_id", job.ID))
+			}
+		}
+		return errExportClaimLost
+	}
+	return err
+}
+
+func (uc *exportJobUseCase) fail(ctx context.Context, job *repository.ExportJob, cause error) {
+	job.Status = repository.ExportFailed
+	job.Error = cause.Error()
+	job.CompletedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if err := uc.jobs.UpdateExportJob(ctx, job, repository.ExportRunning); err != nil && !errors.Is(err, repository.ErrExportJobNotFound) {
+		uc.logger.Error("Failed to record export job failure", zap.Error(err), zap.String("job_id", job.ID))
+	}
+}
+
+// buildArchive writes the records to a temporary file, then bundles them with the signed
+// manifest into the job's archive and records its size and digest on the job
+func (uc *exportJobUseCase) buildArchive(ctx context.Context, job *repository.ExportJob) error {
+	tmp, err := os.CreateTemp("", "audit-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	manifest := &export.Manifest{
+		Version:     export.ManifestVersion,
+		JobID:       job.ID,
+		Scope:       job.Scope,
+		RequestedBy: job.RequestedBy,
+		Query:       job.Query,
+		Format:      job.Format,
+		CreatedAt:   job.CreatedAt,
+		KeyID:       uc.keyID,
+		PublicKey:   base64.StdEncoding.EncodeToString(uc.key.Public().(ed25519.PublicKey)),
+	}
+
+	records := &countingHash{Hash: sha256.New()}
+	buf := bufio.NewWriter(io.MultiWriter(tmp, records))
+	ew, err := export.NewWriter(job.Format, buf)
+	if err != nil {
+		return err
+	}
+	err = uc.repo.WalkAuditLogs(ctx, job.Scope, &job.Query, func(log *repository.AuditLog) error {
+		if manifest.RecordCount == 0 {
+			manifest.FirstTimestamp = log.Timestamp.UTC()
+		}
+		manifest.LastTimestamp = log.Timestamp.UTC()
+		manifest.RecordCount++
+		return ew.Write(log)
+	})
+	if err != nil {
+		return fmt.Errorf("write records: %w", err)
+	}
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	recordsFile := export.ManifestFile{
+		Name:   export.RecordsName(job.Format),
+		Size:   records.n,
+		SHA256: hex.EncodeToString(records.Sum(nil)),
+	}
+	manifest.Files = []export.ManifestFile{recordsFile}
+	manifest.GeneratedAt = time.Now().UTC().Truncate(time.Millisecond)
+
+	// Every attempt writes its own archive, so an interrupted worker cannot overwrite the next one's
+	name := fmt.Sprintf("%s-%d.tar.gz", job.ID, job.Attempts)
+	out, err := uc.store.Create(name)
+	if err != nil {
+		return err
+	}
+	archive := &countingHash{Hash: sha256.New()}
+	err = export.WriteBundle(io.MultiWriter(out, archive), manifest, uc.key,
+		export.BundleFile{Name: recordsFile.Name, Size: recordsFile.Size, Body: tmp})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if removeErr := uc.store.Remove(name); removeErr != nil {
+			uc.logger.Error("Failed to delete export archive", zap.Error(removeErr), zap.String("job_id", job.ID))
+		}
+		return fmt.Errorf("write archive: %w", err)
+	}
+
+	job.RecordCount = manifest.RecordCount
+	job.ArchiveName = name
+	job.ArchiveSize = archive.n
+	job.ArchiveSHA256 = hex.EncodeToString(archive.Sum(nil))
+	job.KeyID = uc.keyID
+	return nil
+}
+
+// countingHash hashes what is written to it and counts the bytes
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.Hash.Write(p)
+}
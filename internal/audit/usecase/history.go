@@ -0,0 +1,77 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/diff"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// ErrEntityRequired is returned when an entity history is requested without entity and entity id
+var ErrEntityRequired = errors.New("entity and entity_id are required")
+
+type GetEntityHistoryInput struct {
+	// MerchantID narrows a platform administrator's read to one merchant
+	MerchantID string
+	Entity     string
+	EntityID   string
+	PageSize   int32
+	PageToken  string
+}
+
+// EntityChange is one log of an entity's history with the fields it changed
+type EntityChange struct {
+	Log     repository.AuditLog
+	Changes []diff.Change
+}
+
+type EntityHistory struct {
+	// Entries are ordered oldest first
+	Entries []EntityChange
+	// NextPageToken is empty on the last page
+	NextPageToken string
+}
+
+func (uc *auditUseCase) GetAuditLog(ctx context.Context, id string) (*repository.AuditLog, error) {
+	scope, err := readScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return uc.repo.GetAuditLog(ctx, scope, id)
+}
+
+func (uc *auditUseCase) GetEntityHistory(ctx context.Context, input *GetEntityHistoryInput) (*EntityHistory, error) {
+	if input.Entity == "" || input.EntityID == "" {
+		return nil, ErrEntityRequired
+	}
+	scope, err := readScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pageSize := normalizePage(1, input.PageSize)
+	opts := repository.ListOptions{PageSize: pageSize}
+	if input.PageToken != "" {
+		if opts.After, err = decodeCursorToken(input.PageToken); err != nil {
+			return nil, err
+		}
+	}
+
+	page, err := uc.repo.ListEntityLogs(ctx, scope, input.Entity, input.EntityID, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &EntityHistory{
+		Entries:       make([]EntityChange, len(page.Logs)),
+		NextPageToken: encodePageToken(page.Next),
+	}
+	for i, log := range page.Logs {
+		history.Entries[i] = EntityChange{
+			Log:     log,
+			Changes: diff.Fields(log.OldValue, log.NewValue),
+		}
+	}
+	return history, nil
+}
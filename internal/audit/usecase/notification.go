@@ -0,0 +1,582 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/notify"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
+	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Limits on notification channels
+const (
+	maxNotificationChannels = 20
+	maxChannelRecipients    = 20
+	maxChannelRuleIDs       = 50
+	maxWebhookURLLength     = 2048
+	minWebhookSecretLength  = 16
+)
+
+// deliveryLease is how long a claimed delivery is hidden from other workers. It outlasts an
+// attempt, so a delivery is only attempted again once its worker is gone.
+const deliveryLease = 5 * time.Minute
+
+// Defaults for NotificationConfig durations that are not positive
+const (
+	defaultDeliveryBackoff = 30 * time.Second
+	defaultDeliveryTimeout = 10 * time.Second
+)
+
+// dispatchLease is how long a claimed alert is hidden from other instances while its
+// deliveries are recorded
+const dispatchLease = time.Minute
+
+// ErrNotificationChannelLimit is returned when a merchant already has the maximum number of channels
+var ErrNotificationChannelLimit = fmt.Errorf("a merchant may have at most %d notification channels", maxNotificationChannels)
+
+// ErrChannelTypeUnavailable is returned for channel types this instance cannot deliver to, e.g.
+// email without a mail server
+var ErrChannelTypeUnavailable = errors.New("notification channel type is not configured")
+
+// AlertObserver is told about every alert stored. Alerts are stored pending dispatch, so an
+// observer that misses one finds it when it polls.
+type AlertObserver interface {
+	AlertRaised(alert *repository.Alert)
+}
+
+type NotificationConfig struct {
+	Workers int
+	// MaxAttempts is how often a delivery is tried before it is failed
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles with every attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout bounds a single attempt
+	Timeout time.Duration
+	// PollInterval is how often pending alerts and due retries are looked for
+	PollInterval time.Duration
+	// KafkaTopic is the topic the kafka notifier publishes to, recorded as the delivery target
+	KafkaTopic string
+}
+
+type NotificationChannelInput struct {
+	// MerchantID names the merchant when a platform administrator creates a channel
+	MerchantID string
+	Name       string
+	// Type is webhook or email
+	Type    string
+	Enabled bool
+	URL     string
+	// Secret signs webhook requests. One is generated when a webhook is created without it,
+	// an update without it keeps the current one.
+	Secret      string
+	Recipients  []string
+	MinSeverity string
+	RuleIDs     []string
+}
+
+type ListAlertDeliveriesInput struct {
+	MerchantID string
+	AlertID    string
+	ChannelID  string
+	Status     string
+	Page       int32
+	PageSize   int32
+}
+
+type NotificationUseCase interface {
+	AlertObserver
+	// Run delivers raised alerts and retries failed deliveries until ctx is done
+	Run(ctx context.Context)
+	// CreateNotificationChannel returns the channel with its webhook secret, which is not returned again
+	CreateNotificationChannel(ctx context.Context, input *NotificationChannelInput) (*repository.NotificationChannel, error)
+	GetNotificationChannel(ctx context.Context, id string) (*repository.NotificationChannel, error)
+	ListNotificationChannels(ctx context.Context, merchantID string) ([]repository.NotificationChannel, error)
+	UpdateNotificationChannel(ctx context.Context, id string, input *NotificationChannelInput) (*repository.NotificationChannel, error)
+	DeleteNotificationChannel(ctx context.Context, id string) error
+	ListAlertDeliveries(ctx context.Context, input *ListAlertDeliveriesInput) ([]repository.AlertDelivery, int32, error)
+}
+
+type notificationUseCase struct {
+	repo repository.NotificationRepository
+	// notifiers by channel type, the kafka notifier receives every alert
+	notifiers map[string]notify.Notifier
+	cfg       NotificationConfig
+	logger    logger.ZapLogger
+	// raised wakes the dispatcher, wake the delivery workers
+	raised chan struct{}
+	wake   chan struct{}
+}
+
+func NewNotificationUseCase(
+	repo repository.NotificationRepository,
+	notifiers map[string]notify.Notifier,
+	cfg NotificationConfig,
+	logger logger.ZapLogger,
+) NotificationUseCase {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultDeliveryBackoff
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = cfg.Backoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultDeliveryTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = cfg.Backoff
+	}
+	return &notificationUseCase{
+		repo:      repo,
+		notifiers: notifiers,
+		cfg:       cfg,
+		logger:    logger,
+		raised:    make(chan struct{}, 1),
+		wake:      make(chan struct{}, cfg.Workers),
+	}
+}
+
+// AlertRaised makes the dispatcher look for pending alerts without blocking rule evaluation
+func (uc *notificationUseCase) AlertRaised(alert *repository.Alert) {
+	select {
+	case uc.raised <- struct{}{}:
+	default:
+	}
+}
+
+func (uc *notificationUseCase) Run(ctx context.Context) {
+	for i := 0; i < uc.cfg.Workers; i++ {
+		go uc.work(ctx)
+	}
+
+	ticker := time.NewTicker(uc.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		uc.dispatchPending(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-uc.raised:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatchPending dispatches stored alerts until none is pending. An alert that fails to
+// dispatch stays pending and is claimed again once its lease ends.
+func (uc *notificationUseCase) dispatchPending(ctx context.Context) {
+	for ctx.Err() == nil {
+		alert, err := uc.repo.ClaimPendingAlert(ctx, time.Now().UTC(), dispatchLease)
+		if err != nil {
+			if !errors.Is(err, repository.ErrNoPendingAlert) && ctx.Err() == nil {
+				uc.logger.Error("Failed to claim pending alert", zap.Error(err))
+			}
+			return
+		}
+		if err := uc.dispatch(ctx, alert); err != nil {
+			uc.logger.Error("Failed to dispatch alert", zap.Error(err),
+				zap.String("alert_id", alert.ID), zap.String("merchant_id", alert.MerchantID))
+			continue
+		}
+		if err := uc.repo.MarkAlertDispatched(ctx, alert.ID); err != nil {
+			uc.logger.Error("Failed to mark alert dispatched", zap.Error(err), zap.String("alert_id", alert.ID))
+		}
+	}
+}
+
+// dispatch records a pending delivery of the alert for every channel that wants it. Delivery
+// ids are derived from the alert and the channel, so dispatching twice records them once.
+func (uc *notificationUseCase) dispatch(ctx context.Context, alert *repository.Alert) error {
+	channels, err := uc.repo.ListNotificationChannels(ctx, repository.MerchantScope(alert.MerchantID), true)
+	if err != nil {
+		return fmt.Errorf("load notification channels: %w", err)
+	}
+
+	delivered := *alert
+	delivered.DispatchPending = false
+	delivered.DispatchAt = time.Time{}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	newDelivery := func(channelID, channelType, target string) repository.AlertDelivery {
+		return repository.AlertDelivery{
+			ID:            deliveryID(alert.ID, channelID, channelType),
+			MerchantID:    alert.MerchantID,
+			AlertID:       alert.ID,
+			ChannelID:     channelID,
+			ChannelType:   channelType,
+			Target:        target,
+			Alert:         delivered,
+			Status:        repository.DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+	}
+
+	var deliveries []repository.AlertDelivery
+	for i := range channels {
+		ch := &channels[i]
+		if !channelAccepts(ch, alert) {
+			continue
+		}
+		deliveries = append(deliveries, newDelivery(ch.ID, ch.Type, channelTarget(ch)))
+	}
+	if _, ok := uc.notifiers[repository.ChannelKafka]; ok {
+		deliveries = append(deliveries, newDelivery("", repository.ChannelKafka, uc.cfg.KafkaTopic))
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	if err := uc.repo.CreateAlertDeliveries(ctx, deliveries); err != nil {
+		return fmt.Errorf("record alert deliveries: %w", err)
+	}
+	for i := 0; i < uc.cfg.Workers; i++ {
+		select {
+		case uc.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// deliveryID identifies the delivery of an alert to a channel, the Kafka topic has no channel id
+func deliveryID(alertID, channelID, channelType string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(alertID+"|"+channelType+"|"+channelID)).String()
+}
+
+func (uc *notificationUseCase) work(ctx context.Context) {
+	ticker := time.NewTicker(uc.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		uc.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-uc.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue attempts pending deliveries until none is due
+func (uc *notificationUseCase) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		delivery, err := uc.repo.ClaimAlertDelivery(ctx, time.Now().UTC(), deliveryLease)
+		if err != nil {
+			if !errors.Is(err, repository.ErrNoDueDelivery) && ctx.Err() == nil {
+				uc.logger.Error("Failed to claim alert delivery", zap.Error(err))
+			}
+			return
+		}
+		uc.attempt(ctx, delivery)
+	}
+}
+
+func (uc *notificationUseCase) attempt(ctx context.Context, d *repository.AlertDelivery) {
+	err := uc.send(ctx, d)
+	if ctx.Err() != nil {
+		// Shutting down, the delivery is attempted again once its lease ends
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	d.Attempts++
+	d.UpdatedAt = now
+	switch {
+	case err == nil:
+		d.Status = repository.DeliverySucceeded
+		d.DeliveredAt = now
+		d.NextAttemptAt = time.Time{}
+		d.LastError = ""
+	case notify.IsPermanent(err) || d.Attempts >= uc.cfg.MaxAttempts:
+		d.Status = repository.DeliveryFailed
+		d.NextAttemptAt = time.Time{}
+		d.LastError = err.Error()
+	default:
+		d.NextAttemptAt = now.Add(uc.backoff(d.Attempts))
+		d.LastError = err.Error()
+	}
+
+	if err != nil {
+		uc.logger.Warn("Alert delivery failed",
+			zap.Error(err),
+			zap.String("delivery_id", d.ID),
+			zap.String("alert_id", d.AlertID),
+			zap.String("channel_type", d.ChannelType),
+			zap.Int("attempts", d.Attempts),
+			zap.String("status", d.Status),
+		)
+	}
+	if err := uc.repo.UpdateAlertDelivery(ctx, d); err != nil {
+		uc.logger.Error("Failed to update alert delivery", zap.Error(err), zap.String("delivery_id", d.ID))
+	}
+}
+
+func (uc *notificationUseCase) send(ctx context.Context, d *repository.AlertDelivery) error {
+	n, ok := uc.notifiers[d.ChannelType]
+	if !ok {
+		return notify.Permanent(ErrChannelTypeUnavailable)
+	}
+
+	target := notify.Target{DeliveryID: d.ID}
+	if d.ChannelID != "" {
+		// Channels are read on every attempt, so retries use a rotated secret
+		ch, err := uc.repo.GetNotificationChannel(ctx, repository.MerchantScope(d.MerchantID), d.ChannelID)
+		if errors.Is(err, repository.ErrNotificationChannelNotFound) {
+			return notify.Permanent(errors.New("notification channel was deleted"))
+		}
+		if err != nil {
+			return err
+		}
+		target.URL = ch.URL
+		target.Secret = ch.Secret
+		target.Recipients = ch.Recipients
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, uc.cfg.Timeout)
+	defer cancel()
+	return n.Notify(sendCtx, target, &d.Alert)
+}
+
+// backoff returns the wait after the given number of failed attempts
+func (uc *notificationUseCase) backoff(attempts int) time.Duration {
+	wait := uc.cfg.Backoff
+	for i := 1; i < attempts && wait < uc.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, uc.cfg.MaxBackoff)
+}
+
+// channelAccepts reports whether the channel's severity and rule filters let the alert through
+func channelAccepts(ch *repository.NotificationChannel, alert *repository.Alert) bool {
+	if ch.MinSeverity != "" && slices.Index(allowedSeverities, alert.Severity) < slices.Index(allowedSeverities, ch.MinSeverity) {
+		return false
+	}
+	return len(ch.RuleIDs) == 0 || slices.Contains(ch.RuleIDs, alert.RuleID)
+}
+
+func channelTarget(ch *repository.NotificationChannel) string {
+	if ch.Type == repository.ChannelEmail {
+		return strings.Join(ch.Recipients, ", ")
+	}
+	return ch.URL
+}
+
+func (uc *notificationUseCase) CreateNotificationChannel(ctx context.Context, input *NotificationChannelInput) (*repository.NotificationChannel, error) {
+	scope, err := ruleScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	if scope.MerchantID == "" {
+		if scope.AllMerchants {
+			return nil, ErrMerchantRequired
+		}
+		return nil, repository.ErrUnscopedQuery
+	}
+
+	ch := &repository.NotificationChannel{
+		ID:         uuid.New().String(),
+		MerchantID: scope.MerchantID,
+	}
+	if input.Type == repository.ChannelWebhook && input.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		input.Secret = hex.EncodeToString(secret)
+	}
+	if err := uc.applyChannelInput(ch, input); err != nil {
+		return nil, err
+	}
+
+	existing, err := uc.repo.ListNotificationChannels(ctx, scope, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxNotificationChannels {
+		return nil, ErrNotificationChannelLimit
+	}
+
+	id, _ := auth.IdentityFrom(ctx)
+	ch.CreatedBy = id.UserID
+	ch.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	ch.UpdatedAt = ch.CreatedAt
+	if err := uc.repo.CreateNotificationChannel(ctx, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (uc *notificationUseCase) GetNotificationChannel(ctx context.Context, id string) (*repository.NotificationChannel, error) {
+	scope, err := ruleScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	ch, err := uc.repo.GetNotificationChannel(ctx, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	ch.Secret = ""
+	return ch, nil
+}
+
+func (uc *notificationUseCase) ListNotificationChannels(ctx context.Context, merchantID string) ([]repository.NotificationChannel, error) {
+	scope, err := ruleScope(ctx, merchantID)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := uc.repo.ListNotificationChannels(ctx, scope, false)
+	if err != nil {
+		return nil, err
+	}
+	for i := range channels {
+		channels[i].Secret = ""
+	}
+	return channels, nil
+}
+
+func (uc *notificationUseCase) UpdateNotificationChannel(ctx context.Context, id string, input *NotificationChannelInput) (*repository.NotificationChannel, error) {
+	scope, err := ruleScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	ch, err := uc.repo.GetNotificationChannel(ctx, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if input.MerchantID != "" && input.MerchantID != ch.MerchantID {
+		return nil, ErrCrossTenant
+	}
+
+	if input.Secret == "" && input.Type == ch.Type {
+		input.Secret = ch.Secret
+	}
+	if err := uc.applyChannelInput(ch, input); err != nil {
+		return nil, err
+	}
+	ch.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if err := uc.repo.UpdateNotificationChannel(ctx, scope, ch); err != nil {
+		return nil, err
+	}
+	ch.Secret = ""
+	return ch, nil
+}
+
+func (uc *notificationUseCase) DeleteNotificationChannel(ctx context.Context, id string) error {
+	scope, err := ruleScope(ctx, "")
+	if err != nil {
+		return err
+	}
+	return uc.repo.DeleteNotificationChannel(ctx, scope, id)
+}
+
+func (uc *notificationUseCase) ListAlertDeliveries(ctx context.Context, input *ListAlertDeliveriesInput) ([]repository.AlertDelivery, int32, error) {
+	scope, err := ruleScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	page, pageSize := normalizePage(input.Page, input.PageSize)
+	filter := repository.AlertDeliveryFilter{
+		AlertID:   input.AlertID,
+		ChannelID: input.ChannelID,
+		Status:    input.Status,
+	}
+	return uc.repo.ListAlertDeliveries(ctx, scope, filter, page, pageSize)
+}
+
+// applyChannelInput validates the input and copies it onto the channel. Invalid input is
+// reported as a *ValidationError.
+func (uc *notificationUseCase) applyChannelInput(ch *repository.NotificationChannel, input *NotificationChannelInput) error {
+	v := &validator{}
+	if v.required("name", input.Name) {
+		v.maxLength("name", input.Name, maxRuleNameLength)
+	}
+
+	var channelURL string
+	var recipients []string
+	switch input.Type {
+	case repository.ChannelWebhook:
+		u, err := url.Parse(input.URL)
+		switch {
+		case input.URL == "":
+			v.add("url", "is required")
+		case len(input.URL) > maxWebhookURLLength:
+			v.add("url", "must be at most %d bytes", maxWebhookURLLength)
+		case err != nil || u.Scheme != "https" || u.Host == "":
+			v.add("url", "must be an absolute https URL")
+		case u.Hostname() == "localhost" || (net.ParseIP(u.Hostname()) != nil && !notify.PublicAddress(net.ParseIP(u.Hostname()))):
+			v.add("url", "must not point at a loopback, private or link-local address")
+		default:
+			channelURL = input.URL
+		}
+		if len(input.Secret) < minWebhookSecretLength {
+			v.add("secret", "must be at least %d characters", minWebhookSecretLength)
+		}
+	case repository.ChannelEmail:
+		if len(input.Recipients) == 0 {
+			v.add("recipients", "is required")
+		} else if len(input.Recipients) > maxChannelRecipients {
+			v.add("recipients", "must have at most %d entries", maxChannelRecipients)
+		}
+		for i, r := range input.Recipients {
+			addr, err := mail.ParseAddress(r)
+			if err != nil {
+				v.add(fmt.Sprintf("recipients[%d]", i), "must be an email address")
+				continue
+			}
+			recipients = append(recipients, addr.Address)
+		}
+	default:
+		v.add("type", "must be one of %s, %s", repository.ChannelWebhook, repository.ChannelEmail)
+	}
+
+	if input.MinSeverity != "" {
+		v.oneOf("min_severity", input.MinSeverity, allowedSeverities)
+	}
+	if len(input.RuleIDs) > maxChannelRuleIDs {
+		v.add("rule_ids", "must have at most %d entries", maxChannelRuleIDs)
+	}
+
+	if err := v.err(); err != nil {
+		return err
+	}
+	if _, ok := uc.notifiers[input.Type]; !ok {
+		return ErrChannelTypeUnavailable
+	}
+
+	ch.Name = input.Name
+	ch.Type = input.Type
+	ch.Enabled = input.Enabled
+	ch.URL = channelURL
+	ch.Secret = ""
+	if input.Type == repository.ChannelWebhook {
+		ch.Secret = input.Secret
+	}
+	ch.Recipients = recipients
+	ch.MinSeverity = input.MinSeverity
+	ch.RuleIDs = input.RuleIDs
+	return nil
+}
@@ -0,0 +1,173 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Reasons an event is quarantined
+const (
+	QuarantineReasonUnmarshal  = "unmarshal_failed"
+	QuarantineReasonValidation = "validation_failed"
+	QuarantineReasonPersist    = "persist_failed"
+)
+
+// ErrUndecodableEvent is returned when a quarantined payload still cannot be parsed
+var ErrUndecodableEvent = errors.New("quarantined payload is not a valid audit event")
+
+type QuarantineInput struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       string
+	Payload   []byte
+	Reason    string
+	Err       error
+	Attempts  int
+}
+
+type ListQuarantinedEventsInput struct {
+	Status string
+	// MerchantID narrows a platform administrator's read to one merchant
+	MerchantID string
+	Reason     string
+	Page       int32
+	PageSize   int32
+}
+
+type QuarantineUseCase interface {
+	// Quarantine stores a message that could not be stored as an audit log. A message delivered
+	// again returns the record it was first quarantined under.
+	Quarantine(ctx context.Context, input *QuarantineInput) (*repository.QuarantinedEvent, error)
+	ListQuarantinedEvents(ctx context.Context, input *ListQuarantinedEventsInput) ([]repository.QuarantinedEvent, int32, error)
+	GetQuarantinedEvent(ctx context.Context, id string) (*repository.QuarantinedEvent, error)
+	// ReplayQuarantinedEvent stores the event again, e.g. after the bug that rejected it is fixed
+	ReplayQuarantinedEvent(ctx context.Context, id string) (*repository.QuarantinedEvent, error)
+	DiscardQuarantinedEvent(ctx context.Context, id, reason string) (*repository.QuarantinedEvent, error)
+}
+
+type quarantineUseCase struct {
+	repo   repository.QuarantineRepository
+	audit  UseCase
+	logger logger.ZapLogger
+}
+
+func NewQuarantineUseCase(repo repository.QuarantineRepository, audit UseCase, logger logger.ZapLogger) QuarantineUseCase {
+	return &quarantineUseCase{
+		repo:   repo,
+		audit:  audit,
+		logger: logger,
+	}
+}
+
+func (uc *quarantineUseCase) Quarantine(ctx context.Context, input *QuarantineInput) (*repository.QuarantinedEvent, error) {
+	event := &repository.QuarantinedEvent{
+		ID:            uuid.New().String(),
+		Topic:         input.Topic,
+		Partition:     input.Partition,
+		Offset:        input.Offset,
+		Key:           input.Key,
+		Payload:       input.Payload,
+		Reason:        input.Reason,
+		Attempts:      input.Attempts,
+		Status:        repository.QuarantineStatusQuarantined,
+		QuarantinedAt: time.Now().UTC(),
+	}
+	if input.Err != nil {
+		event.Error = input.Err.Error()
+	}
+	// Keep the ids when the payload is readable so events can be found per merchant
+	if decoded, err := DecodeAuditEvent(input.Payload); err == nil {
+		event.EventID = decoded.EventID
+		event.MerchantID = decoded.Payload.MerchantID
+	}
+
+	// A redelivered message keeps the id it was first quarantined under
+	return uc.repo.CreateQuarantinedEvent(ctx, event)
+}
+
+func (uc *quarantineUseCase) ListQuarantinedEvents(ctx context.Context, input *ListQuarantinedEventsInput) ([]repository.QuarantinedEvent, int32, error) {
+	scope, err := merchantReadScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	page, pageSize := normalizePage(input.Page, input.PageSize)
+	filter := repository.QuarantineFilter{
+		Status: input.Status,
+		Reason: input.Reason,
+	}
+	return uc.repo.ListQuarantinedEvents(ctx, scope, filter, page, pageSize)
+}
+
+func (uc *quarantineUseCase) GetQuarantinedEvent(ctx context.Context, id string) (*repository.QuarantinedEvent, error) {
+	scope, err := merchantReadScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return uc.repo.GetQuarantinedEvent(ctx, scope, id)
+}
+
+func (uc *quarantineUseCase) ReplayQuarantinedEvent(ctx context.Context, id string) (*repository.QuarantinedEvent, error) {
+	scope, err := merchantReadScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := uc.repo.GetQuarantinedEvent(ctx, scope, id)
+	if err != nil {
+		return nil, err
+	}
+	if event.Status != repository.QuarantineStatusQuarantined {
+		return nil, repository.ErrQuarantineResolved
+	}
+
+	decoded, err := DecodeAuditEvent(event.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUndecodableEvent, err)
+	}
+
+	// The original event id keeps a replay idempotent if it is retried
+	input := decoded.ToInput(KafkaEventID(event.Topic, event.Partition, event.Offset))
+	if err := uc.audit.CreateAuditLog(ctx, input); err != nil {
+		if recErr := uc.repo.RecordReplayFailure(ctx, id, err.Error()); recErr != nil {
+			uc.logger.Error("Failed to record replay failure", zap.Error(recErr), zap.String("id", id))
+		}
+		return nil, err
+	}
+
+	return uc.repo.ResolveQuarantinedEvent(ctx, scope, id, repository.QuarantineStatusReplayed, "replayed")
+}
+
+func (uc *quarantineUseCase) DiscardQuarantinedEvent(ctx context.Context, id, reason string) (*repository.QuarantinedEvent, error) {
+	scope, err := merchantReadScope(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if reason == "" {
+		reason = "discarded"
+	}
+	return uc.repo.ResolveQuarantinedEvent(ctx, scope, id, repository.QuarantineStatusDiscarded, reason)
+}
+
+// normalizePage applies the default page and caps the page size
+func normalizePage(page, pageSize int32) (int32, int32) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+	return page, pageSize
+}
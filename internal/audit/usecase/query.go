@@ -0,0 +1,154 @@
+package usecase
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// Limits on the filters of a listing
+const (
+	maxFilters         = 20
+	maxFilterValues    = 100
+	maxFilterValueSize = 256
+)
+
+// FieldFilter matches logs whose field has one of Values. A value ending in "*" matches by
+// prefix, e.g. "order.*". Not excludes the matching logs instead.
+type FieldFilter struct {
+	// Field is user_id, entity, entity_id, action, store_id, severity, result, source_service,
+	// correlation_id, changed_field or details.<path>, e.g. details.payment.method
+	Field  string
+	Values []string
+	Not    bool
+}
+
+// filterFields maps the filterable fields to the stored ones
+var filterFields = map[string]repository.Field{
+	"user_id":        repository.FieldUserID,
+	"entity":         repository.FieldEntity,
+	"entity_id":      repository.FieldEntityID,
+	"action":         repository.FieldAction,
+	"store_id":       repository.FieldStoreID,
+	"severity":       repository.FieldSeverity,
+	"result":         repository.FieldResult,
+	"source_service": repository.FieldSourceService,
+	"correlation_id": repository.FieldCorrelationID,
+	"changed_field":  repository.FieldChangedFields,
+}
+
+// buildLogQuery turns the filters of a listing into a query. Invalid filters are reported
+// as a *ValidationError.
+func buildLogQuery(input *ListAuditLogsInput) (*repository.LogQuery, error) {
+	v := &validator{}
+	q := &repository.LogQuery{
+		StartDate:     input.StartDate,
+		EndDate:       input.EndDate,
+		MinDurationMs: input.MinDurationMs,
+		MaxDurationMs: input.MaxDurationMs,
+		Text:          input.Query,
+	}
+
+	// The single-value filters are shorthands for one-value conditions
+	for _, f := range []struct {
+		field repository.Field
+		value string
+	}{
+		{repository.FieldUserID, input.UserID},
+		{repository.FieldEntity, input.Entity},
+		{repository.FieldEntityID, input.EntityID},
+		{repository.FieldAction, input.Action},
+		{repository.FieldStoreID, input.StoreID},
+		{repository.FieldSeverity, input.Severity},
+		{repository.FieldResult, input.Result},
+		{repository.FieldSourceService, input.SourceService},
+		{repository.FieldCorrelationID, input.CorrelationID},
+		{repository.FieldChangedFields, input.ChangedField},
+	} {
+		if f.value != "" {
+			q.Conditions = append(q.Conditions, repository.Condition{Field: f.field, Values: []string{f.value}})
+		}
+	}
+
+	if len(input.Filters) > maxFilters {
+		v.add("filters", "must have at most %d entries", maxFilters)
+	}
+	for i, f := range input.Filters {
+		if c, ok := v.condition(fmt.Sprintf("filters[%d]", i), f); ok {
+			q.Conditions = append(q.Conditions, c)
+		}
+	}
+
+	if !input.StartDate.IsZero() && !input.EndDate.IsZero() && input.EndDate.Before(input.StartDate) {
+		v.add("end_date", "must not be before start_date")
+	}
+	if input.MinDurationMs != nil && *input.MinDurationMs < 0 {
+		v.add("min_duration_ms", "must not be negative")
+	}
+	if input.MinDurationMs != nil && input.MaxDurationMs != nil && *input.MaxDurationMs < *input.MinDurationMs {
+		v.add("max_duration_ms", "must not be below min_duration_ms")
+	}
+
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (v *validator) condition(name string, f FieldFilter) (repository.Condition, bool) {
+	c := repository.Condition{Not: f.Not}
+	valid := true
+
+	if path, ok := strings.CutPrefix(f.Field, "details."); ok {
+		if !repository.ValidDetailsPath(path) {
+			v.add(name+".field", "must be a dotted path of letters, digits, '_' or '-' at most 8 levels deep")
+			valid = false
+		}
+		c.Field = repository.DetailsField(path)
+	} else if field, ok := filterFields[f.Field]; ok {
+		c.Field = field
+	} else {
+		v.add(name+".field", "cannot filter on %q", f.Field)
+		valid = false
+	}
+
+	if len(f.Values) == 0 {
+		v.add(name+".values", "is required")
+		valid = false
+	} else if len(f.Values) > maxFilterValues {
+		v.add(name+".values", "must have at most %d entries", maxFilterValues)
+		valid = false
+	}
+	for j, value := range f.Values {
+		field := fmt.Sprintf("%s.values[%d]", name, j)
+		if len(value) > maxFilterValueSize {
+			v.add(field, "must be at most %d bytes", maxFilterValueSize)
+			valid = false
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(value, "*"); ok {
+			if prefix == "" {
+				v.add(field, "must not be a bare '*'")
+				valid = false
+			}
+			c.Prefixes = append(c.Prefixes, prefix)
+			continue
+		}
+		switch c.Field {
+		case repository.FieldSeverity:
+			valid = v.allowed(field, value, allowedSeverities) && valid
+		case repository.FieldResult:
+			valid = v.allowed(field, value, allowedResults) && valid
+		}
+		c.Values = append(c.Values, value)
+	}
+	return c, valid
+}
+
+// allowed is oneOf reporting whether value was accepted
+func (v *validator) allowed(field, value string, allowed []string) bool {
+	n := len(v.violations)
+	v.oneOf(field, value, allowed)
+	return len(v.violations) == n
+}
@@ -0,0 +1,175 @@
+package usecase
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// maxDetailsTextValues bounds how many strings of a log's details are indexed for text search
+const maxDetailsTextValues = 256
+
+// snippetContext is the number of characters kept on each side of a highlighted term
+const snippetContext = 40
+
+// SearchMatch is the relevance of a log to a text query and where the query matched
+type SearchMatch struct {
+	Score      float64
+	Highlights []Highlight
+}
+
+// Highlight is a snippet of a matching field with the query terms wrapped in <em> tags. The
+// snippet is HTML: the text around and inside the tags is escaped.
+type Highlight struct {
+	// Field is action, entity, error_message or details.<path>
+	Field   string
+	Snippet string
+}
+
+// detailsText collects the string values inside details for the text index
+func detailsText(details map[string]interface{}) []string {
+	var values []string
+	walkStrings("", jsonvalue.Normalize(details), func(_, s string) bool {
+		values = append(values, s)
+		return len(values) < maxDetailsTextValues
+	})
+	return values
+}
+
+// walkStrings calls fn with the dotted path of every string in v until fn returns false
+func walkStrings(path string, v interface{}, fn func(path, s string) bool) bool {
+	switch val := v.(type) {
+	case string:
+		if val == "" {
+			return true
+		}
+		return fn(path, val)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			if !walkStrings(child, val[k], fn) {
+				return false
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if !walkStrings(path, item, fn) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// searchTerms returns the lower-cased words of a text query, negated words are left out
+func searchTerms(query string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		word = strings.ToLower(strings.Trim(word, `"`))
+		if word != "" && !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// highlight returns a snippet for every searched field of the log containing a term.
+// The text index also ignores diacritics, so a matching log can have no highlights.
+func highlight(log *repository.AuditLog, terms []string) []Highlight {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var highlights []Highlight
+	add := func(field, value string) bool {
+		if snippet, ok := snippetOf(value, terms); ok {
+			highlights = append(highlights, Highlight{Field: field, Snippet: snippet})
+		}
+		return true
+	}
+	add("action", log.Action)
+	add("entity", log.Entity)
+	add("error_message", log.ErrorMessage)
+	walkStrings("details", jsonvalue.Normalize(log.Details), add)
+	return highlights
+}
+
+// snippetOf cuts the text around the first term found and wraps every term in it in <em> tags.
+// The text comes from producers, so everything but the tags is HTML-escaped.
+func snippetOf(text string, terms []string) (string, bool) {
+	lower := strings.ToLower(text)
+	// Lower-casing can change byte lengths, then positions would not line up with text
+	if len(lower) != len(text) {
+		return "", false
+	}
+
+	first := -1
+	for _, t := range terms {
+		if i := strings.Index(lower, t); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	start := first
+	for n := 0; start > 0 && n < snippetContext; n++ {
+		_, size := utf8.DecodeLastRuneInString(text[:start])
+		start -= size
+	}
+	end := first
+	for n := 0; end < len(text) && n < 2*snippetContext; n++ {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		if t := termAt(lower[i:end], terms); t != "" {
+			b.WriteString("<em>")
+			b.WriteString(html.EscapeString(text[i : i+len(t)]))
+			b.WriteString("</em>")
+			i += len(t)
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		b.WriteString(html.EscapeString(text[i : i+size]))
+		i += size
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// termAt returns the longest term s starts with
+func termAt(s string, terms []string) string {
+	match := ""
+	for _, t := range terms {
+		if len(t) > len(match) && strings.HasPrefix(s, t) {
+			match = t
+		}
+	}
+	return match
+}
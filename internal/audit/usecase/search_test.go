@@ -0,0 +1,79 @@
+package usecase
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+func TestSnippetOf(t *testing.T) {
+	long := strings.Repeat("a", 60)
+
+	tests := []struct {
+		name  string
+		text  string
+		query string
+		want  string
+		ok    bool
+	}{
+		{name: "term", text: "payment declined", query: "declined", want: "payment <em>declined</em>", ok: true},
+		{name: "case insensitive", text: "Payment Declined", query: "declined", want: "Payment <em>Declined</em>", ok: true},
+		{name: "every term", text: "card declined by bank", query: "bank declined", want: "card <em>declined</em> by <em>bank</em>", ok: true},
+		{name: "longest term", text: "refunded", query: "refund refunded", want: "<em>refunded</em>", ok: true},
+		{name: "no match", text: "payment declined", query: "refund"},
+		{name: "cut before", text: long + " declined", query: "declined", want: "…" + strings.Repeat("a", 39) + " <em>declined</em>", ok: true},
+		{name: "cut after", text: "declined " + long + long, query: "declined", want: "<em>declined</em> " + strings.Repeat("a", 71) + "…", ok: true},
+		{
+			name:  "script payload",
+			text:  `<script>alert("declined")</script>`,
+			query: "declined",
+			want:  `&lt;script&gt;alert(&#34;<em>declined</em>&#34;)&lt;/script&gt;`,
+			ok:    true,
+		},
+		{
+			name:  "markup in the term",
+			text:  `failed at <img src=x onerror=alert(1)>`,
+			query: "<img",
+			want:  `failed at <em>&lt;img</em> src=x onerror=alert(1)&gt;`,
+			ok:    true,
+		},
+		{name: "entities", text: "fish & chips declined", query: "declined", want: "fish &amp; chips <em>declined</em>", ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := snippetOf(tt.text, searchTerms(tt.query))
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("snippetOf(%q) = %q, %v, want %q, %v", tt.text, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHighlightEscapesProducerText(t *testing.T) {
+	log := &repository.AuditLog{
+		Action:       "payment.declined",
+		ErrorMessage: `<script>alert("xss")</script> declined`,
+		Details: map[string]interface{}{
+			"note": `<img src=x onerror=alert(1)> declined`,
+		},
+	}
+
+	got := highlight(log, searchTerms("declined"))
+	want := []Highlight{
+		{Field: "action", Snippet: "payment.<em>declined</em>"},
+		{Field: "error_message", Snippet: `&lt;script&gt;alert(&#34;xss&#34;)&lt;/script&gt; <em>declined</em>`},
+		{Field: "details.note", Snippet: `&lt;img src=x onerror=alert(1)&gt; <em>declined</em>`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("highlight = %q, want %q", got, want)
+	}
+	for _, h := range got {
+		stripped := strings.NewReplacer("<em>", "", "</em>", "").Replace(h.Snippet)
+		if strings.ContainsAny(stripped, "<>") {
+			t.Errorf("%s snippet %q contains markup besides <em>", h.Field, h.Snippet)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/jsonvalue"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// ErrNoEntityHistory is returned when an entity has no logs up to the requested time
+var ErrNoEntityHistory = errors.New("entity has no audit logs up to the requested time")
+
+// Reasons the rebuilt state of an entity may be incomplete
+const (
+	// GapMissingInitialState: the first log is not a creation, fields it does not mention are unknown
+	GapMissingInitialState = "missing_initial_state"
+	// GapOldValueMismatch: a log's old_value disagrees with the rebuilt state, so a change was not audited
+	GapOldValueMismatch = "old_value_mismatch"
+	// GapNoSnapshot: a log has neither old_value nor new_value, any change it made is unknown
+	GapNoSnapshot = "no_snapshot"
+)
+
+type GetEntityStateInput struct {
+	// MerchantID narrows a platform administrator's read to one merchant
+	MerchantID string
+	Entity     string
+	EntityID   string
+	// AsOf defaults to now
+	AsOf time.Time
+}
+
+// StateGap is a log after which the rebuilt state may not match the real one
+type StateGap struct {
+	LogID     string
+	Timestamp time.Time
+	Reason    string
+	// Fields are the affected fields, empty when unknown
+	Fields []string
+}
+
+// EntityState is an entity as rebuilt from the snapshots of its audit trail
+type EntityState struct {
+	Entity   string
+	EntityID string
+	AsOf     time.Time
+	// State is nil when the entity did not exist, or was deleted, at AsOf
+	State  map[string]interface{}
+	Exists bool
+	// LastLog is the last log applied
+	LastLog     *repository.AuditLog
+	AppliedLogs int64
+	Gaps        []StateGap
+	// Complete is set when no gaps were found
+	Complete bool
+}
+
+// GetEntityState replays an entity's trail up to AsOf. Snapshots may be partial: new_value
+// fields are applied over the state and fields only in old_value are removed. A log with only
+// old_value deletes the entity.
+func (uc *auditUseCase) GetEntityState(ctx context.Context, input *GetEntityStateInput) (*EntityState, error) {
+	if input.Entity == "" || input.EntityID == "" {
+		return nil, ErrEntityRequired
+	}
+	scope, err := readScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+
+	asOf := input.AsOf
+	if asOf.IsZero() {
+		asOf = time.Now().UTC()
+	}
+	res := &EntityState{Entity: input.Entity, EntityID: input.EntityID, AsOf: asOf}
+
+	err = uc.repo.WalkEntityLogs(ctx, scope, input.Entity, input.EntityID, asOf, func(log *repository.AuditLog) error {
+		res.apply(log)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.LastLog == nil {
+		return nil, ErrNoEntityHistory
+	}
+
+	res.Complete = len(res.Gaps) == 0
+	return res, nil
+}
+
+func (s *EntityState) apply(log *repository.AuditLog) {
+	first := s.LastLog == nil
+	s.LastLog = log
+	s.AppliedLogs++
+
+	oldValue, _ := jsonvalue.Normalize(log.OldValue).(map[string]interface{})
+	newValue, _ := jsonvalue.Normalize(log.NewValue).(map[string]interface{})
+
+	switch {
+	case len(oldValue) == 0 && len(newValue) == 0:
+		s.addGap(log, GapNoSnapshot, nil)
+		return
+	case first && len(oldValue) > 0:
+		s.addGap(log, GapMissingInitialState, nil)
+	case !first:
+		if fields := s.mismatchedFields(oldValue); len(fields) > 0 {
+			s.addGap(log, GapOldValueMismatch, fields)
+		}
+	}
+
+	if len(newValue) == 0 {
+		// Only the old snapshot is left, the entity was deleted
+		s.State = nil
+		s.Exists = false
+		return
+	}
+
+	if s.State == nil {
+		s.State = make(map[string]interface{}, len(newValue))
+	}
+	for k := range oldValue {
+		if _, ok := newValue[k]; !ok {
+			delete(s.State, k)
+		}
+	}
+	for k, v := range newValue {
+		s.State[k] = v
+	}
+	s.Exists = true
+}
+
+// mismatchedFields returns the old_value fields that differ from the rebuilt state
+func (s *EntityState) mismatchedFields(oldValue map[string]interface{}) []string {
+	var fields []string
+	for k, v := range oldValue {
+		current, ok := s.State[k]
+		if !ok || !reflect.DeepEqual(current, v) {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (s *EntityState) addGap(log *repository.AuditLog, reason string, fields []string) {
+	s.Gaps = append(s.Gaps, StateGap{
+		LogID:     log.ID,
+		Timestamp: log.Timestamp,
+		Reason:    reason,
+		Fields:    fields,
+	})
+}
@@ -0,0 +1,156 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// maxStatsGroupBy bounds the dimensions of one aggregation
+const maxStatsGroupBy = 3
+
+// defaultStatsRange is the window aggregated when no start date is given
+const defaultStatsRange = 30 * 24 * time.Hour
+
+// statsGroupFields maps the dimensions stats can be grouped by to the stored fields
+var statsGroupFields = map[string]repository.Field{
+	"action":         repository.FieldAction,
+	"entity":         repository.FieldEntity,
+	"user_id":        repository.FieldUserID,
+	"store_id":       repository.FieldStoreID,
+	"severity":       repository.FieldSeverity,
+	"result":         repository.FieldResult,
+	"source_service": repository.FieldSourceService,
+}
+
+var allowedStatsBuckets = []string{repository.BucketHour, repository.BucketDay, repository.BucketWeek}
+
+type GetAuditStatsInput struct {
+	// Filter selects the logs, paging and search ordering are ignored. Without a start date
+	// the last 30 days before the end date, or now, are aggregated.
+	Filter ListAuditLogsInput
+	// GroupBy lists up to three of action, entity, user_id, store_id, severity, result and source_service
+	GroupBy []string
+	// Bucket is empty, hour, day or week
+	Bucket string
+	// Timezone is the IANA zone bucket boundaries are computed in, UTC when empty
+	Timezone string
+}
+
+// AuditStatsRow holds the metrics of one group in one time bucket
+type AuditStatsRow struct {
+	// Bucket is the start of the time bucket, zero without bucketing
+	Bucket time.Time
+	// Keys maps each grouped dimension to its value
+	Keys         map[string]string
+	Count        int64
+	FailureCount int64
+	PartialCount int64
+	FailureRate  float64
+	// Duration metrics cover logs reporting a duration, nil when none do
+	AvgDurationMs *float64
+	P50DurationMs *float64
+	P90DurationMs *float64
+	P99DurationMs *float64
+}
+
+type AuditStats struct {
+	StartDate time.Time
+	EndDate   time.Time
+	// Rows are ordered by bucket, then by descending count
+	Rows []AuditStatsRow
+	// Truncated is set when there were more groups than repository.MaxStatsRows
+	Truncated bool
+}
+
+func (uc *auditUseCase) GetAuditStats(ctx context.Context, input *GetAuditStatsInput) (*AuditStats, error) {
+	scope, err := readScope(ctx, input.Filter.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := input.Filter
+	if filter.EndDate.IsZero() {
+		filter.EndDate = time.Now().UTC()
+	}
+	if filter.StartDate.IsZero() {
+		filter.StartDate = filter.EndDate.Add(-defaultStatsRange)
+	}
+	q, err := buildLogQuery(&filter)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := statsSpec(input)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := uc.repo.AggregateStats(ctx, scope, q, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &AuditStats{
+		StartDate: filter.StartDate,
+		EndDate:   filter.EndDate,
+		Rows:      make([]AuditStatsRow, len(res.Rows)),
+		Truncated: res.Truncated,
+	}
+	for i, r := range res.Rows {
+		row := AuditStatsRow{
+			Bucket:        r.Bucket,
+			Keys:          make(map[string]string, len(input.GroupBy)),
+			Count:         r.Count,
+			FailureCount:  r.Failures,
+			PartialCount:  r.Partials,
+			AvgDurationMs: r.AvgDurationMs,
+			P50DurationMs: r.P50DurationMs,
+			P90DurationMs: r.P90DurationMs,
+			P99DurationMs: r.P99DurationMs,
+		}
+		if r.Count > 0 {
+			row.FailureRate = float64(r.Failures) / float64(r.Count)
+		}
+		for _, name := range input.GroupBy {
+			row.Keys[name] = r.Keys[statsGroupFields[name]]
+		}
+		stats.Rows[i] = row
+	}
+	return stats, nil
+}
+
+// statsSpec validates the grouping of a stats request. Invalid input is reported as a *ValidationError.
+func statsSpec(input *GetAuditStatsInput) (repository.StatsSpec, error) {
+	v := &validator{}
+	spec := repository.StatsSpec{Bucket: input.Bucket}
+
+	if len(input.GroupBy) > maxStatsGroupBy {
+		v.add("group_by", "at most %d dimensions are allowed", maxStatsGroupBy)
+	}
+	seen := make(map[string]bool)
+	for i, name := range input.GroupBy {
+		field, ok := statsGroupFields[name]
+		switch {
+		case !ok:
+			v.add(fmt.Sprintf("group_by[%d]", i), "cannot group by %q", name)
+		case seen[name]:
+			v.add(fmt.Sprintf("group_by[%d]", i), "%s is listed twice", name)
+		default:
+			spec.GroupBy = append(spec.GroupBy, field)
+		}
+		seen[name] = true
+	}
+	if input.Bucket != "" {
+		v.oneOf("bucket", input.Bucket, allowedStatsBuckets)
+	}
+	if input.Timezone != "" {
+		loc, err := time.LoadLocation(input.Timezone)
+		if err != nil {
+			v.add("timezone", "unknown time zone %q", input.Timezone)
+		}
+		spec.Location = loc
+	}
+	return spec, v.err()
+}
@@ -0,0 +1,63 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
+)
+
+// ErrCrossTenant is returned when a caller asks for data of a merchant other than its own
+var ErrCrossTenant = errors.New("merchant is outside the caller's tenant")
+
+// ErrForbidden is returned when the caller's role may not read the requested audit data
+var ErrForbidden = errors.New("caller's role may not read this audit data")
+
+// readScope scopes a read to what the caller may see: owners see their merchant, managers
+// their store and cashiers their own actions. Platform administrators may read any merchant,
+// or all of them when no merchant is requested. A caller without a merchant gets an empty
+// scope, which the repository rejects with repository.ErrUnscopedQuery.
+func readScope(ctx context.Context, merchantID string) (repository.TenantScope, error) {
+	id, _ := auth.IdentityFrom(ctx)
+	if id.IsPlatformAdmin() {
+		if merchantID != "" {
+			return repository.MerchantScope(merchantID), nil
+		}
+		return repository.TenantScope{AllMerchants: true}, nil
+	}
+	if merchantID != "" && merchantID != id.MerchantID {
+		return repository.TenantScope{}, ErrCrossTenant
+	}
+
+	scope := repository.MerchantScope(id.MerchantID)
+	switch id.Role {
+	case auth.RoleOwner:
+	case auth.RoleManager:
+		if id.StoreID == "" {
+			return repository.TenantScope{}, ErrForbidden
+		}
+		scope.StoreID = id.StoreID
+	case auth.RoleCashier:
+		if id.UserID == "" {
+			return repository.TenantScope{}, ErrForbidden
+		}
+		scope.UserID = id.UserID
+	default:
+		return repository.TenantScope{}, ErrForbidden
+	}
+	return scope, nil
+}
+
+// merchantReadScope is readScope for operations over a merchant's whole log, such as chain
+// verification and quarantine management, which only owners and platform administrators may run
+func merchantReadScope(ctx context.Context, merchantID string) (repository.TenantScope, error) {
+	scope, err := readScope(ctx, merchantID)
+	if err != nil {
+		return repository.TenantScope{}, err
+	}
+	if scope.StoreID != "" || scope.UserID != "" {
+		return repository.TenantScope{}, ErrForbidden
+	}
+	return scope, nil
+}
@@ -0,0 +1,325 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/auth"
+	"go.uber.org/zap"
+)
+
+const (
+	merchantA = "6f1c2f4e-1b7a-4d55-9a53-1f0e4c1d0a01"
+	merchantB = "6f1c2f4e-1b7a-4d55-9a53-1f0e4c1d0b02"
+	userOne   = "0c0f3a52-7d1e-4e0b-8c57-2a4f3e6b0001"
+	userTwo   = "0c0f3a52-7d1e-4e0b-8c57-2a4f3e6b0002"
+	storeOne  = "9b3e5d10-4c2a-4f7e-b1d8-5e6f7a8b0001"
+	storeTwo  = "9b3e5d10-4c2a-4f7e-b1d8-5e6f7a8b0002"
+)
+
+// tenantFixtures are labelled through their correlation id and source service. b1 shares
+// its user and store ids with merchant A's logs, so only the merchant keeps it apart.
+var tenantFixtures = []*CreateAuditLogInput{
+	{MerchantID: merchantA, UserID: userOne, StoreID: storeOne, CorrelationID: "a1", SourceService: "a1"},
+	{MerchantID: merchantA, UserID: userTwo, StoreID: storeOne, CorrelationID: "a2", SourceService: "a2"},
+	{MerchantID: merchantA, UserID: userTwo, StoreID: storeTwo, CorrelationID: "a3", SourceService: "a3"},
+	{MerchantID: merchantB, UserID: userOne, StoreID: storeOne, CorrelationID: "b1", SourceService: "b1"},
+}
+
+var (
+	ownerA     = auth.Identity{MerchantID: merchantA, UserID: userOne, Role: auth.RoleOwner}
+	managerA   = auth.Identity{MerchantID: merchantA, UserID: userOne, StoreID: storeOne, Role: auth.RoleManager}
+	cashierA   = auth.Identity{MerchantID: merchantA, UserID: userTwo, Role: auth.RoleCashier}
+	platform   = auth.Identity{UserID: userOne, Role: auth.RolePlatformAdmin}
+	noMerchant = auth.Identity{UserID: userOne, Role: auth.RoleOwner}
+)
+
+// tenantCases are the reads every read RPC is checked against. want lists the labels the
+// caller may see, err the error the read is rejected with.
+var tenantCases = []struct {
+	name       string
+	caller     *auth.Identity
+	merchantID string
+	want       []string
+	err        error
+}{
+	{name: "owner", caller: &ownerA, want: []string{"a1", "a2", "a3"}},
+	{name: "owner naming its merchant", caller: &ownerA, merchantID: merchantA, want: []string{"a1", "a2", "a3"}},
+	{name: "owner naming another merchant", caller: &ownerA, merchantID: merchantB, err: ErrCrossTenant},
+	{name: "manager", caller: &managerA, want: []string{"a1", "a2"}},
+	{name: "manager naming another merchant", caller: &managerA, merchantID: merchantB, err: ErrCrossTenant},
+	{name: "manager without store", caller: &auth.Identity{MerchantID: merchantA, UserID: userOne, Role: auth.RoleManager}, err: ErrForbidden},
+	{name: "cashier", caller: &cashierA, want: []string{"a2", "a3"}},
+	{name: "cashier naming another merchant", caller: &cashierA, merchantID: merchantB, err: ErrCrossTenant},
+	{name: "caller without merchant", caller: &noMerchant, err: repository.ErrUnscopedQuery},
+	{name: "caller without merchant naming one", caller: &noMerchant, merchantID: merchantB, err: ErrCrossTenant},
+	{name: "service", caller: &auth.Identity{MerchantID: merchantA, Role: auth.RoleService}, err: ErrForbidden},
+	{name: "unknown role", caller: &auth.Identity{MerchantID: merchantA, UserID: userOne, Role: "auditor"}, err: ErrForbidden},
+	{name: "anonymous", err: ErrForbidden},
+	{name: "platform admin", caller: &platform, want: []string{"a1", "a2", "a3", "b1"}},
+	{name: "platform admin naming a merchant", caller: &platform, merchantID: merchantB, want: []string{"b1"}},
+}
+
+func newTenantUseCase(t *testing.T) (UseCase, map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	uc := NewAuditUseCase(repo, nil, zap.NewNop())
+
+	for i, f := range tenantFixtures {
+		input := *f
+		input.Action = "order.update"
+		input.Entity = "order"
+		input.EntityID = "o1"
+		input.NewValue = map[string]interface{}{"total": i + 1}
+		if err := uc.CreateAuditLog(ctx, &input); err != nil {
+			t.Fatalf("create %s: %v", f.CorrelationID, err)
+		}
+	}
+
+	// labels maps the generated log ids to the fixture labels
+	labels := make(map[string]string)
+	page, err := repo.ListAuditLogs(ctx, repository.TenantScope{AllMerchants: true}, &repository.LogQuery{}, repository.ListOptions{PageSize: 100})
+	if err != nil {
+		t.Fatalf("list fixtures: %v", err)
+	}
+	for _, log := range page.Logs {
+		labels[log.ID] = log.CorrelationID
+	}
+	return uc, labels
+}
+
+func callerContext(caller *auth.Identity) context.Context {
+	ctx := context.Background()
+	if caller != nil {
+		ctx = auth.WithIdentity(ctx, *caller)
+	}
+	return ctx
+}
+
+func TestTenantIsolation(t *testing.T) {
+	uc, labels := newTenantUseCase(t)
+
+	reads := []struct {
+		name string
+		read func(ctx context.Context, merchantID string) ([]string, error)
+	}{
+		{"ListAuditLogs", func(ctx context.Context, merchantID string) ([]string, error) {
+			res, err := uc.ListAuditLogs(ctx, &ListAuditLogsInput{MerchantID: merchantID, PageSize: 100})
+			if err != nil {
+				return nil, err
+			}
+			var got []string
+			for _, log := range res.Logs {
+				got = append(got, log.CorrelationID)
+			}
+			return got, nil
+		}},
+		{"ListAuditLogs by filter", func(ctx context.Context, merchantID string) ([]string, error) {
+			// filters on fields shared across merchants must not widen the scope
+			res, err := uc.ListAuditLogs(ctx, &ListAuditLogsInput{MerchantID: merchantID, UserID: userOne, PageSize: 100})
+			if err != nil {
+				return nil, err
+			}
+			var got []string
+			for _, log := range res.Logs {
+				got = append(got, log.CorrelationID)
+			}
+			res, err = uc.ListAuditLogs(ctx, &ListAuditLogsInput{MerchantID: merchantID, UserID: userTwo, PageSize: 100})
+			if err != nil {
+				return nil, err
+			}
+			for _, log := range res.Logs {
+				got = append(got, log.CorrelationID)
+			}
+			return got, nil
+		}},
+		{"GetEntityHistory", func(ctx context.Context, merchantID string) ([]string, error) {
+			res, err := uc.GetEntityHistory(ctx, &GetEntityHistoryInput{MerchantID: merchantID, Entity: "order", EntityID: "o1", PageSize: 100})
+			if err != nil {
+				return nil, err
+			}
+			var got []string
+			for _, e := range res.Entries {
+				got = append(got, e.Log.CorrelationID)
+			}
+			return got, nil
+		}},
+		{"GetEntityState", func(ctx context.Context, merchantID string) ([]string, error) {
+			res, err := uc.GetEntityState(ctx, &GetEntityStateInput{MerchantID: merchantID, Entity: "order", EntityID: "o1"})
+			if err != nil {
+				return nil, err
+			}
+			// the replay only reveals how many logs were applied and the last of them
+			got := make([]string, res.AppliedLogs)
+			for i := range got {
+				got[i] = "?"
+			}
+			if res.LastLog != nil {
+				got[len(got)-1] = res.LastLog.CorrelationID
+			}
+			return got, nil
+		}},
+		{"ExportAuditLogs", func(ctx context.Context, merchantID string) ([]string, error) {
+			var buf bytes.Buffer
+			input := &ExportAuditLogsInput{Filter: ListAuditLogsInput{MerchantID: merchantID}, Format: "ndjson"}
+			if _, err := uc.ExportAuditLogs(ctx, input, &buf); err != nil {
+				return nil, err
+			}
+			var got []string
+			dec := json.NewDecoder(&buf)
+			for dec.More() {
+				var row struct {
+					CorrelationID string `json:"correlation_id"`
+				}
+				if err := dec.Decode(&row); err != nil {
+					return nil, err
+				}
+				got = append(got, row.CorrelationID)
+			}
+			return got, nil
+		}},
+		{"GetAuditStats", func(ctx context.Context, merchantID string) ([]string, error) {
+			res, err := uc.GetAuditStats(ctx, &GetAuditStatsInput{
+				Filter:  ListAuditLogsInput{MerchantID: merchantID},
+				GroupBy: []string{"source_service"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			var got []string
+			for _, row := range res.Rows {
+				for i := int64(0); i < row.Count; i++ {
+					got = append(got, row.Keys["source_service"])
+				}
+			}
+			return got, nil
+		}},
+	}
+
+	for _, read := range reads {
+		for _, tt := range tenantCases {
+			t.Run(read.name+"/"+tt.name, func(t *testing.T) {
+				got, err := read.read(callerContext(tt.caller), tt.merchantID)
+				if tt.err != nil {
+					if !errors.Is(err, tt.err) {
+						t.Fatalf("error = %v, want %v", err, tt.err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("error = %v", err)
+				}
+				if !sameLabels(got, tt.want) {
+					t.Errorf("read %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+
+	// GetAuditLog takes no merchant, every id outside the caller's scope reads as not found
+	for _, tt := range tenantCases {
+		if tt.merchantID != "" {
+			continue
+		}
+		t.Run("GetAuditLog/"+tt.name, func(t *testing.T) {
+			visible := make(map[string]bool)
+			for _, label := range tt.want {
+				visible[label] = true
+			}
+			for id, label := range labels {
+				log, err := uc.GetAuditLog(callerContext(tt.caller), id)
+				switch {
+				case tt.err != nil:
+					if !errors.Is(err, tt.err) {
+						t.Errorf("get %s: error = %v, want %v", label, err, tt.err)
+					}
+				case visible[label]:
+					if err != nil || log.CorrelationID != label {
+						t.Errorf("get %s: %v, %v", label, log, err)
+					}
+				default:
+					if !errors.Is(err, repository.ErrAuditLogNotFound) {
+						t.Errorf("get %s: error = %v, want not found", label, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTenantIsolationVerifyChain(t *testing.T) {
+	uc, _ := newTenantUseCase(t)
+
+	tests := []struct {
+		name       string
+		caller     *auth.Identity
+		merchantID string
+		wantChain  string
+		wantCount  int64
+		err        error
+	}{
+		{name: "owner", caller: &ownerA, wantChain: merchantA, wantCount: 3},
+		{name: "owner naming another merchant", caller: &ownerA, merchantID: merchantB, err: ErrCrossTenant},
+		{name: "manager", caller: &managerA, err: ErrForbidden},
+		{name: "cashier", caller: &cashierA, err: ErrForbidden},
+		{name: "caller without merchant", caller: &noMerchant, err: ErrMerchantRequired},
+		{name: "anonymous", err: ErrForbidden},
+		{name: "platform admin without merchant", caller: &platform, err: ErrMerchantRequired},
+		{name: "platform admin naming a merchant", caller: &platform, merchantID: merchantB, wantChain: merchantB, wantCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := uc.VerifyChain(callerContext(tt.caller), &VerifyChainInput{MerchantID: tt.merchantID})
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if res.MerchantID != tt.wantChain || res.CheckedRecords != tt.wantCount || !res.Valid {
+				t.Errorf("verified %s with %d records (valid %v), want %s with %d",
+					res.MerchantID, res.CheckedRecords, res.Valid, tt.wantChain, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestReadScopeAllMerchants(t *testing.T) {
+	for _, tt := range tenantCases {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := readScope(callerContext(tt.caller), tt.merchantID)
+			if err != nil {
+				return
+			}
+			admin := tt.caller != nil && tt.caller.IsPlatformAdmin()
+			if scope.AllMerchants && !(admin && tt.merchantID == "") {
+				t.Errorf("scope %+v reads all merchants", scope)
+			}
+			if !admin && scope.MerchantID != tt.caller.MerchantID {
+				t.Errorf("scope %+v is not the caller's merchant %q", scope, tt.caller.MerchantID)
+			}
+		})
+	}
+}
+
+// sameLabels compares labels ignoring order, "?" stands for any label
+func sameLabels(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for _, label := range got {
+		if label != "?" && !slices.Contains(want, label) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,16 +2,45 @@ package usecase
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"time"
 
+	"github.com/fekuna/omnipos-audit-service/internal/audit/diff"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/hashchain"
 	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/signing"
 	"github.com/fekuna/omnipos-pkg/logger"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
 type UseCase interface {
 	CreateAuditLog(ctx context.Context, input *CreateAuditLogInput) error
-	ListAuditLogs(ctx context.Context, input *ListAuditLogsInput) ([]repository.AuditLog, int32, error)
+	// CreateAuditLogs stores many logs at once and returns one error per input, nil when stored.
+	// Invalid inputs get a *ValidationError and do not prevent the others from being stored.
+	CreateAuditLogs(ctx context.Context, inputs []*CreateAuditLogInput) []error
+	ListAuditLogs(ctx context.Context, input *ListAuditLogsInput) (*ListAuditLogsResult, error)
+	GetAuditLog(ctx context.Context, id string) (*repository.AuditLog, error)
+	// GetEntityHistory returns the logs of one entity oldest first, each with its field changes
+	GetEntityHistory(ctx context.Context, input *GetEntityHistoryInput) (*EntityHistory, error)
+	GetEntityState(ctx context.Context, input *GetEntityStateInput) (*EntityState, error)
+	// ExportAuditLogs writes every matching log to w in the requested format
+	ExportAuditLogs(ctx context.Context, input *ExportAuditLogsInput, w io.Writer) (int64, error)
+	// GetAuditStats counts the matching logs per group and time bucket
+	GetAuditStats(ctx context.Context, input *GetAuditStatsInput) (*AuditStats, error)
+	// VerifyChain checks the hashes and links of a merchant's chain. The newest records are checked
+	// against the latest checkpoint, once its signature and witnessed copy check out; records
+	// appended after it can be deleted undetected.
+	VerifyChain(ctx context.Context, input *VerifyChainInput) (*VerifyChainResult, error)
+}
+
+// AppendObserver is notified after a log has been stored and linked into its merchant's chain.
+// Implementations must not block.
+type AppendObserver interface {
+	LogAppended(log *repository.AuditLog)
 }
 
 type CreateAuditLogInput struct {
@@ -34,9 +63,13 @@ type CreateAuditLogInput struct {
 	SourceService string
 	CorrelationID string
 	DurationMs    int64
+	// EventID deduplicates redeliveries and retries of the same event
+	EventID string
 }
 
 type ListAuditLogsInput struct {
+	// MerchantID narrows a platform administrator's read to one merchant.
+	// Other callers only ever see their own merchant.
 	MerchantID string
 	UserID     string
 	Entity     string
@@ -44,29 +77,116 @@ type ListAuditLogsInput struct {
 	Action     string
 	StartDate  time.Time
 	EndDate    time.Time
-	Page       int32
-	PageSize   int32
+	// Page selects a page by number, which gets slow deep into large merchants.
+	// PageToken continues after the previous page instead and takes precedence.
+	Page      int32
+	PageSize  int32
+	PageToken string
+	// TotalMode is one of none, exact or estimated. Page-numbered listings default
+	// to exact, listings by page token to none.
+	TotalMode string
 	// Enhanced filters
 	StoreID       string
 	Severity      string
 	Result        string
 	SourceService string
 	CorrelationID string
+	// ChangedField matches logs whose snapshots differ in the field, e.g. "price" or "address.city"
+	ChangedField string
+	// Query searches action, entity, error message and the text in details. Results are then
+	// ordered by relevance instead of time.
+	Query string
+	// Filters add conditions to the single-value filters above, all must match
+	Filters       []FieldFilter
+	MinDurationMs *int64
+	MaxDurationMs *int64
+}
+
+// Ways of counting the matches of a listing
+const (
+	TotalModeNone      = "none"
+	TotalModeExact     = "exact"
+	TotalModeEstimated = "estimated"
+)
+
+// ErrInvalidTotalMode is returned for an unknown ListAuditLogsInput.TotalMode
+var ErrInvalidTotalMode = errors.New("total mode must be none, exact or estimated")
+
+type ListAuditLogsResult struct {
+	Logs []repository.AuditLog
+	// Total is only set when counted, see ListAuditLogsInput.TotalMode
+	Total int64
+	// TotalEstimated is set when there are at least Total matches
+	TotalEstimated bool
+	// NextPageToken is empty on the last page
+	NextPageToken string
+	// Matches describe why each log matched a Query, Matches[i] belongs to Logs[i]
+	Matches []SearchMatch
+}
+
+// maxChainAttempts bounds how often an insert is retried when another writer extends the chain first
+const maxChainAttempts = 5
+
+// ChainCheckpoints are what VerifyChain checks the newest records of a chain against
+type ChainCheckpoints struct {
+	Repo repository.CheckpointRepository
+	// Witness is optional, the latest checkpoint must match its witnessed copy when set
+	Witness repository.CheckpointWitness
+	// Keys are the public keys checkpoints may be signed with
+	Keys signing.KeyRing
 }
 
 type auditUseCase struct {
-	repo   repository.Repository
-	logger logger.ZapLogger
+	repo repository.Repository
+	// checkpoints is optional, chains are verified against their latest checkpoint when set
+	checkpoints *ChainCheckpoints
+	logger      logger.ZapLogger
+	observers   []AppendObserver
+	// chainLocks serializes chain appends per merchant within this process
+	chainLocks sync.Map
 }
 
-func NewAuditUseCase(repo repository.Repository, logger logger.ZapLogger) UseCase {
+func NewAuditUseCase(
+	repo repository.Repository,
+	checkpoints *ChainCheckpoints,
+	logger logger.ZapLogger,
+	observers ...AppendObserver,
+) UseCase {
 	return &auditUseCase{
-		repo:   repo,
-		logger: logger,
+		repo:        repo,
+		checkpoints: checkpoints,
+		logger:      logger,
+		observers:   observers,
 	}
 }
 
 func (uc *auditUseCase) CreateAuditLog(ctx context.Context, input *CreateAuditLogInput) error {
+	if err := ValidateCreateAuditLogInput(input); err != nil {
+		return err
+	}
+	log := newAuditLog(input)
+
+	mu := uc.chainLock(log.MerchantID)
+	mu.Lock()
+	err := uc.appendToChain(ctx, log)
+	mu.Unlock()
+
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicateEvent) {
+			uc.logger.Debug("Skipping duplicate audit event",
+				zap.String("event_id", input.EventID),
+				zap.String("merchant_id", input.MerchantID),
+			)
+			return nil
+		}
+		return err
+	}
+
+	uc.notify(log)
+	return nil
+}
+
+func newAuditLog(input *CreateAuditLogInput) *repository.AuditLog {
 	// Set defaults for required fields
 	result := input.Result
 	if result == "" {
@@ -87,7 +207,7 @@ func (uc *auditUseCase) CreateAuditLog(ctx context.Context, input *CreateAuditLo
 		Details:    input.Details,
 		IPAddress:  input.IPAddress,
 		UserAgent:  input.UserAgent,
-		Timestamp:  time.Now(),
+		Timestamp:  time.Now().UTC().Truncate(time.Millisecond), // stored precision, so the hash survives a round trip
 		// Enhanced fields
 		StoreID:       input.StoreID,
 		SessionID:     input.SessionID,
@@ -99,27 +219,128 @@ func (uc *auditUseCase) CreateAuditLog(ctx context.Context, input *CreateAuditLo
 		SourceService: input.SourceService,
 		CorrelationID: input.CorrelationID,
 		DurationMs:    input.DurationMs,
+		EventID:       input.EventID,
 	}
+	log.DetailsText = detailsText(input.Details)
+	if len(input.OldValue) > 0 && len(input.NewValue) > 0 {
+		log.Patch = diff.Patch(input.OldValue, input.NewValue)
+		log.ChangedFields = diff.ChangedFields(input.OldValue, input.NewValue)
+	}
+	return log
+}
+
+// appendToChain links the log to its merchant's hash chain and stores it.
+// Sequence conflicts with other replicas are retried against the new head.
+// The caller must hold the merchant's chain lock.
+func (uc *auditUseCase) appendToChain(ctx context.Context, log *repository.AuditLog) error {
+	for attempt := 1; attempt <= maxChainAttempts; attempt++ {
+		head, err := uc.repo.GetChainHead(ctx, log.MerchantID)
+		if err != nil {
+			return fmt.Errorf("get chain head: %w", err)
+		}
+		if err := hashchain.Link(log, head); err != nil {
+			return fmt.Errorf("hash audit log: %w", err)
+		}
 
-	return uc.repo.CreateAuditLog(ctx, log)
+		err = uc.repo.CreateAuditLog(ctx, log)
+		if errors.Is(err, repository.ErrSequenceConflict) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("append audit log to chain after %d attempts: %w", maxChainAttempts, repository.ErrSequenceConflict)
 }
 
-func (uc *auditUseCase) ListAuditLogs(ctx context.Context, input *ListAuditLogsInput) ([]repository.AuditLog, int32, error) {
-	filter := map[string]interface{}{
-		"merchant_id": input.MerchantID,
-		"user_id":     input.UserID,
-		"entity":      input.Entity,
-		"entity_id":   input.EntityID,
-		"action":      input.Action,
-		"start_date":  input.StartDate,
-		"end_date":    input.EndDate,
-		// Enhanced filters
-		"store_id":       input.StoreID,
-		"severity":       input.Severity,
-		"result":         input.Result,
-		"source_service": input.SourceService,
-		"correlation_id": input.CorrelationID,
-	}
-
-	return uc.repo.ListAuditLogs(ctx, filter, input.Page, input.PageSize)
+func (uc *auditUseCase) notify(log *repository.AuditLog) {
+	for _, o := range uc.observers {
+		o.LogAppended(log)
+	}
+}
+
+func (uc *auditUseCase) chainLock(merchantID string) *sync.Mutex {
+	mu, _ := uc.chainLocks.LoadOrStore(merchantID, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+func (uc *auditUseCase) ListAuditLogs(ctx context.Context, input *ListAuditLogsInput) (*ListAuditLogsResult, error) {
+	scope, err := readScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := listOptions(input)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := buildLogQuery(input)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := uc.repo.ListAuditLogs(ctx, scope, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	res := &ListAuditLogsResult{
+		Logs:           page.Logs,
+		Total:          page.Total,
+		TotalEstimated: page.TotalEstimated,
+	}
+	if !opts.ByRelevance {
+		res.NextPageToken = encodePageToken(page.Next)
+		return res, nil
+	}
+
+	if page.Next != nil {
+		res.NextPageToken = encodeOffsetToken(opts.Skip + int64(len(page.Logs)))
+	}
+	terms := searchTerms(input.Query)
+	res.Matches = make([]SearchMatch, len(page.Logs))
+	for i := range page.Logs {
+		res.Matches[i] = SearchMatch{
+			Score:      page.Scores[i],
+			Highlights: highlight(&page.Logs[i], terms),
+		}
+	}
+	return res, nil
+}
+
+func listOptions(input *ListAuditLogsInput) (repository.ListOptions, error) {
+	page, pageSize := normalizePage(input.Page, input.PageSize)
+	opts := repository.ListOptions{PageSize: pageSize}
+
+	totalMode := input.TotalMode
+	opts.ByRelevance = input.Query != ""
+	if input.PageToken != "" {
+		token, err := decodePageToken(input.PageToken)
+		if err != nil {
+			return opts, err
+		}
+		// Relevance order has no stable position to seek to, so text searches page by offset
+		if opts.ByRelevance != (token.ID == "") {
+			return opts, ErrInvalidPageToken
+		}
+		if opts.ByRelevance {
+			opts.Skip = token.Offset
+		} else {
+			opts.After = token.cursor()
+		}
+	} else if input.Page > 0 {
+		opts.Skip = int64(page-1) * int64(pageSize)
+		if totalMode == "" {
+			totalMode = TotalModeExact
+		}
+	}
+
+	switch totalMode {
+	case "", TotalModeNone:
+		opts.Total = repository.TotalNone
+	case TotalModeExact:
+		opts.Total = repository.TotalExact
+	case TotalModeEstimated:
+		opts.Total = repository.TotalEstimated
+	default:
+		return opts, ErrInvalidTotalMode
+	}
+	return opts, nil
 }
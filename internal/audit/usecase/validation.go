@@ -0,0 +1,165 @@
+package usecase
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Limits on free-form fields of an audit log
+const (
+	maxPayloadBytes      = 64 * 1024 // JSON size of Details, OldValue and NewValue each
+	maxNameLength        = 128       // action, entity, source service
+	maxIDLength          = 128       // merchant, user, store, entity, session, correlation and event ids
+	maxIPAddressLength   = 64
+	maxErrorMessageBytes = 4096
+	maxUserAgentLength   = 512
+)
+
+var (
+	allowedSeverities = []string{"info", "warning", "critical"}
+	allowedResults    = []string{"success", "failure", "partial"}
+
+	// namePattern matches actions such as "order.void" and entities such as "product"
+	namePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.:-]*$`)
+	// idPattern matches opaque identifiers like order numbers or trace ids
+	idPattern = regexp.MustCompile(`^[A-Za-z0-9#][A-Za-z0-9#_.:/-]*$`)
+)
+
+// FieldViolation describes why one field of an input was rejected
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+// ValidationError is returned when an input has invalid fields
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Field + ": " + v.Description
+	}
+	return "invalid audit log: " + strings.Join(parts, "; ")
+}
+
+type validator struct {
+	violations []FieldViolation
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.violations = append(v.violations, FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: v.violations}
+}
+
+func (v *validator) required(field, value string) bool {
+	if value == "" {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) name(field, value string) {
+	if value == "" {
+		return
+	}
+	if len(value) > maxNameLength {
+		v.add(field, "must be at most %d characters", maxNameLength)
+	} else if !namePattern.MatchString(value) {
+		v.add(field, "must start with a letter and contain only letters, digits, '_', '.', ':' or '-'")
+	}
+}
+
+func (v *validator) id(field, value string) {
+	if value == "" {
+		return
+	}
+	if len(value) > maxIDLength {
+		v.add(field, "must be at most %d characters", maxIDLength)
+	} else if !idPattern.MatchString(value) {
+		v.add(field, "contains invalid characters")
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed []string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(field, "must be one of %s", strings.Join(allowed, ", "))
+}
+
+func (v *validator) maxLength(field, value string, max int) {
+	if len(value) > max {
+		v.add(field, "must be at most %d bytes", max)
+	}
+}
+
+func (v *validator) payload(field string, value map[string]interface{}) {
+	if len(value) == 0 {
+		return
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		v.add(field, "must be JSON serializable")
+		return
+	}
+	if len(b) > maxPayloadBytes {
+		v.add(field, "must be at most %d bytes when encoded as JSON, got %d", maxPayloadBytes, len(b))
+	}
+}
+
+// ValidateCreateAuditLogInput checks required fields, enums, sizes and id formats.
+// Empty Result and Severity are allowed and default to success and info. Merchant, user and
+// store ids are opaque, producers use UUIDs as well as other formats, and the IP address is
+// kept as sent, e.g. a forwarded header value.
+func ValidateCreateAuditLogInput(input *CreateAuditLogInput) error {
+	v := &validator{}
+
+	if v.required("merchant_id", input.MerchantID) {
+		v.maxLength("merchant_id", input.MerchantID, maxIDLength)
+	}
+	v.maxLength("user_id", input.UserID, maxIDLength)
+	v.maxLength("store_id", input.StoreID, maxIDLength)
+	if v.required("action", input.Action) {
+		v.name("action", input.Action)
+	}
+	if v.required("entity", input.Entity) {
+		v.name("entity", input.Entity)
+	}
+	v.id("entity_id", input.EntityID)
+	v.id("session_id", input.SessionID)
+	v.id("correlation_id", input.CorrelationID)
+	v.maxLength("event_id", input.EventID, 2*maxIDLength)
+	v.name("source_service", input.SourceService)
+
+	v.oneOf("severity", input.Severity, allowedSeverities)
+	v.oneOf("result", input.Result, allowedResults)
+
+	v.payload("details", input.Details)
+	v.payload("old_value", input.OldValue)
+	v.payload("new_value", input.NewValue)
+	v.maxLength("error_message", input.ErrorMessage, maxErrorMessageBytes)
+	v.maxLength("user_agent", input.UserAgent, maxUserAgentLength)
+
+	v.maxLength("ip_address", input.IPAddress, maxIPAddressLength)
+	if input.DurationMs < 0 {
+		v.add("duration_ms", "must not be negative")
+	}
+
+	return v.err()
+}
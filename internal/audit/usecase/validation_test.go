@@ -0,0 +1,149 @@
+package usecase
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validInput returns an input that passes validation, edit changes it before it is checked
+func validInput(edit func(*CreateAuditLogInput)) *CreateAuditLogInput {
+	input := &CreateAuditLogInput{
+		MerchantID: merchantA,
+		UserID:     userOne,
+		StoreID:    storeOne,
+		Action:     "order.void",
+		Entity:     "order",
+		EntityID:   "ORD-2025/0001",
+		Details:    map[string]interface{}{"reason": "customer left"},
+		IPAddress:  "203.0.113.7",
+		Severity:   "warning",
+		Result:     "success",
+	}
+	if edit != nil {
+		edit(input)
+	}
+	return input
+}
+
+func TestValidateCreateAuditLogInput(t *testing.T) {
+	long := func(n int) string { return strings.Repeat("a", n) }
+
+	tests := []struct {
+		name  string
+		input *CreateAuditLogInput
+		// wantFields are the fields reported as violations, in order
+		wantFields []string
+	}{
+		{name: "valid", input: validInput(nil)},
+		{
+			name: "minimal",
+			input: &CreateAuditLogInput{
+				MerchantID: "m1", Action: "login", Entity: "user",
+			},
+		},
+		{
+			name: "opaque merchant, user and store ids",
+			input: validInput(func(in *CreateAuditLogInput) {
+				in.MerchantID, in.UserID, in.StoreID = "merchant-42", "emp_0007", "store 3"
+			}),
+		},
+		{
+			name:  "forwarded ip address kept as sent",
+			input: validInput(func(in *CreateAuditLogInput) { in.IPAddress = "203.0.113.7, 10.0.0.1" }),
+		},
+		{
+			name:       "missing required fields",
+			input:      &CreateAuditLogInput{},
+			wantFields: []string{"merchant_id", "action", "entity"},
+		},
+		{
+			name: "ids too long",
+			input: validInput(func(in *CreateAuditLogInput) {
+				in.MerchantID, in.UserID, in.StoreID = long(maxIDLength+1), long(maxIDLength+1), long(maxIDLength+1)
+			}),
+			wantFields: []string{"merchant_id", "user_id", "store_id"},
+		},
+		{
+			name:       "ip address too long",
+			input:      validInput(func(in *CreateAuditLogInput) { in.IPAddress = long(maxIPAddressLength + 1) }),
+			wantFields: []string{"ip_address"},
+		},
+		{
+			name: "invalid names",
+			input: validInput(func(in *CreateAuditLogInput) {
+				in.Action, in.Entity, in.SourceService = "1order", "order entity", long(maxNameLength+1)
+			}),
+			wantFields: []string{"action", "entity", "source_service"},
+		},
+		{
+			name: "invalid opaque ids",
+			input: validInput(func(in *CreateAuditLogInput) {
+				in.EntityID, in.SessionID, in.CorrelationID = "-leading", "with space", long(maxIDLength+1)
+			}),
+			wantFields: []string{"entity_id", "session_id", "correlation_id"},
+		},
+		{
+			name:       "event id too long",
+			input:      validInput(func(in *CreateAuditLogInput) { in.EventID = long(2*maxIDLength + 1) }),
+			wantFields: []string{"event_id"},
+		},
+		{
+			name: "unknown severity and result",
+			input: validInput(func(in *CreateAuditLogInput) {
+				in.Severity, in.Result = "fatal", "ok"
+			}),
+			wantFields: []string{"severity", "result"},
+		},
+		{
+			name: "payloads too large",
+			input: validInput(func(in *CreateAuditLogInput) {
+				big := map[string]interface{}{"blob": long(maxPayloadBytes)}
+				in.Details, in.OldValue, in.NewValue = big, big, big
+			}),
+			wantFields: []string{"details", "old_value", "new_value"},
+		},
+		{
+			name:       "payload not serializable",
+			input:      validInput(func(in *CreateAuditLogInput) { in.Details = map[string]interface{}{"f": func() {}} }),
+			wantFields: []string{"details"},
+		},
+		{
+			name: "free text too long",
+			input: validInput(func(in *CreateAuditLogInput) {
+				in.ErrorMessage, in.UserAgent = long(maxErrorMessageBytes+1), long(maxUserAgentLength+1)
+			}),
+			wantFields: []string{"error_message", "user_agent"},
+		},
+		{
+			name:       "negative duration",
+			input:      validInput(func(in *CreateAuditLogInput) { in.DurationMs = -1 }),
+			wantFields: []string{"duration_ms"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCreateAuditLogInput(tt.input)
+			if tt.wantFields == nil {
+				if err != nil {
+					t.Fatalf("ValidateCreateAuditLogInput: %v", err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("error = %v, want a *ValidationError", err)
+			}
+			fields := make([]string, len(verr.Violations))
+			for i, v := range verr.Violations {
+				fields[i] = v.Field
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("violations = %v, want fields %v", verr.Violations, tt.wantFields)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/hashchain"
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+)
+
+// maxReportedIssues caps the gaps and tampered records returned by a single verification
+const maxReportedIssues = 1000
+
+// Reasons reported for a broken chain link
+const (
+	BreakHashMismatch     = "hash_mismatch"       // record content no longer matches its stored hash
+	BreakPrevHashMismatch = "prev_hash_mismatch"  // record does not point at its predecessor's hash
+	BreakMissingPrevious  = "missing_previous"    // predecessor record is missing
+	BreakDuplicate        = "duplicate_sequence"  // sequence number appears more than once
+	BreakCheckpoint       = "checkpoint_mismatch" // record differs from the head of the latest checkpoint
+)
+
+// Reasons the latest checkpoint is not trusted
+const (
+	CheckpointUnknownKey   = "checkpoint_unknown_key"   // signed by a key that is not configured
+	CheckpointBadSignature = "checkpoint_bad_signature" // signature does not verify
+	CheckpointNotWitnessed = "checkpoint_not_witnessed" // missing from the witness or different there
+)
+
+type VerifyChainInput struct {
+	MerchantID   string
+	FromSequence int64
+	ToSequence   int64
+	StartDate    time.Time
+	EndDate      time.Time
+}
+
+// ChainBreak describes a record whose hash or link does not verify
+type ChainBreak struct {
+	Sequence     int64  `json:"sequence"`
+	LogID        string `json:"log_id"`
+	Reason       string `json:"reason"`
+	ExpectedHash string `json:"expected_hash,omitempty"`
+	ActualHash   string `json:"actual_hash,omitempty"`
+}
+
+// SequenceGap is an inclusive range of missing sequence numbers
+type SequenceGap struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// VerifyChainResult is also printed as JSON by the verify-chain command
+type VerifyChainResult struct {
+	MerchantID       string        `json:"merchant_id"`
+	Valid            bool          `json:"valid"`
+	CheckedRecords   int64         `json:"checked_records"`
+	FirstSequence    int64         `json:"first_sequence"`
+	LastSequence     int64         `json:"last_sequence"`
+	FirstBrokenLink  *ChainBreak   `json:"first_broken_link,omitempty"`
+	MissingSequences []SequenceGap `json:"missing_sequences,omitempty"`
+	TamperedRecords  []ChainBreak  `json:"tampered_records,omitempty"`
+	// Truncated is set when more issues were found than are reported
+	Truncated bool `json:"truncated,omitempty"`
+	// CheckpointFailure is why the latest checkpoint is not trusted, the chain is then not
+	// checked against it
+	CheckpointFailure string `json:"checkpoint_failure,omitempty"`
+}
+
+// ErrMerchantRequired is returned when an operation needs a merchant scope and none was given
+var ErrMerchantRequired = errors.New("merchant id is required")
+
+func (uc *auditUseCase) VerifyChain(ctx context.Context, input *VerifyChainInput) (*VerifyChainResult, error) {
+	scope, err := merchantReadScope(ctx, input.MerchantID)
+	if err != nil {
+		return nil, err
+	}
+	// A chain belongs to exactly one merchant, so platform administrators must name it
+	if scope.MerchantID == "" {
+		return nil, ErrMerchantRequired
+	}
+	merchantID := scope.MerchantID
+
+	// The latest checkpoint reveals newest records that were deleted or rewritten
+	checkpoint, err := uc.latestCheckpoint(ctx, merchantID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &VerifyChainResult{MerchantID: merchantID}
+	var untrusted *ChainBreak
+	if checkpoint != nil {
+		failure, err := uc.authenticateCheckpoint(checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		if failure != "" {
+			res.CheckpointFailure = failure
+			untrusted = &ChainBreak{Sequence: checkpoint.ToSequence, Reason: failure, ExpectedHash: checkpoint.HeadHash}
+			checkpoint = nil
+		}
+	}
+	var (
+		prev     *repository.AuditLog
+		prevHash string // recomputed hash of prev, what the next record must point at
+	)
+
+	rng := repository.ChainRange{
+		MerchantID:   merchantID,
+		FromSequence: input.FromSequence,
+		ToSequence:   input.ToSequence,
+		StartDate:    input.StartDate,
+		EndDate:      input.EndDate,
+	}
+	err = uc.repo.WalkChain(ctx, rng, func(log *repository.AuditLog) error {
+		res.CheckedRecords++
+		if res.FirstSequence == 0 {
+			res.FirstSequence = log.Sequence
+		}
+		res.LastSequence = log.Sequence
+
+		actual, err := hashchain.Compute(log)
+		if err != nil {
+			return fmt.Errorf("hash audit log %s: %w", log.ID, err)
+		}
+		if actual != log.Hash {
+			res.addTampered(ChainBreak{
+				Sequence:     log.Sequence,
+				LogID:        log.ID,
+				Reason:       BreakHashMismatch,
+				ExpectedHash: log.Hash,
+				ActualHash:   actual,
+			})
+		}
+		if checkpoint != nil && log.Sequence == checkpoint.ToSequence && actual != checkpoint.HeadHash {
+			res.addBreak(ChainBreak{Sequence: log.Sequence, LogID: log.ID, Reason: BreakCheckpoint, ExpectedHash: checkpoint.HeadHash, ActualHash: actual})
+		}
+
+		switch {
+		case prev == nil:
+			expected, err := uc.chainAnchor(ctx, log)
+			if err != nil {
+				return err
+			}
+			from := max(input.FromSequence, 1)
+			if log.Sequence > from && input.StartDate.IsZero() {
+				res.addGap(SequenceGap{From: from, To: log.Sequence - 1})
+			}
+			if expected == "" {
+				res.addBreak(ChainBreak{Sequence: log.Sequence, LogID: log.ID, Reason: BreakMissingPrevious, ActualHash: log.PrevHash})
+			} else if expected != log.PrevHash {
+				res.addBreak(ChainBreak{Sequence: log.Sequence, LogID: log.ID, Reason: BreakPrevHashMismatch, ExpectedHash: expected, ActualHash: log.PrevHash})
+			}
+		case log.Sequence == prev.Sequence:
+			res.addBreak(ChainBreak{Sequence: log.Sequence, LogID: log.ID, Reason: BreakDuplicate})
+		case log.Sequence > prev.Sequence+1:
+			res.addGap(SequenceGap{From: prev.Sequence + 1, To: log.Sequence - 1})
+			res.addBreak(ChainBreak{Sequence: log.Sequence, LogID: log.ID, Reason: BreakMissingPrevious, ActualHash: log.PrevHash})
+		case log.PrevHash != prevHash:
+			res.addBreak(ChainBreak{Sequence: log.Sequence, LogID: log.ID, Reason: BreakPrevHashMismatch, ExpectedHash: prevHash, ActualHash: log.PrevHash})
+		}
+
+		prev = log
+		prevHash = actual
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk chain: %w", err)
+	}
+
+	// Records missing after the last one checked are only detectable for open-ended time ranges
+	if input.EndDate.IsZero() && (res.CheckedRecords > 0 || input.StartDate.IsZero()) {
+		head, err := uc.repo.GetChainHead(ctx, merchantID)
+		if err != nil {
+			return nil, fmt.Errorf("get chain head: %w", err)
+		}
+		lower := res.LastSequence + 1
+		if input.FromSequence > lower {
+			lower = input.FromSequence
+		}
+		// A head behind the latest checkpoint means the newest records were deleted
+		upper := head.Sequence
+		if checkpoint != nil && checkpoint.ToSequence > upper {
+			upper = checkpoint.ToSequence
+		}
+		if input.ToSequence > 0 && input.ToSequence < upper {
+			upper = input.ToSequence
+		}
+		if lower <= upper {
+			res.addGap(SequenceGap{From: lower, To: upper})
+		}
+	}
+
+	// Reported as a break too, for callers that only read the first broken link
+	if untrusted != nil {
+		res.addBreak(*untrusted)
+	}
+
+	res.Valid = res.FirstBrokenLink == nil && len(res.MissingSequences) == 0 && len(res.TamperedRecords) == 0
+	return res, nil
+}
+
+// latestCheckpoint returns the merchant's latest checkpoint, nil when there is none
+func (uc *auditUseCase) latestCheckpoint(ctx context.Context, merchantID string) (*repository.Checkpoint, error) {
+	if uc.checkpoints == nil {
+		return nil, nil
+	}
+	cp, err := uc.checkpoints.Repo.GetLatestCheckpoint(ctx, merchantID)
+	if errors.Is(err, repository.ErrCheckpointNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get latest checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+// authenticateCheckpoint checks a checkpoint read from MongoDB against its signature and its
+// witnessed copy. It returns why the checkpoint is not trusted, empty when it is.
+func (uc *auditUseCase) authenticateCheckpoint(cp *repository.Checkpoint) (string, error) {
+	if _, ok := uc.checkpoints.Keys[cp.KeyID]; !ok {
+		return CheckpointUnknownKey, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil || !uc.checkpoints.Keys.Verify(cp.KeyID, CheckpointMessage(cp), sig) {
+		return CheckpointBadSignature, nil
+	}
+
+	if uc.checkpoints.Witness == nil {
+		return "", nil
+	}
+	witnessed, err := uc.checkpoints.Witness.Find(cp.MerchantID, cp.ID)
+	if errors.Is(err, repository.ErrCheckpointNotFound) {
+		return CheckpointNotWitnessed, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read checkpoint witness: %w", err)
+	}
+	if !bytes.Equal(CheckpointMessage(witnessed), CheckpointMessage(cp)) || witnessed.Signature != cp.Signature {
+		return CheckpointNotWitnessed, nil
+	}
+	return "", nil
+}
+
+// chainAnchor returns the hash the first verified record must point at.
+// It is empty when the predecessor is missing.
+func (uc *auditUseCase) chainAnchor(ctx context.Context, log *repository.AuditLog) (string, error) {
+	if log.Sequence == 1 {
+		return hashchain.GenesisHash, nil
+	}
+
+	prev, err := uc.repo.GetAuditLogBySequence(ctx, log.MerchantID, log.Sequence-1)
+	if errors.Is(err, repository.ErrAuditLogNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get previous audit log: %w", err)
+	}
+	return hashchain.Compute(prev)
+}
+
+func (r *VerifyChainResult) addBreak(b ChainBreak) {
+	if r.FirstBrokenLink == nil {
+		r.FirstBrokenLink = &b
+	}
+}
+
+func (r *VerifyChainResult) addTampered(b ChainBreak) {
+	r.addBreak(b)
+	if len(r.TamperedRecords) >= maxReportedIssues {
+		r.Truncated = true
+		return
+	}
+	r.TamperedRecords = append(r.TamperedRecords, b)
+}
+
+func (r *VerifyChainResult) addGap(g SequenceGap) {
+	if len(r.MissingSequences) >= maxReportedIssues {
+		r.Truncated = true
+		return
+	}
+	r.MissingSequences = append(r.MissingSequences, g)
+}
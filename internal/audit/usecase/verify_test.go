@@ -0,0 +1,255 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-audit-service/internal/signing"
+	"go.uber.org/zap"
+)
+
+// checkpointStub serves a fixed latest checkpoint
+type checkpointStub struct {
+	repository.CheckpointRepository
+	latest *repository.Checkpoint
+}
+
+func (s *checkpointStub) GetLatestCheckpoint(ctx context.Context, merchantID string) (*repository.Checkpoint, error) {
+	if s.latest == nil || s.latest.MerchantID != merchantID {
+		return nil, repository.ErrCheckpointNotFound
+	}
+	return s.latest, nil
+}
+
+// witnessStub holds witnessed checkpoints in memory
+type witnessStub struct {
+	checkpoints []*repository.Checkpoint
+}
+
+func (w *witnessStub) Append(cp *repository.Checkpoint) error {
+	w.checkpoints = append(w.checkpoints, cp)
+	return nil
+}
+
+func (w *witnessStub) Find(merchantID, id string) (*repository.Checkpoint, error) {
+	for _, cp := range w.checkpoints {
+		if cp.MerchantID == merchantID && cp.ID == id {
+			return cp, nil
+		}
+	}
+	return nil, repository.ErrCheckpointNotFound
+}
+
+// checkpointKey signs the checkpoints of the verify tests
+var checkpointKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+// signedCheckpoint returns a checkpoint of merchant A up to the given head, signed by key
+func signedCheckpoint(key ed25519.PrivateKey, toSequence int64, headHash string) *repository.Checkpoint {
+	cp := &repository.Checkpoint{
+		ID:           "cp-" + headHash,
+		MerchantID:   merchantA,
+		FromSequence: 1,
+		ToSequence:   toSequence,
+		LeafCount:    toSequence,
+		RootHash:     "root",
+		HeadHash:     headHash,
+		CreatedAt:    time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC),
+		KeyID:        signing.KeyID(key.Public().(ed25519.PublicKey)),
+	}
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, CheckpointMessage(cp)))
+	return cp
+}
+
+// chainFixture returns the first n records of a valid chain of merchant A
+func chainFixture(t *testing.T, n int) []*repository.AuditLog {
+	t.Helper()
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	uc := NewAuditUseCase(repo, nil, zap.NewNop())
+
+	logs := make([]*repository.AuditLog, n)
+	for i := range logs {
+		input := &CreateAuditLogInput{MerchantID: merchantA, UserID: userOne, Action: "order.update", Entity: "order", EntityID: "o1"}
+		if err := uc.CreateAuditLog(ctx, input); err != nil {
+			t.Fatalf("create log: %v", err)
+		}
+		log, err := repo.GetAuditLogBySequence(ctx, merchantA, int64(i+1))
+		if err != nil {
+			t.Fatalf("get log %d: %v", i+1, err)
+		}
+		logs[i] = log
+	}
+	return logs
+}
+
+func TestVerifyChainMissingRecords(t *testing.T) {
+	logs := chainFixture(t, 5)
+	head := signedCheckpoint(checkpointKey, 5, logs[4].Hash)
+	rewritten := signedCheckpoint(checkpointKey, 5, "rewritten")
+
+	tests := []struct {
+		name       string
+		stored     []*repository.AuditLog
+		checkpoint *repository.Checkpoint
+		input      VerifyChainInput
+		wantGaps   []SequenceGap
+		wantBreak  *ChainBreak
+	}{
+		{name: "complete chain", stored: logs},
+		{name: "complete chain at its checkpoint", stored: logs, checkpoint: head},
+		{
+			name:     "oldest records deleted",
+			stored:   logs[2:],
+			wantGaps: []SequenceGap{{From: 1, To: 2}},
+			wantBreak: &ChainBreak{
+				Sequence: 3, LogID: logs[2].ID, Reason: BreakMissingPrevious, ActualHash: logs[2].PrevHash,
+			},
+		},
+		{
+			name:     "oldest records deleted below the requested range",
+			stored:   logs[3:],
+			input:    VerifyChainInput{FromSequence: 2},
+			wantGaps: []SequenceGap{{From: 2, To: 3}},
+			wantBreak: &ChainBreak{
+				Sequence: 4, LogID: logs[3].ID, Reason: BreakMissingPrevious, ActualHash: logs[3].PrevHash,
+			},
+		},
+		{name: "newest records deleted without a checkpoint", stored: logs[:3]},
+		{
+			name:       "newest records deleted behind the checkpoint",
+			stored:     logs[:3],
+			checkpoint: head,
+			wantGaps:   []SequenceGap{{From: 4, To: 5}},
+		},
+		{
+			name:       "newest records deleted within the requested range",
+			stored:     logs[:3],
+			checkpoint: head,
+			input:      VerifyChainInput{ToSequence: 4},
+			wantGaps:   []SequenceGap{{From: 4, To: 4}},
+		},
+		{
+			name:       "checkpointed head rewritten",
+			stored:     logs,
+			checkpoint: rewritten,
+			wantBreak: &ChainBreak{
+				Sequence: 5, LogID: logs[4].ID, Reason: BreakCheckpoint, ExpectedHash: "rewritten", ActualHash: logs[4].Hash,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := repository.NewMemoryRepository()
+			if len(tt.stored) > 0 {
+				if _, err := repo.InsertAuditLogs(ctx, tt.stored); err != nil {
+					t.Fatalf("insert logs: %v", err)
+				}
+			}
+			witness := &witnessStub{}
+			if tt.checkpoint != nil {
+				witness.Append(tt.checkpoint)
+			}
+			uc := NewAuditUseCase(repo, &ChainCheckpoints{
+				Repo:    &checkpointStub{latest: tt.checkpoint},
+				Witness: witness,
+				Keys:    signing.NewKeyRing(checkpointKey.Public().(ed25519.PublicKey)),
+			}, zap.NewNop())
+
+			input := tt.input
+			res, err := uc.VerifyChain(callerContext(&ownerA), &input)
+			if err != nil {
+				t.Fatalf("VerifyChain: %v", err)
+			}
+			if !reflect.DeepEqual(res.MissingSequences, tt.wantGaps) {
+				t.Errorf("missing sequences = %v, want %v", res.MissingSequences, tt.wantGaps)
+			}
+			if !reflect.DeepEqual(res.FirstBrokenLink, tt.wantBreak) {
+				t.Errorf("first broken link = %+v, want %+v", res.FirstBrokenLink, tt.wantBreak)
+			}
+			if want := tt.wantGaps == nil && tt.wantBreak == nil; res.Valid != want {
+				t.Errorf("valid = %v, want %v", res.Valid, want)
+			}
+		})
+	}
+}
+
+func TestVerifyChainAuthenticatesCheckpoint(t *testing.T) {
+	logs := chainFixture(t, 3)
+	head := signedCheckpoint(checkpointKey, 3, logs[2].Hash)
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+
+	// Claims more records than were signed
+	forged := *head
+	forged.ToSequence = 5
+
+	tests := []struct {
+		name        string
+		checkpoint  *repository.Checkpoint
+		witnessed   []*repository.Checkpoint
+		wantFailure string
+	}{
+		{name: "signed and witnessed", checkpoint: head, witnessed: []*repository.Checkpoint{head}},
+		{
+			name:        "signed by an unknown key",
+			checkpoint:  signedCheckpoint(otherKey, 3, logs[2].Hash),
+			witnessed:   []*repository.Checkpoint{signedCheckpoint(otherKey, 3, logs[2].Hash)},
+			wantFailure: CheckpointUnknownKey,
+		},
+		{
+			name:        "edited after signing",
+			checkpoint:  &forged,
+			witnessed:   []*repository.Checkpoint{&forged},
+			wantFailure: CheckpointBadSignature,
+		},
+		{name: "missing from the witness", checkpoint: head, wantFailure: CheckpointNotWitnessed},
+		{
+			name:       "witnessed with another range",
+			checkpoint: head,
+			witnessed: []*repository.Checkpoint{
+				{ID: head.ID, MerchantID: merchantA, FromSequence: 1, ToSequence: 2, Signature: head.Signature},
+			},
+			wantFailure: CheckpointNotWitnessed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := repository.NewMemoryRepository()
+			if _, err := repo.InsertAuditLogs(ctx, logs); err != nil {
+				t.Fatalf("insert logs: %v", err)
+			}
+			uc := NewAuditUseCase(repo, &ChainCheckpoints{
+				Repo:    &checkpointStub{latest: tt.checkpoint},
+				Witness: &witnessStub{checkpoints: tt.witnessed},
+				Keys:    signing.NewKeyRing(checkpointKey.Public().(ed25519.PublicKey)),
+			}, zap.NewNop())
+
+			res, err := uc.VerifyChain(callerContext(&ownerA), &VerifyChainInput{})
+			if err != nil {
+				t.Fatalf("VerifyChain: %v", err)
+			}
+			if res.CheckpointFailure != tt.wantFailure {
+				t.Errorf("checkpoint failure = %q, want %q", res.CheckpointFailure, tt.wantFailure)
+			}
+			if want := tt.wantFailure == ""; res.Valid != want {
+				t.Errorf("valid = %v, want %v", res.Valid, want)
+			}
+			if tt.wantFailure != "" && (res.FirstBrokenLink == nil || res.FirstBrokenLink.Reason != tt.wantFailure) {
+				t.Errorf("first broken link = %+v, want reason %s", res.FirstBrokenLink, tt.wantFailure)
+			}
+			// An untrusted checkpoint is not used, its range does not show up as missing records
+			if len(res.MissingSequences) > 0 {
+				t.Errorf("missing sequences = %v, want none", res.MissingSequences)
+			}
+		})
+	}
+}
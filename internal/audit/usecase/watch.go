@@ -0,0 +1,253 @@
+package usecase
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fekuna/omnipos-audit-service/internal/audit/repository"
+	"github.com/fekuna/omnipos-pkg/logger"
+	"github.com/google/uuid"
+)
+
+// Watch modes
+const (
+	WatchAuto         = "auto" // change streams when the server supports them, else local
+	WatchChangeStream = "changestream"
+	WatchLocal        = "local" // logs appended by this instance only
+)
+
+// watcherBuffer is the number of logs a local watcher may fall behind before it is disconnected
+const watcherBuffer = 256
+
+// ErrInvalidResumeToken is returned for a resume token this service did not issue
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// ErrResumeTokenExpired is returned when the logs after a resume token are no longer available.
+// The caller lists what it missed with ListAuditLogs and watches again without a token.
+var ErrResumeTokenExpired = errors.New("resume token has expired")
+
+// ErrWatcherLagged is returned when a watcher reads too slowly to keep up. It may resume
+// with the token of the last log it received.
+var ErrWatcherLagged = errors.New("watcher fell behind")
+
+type WatchConfig struct {
+	Mode string
+	// BufferSize is the number of recent logs kept to resume local watchers
+	BufferSize int
+}
+
+type WatchAuditLogsInput struct {
+	// Filter selects the logs to push, paging and text search are not supported
+	Filter ListAuditLogsInput
+	// ResumeToken continues after the log it was sent with
+	ResumeToken string
+}
+
+// WatchEvent is a log pushed to a watcher with the token to resume after it
+type WatchEvent struct {
+	Log         *repository.AuditLog
+	ResumeToken string
+}
+
+type WatchUseCase interface {
+	AppendObserver
+	// WatchAuditLogs calls send for every new matching log until ctx is done or send fails
+	WatchAuditLogs(ctx context.Context, input *WatchAuditLogsInput, send func(*WatchEvent) error) error
+}
+
+// watchToken is the content of an opaque resume token. Change stream tokens carry the
+// server's token, local ones the sequence of a log in this process' buffer.
+type watchToken struct {
+	Stream string `json:"cs,omitempty"`
+	Epoch  string `json:"e,omitempty"`
+	Seq    int64  `json:"n,omitempty"`
+}
+
+type watchUseCase struct {
+	repo   repository.Repository
+	cfg    WatchConfig
+	logger logger.ZapLogger
+	// local is set once change streams turned out to be unavailable in auto mode
+	local atomic.Bool
+
+	mu       sync.Mutex
+	epoch    string // identifies this process, local tokens of other processes cannot be resumed
+	seq      int64
+	recent   []localEntry // ring buffer of the last BufferSize logs, by seq
+	watchers map[*localWatcher]struct{}
+}
+
+type localEntry struct {
+	seq int64
+	log *repository.AuditLog
+}
+
+type localWatcher struct {
+	ch     chan localEntry
+	lagged bool // set under watchUseCase.mu when ch was full, ch is then closed
+}
+
+func NewWatchUseCase(repo repository.Repository, cfg WatchConfig, logger logger.ZapLogger) WatchUseCase {
+	if cfg.BufferSize < 1 {
+		cfg.BufferSize = 1
+	}
+	uc := &watchUseCase{
+		repo:     repo,
+		cfg:      cfg,
+		logger:   logger,
+		epoch:    uuid.New().String(),
+		recent:   make([]localEntry, cfg.BufferSize),
+		watchers: make(map[*localWatcher]struct{}),
+	}
+	uc.local.Store(cfg.Mode == WatchLocal)
+	return uc
+}
+
+// LogAppended fans a stored log out to the local watchers without blocking
+func (uc *watchUseCase) LogAppended(log *repository.AuditLog) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	uc.seq++
+	entry := localEntry{seq: uc.seq, log: log}
+	uc.recent[uc.seq%int64(len(uc.recent))] = entry
+	for w := range uc.watchers {
+		select {
+		case w.ch <- entry:
+		default:
+			w.lagged = true
+			close(w.ch)
+			delete(uc.watchers, w)
+		}
+	}
+}
+
+func (uc *watchUseCase) WatchAuditLogs(ctx context.Context, input *WatchAuditLogsInput, send func(*WatchEvent) error) error {
+	scope, err := readScope(ctx, input.Filter.MerchantID)
+	if err != nil {
+		return err
+	}
+	if scope.MerchantID == "" && !scope.AllMerchants {
+		return repository.ErrUnscopedQuery
+	}
+	if input.Filter.Query != "" {
+		return &ValidationError{Violations: []FieldViolation{{Field: "query", Description: "text search cannot be watched"}}}
+	}
+	q, err := buildLogQuery(&input.Filter)
+	if err != nil {
+		return err
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	var token watchToken
+	if input.ResumeToken != "" {
+		data, err := base64.RawURLEncoding.DecodeString(input.ResumeToken)
+		if err != nil || json.Unmarshal(data, &token) != nil || (token.Stream == "") == (token.Epoch == "") {
+			return ErrInvalidResumeToken
+		}
+	}
+	match := func(log *repository.AuditLog) bool {
+		return scope.Contains(log) && q.Matches(log)
+	}
+
+	useStream := token.Stream != "" || (token.Epoch == "" && uc.cfg.Mode != WatchLocal && !uc.local.Load())
+	if useStream {
+		err := uc.watchStream(ctx, scope, token.Stream, match, send)
+		if !errors.Is(err, repository.ErrChangeStreamsUnsupported) || uc.cfg.Mode == WatchChangeStream || token.Stream != "" {
+			return err
+		}
+		if !uc.local.Swap(true) {
+			uc.logger.Warn("MongoDB has no change streams, watching logs appended by this instance only")
+		}
+	}
+	return uc.watchLocal(ctx, token, match, send)
+}
+
+func (uc *watchUseCase) watchStream(ctx context.Context, scope repository.TenantScope, resume string, match func(*repository.AuditLog) bool, send func(*WatchEvent) error) error {
+	err := uc.repo.WatchAuditLogs(ctx, scope, resume, func(log *repository.AuditLog, token string) error {
+		if !match(log) {
+			return nil
+		}
+		return send(&WatchEvent{Log: log, ResumeToken: encodeWatchToken(watchToken{Stream: token})})
+	})
+	switch {
+	case errors.Is(err, repository.ErrInvalidWatchToken):
+		return ErrInvalidResumeToken
+	case errors.Is(err, repository.ErrWatchHistoryLost):
+		return ErrResumeTokenExpired
+	}
+	return err
+}
+
+func (uc *watchUseCase) watchLocal(ctx context.Context, token watchToken, match func(*repository.AuditLog) bool, send func(*WatchEvent) error) error {
+	w, backlog, err := uc.subscribe(token)
+	if err != nil {
+		return err
+	}
+	defer uc.unsubscribe(w)
+
+	deliver := func(e localEntry) error {
+		if !match(e.log) {
+			return nil
+		}
+		return send(&WatchEvent{Log: e.log, ResumeToken: encodeWatchToken(watchToken{Epoch: uc.epoch, Seq: e.seq})})
+	}
+	for _, e := range backlog {
+		if err := deliver(e); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-w.ch:
+			if !ok {
+				return ErrWatcherLagged
+			}
+			if err := deliver(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// subscribe registers a local watcher and returns the buffered logs after the token
+func (uc *watchUseCase) subscribe(token watchToken) (*localWatcher, []localEntry, error) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	var backlog []localEntry
+	if token.Epoch != "" {
+		oldest := uc.seq - int64(len(uc.recent)) + 1
+		if token.Epoch != uc.epoch || token.Seq > uc.seq || token.Seq+1 < oldest {
+			return nil, nil, ErrResumeTokenExpired
+		}
+		for seq := token.Seq + 1; seq <= uc.seq; seq++ {
+			backlog = append(backlog, uc.recent[seq%int64(len(uc.recent))])
+		}
+	}
+
+	w := &localWatcher{ch: make(chan localEntry, watcherBuffer)}
+	uc.watchers[w] = struct{}{}
+	return w, backlog, nil
+}
+
+func (uc *watchUseCase) unsubscribe(w *localWatcher) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if !w.lagged {
+		delete(uc.watchers, w)
+	}
+}
+
+func encodeWatchToken(t watchToken) string {
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
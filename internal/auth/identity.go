@@ -0,0 +1,40 @@
+// Package auth identifies the caller of a gRPC request.
+package auth
+
+import "context"
+
+// Roles a caller can have
+const (
+	RolePlatformAdmin = "platform_admin"
+	RoleOwner         = "owner"
+	RoleManager       = "manager"
+	RoleCashier       = "cashier"
+	// RoleService is used by other OmniPOS services writing audit logs on behalf of merchants
+	RoleService = "service"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	MerchantID string
+	UserID     string
+	StoreID    string
+	Role       string
+}
+
+// IsPlatformAdmin reports whether the caller may read across merchants
+func (i Identity) IsPlatformAdmin() bool {
+	return i.Role == RolePlatformAdmin
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context carrying the caller's identity
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the caller's identity, if any
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// VerifierConfig holds the keys access tokens may be signed with. At least one must be set.
+type VerifierConfig struct {
+	HMACSecret    string // HS256 shared secret
+	PublicKeyFile string // PEM encoded RSA public key for RS256
+	JWKSFile      string // local JWKS document with RSA keys, selected by the token's kid
+	Issuer        string // expected iss claim, not checked when empty
+	Audience      string // expected aud claim, not checked when empty
+}
+
+// Claims are the OmniPOS claims of an access token. The user is the user_id claim, or the
+// subject when it is missing.
+type Claims struct {
+	MerchantID string `json:"merchant_id"`
+	UserID     string `json:"user_id"`
+	StoreID    string `json:"store_id"`
+	Role       string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// leeway tolerates clock skew between the token issuer and this service
+const leeway = 30 * time.Second
+
+// Verifier checks signed access tokens
+type Verifier struct {
+	hmacKey []byte
+	rsaKey  *rsa.PublicKey
+	jwks    map[string]*rsa.PublicKey
+	parser  *jwt.Parser
+}
+
+func NewVerifier(cfg VerifierConfig) (*Verifier, error) {
+	v := &Verifier{}
+	if cfg.HMACSecret != "" {
+		v.hmacKey = []byte(cfg.HMACSecret)
+	}
+	if cfg.PublicKeyFile != "" {
+		pem, err := os.ReadFile(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read public key: %w", err)
+		}
+		if v.rsaKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+	}
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.jwks = keys
+	}
+	if v.hmacKey == nil && v.rsaKey == nil && len(v.jwks) == 0 {
+		return nil, errors.New("no token verification key configured")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+	return v, nil
+}
+
+// Verify checks the token's signature and claims and returns the caller it identifies
+func (v *Verifier) Verify(token string) (Identity, error) {
+	var claims Claims
+	if _, err := v.parser.ParseWithClaims(token, &claims, v.key); err != nil {
+		return Identity{}, err
+	}
+
+	id := Identity{
+		MerchantID: claims.MerchantID,
+		UserID:     claims.UserID,
+		StoreID:    claims.StoreID,
+		Role:       claims.Role,
+	}
+	if id.UserID == "" {
+		id.UserID = claims.Subject
+	}
+
+	switch id.Role {
+	case RolePlatformAdmin, RoleService:
+	case RoleOwner, RoleManager, RoleCashier:
+		if id.MerchantID == "" {
+			return Identity{}, errors.New("token has no merchant_id claim")
+		}
+	default:
+		return Identity{}, fmt.Errorf("token has unknown role %q", id.Role)
+	}
+	return id, nil
+}
+
+// key picks the verification key matching the token's algorithm, so an RSA public key
+// can never be used as an HMAC secret
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if v.hmacKey == nil {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		return v.hmacKey, nil
+	case *jwt.SigningMethodRSA:
+		if kid, _ := token.Header["kid"].(string); kid != "" {
+			if key, ok := v.jwks[kid]; ok {
+				return key, nil
+			}
+		}
+		if v.rsaKey == nil {
+			return nil, errors.New("no RSA key matches the token")
+		}
+		return v.rsaKey, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+type jwksDocument struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// loadJWKS reads the RSA signing keys of a JWKS document, other key types are ignored
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jwks: %w", err)
+	}
+	var doc jwksDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: invalid modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: invalid exponent: %w", k.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("jwks key %q: unsupported exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no RSA signing keys")
+	}
+	return keys, nil
+}
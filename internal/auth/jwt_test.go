@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+// testKeys are the RSA keys of the verifier tests, written to files the verifier loads
+type testKeys struct {
+	pemKey     *rsa.PrivateKey // in PublicKeyFile
+	jwksKey    *rsa.PrivateKey // in JWKSFile as "k1"
+	pemFile    string
+	jwksFile   string
+	pemPublic  []byte
+	unknownKey *rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	dir := t.TempDir()
+	k := &testKeys{
+		pemKey:     generateKey(t),
+		jwksKey:    generateKey(t),
+		unknownKey: generateKey(t),
+		pemFile:    filepath.Join(dir, "public.pem"),
+		jwksFile:   filepath.Join(dir, "jwks.json"),
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&k.pemKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	k.pemPublic = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(k.pemFile, k.pemPublic, 0o600); err != nil {
+		t.Fatalf("write public key: %v", err)
+	}
+
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec"},
+		{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(k.jwksKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.jwksKey.E)).Bytes()),
+		},
+	}})
+	if err != nil {
+		t.Fatalf("marshal jwks: %v", err)
+	}
+	if err := os.WriteFile(k.jwksFile, jwks, 0o600); err != nil {
+		t.Fatalf("write jwks: %v", err)
+	}
+	return k
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// ownerClaims are valid claims of a merchant owner, edit changes them before signing
+func ownerClaims(edit func(*Claims)) *Claims {
+	c := &Claims{
+		MerchantID: "m1",
+		UserID:     "u1",
+		StoreID:    "s1",
+		Role:       RoleOwner,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "subject",
+			Issuer:    "omnipos-auth",
+			Audience:  jwt.ClaimStrings{"omnipos-audit"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	if edit != nil {
+		edit(c)
+	}
+	return c
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims *Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed
+}
+
+func TestVerifierVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	owner := Identity{MerchantID: "m1", UserID: "u1", StoreID: "s1", Role: RoleOwner}
+
+	hmacOnly := VerifierConfig{HMACSecret: testSecret, Issuer: "omnipos-auth", Audience: "omnipos-audit"}
+	rsaOnly := VerifierConfig{PublicKeyFile: keys.pemFile, JWKSFile: keys.jwksFile}
+
+	tests := []struct {
+		name    string
+		cfg     VerifierConfig
+		token   func(t *testing.T) string
+		want    Identity
+		wantErr bool
+	}{
+		{
+			name: "HS256 owner",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(nil))
+			},
+			want: owner,
+		},
+		{
+			name: "user falls back to the subject",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) { c.UserID = "" }))
+			},
+			want: Identity{MerchantID: "m1", UserID: "subject", StoreID: "s1", Role: RoleOwner},
+		},
+		{
+			name: "platform administrator without a merchant",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) {
+					c.MerchantID, c.StoreID, c.Role = "", "", RolePlatformAdmin
+				}))
+			},
+			want: Identity{UserID: "u1", Role: RolePlatformAdmin},
+		},
+		{
+			name:  "RS256 with the public key file",
+			cfg:   rsaOnly,
+			token: func(t *testing.T) string { return sign(t, jwt.SigningMethodRS256, "", keys.pemKey, ownerClaims(nil)) },
+			want:  owner,
+		},
+		{
+			name: "RS256 with a JWKS key selected by kid",
+			cfg:  rsaOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodRS256, "k1", keys.jwksKey, ownerClaims(nil))
+			},
+			want: owner,
+		},
+		{
+			name: "RS256 signed by an unknown key",
+			cfg:  rsaOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodRS256, "k1", keys.unknownKey, ownerClaims(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "RS256 with an unknown kid and no public key file",
+			cfg:  VerifierConfig{JWKSFile: keys.jwksFile},
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodRS256, "k2", keys.jwksKey, ownerClaims(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "HS256 signed with the RSA public key",
+			cfg:  rsaOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", keys.pemPublic, ownerClaims(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "HS384 is not accepted",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS384, "", []byte(testSecret), ownerClaims(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsigned",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, ownerClaims(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong secret",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte("other"), ownerClaims(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) {
+					c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+				}))
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired within the leeway",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) {
+					c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-leeway / 2))
+				}))
+			},
+			want: owner,
+		},
+		{
+			name: "without expiry",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) { c.ExpiresAt = nil }))
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) { c.Issuer = "other" }))
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) {
+					c.Audience = jwt.ClaimStrings{"other"}
+				}))
+			},
+			wantErr: true,
+		},
+		{
+			name: "merchant role without a merchant",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) { c.MerchantID = "" }))
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown role",
+			cfg:  hmacOnly,
+			token: func(t *testing.T) string {
+				return sign(t, jwt.SigningMethodHS256, "", []byte(testSecret), ownerClaims(func(c *Claims) { c.Role = "root" }))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVerifier(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewVerifier: %v", err)
+			}
+			got, err := v.Verify(tt.token(t))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Verify = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Verify = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewVerifierRequiresKey(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  VerifierConfig
+	}{
+		{name: "no key"},
+		{name: "missing public key file", cfg: VerifierConfig{PublicKeyFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "missing jwks file", cfg: VerifierConfig{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewVerifier(tt.cfg); err == nil {
+				t.Error("NewVerifier succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Package signing loads Ed25519 signing keys from configuration and identifies them.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ParsePrivateKey decodes a base64 Ed25519 seed (32 bytes) or private key (64 bytes)
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decode signing key: %w", err)
+	}
+
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	default:
+		return nil, fmt.Errorf("signing key must be %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+}
+
+// KeyID returns a short stable identifier of a public key
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParsePublicKeys decodes a comma separated list of base64 Ed25519 public keys
+func ParsePublicKeys(encoded string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, part := range strings.Split(encoded, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("decode public key: %w", err)
+		}
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+		}
+		keys = append(keys, ed25519.PublicKey(raw))
+	}
+	return keys, nil
+}
+
+// KeyRing holds the public keys signatures may have been made with, by KeyID
+type KeyRing map[string]ed25519.PublicKey
+
+// NewKeyRing returns a key ring holding keys
+func NewKeyRing(keys ...ed25519.PublicKey) KeyRing {
+	ring := make(KeyRing, len(keys))
+	for _, k := range keys {
+		ring[KeyID(k)] = k
+	}
+	return ring
+}
+
+// Verify reports whether sig is a valid signature of msg by the key named keyID, a key that is
+// not in the ring never verifies
+func (r KeyRing) Verify(keyID string, msg, sig []byte) bool {
+	pub, ok := r[keyID]
+	return ok && ed25519.Verify(pub, msg, sig)
+}